@@ -0,0 +1,42 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/armon/consul-api"
+)
+
+// AgentInfo is the information of the local Consul agent, exposed
+// to templates as .Agent. It is read once at startup, and again
+// when the configuration is reloaded.
+type AgentInfo struct {
+	Datacenter    string
+	NodeName      string
+	AdvertiseAddr string
+}
+
+// fetchAgent is used to read the information of the agent
+func fetchAgent(client *consulapi.Client) (AgentInfo, error) {
+	self, err := client.Agent().Self()
+	if err != nil {
+		return AgentInfo{}, err
+	}
+	return agentFromSelf(self), nil
+}
+
+// agentFromSelf extracts the agent information from the
+// configuration returned by the agent
+func agentFromSelf(self map[string]map[string]interface{}) AgentInfo {
+	config := self["Config"]
+	field := func(name string) string {
+		if v, ok := config[name]; ok && v != nil {
+			return fmt.Sprintf("%v", v)
+		}
+		return ""
+	}
+	return AgentInfo{
+		Datacenter:    field("Datacenter"),
+		NodeName:      field("NodeName"),
+		AdvertiseAddr: field("AdvertiseAddr"),
+	}
+}
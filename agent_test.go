@@ -0,0 +1,58 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/armon/consul-api"
+)
+
+func TestAgentFromSelf(t *testing.T) {
+	self := map[string]map[string]interface{}{
+		"Config": map[string]interface{}{
+			"Datacenter":    "dc1",
+			"NodeName":      "lb1",
+			"AdvertiseAddr": "10.0.0.1",
+			"Server":        false,
+		},
+	}
+	agent := agentFromSelf(self)
+	if agent != (AgentInfo{Datacenter: "dc1", NodeName: "lb1", AdvertiseAddr: "10.0.0.1"}) {
+		t.Fatalf("bad: %v", agent)
+	}
+
+	// Missing fields are empty
+	if agent := agentFromSelf(nil); agent != (AgentInfo{}) {
+		t.Fatalf("bad: %v", agent)
+	}
+}
+
+func TestBuildTemplate_Agent(t *testing.T) {
+	servers := map[string][]*backendEntry{
+		"app": []*backendEntry{
+			&backendEntry{ServiceEntry: &consulapi.ServiceEntry{
+				Node:    &consulapi.Node{Node: "node1", Address: "127.0.0.1"},
+				Service: &consulapi.AgentService{ID: "app", Port: 8000},
+			}},
+		},
+	}
+	conf := &Config{
+		DryRun:    true,
+		Templates: []string{"test-fixtures/agent.conf"},
+		Backends:  []string{"app=app", "Agent=agent"},
+	}
+	// The agent does not take a backend name
+	if errs := validateConfig(conf); len(errs) > 0 {
+		t.Fatalf("err: %v", errs)
+	}
+	conf.agent = AgentInfo{Datacenter: "dc1", NodeName: "lb1", AdvertiseAddr: "10.0.0.1"}
+
+	out, err := buildTemplate(conf, "test-fixtures/agent.conf", servers, false)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	expect := "# Generated by lb1 in dc1\nlisten http-in\n    bind 10.0.0.1:80\n    server node1_app 127.0.0.1:8000\n"
+	if !bytes.Contains(out, []byte(expect)) {
+		t.Fatalf("bad: %s", out)
+	}
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io/ioutil"
+	"log"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/armon/consul-api"
+)
+
+const (
+	// stageSuffix is appended to the configuration paths to
+	// stage the new configuration before it is put in place
+	stageSuffix = ".tmp"
+
+	// kvPrefix marks a configuration path as a Consul KV key
+	kvPrefix = "kv:"
+)
+
+// kvClient is the part of the Consul KV API used to write
+// the configuration to keys
+type kvClient interface {
+	Get(key string, q *consulapi.QueryOptions) (*consulapi.KVPair, *consulapi.QueryMeta, error)
+	CAS(p *consulapi.KVPair, q *consulapi.WriteOptions) (bool, *consulapi.WriteMeta, error)
+}
+
+// Applier is used to apply the rendered configuration. The default
+// writes each configuration file and invokes the reload command, but
+// an embedding program can provide its own to use other sinks.
+type Applier interface {
+	// Apply is called with the rendered output of each template,
+	// keyed by the configured output path, along with the names of
+	// the backends that changed since the last successful apply.
+	Apply(rendered map[string][]byte, changed []string) error
+}
+
+// fileApplier is the default Applier. It writes the configuration
+// files, validating them first if configured, and then invokes the
+// reload command, if any. Paths prefixed with "kv:" are written to
+// the Consul KV key instead.
+type fileApplier struct {
+	conf *Config
+	kv   kvClient
+
+	// skipReload is why the reload is skipped, as decided by
+	// decideReload, or empty to reload
+	skipReload string
+
+	// reloaded is set once the reload command succeeds
+	reloaded bool
+}
+
+func (f *fileApplier) Apply(rendered map[string][]byte, changed []string) error {
+	// Stage all the configuration files first, so that they are
+	// either all updated or none are
+	var paths, staged, keys []string
+	for _, path := range outputPaths(f.conf, rendered) {
+		output, ok := rendered[path]
+		if !ok {
+			continue
+		}
+		if strings.HasPrefix(path, kvPrefix) {
+			keys = append(keys, path)
+			continue
+		}
+		stagePath := path + stageSuffix
+		if err := ioutil.WriteFile(stagePath, output, 0660); err != nil {
+			removeStaged(staged)
+			return &RefreshError{Stage: "write", Path: path, Err: err}
+		}
+		paths = append(paths, path)
+		staged = append(staged, stagePath)
+	}
+
+	// Validate the staged configuration
+	if f.conf.ValidateCommand != "" {
+		env := []string{"CONSUL_HAPROXY_FILES=" + strings.Join(staged, " ")}
+		if err := runCommand(f.conf.ValidateCommand, env); err != nil {
+			removeStaged(staged)
+			return &RefreshError{Stage: "validate", Err: err}
+		}
+	}
+
+	// Write the configuration to any keys
+	for _, path := range keys {
+		key := strings.TrimPrefix(path, kvPrefix)
+		value := rendered[path]
+		if f.conf.CompressKV {
+			var err error
+			if value, err = compress(value); err != nil {
+				removeStaged(staged)
+				return &RefreshError{Stage: "kv", Path: key, Err: err}
+			}
+		}
+		if err := writeKey(f.kv, key, value); err != nil {
+			removeStaged(staged)
+			return &RefreshError{Stage: "kv", Path: key, Err: err}
+		}
+	}
+
+	// Move the configuration into place
+	for idx, path := range paths {
+		if err := os.Rename(staged[idx], path); err != nil {
+			removeStaged(staged[idx:])
+			return &RefreshError{Stage: "write", Path: path, Err: err}
+		}
+		log.Printf("[INFO] Updated configuration file at %s", path)
+	}
+
+	// Invoke the reload hook
+	switch f.skipReload {
+	case "":
+	case skipNoCommand, skipOutsideWindows:
+		log.Printf("[INFO] Not reloading, %s", f.skipReload)
+		return nil
+	default:
+		log.Printf("[WARN] Not reloading, %s", f.skipReload)
+		return nil
+	}
+	if err := reload(f.conf); err != nil {
+		return &RefreshError{Stage: "reload", Err: err}
+	}
+	f.reloaded = true
+	log.Printf("[INFO] Completed reload")
+	return nil
+}
+
+// validateDryRun is used to run the validate command against the
+// outputs of a dry run. They are written to temporary files, which
+// are removed afterwards, so the live configuration is untouched.
+func validateDryRun(conf *Config, outputs [][]byte) error {
+	var files []string
+	defer func() { removeStaged(files) }()
+	for _, output := range outputs {
+		f, err := ioutil.TempFile("", "consul-haproxy")
+		if err != nil {
+			return &RefreshError{Stage: "validate", Err: err}
+		}
+		files = append(files, f.Name())
+		_, err = f.Write(output)
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			return &RefreshError{Stage: "validate", Path: f.Name(), Err: err}
+		}
+	}
+
+	env := []string{"CONSUL_HAPROXY_FILES=" + strings.Join(files, " ")}
+	if err := runCommand(conf.ValidateCommand, env); err != nil {
+		return &RefreshError{Stage: "validate", Err: err}
+	}
+	return nil
+}
+
+// outputPaths returns the paths to apply, in the configured order.
+// Rendering per datacenter substitutes the datacenter into each
+// configured path, so the rendered paths are used, sorted, instead.
+func outputPaths(conf *Config, rendered map[string][]byte) []string {
+	if !conf.PerDatacenter {
+		return conf.Paths
+	}
+	paths := make([]string, 0, len(rendered))
+	for path := range rendered {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+// removeStaged is used to clean up the staged configuration
+func removeStaged(staged []string) {
+	for _, path := range staged {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			log.Printf("[WARN] Failed to remove %s: %v", path, err)
+		}
+	}
+}
+
+// writeKey is used to write the configuration to a Consul KV key.
+// A check-and-set is used so that a concurrent write is not lost.
+func writeKey(kv kvClient, key string, value []byte) error {
+	if kv == nil {
+		return errors.New("no consul client")
+	}
+	pair, _, err := kv.Get(key, nil)
+	if err != nil {
+		return err
+	}
+	var index uint64
+	if pair != nil {
+		if bytes.Equal(pair.Value, value) {
+			log.Printf("[DEBUG] Configuration key %s is up to date", key)
+			return nil
+		}
+		index = pair.ModifyIndex
+	}
+	ok, _, err := kv.CAS(&consulapi.KVPair{Key: key, Value: value, ModifyIndex: index}, nil)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return errors.New("key was modified concurrently")
+	}
+	log.Printf("[INFO] Updated configuration key %s", key)
+	return nil
+}
+
+// compress is used to gzip the configuration. The output starts with
+// the gzip magic bytes, so consumers can detect the compression. The
+// header carries no timestamp, so the same input compresses the same.
+func compress(value []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	if _, err := w.Write(value); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
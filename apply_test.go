@@ -0,0 +1,401 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/armon/consul-api"
+)
+
+func TestFileApplier(t *testing.T) {
+	dir, err := ioutil.TempDir("", "consul-haproxy")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	front := filepath.Join(dir, "frontend.cfg")
+	back := filepath.Join(dir, "backend.cfg")
+	conf := &Config{
+		Paths:           []string{front, back},
+		ValidateCommand: "! grep -q invalid $CONSUL_HAPROXY_FILES",
+	}
+	applier := &fileApplier{conf: conf}
+
+	rendered := map[string][]byte{
+		front: []byte("frontend"),
+		back:  []byte("backend"),
+	}
+	if err := applier.Apply(rendered, nil); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	for path, expect := range rendered {
+		out, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if string(out) != string(expect) {
+			t.Fatalf("bad: %s", out)
+		}
+	}
+}
+
+func TestFileApplier_ValidateFails(t *testing.T) {
+	dir, err := ioutil.TempDir("", "consul-haproxy")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	front := filepath.Join(dir, "frontend.cfg")
+	back := filepath.Join(dir, "backend.cfg")
+	conf := &Config{
+		Paths:           []string{front, back},
+		ValidateCommand: "! grep -q invalid $CONSUL_HAPROXY_FILES",
+		ReloadCommand:   "touch " + filepath.Join(dir, "reloaded"),
+	}
+	applier := &fileApplier{conf: conf}
+
+	rendered := map[string][]byte{
+		front: []byte("frontend"),
+		back:  []byte("invalid"),
+	}
+	err = applier.Apply(rendered, nil)
+	rerr, ok := err.(*RefreshError)
+	if !ok || rerr.Stage != "validate" {
+		t.Fatalf("bad: %v", err)
+	}
+
+	// Neither file is written, nor is anything left behind
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(files) != 0 {
+		t.Fatalf("bad: %v", files)
+	}
+}
+
+func TestForceRefresh_DryRunValidate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "consul-haproxy")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	validated := filepath.Join(dir, "validated")
+	reloaded := filepath.Join(dir, "reloaded")
+	out := filepath.Join(dir, "haproxy.cfg")
+	conf := &Config{
+		DryRun:          true,
+		Templates:       []string{"test-fixtures/simple.conf"},
+		Paths:           []string{out},
+		Backends:        []string{"app=app"},
+		ValidateCommand: "cat $CONSUL_HAPROXY_FILES > " + validated,
+		ReloadCommand:   "touch " + reloaded,
+	}
+	if errs := validateConfig(conf); len(errs) > 0 {
+		t.Fatalf("err: %v", errs)
+	}
+	wp := conf.watches[0]
+	d := &backendData{
+		Servers: map[*WatchPath][]*consulapi.ServiceEntry{
+			wp: []*consulapi.ServiceEntry{
+				&consulapi.ServiceEntry{
+					Node:    &consulapi.Node{Node: "node1", Address: "127.0.0.1"},
+					Service: &consulapi.AgentService{ID: "app", Service: "app", Port: 8000},
+				},
+			},
+		},
+		Backends: map[string][]*WatchPath{"app": []*WatchPath{wp}},
+		ErrCh:    make(chan error, errChSize),
+	}
+	if !forceRefresh(conf, d) {
+		t.Fatalf("expected exit")
+	}
+
+	// The outputs were validated
+	raw, err := ioutil.ReadFile(validated)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !bytes.Contains(raw, []byte("server node1_app 127.0.0.1:8000")) {
+		t.Fatalf("bad: %s", raw)
+	}
+
+	// Nothing was written or reloaded
+	if _, err := os.Stat(out); !os.IsNotExist(err) {
+		t.Fatalf("bad: %v", err)
+	}
+	if _, err := os.Stat(reloaded); !os.IsNotExist(err) {
+		t.Fatalf("bad: %v", err)
+	}
+	select {
+	case err := <-d.ErrCh:
+		t.Fatalf("err: %v", err)
+	default:
+	}
+
+	// A failed validation is reported
+	conf.ValidateCommand = "false"
+	if !forceRefresh(conf, d) {
+		t.Fatalf("expected exit")
+	}
+	select {
+	case err := <-d.ErrCh:
+		if rerr, ok := err.(*RefreshError); !ok || rerr.Stage != "validate" {
+			t.Fatalf("bad: %v", err)
+		}
+	default:
+		t.Fatalf("expected error")
+	}
+}
+
+func TestForceRefresh_MinReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "consul-haproxy")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	reloaded := filepath.Join(dir, "reloaded")
+	out := filepath.Join(dir, "haproxy.cfg")
+	conf := &Config{
+		Templates:     []string{"test-fixtures/simple.conf"},
+		Paths:         []string{out},
+		Backends:      []string{"app=app"},
+		ReloadCommand: "touch " + reloaded,
+		MinReload:     map[string]int{"app": 2},
+	}
+	if errs := validateConfig(conf); len(errs) > 0 {
+		t.Fatalf("err: %v", errs)
+	}
+	wp := conf.watches[0]
+	entry := func(node, addr string) *consulapi.ServiceEntry {
+		return &consulapi.ServiceEntry{
+			Node:    &consulapi.Node{Node: node, Address: addr},
+			Service: &consulapi.AgentService{ID: "app", Service: "app", Port: 8000},
+		}
+	}
+	d := &backendData{
+		Servers:  make(map[*WatchPath][]*consulapi.ServiceEntry),
+		Backends: map[string][]*WatchPath{"app": []*WatchPath{wp}},
+		ChangeCh: make(chan struct{}, 1),
+	}
+
+	// The file is written, but not reloaded below the minimum
+	updateEntries(conf, d, wp, []*consulapi.ServiceEntry{entry("node1", "127.0.0.1")}, nil)
+	if forceRefresh(conf, d) {
+		t.Fatalf("unexpected exit")
+	}
+	raw, err := ioutil.ReadFile(out)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !bytes.Contains(raw, []byte("server node1_app 127.0.0.1:8000")) {
+		t.Fatalf("bad: %s", raw)
+	}
+	if _, err := os.Stat(reloaded); !os.IsNotExist(err) {
+		t.Fatalf("bad: %v", err)
+	}
+
+	// Reloaded once the minimum is met
+	updateEntries(conf, d, wp, []*consulapi.ServiceEntry{
+		entry("node1", "127.0.0.1"),
+		entry("node2", "127.0.0.2"),
+	}, nil)
+	if forceRefresh(conf, d) {
+		t.Fatalf("unexpected exit")
+	}
+	if _, err := os.Stat(reloaded); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+}
+
+func TestForceRefresh_ReloadThreshold(t *testing.T) {
+	dir, err := ioutil.TempDir("", "consul-haproxy")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	reloaded := filepath.Join(dir, "reloaded")
+	out := filepath.Join(dir, "haproxy.cfg")
+	conf := &Config{
+		Templates:             []string{"test-fixtures/simple.conf"},
+		Paths:                 []string{out},
+		Backends:              []string{"app=app"},
+		ReloadCommand:         "touch " + reloaded,
+		ReloadChangeThreshold: "2",
+	}
+	if errs := validateConfig(conf); len(errs) > 0 {
+		t.Fatalf("err: %v", errs)
+	}
+	wp := conf.watches[0]
+	entry := func(node, addr string) *consulapi.ServiceEntry {
+		return &consulapi.ServiceEntry{
+			Node:    &consulapi.Node{Node: node, Address: addr},
+			Service: &consulapi.AgentService{ID: "app", Service: "app", Port: 8000},
+		}
+	}
+	d := &backendData{
+		Servers:  make(map[*WatchPath][]*consulapi.ServiceEntry),
+		Backends: map[string][]*WatchPath{"app": []*WatchPath{wp}},
+		ChangeCh: make(chan struct{}, 1),
+	}
+	refresh := func(entries ...*consulapi.ServiceEntry) bool {
+		os.Remove(reloaded)
+		updateEntries(conf, d, wp, entries, nil)
+		if forceRefresh(conf, d) {
+			t.Fatalf("unexpected exit")
+		}
+		_, err := os.Stat(reloaded)
+		return err == nil
+	}
+
+	// The first reload is never skipped
+	if !refresh(entry("node1", "127.0.0.1"), entry("node2", "127.0.0.2")) {
+		t.Fatalf("expected reload")
+	}
+
+	// A single server changing is written, but not reloaded
+	if refresh(entry("node1", "127.0.0.1")) {
+		t.Fatalf("unexpected reload")
+	}
+	raw, err := ioutil.ReadFile(out)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if bytes.Contains(raw, []byte("node2_app")) {
+		t.Fatalf("bad: %s", raw)
+	}
+
+	// Changes since the last reload add up
+	if !refresh(entry("node1", "127.0.0.1"), entry("node3", "127.0.0.3")) {
+		t.Fatalf("expected reload")
+	}
+
+	// A percentage of the servers at the last reload
+	conf.ReloadChangeThreshold = "50%"
+	if errs := validateConfig(conf); len(errs) > 0 {
+		t.Fatalf("err: %v", errs)
+	}
+	if !refresh(entry("node1", "127.0.0.1")) {
+		t.Fatalf("expected reload")
+	}
+}
+
+type fakeKV struct {
+	pairs map[string]*consulapi.KVPair
+	index uint64
+}
+
+func (f *fakeKV) Get(key string, q *consulapi.QueryOptions) (*consulapi.KVPair, *consulapi.QueryMeta, error) {
+	return f.pairs[key], &consulapi.QueryMeta{}, nil
+}
+
+func (f *fakeKV) CAS(p *consulapi.KVPair, q *consulapi.WriteOptions) (bool, *consulapi.WriteMeta, error) {
+	var index uint64
+	if pair, ok := f.pairs[p.Key]; ok {
+		index = pair.ModifyIndex
+	}
+	if p.ModifyIndex != index {
+		return false, &consulapi.WriteMeta{}, nil
+	}
+	f.index++
+	f.pairs[p.Key] = &consulapi.KVPair{Key: p.Key, Value: p.Value, ModifyIndex: f.index}
+	return true, &consulapi.WriteMeta{}, nil
+}
+
+func TestFileApplier_KV(t *testing.T) {
+	kv := &fakeKV{pairs: make(map[string]*consulapi.KVPair)}
+	conf := &Config{
+		Paths: []string{"kv:haproxy/config"},
+	}
+	applier := &fileApplier{conf: conf, kv: kv}
+
+	rendered := map[string][]byte{"kv:haproxy/config": []byte("backend app")}
+	if err := applier.Apply(rendered, nil); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	pair := kv.pairs["haproxy/config"]
+	if pair == nil || string(pair.Value) != "backend app" {
+		t.Fatalf("bad: %v", pair)
+	}
+
+	// An existing value is replaced
+	rendered["kv:haproxy/config"] = []byte("backend db")
+	if err := applier.Apply(rendered, nil); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if pair := kv.pairs["haproxy/config"]; string(pair.Value) != "backend db" || pair.ModifyIndex != 2 {
+		t.Fatalf("bad: %v", pair)
+	}
+}
+
+func TestFileApplier_CompressKV(t *testing.T) {
+	kv := &fakeKV{pairs: make(map[string]*consulapi.KVPair)}
+	conf := &Config{
+		Paths:      []string{"kv:haproxy/config"},
+		CompressKV: true,
+	}
+	applier := &fileApplier{conf: conf, kv: kv}
+
+	output := bytes.Repeat([]byte("backend app\n"), 1000)
+	rendered := map[string][]byte{"kv:haproxy/config": output}
+	if err := applier.Apply(rendered, nil); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	value := kv.pairs["haproxy/config"].Value
+	if !bytes.HasPrefix(value, []byte{0x1f, 0x8b}) || len(value) >= len(output) {
+		t.Fatalf("bad: %v", value)
+	}
+
+	r, err := gzip.NewReader(bytes.NewReader(value))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	out, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !bytes.Equal(out, output) {
+		t.Fatalf("bad: %s", out)
+	}
+
+	// The same output is not written again
+	if err := applier.Apply(rendered, nil); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if kv.index != 1 {
+		t.Fatalf("bad: %v", kv.index)
+	}
+}
+
+func TestWriteKey_Conflict(t *testing.T) {
+	kv := &fakeKV{pairs: make(map[string]*consulapi.KVPair)}
+
+	// Simulate a concurrent write between the read and the write
+	racing := &racingKV{fakeKV: kv}
+	err := writeKey(racing, "haproxy/config", []byte("backend app"))
+	if err == nil {
+		t.Fatalf("expected error")
+	}
+	if string(kv.pairs["haproxy/config"].Value) != "other" {
+		t.Fatalf("bad: %v", kv.pairs["haproxy/config"])
+	}
+}
+
+type racingKV struct {
+	*fakeKV
+}
+
+func (r *racingKV) Get(key string, q *consulapi.QueryOptions) (*consulapi.KVPair, *consulapi.QueryMeta, error) {
+	pair, qm, err := r.fakeKV.Get(key, q)
+	r.fakeKV.CAS(&consulapi.KVPair{Key: key, Value: []byte("other")}, nil)
+	return pair, qm, err
+}
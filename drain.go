@@ -0,0 +1,60 @@
+package main
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"sort"
+	"strings"
+)
+
+// serverNames returns the set of server names of each backend
+func serverNames(servers map[string][]*ServerEntry) map[string]map[string]bool {
+	out := make(map[string]map[string]bool, len(servers))
+	for backend, entries := range servers {
+		names := make(map[string]bool, len(entries))
+		for _, server := range entries {
+			names[server.name()] = true
+		}
+		out[backend] = names
+	}
+	return out
+}
+
+// drainedServers returns the servers of the last applied configuration
+// that are no longer present, as sorted "backend/server" names
+func drainedServers(last, current map[string]map[string]bool) []string {
+	var drained []string
+	for backend, names := range last {
+		for name := range names {
+			if !current[backend][name] {
+				drained = append(drained, backend+"/"+name)
+			}
+		}
+	}
+	sort.Strings(drained)
+	return drained
+}
+
+// writeDrain is used to write the servers of the last reload that
+// are not among the given names to the drain file, before a reload
+func writeDrain(conf *Config, data *backendData, names map[string]map[string]bool) {
+	if err := writeDrainFile(conf.DrainPath, drainedServers(data.drainNames, names)); err != nil {
+		log.Printf("[ERR] Failed to write the drain file: %v", err)
+	}
+}
+
+// writeDrainFile is used to write the servers to drain to the drain
+// path, one per line. The file is replaced atomically, so a reload
+// command never reads it partially written.
+func writeDrainFile(path string, drained []string) error {
+	var out string
+	if len(drained) > 0 {
+		out = strings.Join(drained, "\n") + "\n"
+	}
+	tmp := path + stageSuffix
+	if err := ioutil.WriteFile(tmp, []byte(out), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
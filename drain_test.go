@@ -0,0 +1,177 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/armon/consul-api"
+)
+
+func TestForceRefresh_DrainFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "consul-haproxy")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	templatePath := filepath.Join(dir, "app.tmpl")
+	if err := ioutil.WriteFile(templatePath, []byte("{{range .app}}{{.}}\n{{end}}"), 0644); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	drainPath := filepath.Join(dir, "drain")
+
+	wp := &WatchPath{Backend: "app"}
+	d := &backendData{
+		Servers:  make(map[*WatchPath][]*consulapi.ServiceEntry),
+		Backends: map[string][]*WatchPath{"app": []*WatchPath{wp}},
+		ChangeCh: make(chan struct{}, 1),
+	}
+	conf := &Config{
+		watches:   []*WatchPath{wp},
+		Templates: []string{templatePath},
+		Paths:     []string{"config_out"},
+		DrainPath: drainPath,
+		Applier:   &fakeApplier{},
+	}
+	entry := func(node, addr string) *consulapi.ServiceEntry {
+		return &consulapi.ServiceEntry{
+			Node:    &consulapi.Node{Node: node, Address: addr},
+			Service: &consulapi.AgentService{ID: "app", Port: 8000},
+		}
+	}
+	drained := func() string {
+		raw, err := ioutil.ReadFile(drainPath)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		return string(raw)
+	}
+
+	// Nothing is drained on the first apply
+	updateEntries(conf, d, wp, []*consulapi.ServiceEntry{entry("node1", "127.0.0.1"), entry("node2", "127.0.0.2")}, nil)
+	if forceRefresh(conf, d) {
+		t.Fatalf("unexpected exit")
+	}
+	if out := drained(); out != "" {
+		t.Fatalf("bad: %q", out)
+	}
+
+	// A removed server is drained
+	updateEntries(conf, d, wp, []*consulapi.ServiceEntry{entry("node1", "127.0.0.1")}, nil)
+	if forceRefresh(conf, d) {
+		t.Fatalf("unexpected exit")
+	}
+	if out := drained(); out != "app/node2_app\n" {
+		t.Fatalf("bad: %q", out)
+	}
+
+	// Once applied, it is no longer drained
+	if forceRefresh(conf, d) {
+		t.Fatalf("unexpected exit")
+	}
+	if out := drained(); out != "" {
+		t.Fatalf("bad: %q", out)
+	}
+}
+
+func TestForceRefresh_DrainFileSkippedReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "consul-haproxy")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	drainPath := filepath.Join(dir, "drain")
+
+	// A window that is open, and one opening in an hour
+	now := time.Now()
+	start := (now.Hour()+1)%24*60 + now.Minute()
+	closed := &maintenanceWindow{Start: start, End: (start + 60) % (24 * 60)}
+	open := &maintenanceWindow{Start: (now.Hour()+23)%24*60 + now.Minute(), End: start}
+
+	wp := &WatchPath{Backend: "app"}
+	d := &backendData{
+		Servers:  make(map[*WatchPath][]*consulapi.ServiceEntry),
+		Backends: map[string][]*WatchPath{"app": []*WatchPath{wp}},
+		ChangeCh: make(chan struct{}, 1),
+	}
+	conf := &Config{
+		watches:       []*WatchPath{wp},
+		Templates:     []string{"test-fixtures/simple.conf"},
+		Paths:         []string{filepath.Join(dir, "config_out")},
+		DrainPath:     drainPath,
+		ReloadCommand: "true",
+		windows:       []*maintenanceWindow{open},
+	}
+	entry := func(node, addr string) *consulapi.ServiceEntry {
+		return &consulapi.ServiceEntry{
+			Node:    &consulapi.Node{Node: node, Address: addr},
+			Service: &consulapi.AgentService{ID: "app", Port: 8000},
+		}
+	}
+	drained := func() string {
+		raw, err := ioutil.ReadFile(drainPath)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		return string(raw)
+	}
+
+	updateEntries(conf, d, wp, []*consulapi.ServiceEntry{entry("node1", "127.0.0.1"), entry("node2", "127.0.0.2")}, nil)
+	if forceRefresh(conf, d) {
+		t.Fatalf("unexpected exit")
+	}
+
+	// While the reloads are deferred, the removed server stays drained
+	conf.windows = []*maintenanceWindow{closed}
+	updateEntries(conf, d, wp, []*consulapi.ServiceEntry{entry("node1", "127.0.0.1")}, nil)
+	for i := 0; i < 2; i++ {
+		if forceRefresh(conf, d) {
+			t.Fatalf("unexpected exit")
+		}
+		if d.lastReload != "skipped: "+skipOutsideWindows {
+			t.Fatalf("bad: %s", d.lastReload)
+		}
+		if out := drained(); out != "app/node2_app\n" {
+			t.Fatalf("bad: %q", out)
+		}
+	}
+
+	// The deferred reload drains it, after which it is no longer drained
+	conf.windows = []*maintenanceWindow{open}
+	if err := os.Remove(drainPath); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	deferredReload(conf, d)
+	if d.lastReload != reloadReloaded {
+		t.Fatalf("bad: %s", d.lastReload)
+	}
+	if out := drained(); out != "app/node2_app\n" {
+		t.Fatalf("bad: %q", out)
+	}
+	markChanged(d, map[string]bool{"app": true})
+	if forceRefresh(conf, d) {
+		t.Fatalf("unexpected exit")
+	}
+	if out := drained(); out != "" {
+		t.Fatalf("bad: %q", out)
+	}
+}
+
+func TestDrainedServers(t *testing.T) {
+	last := map[string]map[string]bool{
+		"app": map[string]bool{"node1_app": true, "node2_app": true},
+		"db":  map[string]bool{"node3_db": true},
+	}
+	current := map[string]map[string]bool{
+		"app": map[string]bool{"node1_app": true, "node4_app": true},
+	}
+	drained := drainedServers(last, current)
+	if len(drained) != 2 || drained[0] != "app/node2_app" || drained[1] != "db/node3_db" {
+		t.Fatalf("bad: %v", drained)
+	}
+	if drained := drainedServers(nil, current); len(drained) != 0 {
+		t.Fatalf("bad: %v", drained)
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"log"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// defaultEmptyDebounce is how long a backend must stay empty, or
+// have servers, before the transition is reported
+const defaultEmptyDebounce = 10 * time.Second
+
+// emptyState tracks if a backend is empty, as last reported
+type emptyState struct {
+	// empty is set if the backend was last reported without
+	// any enabled servers
+	empty bool
+
+	// since is when the backend stopped matching the reported
+	// state, or zero while it matches
+	since time.Time
+
+	// transitions counts the reported transitions
+	transitions uint64
+}
+
+// emptyEvent is a backend becoming empty, or having servers again
+type emptyEvent struct {
+	backend string
+	empty   bool
+}
+
+// checkEmpty is used to report the backends that became empty, or
+// have servers again, once they stay that way for the debounce. The
+// state of a backend on its first check is not reported. Schedules
+// another check if a transition is still pending.
+func checkEmpty(conf *Config, data *backendData, servers map[string][]*ServerEntry, now time.Time) {
+	debounce := conf.EmptyDebounce
+	if debounce == 0 {
+		debounce = defaultEmptyDebounce
+	}
+
+	data.Lock()
+	if data.empties == nil {
+		data.empties = make(map[string]*emptyState)
+	}
+	backends := make([]string, 0, len(servers))
+	for backend := range servers {
+		backends = append(backends, backend)
+	}
+	for backend := range data.Backends {
+		if _, ok := servers[backend]; !ok {
+			backends = append(backends, backend)
+		}
+	}
+	sort.Strings(backends)
+
+	var events []emptyEvent
+	var next time.Duration
+	for _, backend := range backends {
+		empty := enabledServers(servers[backend]) == 0
+		state, ok := data.empties[backend]
+		switch {
+		case !ok:
+			data.empties[backend] = &emptyState{empty: empty}
+		case empty == state.empty:
+			state.since = time.Time{}
+		case state.since.IsZero():
+			state.since = now
+			if next == 0 || debounce < next {
+				next = debounce
+			}
+		case now.Sub(state.since) >= debounce:
+			state.empty = empty
+			state.since = time.Time{}
+			state.transitions++
+			events = append(events, emptyEvent{backend: backend, empty: empty})
+		default:
+			if wait := debounce - now.Sub(state.since); next == 0 || wait < next {
+				next = wait
+			}
+		}
+	}
+	data.Unlock()
+
+	data.emptyTimer = nil
+	if next > 0 {
+		data.emptyTimer = time.After(next)
+	}
+	for _, event := range events {
+		reportEmpty(conf, event)
+	}
+}
+
+// reportEmpty is used to log a transition, and run the empty
+// command with the backend and if it is empty in its environment
+func reportEmpty(conf *Config, event emptyEvent) {
+	if event.empty {
+		log.Printf("[WARN] Backend %s has no servers", event.backend)
+	} else {
+		log.Printf("[INFO] Backend %s has servers again", event.backend)
+	}
+	if conf.EmptyCommand == "" {
+		return
+	}
+	env := []string{
+		"CONSUL_HAPROXY_BACKEND=" + event.backend,
+		"CONSUL_HAPROXY_EMPTY=" + strconv.FormatBool(event.empty),
+	}
+	if err := runCommand(conf.EmptyCommand, env); err != nil {
+		log.Printf("[ERR] Failed to run the empty command for %s: %v", event.backend, err)
+	}
+}
+
+// enabledServers returns the number of servers that are not disabled
+func enabledServers(servers []*ServerEntry) int {
+	enabled := 0
+	for _, server := range servers {
+		if !server.Disabled {
+			enabled++
+		}
+	}
+	return enabled
+}
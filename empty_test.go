@@ -0,0 +1,99 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCheckEmpty(t *testing.T) {
+	dir, err := ioutil.TempDir("", "consul-haproxy")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	eventsPath := filepath.Join(dir, "events")
+
+	conf := &Config{
+		EmptyCommand:  "echo $CONSUL_HAPROXY_BACKEND=$CONSUL_HAPROXY_EMPTY >> " + eventsPath,
+		EmptyDebounce: time.Minute,
+	}
+	data := &backendData{}
+	server := &ServerEntry{Node: "node1", ID: "app"}
+	full := map[string][]*ServerEntry{"app": []*ServerEntry{server}}
+	empty := map[string][]*ServerEntry{"app": nil}
+	disabled := map[string][]*ServerEntry{"app": []*ServerEntry{&ServerEntry{Node: "node1", Disabled: true}}}
+	events := func() []string {
+		raw, err := ioutil.ReadFile(eventsPath)
+		if os.IsNotExist(err) {
+			return nil
+		} else if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		return strings.Fields(string(raw))
+	}
+
+	start := time.Now()
+	type val struct {
+		servers map[string][]*ServerEntry
+		after   time.Duration
+		events  int
+	}
+	inps := []val{
+		// The initial state is not a transition
+		{full, 0, 0},
+
+		// A blip shorter than the debounce is ignored
+		{empty, time.Second, 0},
+		{full, 10 * time.Second, 0},
+		{full, 2 * time.Minute, 0},
+
+		// Staying empty past the debounce is reported once
+		{empty, 3 * time.Minute, 0},
+		{empty, 3*time.Minute + 30*time.Second, 0},
+		{disabled, 4 * time.Minute, 1},
+		{empty, 5 * time.Minute, 1},
+		{empty, 10 * time.Minute, 1},
+
+		// As is recovering
+		{full, 11 * time.Minute, 1},
+		{full, 12 * time.Minute, 2},
+		{full, 20 * time.Minute, 2},
+	}
+	for idx, inp := range inps {
+		checkEmpty(conf, data, inp.servers, start.Add(inp.after))
+		if out := events(); len(out) != inp.events {
+			t.Fatalf("bad: %d %v", idx, out)
+		}
+	}
+	if out := events(); out[0] != "app=true" || out[1] != "app=false" {
+		t.Fatalf("bad: %v", out)
+	}
+	if state := data.empties["app"]; state.empty || state.transitions != 2 {
+		t.Fatalf("bad: %v", state)
+	}
+}
+
+func TestCheckEmpty_Timer(t *testing.T) {
+	conf := &Config{EmptyDebounce: time.Minute}
+	data := &backendData{}
+	now := time.Now()
+
+	checkEmpty(conf, data, map[string][]*ServerEntry{"app": nil}, now)
+	if data.emptyTimer != nil {
+		t.Fatalf("unexpected timer")
+	}
+
+	// A pending transition is checked again once it may be reported
+	checkEmpty(conf, data, map[string][]*ServerEntry{"app": []*ServerEntry{&ServerEntry{}}}, now)
+	if data.emptyTimer == nil {
+		t.Fatalf("expected timer")
+	}
+	checkEmpty(conf, data, map[string][]*ServerEntry{"app": []*ServerEntry{&ServerEntry{}}}, now.Add(time.Minute))
+	if data.emptyTimer != nil || data.empties["app"].empty {
+		t.Fatalf("bad: %v", data.empties["app"])
+	}
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"github.com/armon/consul-api"
+)
+
+const (
+	// failoverThreshold is the number of consecutive failed queries
+	// of the active address before failing over to the next
+	failoverThreshold = 3
+
+	// failbackInterval is how often the primary address is checked
+	// while failed over, to fail back once it recovers
+	failbackInterval = 30 * time.Second
+)
+
+// failoverQuerier is a ServiceQuerier over several Consul addresses,
+// in order of preference. Queries use the active address, failing over
+// to the next on sustained failure, and failing back to the primary
+// once it responds again. The addresses should be agents of the same
+// cluster, so the indexes of the blocking queries carry over.
+type failoverQuerier struct {
+	addrs    []string
+	queriers []ServiceQuerier
+	kvs      []kvClient
+
+	l         sync.Mutex
+	active    int
+	failures  int
+	lastProbe time.Time
+}
+
+// newFailoverQuerier returns a querier for each of the configurations,
+// starting with the active one
+func newFailoverQuerier(confs []*consulapi.Config, active int) (*failoverQuerier, error) {
+	f := &failoverQuerier{active: active, lastProbe: time.Now()}
+	for _, consulConf := range confs {
+		client, err := consulapi.NewClient(consulConf)
+		if err != nil {
+			return nil, err
+		}
+		f.addrs = append(f.addrs, consulConf.Address)
+		f.queriers = append(f.queriers, &consulQuerier{config: consulConf})
+		f.kvs = append(f.kvs, client.KV())
+	}
+	return f, nil
+}
+
+// KV returns a KV client using the active address, so keys fail
+// over along with the service queries
+func (f *failoverQuerier) KV() kvClient {
+	return &failoverKV{f}
+}
+
+func (f *failoverQuerier) Service(service, tag string, passingOnly bool,
+	q *consulapi.QueryOptions) (entries []*consulapi.ServiceEntry, details instanceDetails,
+	qm *consulapi.QueryMeta, err error) {
+	f.query(func(querier ServiceQuerier) error {
+		_, _, _, err := querier.Service(service, tag, passingOnly, probeOptions(q))
+		return err
+	}, func(querier ServiceQuerier) error {
+		entries, details, qm, err = querier.Service(service, tag, passingOnly, q)
+		return err
+	})
+	return
+}
+
+func (f *failoverQuerier) Connect(service, tag string, passingOnly bool,
+	q *consulapi.QueryOptions) (entries []*consulapi.ServiceEntry, details instanceDetails,
+	qm *consulapi.QueryMeta, err error) {
+	f.query(func(querier ServiceQuerier) error {
+		_, _, _, err := querier.Connect(service, tag, passingOnly, probeOptions(q))
+		return err
+	}, func(querier ServiceQuerier) error {
+		entries, details, qm, err = querier.Connect(service, tag, passingOnly, q)
+		return err
+	})
+	return
+}
+
+func (f *failoverQuerier) Resolver(service string,
+	q *consulapi.QueryOptions) (resolver *ServiceResolver, err error) {
+	f.query(func(querier ServiceQuerier) error {
+		_, err := querier.Resolver(service, probeOptions(q))
+		return err
+	}, func(querier ServiceQuerier) error {
+		resolver, err = querier.Resolver(service, q)
+		return err
+	})
+	return
+}
+
+func (f *failoverQuerier) Intentions(service string,
+	q *consulapi.QueryOptions) (intentions []*Intention, qm *consulapi.QueryMeta, err error) {
+	f.query(func(querier ServiceQuerier) error {
+		_, _, err := querier.Intentions(service, probeOptions(q))
+		return err
+	}, func(querier ServiceQuerier) error {
+		intentions, qm, err = querier.Intentions(service, q)
+		return err
+	})
+	return
+}
+
+// query is used to run a query against the active address. While
+// failed over, the primary is first checked with the probe, which
+// must not block, at most every failbackInterval.
+func (f *failoverQuerier) query(probe, run func(ServiceQuerier) error) {
+	f.do(func(idx int) error {
+		return probe(f.queriers[idx])
+	}, func(idx int) error {
+		return run(f.queriers[idx])
+	})
+}
+
+// do is used to run a request against the index of the active
+// address, failing over on sustained failure
+func (f *failoverQuerier) do(probe, run func(int) error) {
+	idx := f.current(probe)
+	err := run(idx)
+
+	f.l.Lock()
+	defer f.l.Unlock()
+
+	// Ignore the results of queries to an address no longer active
+	if idx != f.active {
+		return
+	}
+	if classifyError(err) != errTransient {
+		f.failures = 0
+		return
+	}
+	f.failures++
+	if f.failures < failoverThreshold || len(f.queriers) == 1 {
+		return
+	}
+	next := (f.active + 1) % len(f.queriers)
+	log.Printf("[WARN] Consul at %s failed %d queries in a row, failing over to %s: %v",
+		f.addrs[f.active], f.failures, f.addrs[next], err)
+	f.active = next
+	f.failures = 0
+	f.lastProbe = time.Now()
+}
+
+// current returns the index of the active address, failing back
+// to the primary if it responds to the probe
+func (f *failoverQuerier) current(probe func(int) error) int {
+	f.l.Lock()
+	if f.active == 0 || time.Since(f.lastProbe) < failbackInterval {
+		defer f.l.Unlock()
+		return f.active
+	}
+	f.lastProbe = time.Now()
+	f.l.Unlock()
+
+	err := probe(0)
+
+	f.l.Lock()
+	defer f.l.Unlock()
+	if err == nil && f.active != 0 {
+		log.Printf("[INFO] Consul at %s recovered, failing back from %s",
+			f.addrs[0], f.addrs[f.active])
+		f.active = 0
+		f.failures = 0
+	}
+	return f.active
+}
+
+// failoverKV is a kvClient using the active address of a
+// failoverQuerier
+type failoverKV struct {
+	f *failoverQuerier
+}
+
+func (k *failoverKV) Get(key string,
+	q *consulapi.QueryOptions) (pair *consulapi.KVPair, qm *consulapi.QueryMeta, err error) {
+	k.f.do(func(idx int) error {
+		_, _, err := k.f.kvs[idx].Get(key, probeOptions(q))
+		return err
+	}, func(idx int) error {
+		pair, qm, err = k.f.kvs[idx].Get(key, q)
+		return err
+	})
+	return
+}
+
+func (k *failoverKV) CAS(p *consulapi.KVPair,
+	q *consulapi.WriteOptions) (ok bool, wm *consulapi.WriteMeta, err error) {
+	k.f.do(func(idx int) error {
+		_, _, err := k.f.kvs[idx].Get(p.Key, nil)
+		return err
+	}, func(idx int) error {
+		ok, wm, err = k.f.kvs[idx].CAS(p, q)
+		return err
+	})
+	return
+}
+
+// probeOptions returns the options of a query without blocking
+func probeOptions(q *consulapi.QueryOptions) *consulapi.QueryOptions {
+	if q == nil {
+		return nil
+	}
+	probe := *q
+	probe.WaitIndex = 0
+	probe.WaitTime = 0
+	return &probe
+}
+
+// consulConfigs returns the configuration of the Consul address
+// followed by that of each failover address
+func consulConfigs(conf *Config) ([]*consulapi.Config, error) {
+	consulConf, err := consulConfig(conf)
+	if err != nil {
+		return nil, err
+	}
+	confs := []*consulapi.Config{consulConf}
+	for _, addr := range conf.FailoverAddresses {
+		failover := *consulConf
+		failover.Address = addr
+		confs = append(confs, &failover)
+	}
+	return confs, nil
+}
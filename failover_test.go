@@ -0,0 +1,157 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/armon/consul-api"
+)
+
+func TestFailoverQuerier(t *testing.T) {
+	primary := &fakeQuerier{err: errors.New("connection refused")}
+	secondary := &fakeQuerier{entries: []*consulapi.ServiceEntry{
+		&consulapi.ServiceEntry{
+			Node:    &consulapi.Node{Node: "node2", Address: "127.0.0.2"},
+			Service: &consulapi.AgentService{ID: "app", Port: 8000},
+		},
+	}}
+	f := &failoverQuerier{
+		addrs:     []string{"primary:8500", "secondary:8500"},
+		queriers:  []ServiceQuerier{primary, secondary},
+		lastProbe: time.Now(),
+	}
+	opts := &consulapi.QueryOptions{}
+
+	// Fails over after sustained failure of the primary
+	for i := 0; i < failoverThreshold; i++ {
+		if _, _, _, err := f.Service("app", "", true, opts); err == nil {
+			t.Fatalf("expected error")
+		}
+	}
+	if f.active != 1 {
+		t.Fatalf("bad: %d", f.active)
+	}
+	entries, _, _, err := f.Service("app", "", true, opts)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(entries) != 1 || entries[0].Node.Node != "node2" {
+		t.Fatalf("bad: %v", entries)
+	}
+	if primary.calls != failoverThreshold || secondary.calls != 1 {
+		t.Fatalf("bad: %d %d", primary.calls, secondary.calls)
+	}
+
+	// The primary is not probed again until the interval passes
+	f.lastProbe = time.Now().Add(-failbackInterval)
+	if _, _, _, err := f.Service("app", "", true, opts); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if f.active != 1 || primary.calls != failoverThreshold+1 {
+		t.Fatalf("bad: %d %d", f.active, primary.calls)
+	}
+	if _, _, _, err := f.Service("app", "", true, opts); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if primary.calls != failoverThreshold+1 {
+		t.Fatalf("bad: %d", primary.calls)
+	}
+
+	// Fails back once the primary recovers
+	primary.err = nil
+	f.lastProbe = time.Now().Add(-failbackInterval)
+	if _, _, _, err := f.Service("app", "", true, opts); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if f.active != 0 {
+		t.Fatalf("bad: %d", f.active)
+	}
+	if secondary.calls != 3 {
+		t.Fatalf("bad: %d", secondary.calls)
+	}
+}
+
+func TestFailoverQuerier_NotFound(t *testing.T) {
+	primary := &fakeQuerier{err: &statusError{Code: 404, Body: "service not found"}}
+	f := &failoverQuerier{
+		addrs:    []string{"primary:8500", "secondary:8500"},
+		queriers: []ServiceQuerier{primary, &fakeQuerier{}},
+	}
+
+	// Errors that are not transient do not fail over
+	for i := 0; i < failoverThreshold+1; i++ {
+		f.Service("app", "", true, &consulapi.QueryOptions{})
+	}
+	if f.active != 0 {
+		t.Fatalf("bad: %d", f.active)
+	}
+}
+
+type failingKV struct {
+	err error
+}
+
+func (f *failingKV) Get(key string, q *consulapi.QueryOptions) (*consulapi.KVPair, *consulapi.QueryMeta, error) {
+	return nil, nil, f.err
+}
+
+func (f *failingKV) CAS(p *consulapi.KVPair, q *consulapi.WriteOptions) (bool, *consulapi.WriteMeta, error) {
+	return false, nil, f.err
+}
+
+func TestFailoverQuerier_KV(t *testing.T) {
+	secondary := &fakeKV{pairs: map[string]*consulapi.KVPair{
+		"haproxy/template": &consulapi.KVPair{Key: "haproxy/template", Value: []byte("foo")},
+	}}
+	f := &failoverQuerier{
+		addrs:     []string{"primary:8500", "secondary:8500"},
+		queriers:  []ServiceQuerier{&fakeQuerier{}, &fakeQuerier{}},
+		kvs:       []kvClient{&failingKV{err: errors.New("connection refused")}, secondary},
+		lastProbe: time.Now(),
+	}
+	kv := f.KV()
+
+	// Keys fail over after sustained failure of the primary
+	for i := 0; i < failoverThreshold; i++ {
+		if _, _, err := kv.Get("haproxy/template", nil); err == nil {
+			t.Fatalf("expected error")
+		}
+	}
+	if f.active != 1 {
+		t.Fatalf("bad: %d", f.active)
+	}
+	pair, _, err := kv.Get("haproxy/template", nil)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if pair == nil || string(pair.Value) != "foo" {
+		t.Fatalf("bad: %v", pair)
+	}
+
+	// Writes use the active address too
+	if err := writeKey(kv, "haproxy/config", []byte("bar")); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if pair := secondary.pairs["haproxy/config"]; pair == nil || string(pair.Value) != "bar" {
+		t.Fatalf("bad: %v", pair)
+	}
+}
+
+func TestConsulConfigs(t *testing.T) {
+	conf := &Config{
+		Address:           "primary:8500",
+		Token:             "secret",
+		FailoverAddresses: []string{"secondary:8500"},
+	}
+	confs, err := consulConfigs(conf)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(confs) != 2 || confs[0].Address != "primary:8500" || confs[1].Address != "secondary:8500" {
+		t.Fatalf("bad: %v", confs)
+	}
+	if confs[1].Token != "secret" {
+		t.Fatalf("bad: %v", confs[1])
+	}
+}
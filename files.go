@@ -0,0 +1,60 @@
+package main
+
+import (
+	"log"
+	"os"
+	"time"
+)
+
+// fileStamp identifies the version of a watched file. A file
+// that does not exist has a zero stamp.
+type fileStamp struct {
+	ModTime time.Time
+	Size    int64
+}
+
+// statFiles returns the stamp of each of the files
+func statFiles(paths []string) map[string]fileStamp {
+	out := make(map[string]fileStamp, len(paths))
+	for _, path := range paths {
+		var stamp fileStamp
+		if info, err := os.Stat(path); err == nil {
+			stamp = fileStamp{ModTime: info.ModTime(), Size: info.Size()}
+		}
+		out[path] = stamp
+	}
+	return out
+}
+
+// changedFiles is used to check the watched files for changes
+// since they were last checked, returning the changed paths
+func changedFiles(conf *Config, data *backendData) []string {
+	stamps := statFiles(conf.WatchFiles)
+	var changed []string
+	for _, path := range conf.WatchFiles {
+		if last, ok := data.fileStamps[path]; ok && last != stamps[path] {
+			changed = append(changed, path)
+		}
+	}
+	data.fileStamps = stamps
+	return changed
+}
+
+// checkFiles is used to reload HAProxy if any of the watched files,
+// such as certificates, changed, even though the configuration did
+// not. The reload is deferred if outside of the maintenance windows.
+func checkFiles(conf *Config, data *backendData) {
+	changed := changedFiles(conf, data)
+	if len(changed) == 0 {
+		return
+	}
+	for _, path := range changed {
+		log.Printf("[INFO] Watched file %s changed", path)
+	}
+
+	// The first render reloads with the current files anyway
+	if !data.rendered {
+		return
+	}
+	invokeReload(conf, data, "file triggered", formatOutput(aggregateServers(conf, data)), nil)
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestCheckFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "consul-haproxy")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	cert := filepath.Join(dir, "cert.pem")
+	if err := ioutil.WriteFile(cert, []byte("cert"), 0644); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	missing := filepath.Join(dir, "hosts.map")
+	reloaded := filepath.Join(dir, "reloaded")
+	conf := &Config{
+		WatchFiles:    []string{cert, missing},
+		ReloadCommand: "touch " + reloaded,
+	}
+	d := &backendData{
+		ErrCh:      make(chan error, errChSize),
+		fileStamps: statFiles(conf.WatchFiles),
+		rendered:   true,
+	}
+
+	// Nothing changed
+	checkFiles(conf, d)
+	if _, err := os.Stat(reloaded); !os.IsNotExist(err) {
+		t.Fatalf("bad: %v", err)
+	}
+
+	// Touching a watched file reloads
+	future := time.Now().Add(time.Minute)
+	if err := os.Chtimes(cert, future, future); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	checkFiles(conf, d)
+	if _, err := os.Stat(reloaded); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if d.lastReload != reloadReloaded {
+		t.Fatalf("bad: %s", d.lastReload)
+	}
+
+	// Creating a missing file is a change, and is only seen once
+	if err := ioutil.WriteFile(missing, []byte("www.example.com web"), 0644); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if changed := changedFiles(conf, d); !reflect.DeepEqual(changed, []string{missing}) {
+		t.Fatalf("bad: %v", changed)
+	}
+	if changed := changedFiles(conf, d); len(changed) != 0 {
+		t.Fatalf("bad: %v", changed)
+	}
+}
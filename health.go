@@ -0,0 +1,183 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	"github.com/armon/consul-api"
+)
+
+// instanceDetail holds the fields of an instance that the consul
+// client drops when decoding the health endpoints
+type instanceDetail struct {
+	// Kind is the kind of the service, such as "connect-proxy",
+	// or empty for a typical service
+	Kind string
+
+	// TaggedAddresses are the tagged addresses of the service, and
+	// NodeTaggedAddresses those of its node, such as "wan"
+	TaggedAddresses     map[string]taggedAddress
+	NodeTaggedAddresses map[string]string
+
+	// Meta is the metadata of the service
+	Meta map[string]string
+}
+
+// taggedAddress is a tagged address of a service
+type taggedAddress struct {
+	Address string
+	Port    int
+}
+
+// instanceDetails is the detail of each instance returned by
+// a query, by its instanceKey
+type instanceDetails map[string]*instanceDetail
+
+// statusError is the error of a health query that Consul answered
+// with a response code other than 200
+type statusError struct {
+	Code int
+	Body string
+}
+
+func (e *statusError) Error() string {
+	return fmt.Sprintf("Unexpected response code: %d (%s)", e.Code, e.Body)
+}
+
+// healthEntry is a service entry as returned by the health
+// endpoints, along with the fields the consul client drops
+type healthEntry struct {
+	Node *struct {
+		consulapi.Node
+		TaggedAddresses map[string]string
+	}
+	Service *struct {
+		consulapi.AgentService
+		Kind            string
+		TaggedAddresses map[string]taggedAddress
+		Meta            map[string]string
+	}
+	Checks []*consulapi.HealthCheck
+}
+
+// healthService is used to query the instances of a service from
+// a health endpoint, "service" for every instance, or "connect" for
+// the Connect capable instances, returning the proxy's service entry
+// for instances using a sidecar so its port is used. The HTTP API is
+// used directly, since the consul client does not support the connect
+// endpoint, and drops the kind, tagged addresses and meta of the
+// service.
+func healthService(consulConf *consulapi.Config, endpoint, service, tag string, passingOnly bool,
+	q *consulapi.QueryOptions) ([]*consulapi.ServiceEntry, instanceDetails, *consulapi.QueryMeta, error) {
+	// Build the request
+	params := queryParams(q)
+	if tag != "" {
+		params.Set("tag", tag)
+	}
+	if passingOnly {
+		params.Set("passing", "1")
+	}
+
+	// Make the request
+	start := time.Now()
+	resp, err := consulGet(consulConf, "/v1/health/"+endpoint+"/"+service, params)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		// Keep the body, as the consul client does, since it
+		// explains the error, such as "No path to datacenter"
+		body, _ := ioutil.ReadAll(resp.Body)
+		return nil, nil, nil, &statusError{Code: resp.StatusCode, Body: strings.TrimSpace(string(body))}
+	}
+
+	// Parse the metadata
+	qm, err := parseQueryMeta(resp, start)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	// Decode the entries, keeping the detail of each
+	var decoded []*healthEntry
+	if err := json.NewDecoder(resp.Body).Decode(&decoded); err != nil {
+		return nil, nil, nil, err
+	}
+	entries := make([]*consulapi.ServiceEntry, 0, len(decoded))
+	details := make(instanceDetails, len(decoded))
+	for _, d := range decoded {
+		if d.Node == nil || d.Service == nil {
+			continue
+		}
+		entry := &consulapi.ServiceEntry{Node: &d.Node.Node, Service: &d.Service.AgentService, Checks: d.Checks}
+		details[instanceKey(entry)] = &instanceDetail{
+			Kind:                d.Service.Kind,
+			TaggedAddresses:     d.Service.TaggedAddresses,
+			NodeTaggedAddresses: d.Node.TaggedAddresses,
+			Meta:                d.Service.Meta,
+		}
+		entries = append(entries, entry)
+	}
+	return entries, details, qm, nil
+}
+
+// kindTypical is the kind of a service that is not a proxy or
+// gateway, which Consul leaves empty
+const kindTypical = "typical"
+
+// entryKind returns the kind of an entry, kindTypical if none
+func entryKind(details instanceDetails, entry *consulapi.ServiceEntry) string {
+	if detail := details[instanceKey(entry)]; detail != nil && detail.Kind != "" {
+		return detail.Kind
+	}
+	return kindTypical
+}
+
+// entryMeta returns the meta of an entry, nil if none
+func entryMeta(details instanceDetails, entry *consulapi.ServiceEntry) map[string]string {
+	if detail := details[instanceKey(entry)]; detail != nil {
+		return detail.Meta
+	}
+	return nil
+}
+
+// filterKinds leaves out the entries not matching any of the kinds
+// of the watch, if set, or matching any of its excluded kinds
+func filterKinds(watch *WatchPath, entries []*consulapi.ServiceEntry,
+	details instanceDetails) []*consulapi.ServiceEntry {
+	if len(watch.Kinds) == 0 && len(watch.ExcludeKinds) == 0 {
+		return entries
+	}
+	var out []*consulapi.ServiceEntry
+	for _, entry := range entries {
+		kind := entryKind(details, entry)
+		if len(watch.Kinds) > 0 && !matchAny(watch.Kinds, kind) {
+			continue
+		}
+		if matchAny(watch.ExcludeKinds, kind) {
+			continue
+		}
+		out = append(out, entry)
+	}
+	return out
+}
+
+// patchTaggedAddress applies the tagged address of the watch to an
+// entry. The address and port of the service are used if it has the
+// tagged address, and otherwise the address of its node if it does.
+func patchTaggedAddress(watch *WatchPath, entry *consulapi.ServiceEntry, detail *instanceDetail) {
+	if watch.TaggedAddress == "" || detail == nil {
+		return
+	}
+	if addr, ok := detail.TaggedAddresses[watch.TaggedAddress]; ok && addr.Address != "" {
+		entry.Node.Address = addr.Address
+		if addr.Port != 0 {
+			entry.Service.Port = addr.Port
+		}
+	} else if addr := detail.NodeTaggedAddresses[watch.TaggedAddress]; addr != "" {
+		entry.Node.Address = addr
+	}
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/armon/consul-api"
+)
+
+// serveHealth serves the fixture of each health endpoint, recording
+// the last request
+func serveHealth(t *testing.T, fixtures map[string]string, req **http.Request) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		*req = r
+		fixture, ok := fixtures[r.URL.Path]
+		if !ok {
+			http.Error(w, "Unknown path", 404)
+			return
+		}
+		raw, err := ioutil.ReadFile(fixture)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		w.Header().Set("X-Consul-Index", "42")
+		w.Header().Set("X-Consul-Knownleader", "true")
+		w.Write(raw)
+	}))
+}
+
+func TestHealthService(t *testing.T) {
+	var req *http.Request
+	srv := serveHealth(t, map[string]string{
+		"/v1/health/service/web": "test-fixtures/health_service.json",
+	}, &req)
+	defer srv.Close()
+
+	consulConf := consulapi.DefaultConfig()
+	consulConf.Address = strings.TrimPrefix(srv.URL, "http://")
+	consulConf.Token = "secret"
+	opts := &consulapi.QueryOptions{
+		Datacenter: "dc2",
+		WaitIndex:  10,
+		WaitTime:   time.Second,
+	}
+	entries, details, qm, err := healthService(consulConf, "service", "web", "v1", true, opts)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	query := req.URL.Query()
+	if query.Get("tag") != "v1" || query.Get("dc") != "dc2" ||
+		query.Get("index") != "10" || query.Get("wait") != "1000ms" ||
+		query.Get("token") != "secret" {
+		t.Fatalf("bad: %v", req.URL)
+	}
+	if _, ok := query["passing"]; !ok {
+		t.Fatalf("bad: %v", req.URL)
+	}
+	if qm.LastIndex != 42 || !qm.KnownLeader {
+		t.Fatalf("bad: %v", qm)
+	}
+
+	// The entries decode as with the consul client
+	if len(entries) != 1 {
+		t.Fatalf("bad: %v", entries)
+	}
+	entry := entries[0]
+	if entry.Node.Node != "node1" || entry.Node.Address != "10.0.0.1" {
+		t.Fatalf("bad: %v", entry.Node)
+	}
+	if entry.Service.ID != "web1" || entry.Service.Service != "web" || entry.Service.Port != 8080 ||
+		len(entry.Service.Tags) != 1 || entry.Service.Tags[0] != "v1" {
+		t.Fatalf("bad: %v", entry.Service)
+	}
+	if len(entry.Checks) != 2 || entry.Checks[1].Status != "warning" || entry.Checks[1].ServiceID != "web1" {
+		t.Fatalf("bad: %v", entry.Checks)
+	}
+
+	// A typical service has no kind, and the meta is kept
+	detail := details["node1/web1"]
+	if detail == nil || detail.Kind != "" || detail.Meta["lb_weight"] != "50" {
+		t.Fatalf("bad: %v", detail)
+	}
+}
+
+func TestPatchTaggedAddress(t *testing.T) {
+	var req *http.Request
+	srv := serveHealth(t, map[string]string{
+		"/v1/health/service/web": "test-fixtures/health_service.json",
+	}, &req)
+	defer srv.Close()
+
+	consulConf := consulapi.DefaultConfig()
+	consulConf.Address = strings.TrimPrefix(srv.URL, "http://")
+	entries, details, _, err := healthService(consulConf, "service", "web", "", true, nil)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	detail := details[instanceKey(entries[0])]
+
+	type val struct {
+		watch *WatchPath
+		addr  string
+		port  int
+	}
+	inps := []val{
+		// The usual address and port
+		{&WatchPath{}, "10.0.0.1", 8080},
+		// The wan address of the service, with its port
+		{&WatchPath{TaggedAddress: "wan"}, "198.51.100.1", 18080},
+		// The lan address of the node, with the service port
+		{&WatchPath{TaggedAddress: "lan"}, "10.0.0.1", 8080},
+		// Not tagged, so unchanged
+		{&WatchPath{TaggedAddress: "other"}, "10.0.0.1", 8080},
+	}
+	for _, inp := range inps {
+		entry := cloneEntry(entries[0])
+		patchTaggedAddress(inp.watch, entry, detail)
+		if entry.Node.Address != inp.addr || entry.Service.Port != inp.port {
+			t.Fatalf("bad: %v %s:%d", inp.watch, entry.Node.Address, entry.Service.Port)
+		}
+	}
+}
+
+func TestHealthService_Connect(t *testing.T) {
+	var req *http.Request
+	srv := serveHealth(t, map[string]string{
+		"/v1/health/connect/web": "test-fixtures/health_connect.json",
+	}, &req)
+	defer srv.Close()
+
+	consulConf := consulapi.DefaultConfig()
+	consulConf.Address = strings.TrimPrefix(srv.URL, "http://")
+	entries, details, _, err := healthService(consulConf, "connect", "web", "", true, nil)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// The sidecar proxy is returned, with its port and kind
+	if len(entries) != 1 || entries[0].Service.ID != "web1-sidecar-proxy" || entries[0].Service.Port != 21000 {
+		t.Fatalf("bad: %v", entries)
+	}
+	if detail := details["node1/web1-sidecar-proxy"]; detail == nil || detail.Kind != "connect-proxy" {
+		t.Fatalf("bad: %v", detail)
+	}
+}
+
+func TestHealthService_Error(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "Permission denied", 403)
+	}))
+	defer srv.Close()
+
+	consulConf := consulapi.DefaultConfig()
+	consulConf.Address = strings.TrimPrefix(srv.URL, "http://")
+	_, _, _, err := healthService(consulConf, "service", "web", "", true, nil)
+	if err == nil || err.Error() != "Unexpected response code: 403 (Permission denied)" {
+		t.Fatalf("bad: %v", err)
+	}
+	if classifyError(err) != errPermissionDenied {
+		t.Fatalf("bad: %v", err)
+	}
+}
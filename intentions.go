@@ -0,0 +1,154 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/armon/consul-api"
+)
+
+// Intention is a Connect intention, allowing or denying a source
+// service to connect to a destination service. The intentions of
+// a destination are exposed to templates by the intentions function.
+type Intention struct {
+	SourceName      string
+	DestinationName string
+	Action          string
+	Precedence      int
+	Description     string
+}
+
+// connectIntentions is used to query the intentions matching a
+// destination service, in order of precedence. The consul client
+// does not support intentions, so the HTTP API is used directly.
+func connectIntentions(consulConf *consulapi.Config, service string,
+	q *consulapi.QueryOptions) ([]*Intention, *consulapi.QueryMeta, error) {
+	params := queryParams(q)
+	params.Set("by", "destination")
+	params.Set("name", service)
+
+	start := time.Now()
+	resp, err := consulGet(consulConf, "/v1/connect/intentions/match", params)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return nil, nil, fmt.Errorf("Unexpected response code: %d", resp.StatusCode)
+	}
+	qm, err := parseQueryMeta(resp, start)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var matches map[string][]*Intention
+	if err := json.NewDecoder(resp.Body).Decode(&matches); err != nil {
+		return nil, nil, err
+	}
+	return matches[service], qm, nil
+}
+
+// intentionValues holds the intentions of each of the
+// IntentionServices that have been read
+type intentionValues struct {
+	sync.Mutex
+	values map[string][]*Intention
+}
+
+// get returns the intentions of a destination, if they were read
+func (i *intentionValues) get(service string) ([]*Intention, bool) {
+	if i == nil {
+		return nil, false
+	}
+	i.Lock()
+	defer i.Unlock()
+	intentions, ok := i.values[service]
+	return intentions, ok
+}
+
+// set updates the intentions of a destination. Returns if
+// they changed.
+func (i *intentionValues) set(service string, intentions []*Intention) bool {
+	i.Lock()
+	defer i.Unlock()
+	old, ok := i.values[service]
+	if intentions == nil {
+		intentions = []*Intention{}
+	}
+	i.values[service] = intentions
+	return !ok || !reflect.DeepEqual(old, intentions)
+}
+
+// fetchIntentions is used to read the intentions of the destinations
+// at startup, so the first render has them. Returns the index of each
+// destination, to watch it from.
+func fetchIntentions(conf *Config, querier ServiceQuerier) map[string]uint64 {
+	conf.intentions = &intentionValues{values: make(map[string][]*Intention)}
+	indexes := make(map[string]uint64)
+	for _, service := range conf.IntentionServices {
+		indexes[service] = 0
+		intentions, qm, err := querier.Intentions(service, nil)
+		if err != nil {
+			log.Printf("[WARN] Failed to read the intentions of %s: %v", service, err)
+			continue
+		}
+		conf.intentions.set(service, intentions)
+		indexes[service] = qm.LastIndex
+	}
+	return indexes
+}
+
+// watchIntentions is used to watch the intentions of a destination,
+// refreshing every backend when they change
+func watchIntentions(conf *Config, data *backendData, service string, index uint64) {
+	opts := &consulapi.QueryOptions{WaitTime: waitTime}
+	var failures FailureTracker
+	for {
+		if shouldStop(data.StopCh) {
+			return
+		}
+		opts.WaitIndex = index
+		intentions, qm, err := data.Querier.Intentions(service, opts)
+		if err != nil {
+			log.Printf("[ERR] Failed to watch the intentions of %s: %v", service, err)
+			failures.Record()
+			time.Sleep(failures.Backoff())
+			continue
+		}
+		failures.Reset()
+		index = nextWaitIndex(index, qm.LastIndex)
+
+		if !conf.intentions.set(service, intentions) {
+			continue
+		}
+		log.Printf("[INFO] Intentions of %s were updated", service)
+
+		// Any template may use the intentions, so refresh every backend
+		markAllChanged(data)
+		asyncNotify(data.ChangeCh)
+	}
+}
+
+// lookupIntentions is used to get the intentions of a destination
+// from a template. The destination must be watched, and failing to
+// read its intentions fails the render.
+func lookupIntentions(conf *Config, service string) ([]*Intention, error) {
+	watched := false
+	for _, s := range conf.IntentionServices {
+		if s == service {
+			watched = true
+		}
+	}
+	if !watched {
+		return nil, fmt.Errorf("Intentions of %s are not watched, add -intentions %s", service, service)
+	}
+	intentions, ok := conf.intentions.get(service)
+	if !ok {
+		return nil, fmt.Errorf("Intentions of %s have not been read", service)
+	}
+	return intentions, nil
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/armon/consul-api"
+)
+
+func TestConnectIntentions(t *testing.T) {
+	var req *http.Request
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		req = r
+		w.Header().Set("X-Consul-Index", "42")
+		fmt.Fprint(w, `{"db": [
+			{"SourceName": "web", "DestinationName": "db", "Action": "allow", "Precedence": 9},
+			{"SourceName": "*", "DestinationName": "db", "Action": "deny", "Precedence": 8}
+		]}`)
+	}))
+	defer srv.Close()
+
+	consulConf := consulapi.DefaultConfig()
+	consulConf.Address = strings.TrimPrefix(srv.URL, "http://")
+	intentions, qm, err := connectIntentions(consulConf, "db", &consulapi.QueryOptions{WaitIndex: 10})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if req.URL.Path != "/v1/connect/intentions/match" {
+		t.Fatalf("bad: %v", req.URL)
+	}
+	query := req.URL.Query()
+	if query.Get("by") != "destination" || query.Get("name") != "db" || query.Get("index") != "10" {
+		t.Fatalf("bad: %v", req.URL)
+	}
+	if qm.LastIndex != 42 {
+		t.Fatalf("bad: %v", qm)
+	}
+	if len(intentions) != 2 || intentions[0].SourceName != "web" || intentions[1].Action != "deny" {
+		t.Fatalf("bad: %v", intentions)
+	}
+}
+
+func TestIntentions_Template(t *testing.T) {
+	dir, err := ioutil.TempDir("", "consul-haproxy")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	templatePath := filepath.Join(dir, "db.tmpl")
+	tmpl := `{{range intentions "db"}}{{.SourceName}}={{.Action}} {{end}}`
+	if err := ioutil.WriteFile(templatePath, []byte(tmpl), 0644); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	querier := &fakeQuerier{intentions: map[string][]*Intention{
+		"db": []*Intention{
+			&Intention{SourceName: "web", DestinationName: "db", Action: "allow", Precedence: 9},
+			&Intention{SourceName: "*", DestinationName: "db", Action: "deny", Precedence: 8},
+		},
+	}}
+	conf := &Config{
+		Templates:         []string{templatePath},
+		IntentionServices: []string{"db"},
+	}
+
+	// The template fails until the intentions are read
+	if _, err := buildTemplate(conf, templatePath, nil, false); err == nil {
+		t.Fatalf("expected error")
+	}
+	if indexes := fetchIntentions(conf, querier); indexes["db"] != 10 {
+		t.Fatalf("bad: %v", indexes)
+	}
+	out, err := buildTemplate(conf, templatePath, nil, false)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if string(out) != "web=allow *=deny " {
+		t.Fatalf("bad: %s", out)
+	}
+
+	// Only changes are reported
+	if conf.intentions.set("db", querier.intentions["db"]) {
+		t.Fatalf("unexpected change")
+	}
+	if !conf.intentions.set("db", nil) {
+		t.Fatalf("expected change")
+	}
+
+	// Destinations that are not watched fail the render
+	if _, err := lookupIntentions(conf, "web"); err == nil {
+		t.Fatalf("expected error")
+	}
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bytes"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/armon/consul-api"
+)
+
+// kvValues holds the values of the Consul KV keys that the
+// templates and reload command are sourced from. A key that
+// has no value falls back to the local template or command.
+type kvValues struct {
+	sync.Mutex
+	values map[string][]byte
+}
+
+// get returns the value of a key, if it has one
+func (k *kvValues) get(key string) ([]byte, bool) {
+	if k == nil {
+		return nil, false
+	}
+	k.Lock()
+	defer k.Unlock()
+	value, ok := k.values[key]
+	return value, ok
+}
+
+// set updates the value of a key, removing it if the pair is
+// nil. Returns if the value changed.
+func (k *kvValues) set(key string, pair *consulapi.KVPair) bool {
+	k.Lock()
+	defer k.Unlock()
+	old, ok := k.values[key]
+	if pair == nil {
+		delete(k.values, key)
+		return ok
+	}
+	k.values[key] = pair.Value
+	return !ok || !bytes.Equal(old, pair.Value)
+}
+
+// sourceKeys returns the keys the templates and reload command
+// are sourced from, without duplicates
+func sourceKeys(conf *Config) []string {
+	var keys []string
+	seen := make(map[string]bool)
+	for _, key := range append(append([]string{}, conf.TemplateKeys...), conf.ReloadKey) {
+		if key == "" || seen[key] {
+			continue
+		}
+		seen[key] = true
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+// fetchKeys is used to read the source keys at startup. A key that
+// cannot be read or does not exist falls back to the local value.
+// Returns the index of each key, to watch it from.
+func fetchKeys(conf *Config, kv kvClient) map[string]uint64 {
+	conf.kvValues = &kvValues{values: make(map[string][]byte)}
+	indexes := make(map[string]uint64)
+	for _, key := range sourceKeys(conf) {
+		pair, qm, err := kv.Get(key, nil)
+		if err != nil {
+			log.Printf("[WARN] Failed to read key %s, using the local value: %v", key, err)
+			continue
+		}
+		if pair == nil {
+			log.Printf("[WARN] Key %s does not exist, using the local value", key)
+		}
+		conf.kvValues.set(key, pair)
+		indexes[key] = qm.LastIndex
+	}
+	return indexes
+}
+
+// watchKey is used to watch a source key, refreshing every
+// backend when its value changes
+func watchKey(conf *Config, data *backendData, kv kvClient, key string, index uint64) {
+	opts := &consulapi.QueryOptions{WaitTime: waitTime}
+	var failures FailureTracker
+	for {
+		if shouldStop(data.StopCh) {
+			return
+		}
+		opts.WaitIndex = index
+		pair, qm, err := kv.Get(key, opts)
+		if err != nil {
+			log.Printf("[ERR] Failed to watch key %s: %v", key, err)
+			failures.Record()
+			time.Sleep(failures.Backoff())
+			continue
+		}
+		failures.Reset()
+		index = nextWaitIndex(index, qm.LastIndex)
+
+		if !conf.kvValues.set(key, pair) {
+			continue
+		}
+		if pair == nil {
+			log.Printf("[WARN] Key %s was removed, using the local value", key)
+		} else {
+			log.Printf("[INFO] Key %s was updated", key)
+		}
+
+		// Any template may use the key, so refresh every backend
+		markAllChanged(data)
+		asyncNotify(data.ChangeCh)
+	}
+}
+
+// templateKey returns the key a template is sourced from, if any
+func templateKey(conf *Config, templatePath string) string {
+	for idx, t := range conf.Templates {
+		if t == templatePath && idx < len(conf.TemplateKeys) {
+			return conf.TemplateKeys[idx]
+		}
+	}
+	return ""
+}
+
+// reloadCommand returns the reload command, from the reload
+// key if it has a value
+func reloadCommand(conf *Config) string {
+	if conf.ReloadKey != "" {
+		if value, ok := conf.kvValues.get(conf.ReloadKey); ok {
+			return string(value)
+		}
+	}
+	return conf.ReloadCommand
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/armon/consul-api"
+)
+
+func TestFetchKeys_Template(t *testing.T) {
+	kv := &fakeKV{pairs: map[string]*consulapi.KVPair{
+		"haproxy/template": &consulapi.KVPair{
+			Key:         "haproxy/template",
+			Value:       []byte("backend kv{{range .app}}\n    {{.}}{{end}}\n"),
+			ModifyIndex: 4,
+		},
+		"haproxy/reload": &consulapi.KVPair{
+			Key:   "haproxy/reload",
+			Value: []byte("kv-reload"),
+		},
+	}}
+	conf := &Config{
+		Templates:     []string{"test-fixtures/simple.conf", "test-fixtures/second.conf"},
+		TemplateKeys:  []string{"haproxy/template", "haproxy/missing"},
+		Paths:         []string{"config_out", "config_out2"},
+		Backends:      []string{"app=app"},
+		ReloadCommand: "local-reload",
+		ReloadKey:     "haproxy/reload",
+	}
+
+	// Running the key as a command must be allowed explicitly
+	if errs := validateConfig(conf); len(errs) != 1 || !strings.Contains(errs[0].Error(), "reload-key-exec") {
+		t.Fatalf("bad: %v", errs)
+	}
+	conf.ReloadKeyExec = true
+	if errs := validateConfig(conf); len(errs) > 0 {
+		t.Fatalf("err: %v", errs)
+	}
+	fetchKeys(conf, kv)
+
+	servers := map[string][]*backendEntry{
+		"app": []*backendEntry{
+			&backendEntry{
+				ServiceEntry: &consulapi.ServiceEntry{
+					Node:    &consulapi.Node{Node: "node1", Address: "127.0.0.1"},
+					Service: &consulapi.AgentService{ID: "app", Service: "app", Port: 8000},
+				},
+				Watch: conf.watches[0],
+			},
+		},
+	}
+
+	// The first template is sourced from its key
+	out, err := buildTemplate(conf, conf.Templates[0], servers, false)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !bytes.HasPrefix(out, []byte("backend kv\n    server node1_app 127.0.0.1:8000")) {
+		t.Fatalf("bad: %s", out)
+	}
+
+	// The key of the second template is missing, so the file is used
+	raw, err := readTemplate(conf, conf.Templates[1])
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	expect, err := ioutil.ReadFile(conf.Templates[1])
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !bytes.Equal(raw, expect) {
+		t.Fatalf("bad: %s", raw)
+	}
+
+	// The reload command is sourced from its key
+	if cmd := reloadCommand(conf); cmd != "kv-reload" {
+		t.Fatalf("bad: %s", cmd)
+	}
+	conf.kvValues.set("haproxy/reload", nil)
+	if cmd := reloadCommand(conf); cmd != "local-reload" {
+		t.Fatalf("bad: %s", cmd)
+	}
+}
+
+func TestValidateConfig_TemplateKeys(t *testing.T) {
+	conf := &Config{
+		Templates:    []string{"test-fixtures/simple.conf"},
+		TemplateKeys: []string{"haproxy/a", "haproxy/b"},
+		Paths:        []string{"config_out"},
+		Backends:     []string{"app=app"},
+	}
+	if errs := validateConfig(conf); len(errs) != 1 {
+		t.Fatalf("bad: %v", errs)
+	}
+}
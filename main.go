@@ -8,10 +8,14 @@ import (
 	"fmt"
 	"io/ioutil"
 	"log"
+	"net"
+	"net/url"
 	"os"
 	"os/signal"
+	"path"
 	"path/filepath"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 	"syscall"
@@ -32,7 +36,152 @@ type WatchPath struct {
 	Service    string
 	Tag        string
 	Datacenter string
-	Port       int
+
+	// Port is the port of the specification, which overrides
+	// the port of every instance
+	Port int
+
+	// ForcePort overrides the port of every instance, such as
+	// to target a sidecar rather than the application, taking
+	// precedence over Port
+	ForcePort int
+
+	// DefaultPort is used for any instance that does not register
+	// a port, if neither Port nor ForcePort is set
+	DefaultPort int
+
+	// FallbackIfEmpty is set when the watches of a backend are
+	// ordered sources rather than merged. Only the servers of the
+	// first non-empty source are used.
+	FallbackIfEmpty bool
+
+	// MaxServers limits the number of servers taken from
+	// this watch. Zero means no limit.
+	MaxServers int
+
+	// Protocol is the protocol of the backend, "tcp" or "http",
+	// and is exposed to the template
+	Protocol string
+
+	// SendProxy enables the PROXY protocol on the server lines
+	SendProxy bool
+
+	// Observe is the traffic observed to detect failing servers,
+	// "layer4" or "layer7", and AgentPort is the port of an agent
+	// reporting the state of each server. Both are off if empty.
+	Observe   string
+	AgentPort int
+
+	// CheckWeight scales the weight of each server by the ratio
+	// of its checks that are passing
+	CheckWeight bool
+
+	// WeightKey is the key of the service meta the weight of each
+	// server is taken from, clamped to the weights HAProxy accepts.
+	// Servers without a valid meta use DefaultWeight.
+	WeightKey     string
+	DefaultWeight int
+
+	// IncludeUnhealthy includes the instances that are not passing
+	// their health checks, but marks their servers as disabled
+	IncludeUnhealthy bool
+
+	// Connect watches the Connect capable instances of the service,
+	// using the sidecar proxy of each instance if it has one
+	Connect bool
+
+	// ExcludeNodes and ExcludeServiceIDs are glob patterns of the
+	// nodes and service IDs to leave out, such as to drain a node
+	ExcludeNodes      []string
+	ExcludeServiceIDs []string
+
+	// Kinds and ExcludeKinds are glob patterns of the service kinds
+	// to keep and to leave out, such as "connect-proxy", with
+	// "typical" for services that are not proxies or gateways
+	Kinds        []string
+	ExcludeKinds []string
+
+	// SortMode controls the order of the servers of the backend,
+	// one of "name", "address", "weight" or "priority". If empty,
+	// the order returned by Consul is kept.
+	SortMode string
+
+	// Backup marks the servers of the watch as backup servers,
+	// which are placed after the other servers of the backend
+	Backup bool
+
+	// Resolver adds backup watches for the failover targets of the
+	// service-resolver config entry of the service
+	Resolver bool
+
+	// SplitTagPrefix splits the instances across backends named by
+	// their tags with this prefix. Instances without such a tag are
+	// kept in the backend of the watch.
+	SplitTagPrefix string
+
+	// Labels are arbitrary key/value pairs attached to the watch,
+	// such as the owning team, which are included in its log lines
+	// and statistics
+	Labels map[string]string
+
+	// AllowMissing treats a service or datacenter that does not
+	// exist as having no instances, rather than as a failure
+	AllowMissing bool
+
+	// MissingAddress is the address used for instances on a node
+	// without an address. If empty, such instances are left out.
+	MissingAddress string
+
+	// TaggedAddress is the name of the tagged address used for the
+	// instances, such as "wan", along with its port. Instances without
+	// it use their usual address and port.
+	TaggedAddress string
+
+	// Consistency is the consistency mode of the queries, one of
+	// "default", "stale" or "consistent". If empty, the default
+	// mode is used.
+	Consistency string
+
+	// MaxFailures is the number of consecutive failed queries of
+	// the watch after which the process exits, overriding the
+	// global MaxConsecutiveFailures. Zero uses the global limit.
+	MaxFailures int
+
+	// MaxDataAge is how long the watch may go without returning
+	// before its data is considered stale. Zero disables the check.
+	MaxDataAge time.Duration
+
+	// MeshGateway is the address of the local mesh gateway, used to
+	// reach the instances of a watch in a federated datacenter. The
+	// servers use the gateway address, routed by SNI.
+	MeshGateway string
+
+	// meshGatewayAddr is the parsed MeshGateway, and meshSNI the
+	// server name the gateway routes to the service by
+	meshGatewayAddr *net.TCPAddr
+	meshSNI         string
+}
+
+// String is used to identify the watch in log lines, with
+// the options replaced by the labels of the watch
+func (wp *WatchPath) String() string {
+	name := wp.Spec
+	if idx := strings.Index(name, "?"); idx >= 0 {
+		if end := strings.Index(name[idx:], " "); end >= 0 {
+			name = name[:idx] + name[idx+end:]
+		} else {
+			name = name[:idx]
+		}
+	}
+	if len(wp.Labels) == 0 {
+		return name
+	}
+	labels := make([]string, 0, len(wp.Labels))
+	for key, val := range wp.Labels {
+		labels = append(labels, key+"="+val)
+	}
+	sort.Strings(labels)
+	return fmt.Sprintf("%s [%s]", name, strings.Join(labels, " "))
 }
 
 // Config is used to configure the HAProxy connector
@@ -44,19 +193,152 @@ type Config struct {
 	// Address is the Consul HTTP API address
 	Address string `mapstructure:"address"`
 
-	// Path to the HAProxy template file
-	Templates []string `mapstructure:"templates"`
+	// FailoverAddresses are the addresses of other agents, in order,
+	// that the watches fail over to while the active one is failing.
+	// The watches fail back once the first address recovers.
+	FailoverAddresses []string `mapstructure:"failover_addresses"`
+
+	// Token is the Consul ACL token
+	Token string `mapstructure:"token"`
+
+	// SSL enables HTTPS when talking to Consul
+	SSL bool `mapstructure:"ssl"`
+
+	// SSLNoVerify disables verification of Consul's certificate
+	SSLNoVerify bool `mapstructure:"ssl_no_verify"`
+
+	// BindAddr is the local IP address that requests to
+	// Consul originate from. Useful on multi-homed hosts.
+	BindAddr string `mapstructure:"bind_addr"`
+
+	// Path to the HAProxy template file. A http:// or https:// URL
+	// is fetched every TemplateURLInterval instead, which defaults to
+	// a minute, and the last good template is used if a fetch fails.
+	Templates           []string      `mapstructure:"templates"`
+	TemplateURLInterval time.Duration `mapstructure:"template_url_interval"`
+
+	// TemplateKeys are Consul KV keys the templates are sourced
+	// from, in the same order as Templates. The keys are watched,
+	// and the local template is used while a key has no value.
+	TemplateKeys []string `mapstructure:"template_keys"`
+
+	// IntentionServices are the destination services whose Connect
+	// intentions are watched, for templates to read with the
+	// intentions function
+	IntentionServices []string `mapstructure:"intention_services"`
 
 	// Path to the HAProxy configuration file to write
 	Paths []string `mapstructure:"paths"`
 
-	// Command used to reload HAProxy
+	// PerDatacenter renders each template once per datacenter, with
+	// only the servers of that datacenter, to the path with
+	// "{{.Datacenter}}" replaced by its name
+	PerDatacenter bool `mapstructure:"per_datacenter"`
+
+	// SharedTemplates are paths or glob patterns of templates parsed
+	// along with every template, so the templates they define can
+	// be invoked to share structure across outputs
+	SharedTemplates []string `mapstructure:"shared_templates"`
+
+	// IncludeBackends and ExcludeBackends are glob patterns of the
+	// backends to render, so several instances can split the backends
+	// between them. If IncludeBackends is empty, every backend not
+	// excluded is rendered. The watches of other backends are skipped.
+	IncludeBackends []string `mapstructure:"include_backends"`
+	ExcludeBackends []string `mapstructure:"exclude_backends"`
+
+	// GroupDatacenters orders the servers of each backend so those of
+	// a datacenter are together, under a "# datacenter: X" comment
+	GroupDatacenters bool `mapstructure:"group_datacenters"`
+
+	// HashComment starts every output with a "# config-hash: <sha256>"
+	// comment, hashing the servers of every backend, so tools can
+	// tell if the servers changed without comparing the files
+	HashComment bool `mapstructure:"hash_comment"`
+
+	// HeaderTemplate and FooterTemplate are paths to templates
+	// rendered before and after the output of every template.
+	// They are given the RenderInfo of the render.
+	HeaderTemplate string `mapstructure:"header_template"`
+	FooterTemplate string `mapstructure:"footer_template"`
+
+	// HAProxyVersion is the version of HAProxy being configured, such
+	// as "1.8". It is available to templates, and the default server
+	// lines only use syntax supported by it. If empty, the latest
+	// version is assumed.
+	HAProxyVersion string `mapstructure:"haproxy_version"`
+
+	// StatsSocket is the path of the HAProxy stats socket, which
+	// is available to templates to configure it
+	StatsSocket string `mapstructure:"stats_socket"`
+
+	// DNSResolvers is the name of an HAProxy resolvers section. If
+	// set, servers with a hostname rather than an IP are resolved
+	// using it, so HAProxy picks up changes to their addresses.
+	DNSResolvers string `mapstructure:"dns_resolvers"`
+
+	// InitAddr is the init-addr policy of servers with a hostname,
+	// such as "last,libc,none", for how HAProxy resolves them on
+	// start. Defaults to "none" if DNSResolvers is set.
+	InitAddr string `mapstructure:"init_addr"`
+
+	// TrustDomain is the trust domain of the Connect CA, such as
+	// "7c2a4f5e.consul", used to build the SNI of mesh gateway routes
+	TrustDomain string `mapstructure:"trust_domain"`
+
+	// MeshCAFile is the path of the Connect CA certificates, used to
+	// verify mesh gateways. If empty, they are not verified.
+	MeshCAFile string `mapstructure:"mesh_ca_file"`
+
+	// MeshCert is the path of the Connect client certificate and key
+	// presented to mesh gateways, which require mutual TLS
+	MeshCert string `mapstructure:"mesh_crt"`
+
+	// Command used to reload HAProxy. If empty, the configuration
+	// files are written but no reload is done.
 	ReloadCommand string `mapstructure:"reload_command"`
 
+	// ReloadKey is a Consul KV key the reload command is sourced
+	// from. The key is watched, and ReloadCommand is used while
+	// it has no value.
+	ReloadKey string `mapstructure:"reload_key"`
+
+	// ReloadKeyExec allows the value of ReloadKey to be run as the
+	// reload command. It must be set explicitly, since anyone able to
+	// write the key can then run commands on this host.
+	ReloadKeyExec bool `mapstructure:"reload_key_exec"`
+
+	// CompressKV gzips the configuration written to Consul KV
+	// keys, for configurations exceeding the size limit of a value
+	CompressKV bool `mapstructure:"compress_kv"`
+
+	// MaintenanceWindows are daily windows of local time, given as
+	// "HH:MM-HH:MM", during which reloads are allowed. Outside of
+	// them, the configuration is written but the reload is deferred
+	// until the next window opens. If empty, reloads are always allowed.
+	MaintenanceWindows []string `mapstructure:"maintenance_windows"`
+
+	// Command used to validate the configuration files before they
+	// are put in place. The staged paths are provided in the
+	// CONSUL_HAPROXY_FILES environment variable. If it fails, none
+	// of the files are updated.
+	ValidateCommand string `mapstructure:"validate_command"`
+
 	// Backends are used to specify what we watch. Given as:
 	// "name=(tag.)service"
 	Backends []string `mapstructure:"backends"`
 
+	// FallbackBackends lists the backends whose watches are used
+	// in order as fallbacks, instead of being merged together.
+	FallbackBackends []string `mapstructure:"fallback_backends"`
+
+	// DuplicateBackends is how backends watching the same service,
+	// tag and datacenter more than once are handled, such as when
+	// given by both the configuration file and the CLI. Either
+	// "merge", the default, to keep every watch, "error" to fail,
+	// or "last-wins" to only keep the last.
+	DuplicateBackends string `mapstructure:"duplicate_backends"`
+
 	// Quiet is how long we wait for a "quiet" period before
 	// trigger the re-build and re-load. This allows us to
 	// wait for the system to reach a quiescent state instead
@@ -70,8 +352,196 @@ type Config struct {
 	// Quiet value if not provided.
 	MaxWait time.Duration `mapstructure:"max_wait"`
 
+	// RenderTimeout limits how long a template may take to render.
+	// A template exceeding it is treated as failed, and the last
+	// configuration is kept. Zero means no limit.
+	RenderTimeout time.Duration `mapstructure:"render_timeout"`
+
+	// StartupStagger is the delay between starting each watch, with
+	// jitter, to spread out their first queries. Zero starts them all
+	// at once.
+	StartupStagger time.Duration `mapstructure:"startup_stagger"`
+
+	// WarmupDelay is how long a new instance is disabled for once
+	// it is discovered, giving it time to become ready. Instances
+	// present on start are not delayed.
+	WarmupDelay time.Duration `mapstructure:"warmup_delay"`
+
+	// CanaryRate limits the new instances added to a backend per
+	// refresh to this fraction of its servers, rounded up, such as
+	// 0.1 for 10%. The rest are added by later refreshes, every
+	// CanaryInterval. Zero adds them all at once.
+	CanaryRate     float64       `mapstructure:"canary_rate"`
+	CanaryInterval time.Duration `mapstructure:"canary_interval"`
+
+	// InitialRender queries every watch once and renders the
+	// configuration before watching for changes, so watch does not
+	// return until the configuration is up to date
+	InitialRender bool `mapstructure:"initial_render"`
+
+	// InitialRenderTimeout limits how long we wait for the initial
+	// render. Defaults to 30 seconds.
+	InitialRenderTimeout time.Duration `mapstructure:"initial_render_timeout"`
+
+	// FinalRender applies any pending changes on shutdown, ignoring
+	// the quiet period, so the configuration is left up to date
+	FinalRender bool `mapstructure:"final_render"`
+
+	// ShutdownTimeout limits how long we wait on shutdown, or for
+	// the watcher to stop on a configuration reload, for the final
+	// render. Defaults to 10 seconds.
+	ShutdownTimeout time.Duration `mapstructure:"shutdown_timeout"`
+
+	// QueryTimeoutMargin is how long a query to Consul may outlast
+	// the wait time of its blocking query before it is abandoned and
+	// retried, such as when the network drops its packets. Defaults
+	// to 10 seconds.
+	QueryTimeoutMargin time.Duration `mapstructure:"query_timeout_margin"`
+
+	// MaxConsecutiveFailures exits the process once a watch fails
+	// this many queries in a row, so an orchestrator can restart
+	// it. Zero, the default, retries forever.
+	MaxConsecutiveFailures int `mapstructure:"max_consecutive_failures"`
+
+	// DedupeAddresses collapses the servers of a backend sharing
+	// the same address and port into the first of them
+	DedupeAddresses bool `mapstructure:"dedupe_addresses"`
+
+	// EmptyBackendPlaceholder emits a disabled placeholder server
+	// for any backend without servers, keeping the configuration
+	// valid for HAProxy during an outage.
+	EmptyBackendPlaceholder bool `mapstructure:"empty_backend_placeholder"`
+
+	// OnAllErrors is how a backend is rendered when every watch
+	// feeding it is failing, rather than just returning no servers.
+	// Either "keep" to keep the last servers of the watches, which
+	// is the default, or "empty" to render it without servers.
+	OnAllErrors string `mapstructure:"on_all_errors"`
+
+	// BackendOrder is the order the backends template function
+	// returns the backends in. Either "name", the default, or
+	// "config" for the order the backends are configured in.
+	BackendOrder string `mapstructure:"backend_order"`
+
+	// NameReplacement replaces the characters of server names that
+	// are not letters, digits, dashes or underscores, such as the
+	// dots of node names. Defaults to "_". RawNames disables this.
+	NameReplacement string `mapstructure:"name_replacement"`
+	RawNames        bool   `mapstructure:"raw_names"`
+
+	// PlaceholderAddress is the address used for the placeholder
+	// server. Defaults to 127.0.0.1:1.
+	PlaceholderAddress string `mapstructure:"placeholder_address"`
+
+	// PidFile is the path to write the PID of this process to.
+	// It is removed on a clean exit.
+	PidFile string `mapstructure:"pid_file"`
+
+	// StateAddr is the address to serve the current state on, at
+	// the /state HTTP endpoint, and the readiness at /readyz. If
+	// empty, the endpoints are disabled.
+	StateAddr string `mapstructure:"state_addr"`
+
+	// MinHealthy is the minimum number of enabled servers of each
+	// critical backend for the /readyz endpoint to report ready
+	MinHealthy map[string]int `mapstructure:"min_healthy"`
+
+	// MinReload is the minimum number of enabled servers of each
+	// critical backend to reload HAProxy. Below it, the configuration
+	// is still written, so it can be inspected, but not reloaded.
+	MinReload map[string]int `mapstructure:"min_reload"`
+
+	// WatchFiles are files the configuration depends on, such as
+	// certificates and map files. HAProxy is reloaded when any of
+	// them changes, even if the servers did not. They are checked
+	// every WatchFilesInterval, which defaults to 5 seconds.
+	WatchFiles         []string      `mapstructure:"watch_files"`
+	WatchFilesInterval time.Duration `mapstructure:"watch_files_interval"`
+
+	// ReloadChangeThreshold is the number of servers, such as "3", or
+	// the percentage of the servers, such as "10%", that must change
+	// since the last reload to reload again. Below it, the configuration
+	// is still written but not reloaded, so a single flapping server in
+	// a large backend does not cause reloads.
+	ReloadChangeThreshold string `mapstructure:"reload_change_threshold"`
+
+	// ReloadFailureThreshold is the number of consecutive failed reloads
+	// after which /readyz reports not ready, until a reload succeeds.
+	// Zero, the default, leaves the readiness unaffected by reloads.
+	ReloadFailureThreshold int `mapstructure:"reload_failure_threshold"`
+
+	// EmptyCommand is run when a backend is left without enabled
+	// servers, or has servers again, once that lasts EmptyDebounce,
+	// which defaults to 10 seconds. The transitions are logged and
+	// counted by the state endpoint either way.
+	EmptyCommand  string        `mapstructure:"empty_command"`
+	EmptyDebounce time.Duration `mapstructure:"empty_debounce"`
+
+	// RecordPath is a file the entries of each watch are recorded
+	// to on every refresh. ReplayPath is a recorded file to render
+	// the templates from once, without contacting Consul.
+	RecordPath string `mapstructure:"record"`
+	ReplayPath string `mapstructure:"replay"`
+
+	// DrainPath is a file the servers removed since the last reload
+	// are written to before each apply and reload, one
+	// "backend/server" per line, for the reload command to disable
+	// them with the runtime API.
+	DrainPath string `mapstructure:"drain_path"`
+
+	// Applier is used to apply the rendered configuration. If not
+	// set, the files are written and the reload command is invoked.
+	// This cannot be set from the configuration file.
+	Applier Applier
+
 	// watches are the watches we need to track
 	watches []*WatchPath
+
+	// windows are the parsed maintenance windows
+	windows []*maintenanceWindow
+
+	// sharedTemplates are the paths matched by SharedTemplates
+	sharedTemplates []string
+
+	// haproxyVersion is the parsed HAProxy version
+	haproxyVersion *haproxyVersion
+
+	// reloadThreshold and reloadThresholdPct are the parsed
+	// ReloadChangeThreshold, as a count or a percentage
+	reloadThreshold    int
+	reloadThresholdPct float64
+
+	// kv is used to read keys from templates
+	kv kvClient
+
+	// kvValues holds the values of the TemplateKeys and ReloadKey
+	kvValues *kvValues
+
+	// intentions holds the intentions of the IntentionServices
+	intentions *intentionValues
+
+	// parsedTemplates holds the last parsed version of the templates
+	parsedTemplates *parsedTemplates
+
+	// templateCache holds the last contents of the templates
+	templateCache *templateCache
+
+	// templateURLs holds the templates fetched from URLs
+	templateURLs *templateURLs
+
+	// agent holds the information of the local agent
+	agent AgentInfo
+
+	// pause is used to pause the writes and reloads
+	pause *pauseControl
+
+	// check is set to only validate the configuration
+	// and templates, without contacting Consul
+	check bool
+
+	// renderTestPath is a JSON file of sample servers to only
+	// render the templates against, without contacting Consul
+	renderTestPath string
 }
 
 func main() {
@@ -84,19 +554,93 @@ func getConfig() (*Config, error) {
 	var backends []string
 	var templates  []string
 	var paths []string
+	var fallbacks []string
+	var windows []string
+	var shared []string
+	var templateKeys []string
+	var intentionServices []string
+	var minHealthy []string
+	var minReload []string
+	var watchFiles []string
+	var failoverAddrs []string
+	var includeBackends []string
+	var excludeBackends []string
 
-	conf := &Config{}
+	conf := &Config{pause: newPauseControl()}
 	cmdFlags := flag.NewFlagSet("consul-haproxy", flag.ContinueOnError)
 	cmdFlags.Usage = usage
-	cmdFlags.StringVar(&conf.Address, "addr", "127.0.0.1:8500", "consul HTTP API address with port")
+	cmdFlags.StringVar(&conf.Address, "addr", "", "consul HTTP API address with port")
+	cmdFlags.Var((*AppendSliceValue)(&failoverAddrs), "failover-addr", "consul HTTP API address to fail over to")
+	cmdFlags.StringVar(&conf.Token, "token", "", "consul ACL token")
+	cmdFlags.BoolVar(&conf.SSL, "ssl", false, "use HTTPS with consul")
+	cmdFlags.BoolVar(&conf.SSLNoVerify, "ssl-no-verify", false, "skip consul certificate verification")
+	cmdFlags.StringVar(&conf.BindAddr, "bind", "", "local address for consul requests")
 	cmdFlags.Var((*AppendSliceValue)(&templates), "in", "template path")
+	cmdFlags.DurationVar(&conf.TemplateURLInterval, "in-url-interval", 0, "period between fetching template URLs")
+	cmdFlags.Var((*AppendSliceValue)(&templateKeys), "in-key", "KV key of a template")
+	cmdFlags.Var((*AppendSliceValue)(&intentionServices), "intentions", "service to watch the intentions of")
 	cmdFlags.Var((*AppendSliceValue)(&paths), "out", "config path")
+	cmdFlags.StringVar(&conf.DrainPath, "drain", "", "path to write the removed servers to")
+	cmdFlags.BoolVar(&conf.PerDatacenter, "per-dc", false, "render a file per datacenter")
+	cmdFlags.BoolVar(&conf.GroupDatacenters, "group-dc", false, "group servers by datacenter")
+	cmdFlags.Var((*AppendSliceValue)(&shared), "shared", "shared template path or glob")
+	cmdFlags.StringVar(&conf.HeaderTemplate, "header", "", "header template path")
+	cmdFlags.BoolVar(&conf.HashComment, "hash-comment", false, "start outputs with a hash of the servers")
+	cmdFlags.StringVar(&conf.FooterTemplate, "footer", "", "footer template path")
 	cmdFlags.StringVar(&conf.ReloadCommand, "reload", "", "reload command")
+	cmdFlags.StringVar(&conf.ReloadKey, "reload-key", "", "KV key of the reload command")
+	cmdFlags.BoolVar(&conf.ReloadKeyExec, "reload-key-exec", false, "allow running the reload command from the KV key")
+	cmdFlags.StringVar(&conf.HAProxyVersion, "haproxy-version", "", "version of HAProxy")
+	cmdFlags.StringVar(&conf.StatsSocket, "stats-socket", "", "path of the HAProxy stats socket")
+	cmdFlags.StringVar(&conf.ValidateCommand, "validate", "", "validate command")
+	cmdFlags.Var((*AppendSliceValue)(&windows), "window", "maintenance window for reloads")
+	cmdFlags.BoolVar(&conf.CompressKV, "compress-kv", false, "gzip configuration written to KV")
 	cmdFlags.StringVar(&configFile, "f", "", "config file")
 	cmdFlags.BoolVar(&conf.DryRun, "dry", false, "dry run")
+	cmdFlags.BoolVar(&conf.check, "check", false, "check configuration")
+	cmdFlags.StringVar(&conf.renderTestPath, "render-test", "", "path of sample servers to render")
+	cmdFlags.StringVar(&conf.RecordPath, "record", "", "path to record the entries to")
+	cmdFlags.StringVar(&conf.ReplayPath, "replay", "", "path to replay the entries from")
+	cmdFlags.StringVar(&conf.PidFile, "pid-file", "", "path to write the PID to")
+	cmdFlags.StringVar(&conf.StateAddr, "state-addr", "", "address to serve the state on")
+	cmdFlags.Var((*AppendSliceValue)(&minHealthy), "min-healthy", "minimum servers of a backend to be ready")
+	cmdFlags.Var((*AppendSliceValue)(&minReload), "min-reload", "minimum servers of a backend to reload")
+	cmdFlags.StringVar(&conf.ReloadChangeThreshold, "reload-threshold", "", "servers or percentage changed to reload")
+	cmdFlags.IntVar(&conf.ReloadFailureThreshold, "reload-failure-threshold", 0, "failed reloads before not ready")
+	cmdFlags.StringVar(&conf.EmptyCommand, "empty-command", "", "command to run when a backend becomes empty or not")
+	cmdFlags.DurationVar(&conf.EmptyDebounce, "empty-debounce", 0, "time a backend must stay empty or not")
+	cmdFlags.Var((*AppendSliceValue)(&watchFiles), "watch-file", "file to reload on changes to")
+	cmdFlags.DurationVar(&conf.WatchFilesInterval, "watch-file-interval", 0, "period between checking watched files")
 	cmdFlags.DurationVar(&conf.Quiet, "quiet", 0, "quiet period")
 	cmdFlags.DurationVar(&conf.MaxWait, "max-wait", 0, "maximum wait for a quiet period")
+	cmdFlags.DurationVar(&conf.RenderTimeout, "render-timeout", 0, "maximum template render time")
+	cmdFlags.DurationVar(&conf.StartupStagger, "stagger", 0, "delay between starting watches")
+	cmdFlags.DurationVar(&conf.WarmupDelay, "warmup", 0, "delay before enabling new servers")
+	cmdFlags.Float64Var(&conf.CanaryRate, "canary-rate", 0, "fraction of new servers added per refresh")
+	cmdFlags.DurationVar(&conf.CanaryInterval, "canary-interval", 0, "period between adding new servers")
+	cmdFlags.BoolVar(&conf.InitialRender, "initial-render", false, "render before watching for changes")
+	cmdFlags.DurationVar(&conf.InitialRenderTimeout, "initial-render-timeout", 0, "maximum wait for the initial render")
+	cmdFlags.BoolVar(&conf.FinalRender, "final-render", false, "apply pending changes on shutdown")
+	cmdFlags.DurationVar(&conf.ShutdownTimeout, "shutdown-timeout", 0, "maximum wait on shutdown")
+	cmdFlags.DurationVar(&conf.QueryTimeoutMargin, "query-timeout-margin", 0, "time a query may outlast its wait")
+	cmdFlags.IntVar(&conf.MaxConsecutiveFailures, "max-consecutive-failures", 0, "exit after a watch fails this often in a row")
 	cmdFlags.Var((*AppendSliceValue)(&backends), "backend", "backend to populate")
+	cmdFlags.Var((*AppendSliceValue)(&fallbacks), "fallback", "backend using fallback ordering")
+	cmdFlags.StringVar(&conf.DuplicateBackends, "duplicate-backends", "", "merge, error or last-wins for duplicate backends")
+	cmdFlags.Var((*AppendSliceValue)(&includeBackends), "include-backend", "backend pattern to render")
+	cmdFlags.Var((*AppendSliceValue)(&excludeBackends), "exclude-backend", "backend pattern not to render")
+	cmdFlags.StringVar(&conf.TrustDomain, "trust-domain", "", "trust domain of the Connect CA")
+	cmdFlags.StringVar(&conf.MeshCAFile, "mesh-ca-file", "", "Connect CA to verify mesh gateways with")
+	cmdFlags.StringVar(&conf.MeshCert, "mesh-crt", "", "client certificate for mesh gateways")
+	cmdFlags.BoolVar(&conf.DedupeAddresses, "dedupe", false, "collapse servers with the same address")
+	cmdFlags.StringVar(&conf.DNSResolvers, "dns-resolvers", "", "resolvers section for hostnames")
+	cmdFlags.StringVar(&conf.InitAddr, "init-addr", "", "init-addr policy of servers with hostnames")
+	cmdFlags.BoolVar(&conf.EmptyBackendPlaceholder, "empty-placeholder", false, "placeholder for empty backends")
+	cmdFlags.StringVar(&conf.PlaceholderAddress, "placeholder-addr", "", "placeholder server address")
+	cmdFlags.StringVar(&conf.OnAllErrors, "on-all-errors", "", "keep or empty backends whose watches all fail")
+	cmdFlags.StringVar(&conf.BackendOrder, "backend-order", "", "order of the backends given to templates")
+	cmdFlags.StringVar(&conf.NameReplacement, "name-replacement", "", "replacement of unsafe characters in server names")
+	cmdFlags.BoolVar(&conf.RawNames, "raw-names", false, "do not replace unsafe characters in server names")
 	if err := cmdFlags.Parse(os.Args[1:]); err != nil {
 		return nil, err
 	}
@@ -110,11 +654,47 @@ func getConfig() (*Config, error) {
 
 	// Merge the templates, paths, and backends together
 	conf.Templates = append(conf.Templates, templates...)
+	conf.TemplateKeys = append(conf.TemplateKeys, templateKeys...)
+	conf.IntentionServices = append(conf.IntentionServices, intentionServices...)
 	conf.Paths = append(conf.Paths, paths...)
 	conf.Backends = append(conf.Backends, backends...)
+	conf.FallbackBackends = append(conf.FallbackBackends, fallbacks...)
+	conf.MaintenanceWindows = append(conf.MaintenanceWindows, windows...)
+	conf.SharedTemplates = append(conf.SharedTemplates, shared...)
+	conf.WatchFiles = append(conf.WatchFiles, watchFiles...)
+	conf.FailoverAddresses = append(conf.FailoverAddresses, failoverAddrs...)
+	conf.IncludeBackends = append(conf.IncludeBackends, includeBackends...)
+	conf.ExcludeBackends = append(conf.ExcludeBackends, excludeBackends...)
+	var err error
+	if conf.MinHealthy, err = parseMinimums(conf.MinHealthy, minHealthy); err != nil {
+		return nil, err
+	}
+	if conf.MinReload, err = parseMinimums(conf.MinReload, minReload); err != nil {
+		return nil, err
+	}
 	return conf, nil
 }
 
+// parseMinimums is used to merge minimums given as backend:count
+// into those from the configuration file
+func parseMinimums(mins map[string]int, raws []string) (map[string]int, error) {
+	for _, raw := range raws {
+		parts := strings.SplitN(raw, ":", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("Invalid minimum '%s', must be backend:count", raw)
+		}
+		n, err := strconv.Atoi(parts[1])
+		if err != nil {
+			return nil, fmt.Errorf("Invalid minimum '%s': %v", raw, err)
+		}
+		if mins == nil {
+			mins = make(map[string]int)
+		}
+		mins[parts[0]] = n
+	}
+	return mins, nil
+}
+
 // realMain is the actual entry point, but we wrap it to set
 // a proper exit code on return
 func realMain() int {
@@ -130,6 +710,27 @@ func realMain() int {
 		return 1
 	}
 
+	// Only check the configuration if requested
+	if conf.check {
+		if errs := checkConfig(conf); len(errs) != 0 {
+			for _, err := range errs {
+				log.Printf("[ERR] %v", err)
+			}
+			return 1
+		}
+		log.Printf("[INFO] Configuration is valid")
+		return 0
+	}
+
+	// Only render the templates against sample servers if requested
+	if conf.renderTestPath != "" {
+		if err := renderSample(conf, os.Stdout); err != nil {
+			log.Printf("[ERR] %v", err)
+			return 1
+		}
+		return 0
+	}
+
 	// Sanity check the configuration
 	if errs := validateConfig(conf); len(errs) != 0 {
 		for _, err := range errs {
@@ -138,13 +739,48 @@ func realMain() int {
 		return 1
 	}
 
+	// Write out the PID file
+	if conf.PidFile != "" {
+		if err := writePidFile(conf.PidFile); err != nil {
+			log.Printf("[ERR] Failed to write PID file: %v", err)
+			return 1
+		}
+		defer removePidFile(conf.PidFile)
+	}
+
+	// Render from a recorded snapshot if requested
+	if conf.ReplayPath != "" {
+		if err := replaySnapshot(conf); err != nil {
+			log.Printf("[ERR] %v", err)
+			return 1
+		}
+		return 0
+	}
+
 	// Start watching for changes
-	stopCh, finishCh := watch(conf)
+	stopCh, finishCh, _ := watch(conf)
 
 	// Wait for termination
 	return waitForTerm(conf, stopCh, finishCh)
 }
 
+// writePidFile is used to write the PID of this process to a file.
+// An existing file is assumed to be stale and is overwritten.
+func writePidFile(path string) error {
+	if _, err := os.Stat(path); err == nil {
+		log.Printf("[WARN] Overwriting stale PID file at %s", path)
+	}
+	pid := fmt.Sprintf("%d\n", os.Getpid())
+	return ioutil.WriteFile(path, []byte(pid), 0644)
+}
+
+// removePidFile is used to remove the PID file on exit
+func removePidFile(path string) {
+	if err := os.Remove(path); err != nil {
+		log.Printf("[WARN] Failed to remove PID file at %s: %v", path, err)
+	}
+}
+
 // readConfig is used to read a configuration file
 func readConfig(path string, config *Config) error {
 	// Read the file
@@ -173,6 +809,12 @@ func validateConfig(conf *Config) (errs []error) {
 		errs = append(errs, errors.New("missing template path"))
 	} else {
 		for _, t := range conf.Templates {
+			if isTemplateURL(t) {
+				if _, err := url.Parse(t); err != nil {
+					errs = append(errs, fmt.Errorf("invalid template URL '%s': %v", t, err))
+				}
+				continue
+			}
 			_, err := ioutil.ReadFile(t)
 			if err != nil {
 				errs = append(errs, fmt.Errorf("failed to read template '%s': %v", t, err))
@@ -180,6 +822,38 @@ func validateConfig(conf *Config) (errs []error) {
 		}
 	}
 
+	if len(conf.TemplateKeys) > len(conf.Templates) {
+		errs = append(errs, errors.New("more template keys than templates"))
+	}
+	if conf.ReloadKey != "" && !conf.ReloadKeyExec {
+		errs = append(errs, errors.New("reload-key runs the value of the key as a shell command, "+
+			"which requires -reload-key-exec"))
+	}
+
+	// Find the shared templates
+	conf.sharedTemplates = nil
+	for _, pattern := range conf.SharedTemplates {
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("Invalid shared template '%s': %v", pattern, err))
+			continue
+		}
+		if len(matches) == 0 {
+			errs = append(errs, fmt.Errorf("Shared template '%s' matches no files", pattern))
+		}
+		conf.sharedTemplates = append(conf.sharedTemplates, matches...)
+	}
+
+	// Check the header and footer templates
+	for _, t := range []string{conf.HeaderTemplate, conf.FooterTemplate} {
+		if t == "" {
+			continue
+		}
+		if _, err := ioutil.ReadFile(t); err != nil {
+			errs = append(errs, fmt.Errorf("failed to read template '%s': %v", t, err))
+		}
+	}
+
 	if len(conf.Paths) == 0 && !conf.DryRun {
 		errs = append(errs, errors.New("missing configuration path"))
 	}
@@ -188,16 +862,33 @@ func validateConfig(conf *Config) (errs []error) {
 		errs = append(errs, errors.New("number of templates and paths do not match"))
 	}
 
-	if conf.ReloadCommand == "" && !conf.DryRun {
-		errs = append(errs, errors.New("missing reload command"))
-	}
-
 	if len(conf.Backends) == 0 {
 		errs = append(errs, errors.New("missing backends to populate"))
 	}
 
+	// Each datacenter needs its own path
+	if conf.PerDatacenter && !conf.DryRun {
+		for _, p := range conf.Paths {
+			if !strings.Contains(p, datacenterPlaceholder) {
+				errs = append(errs, fmt.Errorf("path '%s' must contain %s to render per datacenter",
+					p, datacenterPlaceholder))
+			}
+		}
+	}
+
+	fallback := make(map[string]bool)
+	for _, b := range conf.FallbackBackends {
+		fallback[b] = true
+	}
+
 	for _, b := range conf.Backends {
-		parts := WatchRE.FindStringSubmatch(b)
+		// Split off any watch options
+		spec, rawOpts := b, ""
+		if idx := strings.Index(b, "?"); idx != -1 {
+			spec, rawOpts = b[:idx], b[idx+1:]
+		}
+
+		parts := WatchRE.FindStringSubmatch(spec)
 		if parts == nil || len(parts) != 6 {
 			errs = append(errs, fmt.Errorf("Backend '%s' could not be parsed", b))
 			continue
@@ -212,18 +903,212 @@ func validateConfig(conf *Config) (errs []error) {
 			port = int(p)
 		}
 		wp := &WatchPath{
-			Spec:       parts[0],
+			Spec:       b,
 			Backend:    parts[1],
 			Tag:        strings.TrimSuffix(parts[2], "."),
 			Service:    parts[3],
 			Datacenter: strings.TrimPrefix(parts[4], "@"),
 			Port:       port,
 		}
+		wp.FallbackIfEmpty = fallback[wp.Backend]
+		if err := parseWatchOptions(wp, rawOpts); err != nil {
+			errs = append(errs, fmt.Errorf("Backend '%s' options could not be parsed: %v", b, err))
+			continue
+		}
+		if wp.MeshGateway != "" {
+			if wp.Datacenter == "" || conf.TrustDomain == "" {
+				errs = append(errs, fmt.Errorf("Backend '%s' mesh_gateway requires a datacenter and trust domain", b))
+				continue
+			}
+			wp.meshSNI = fmt.Sprintf("%s.default.%s.internal.%s", wp.Service, wp.Datacenter, conf.TrustDomain)
+		}
 		conf.watches = append(conf.watches, wp)
 	}
 
+	// Handle watches defined more than once
+	var dupErrs []error
+	conf.watches, dupErrs = resolveDuplicates(conf.DuplicateBackends, conf.watches)
+	errs = append(errs, dupErrs...)
+
+	for _, b := range conf.FallbackBackends {
+		found := false
+		for _, wp := range conf.watches {
+			if wp.Backend == b {
+				found = true
+				break
+			}
+		}
+		if !found {
+			errs = append(errs, fmt.Errorf("Fallback backend '%s' is not defined", b))
+		}
+	}
+
+	for kind, mins := range map[string]map[string]int{"healthy": conf.MinHealthy, "reload": conf.MinReload} {
+		for b, min := range mins {
+			found := false
+			for _, wp := range conf.watches {
+				if wp.Backend == b {
+					found = true
+					break
+				}
+			}
+			if !found {
+				errs = append(errs, fmt.Errorf("Minimum %s backend '%s' is not defined", kind, b))
+			}
+			if min < 0 {
+				errs = append(errs, fmt.Errorf("Minimum %s servers of '%s' cannot be negative", kind, b))
+			}
+		}
+	}
+
+	// Leave out the watches of the backends not rendered, unless
+	// they split their instances into other backends
+	for _, pattern := range append(append([]string{}, conf.IncludeBackends...), conf.ExcludeBackends...) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			errs = append(errs, fmt.Errorf("Invalid backend pattern '%s'", pattern))
+		}
+	}
+	rendered := conf.watches[:0]
+	for _, wp := range conf.watches {
+		if wp.SplitTagPrefix == "" && !renderBackend(conf, wp.Backend) {
+			continue
+		}
+		rendered = append(rendered, wp)
+	}
+	conf.watches = rendered
+
+	if conf.BindAddr != "" && net.ParseIP(conf.BindAddr) == nil {
+		errs = append(errs, fmt.Errorf("Bind address '%s' is not an IP", conf.BindAddr))
+	}
+
+	// Recording a replay is not useful
+	if conf.RecordPath != "" && conf.ReplayPath != "" {
+		errs = append(errs, errors.New("Cannot record and replay at the same time"))
+	}
+
+	// Check the state address
+	if conf.StateAddr != "" {
+		if _, _, err := net.SplitHostPort(conf.StateAddr); err != nil {
+			errs = append(errs, fmt.Errorf("Invalid state address '%s': %v", conf.StateAddr, err))
+		}
+	}
+
+	// Parse the maintenance windows
+	conf.windows = nil
+	for _, raw := range conf.MaintenanceWindows {
+		w, err := parseWindow(raw)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		conf.windows = append(conf.windows, w)
+	}
+
+	// Parse the HAProxy version
+	conf.haproxyVersion = nil
+	if conf.HAProxyVersion != "" {
+		v, err := parseHAProxyVersion(conf.HAProxyVersion)
+		if err != nil {
+			errs = append(errs, err)
+		}
+		conf.haproxyVersion = v
+	}
+
+	// Check the placeholder address
+	if conf.EmptyBackendPlaceholder {
+		if conf.PlaceholderAddress == "" {
+			conf.PlaceholderAddress = defaultPlaceholderAddress
+		}
+		if _, err := placeholderServer(conf.PlaceholderAddress); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	// Parse the reload threshold
+	conf.reloadThreshold, conf.reloadThresholdPct = 0, 0
+	if raw := conf.ReloadChangeThreshold; strings.HasSuffix(raw, "%") {
+		pct, err := strconv.ParseFloat(strings.TrimSuffix(raw, "%"), 64)
+		if err != nil || pct < 0 || pct > 100 {
+			errs = append(errs, fmt.Errorf("Invalid reload threshold '%s': must be between 0%% and 100%%", raw))
+		}
+		conf.reloadThresholdPct = pct
+	} else if raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n < 0 {
+			errs = append(errs, fmt.Errorf("Invalid reload threshold '%s': must be a count or percentage", raw))
+		}
+		conf.reloadThreshold = n
+	}
+
+	// Check how to render backends whose watches all fail
+	switch conf.OnAllErrors {
+	case "":
+		conf.OnAllErrors = onAllErrorsKeep
+	case onAllErrorsKeep, onAllErrorsEmpty:
+	default:
+		errs = append(errs, fmt.Errorf("Invalid on_all_errors '%s': must be %s or %s",
+			conf.OnAllErrors, onAllErrorsKeep, onAllErrorsEmpty))
+	}
+
+	// Check how duplicate watches are handled
+	switch conf.DuplicateBackends {
+	case "":
+		conf.DuplicateBackends = duplicateMerge
+	case duplicateMerge, duplicateError, duplicateLastWins:
+	default:
+		errs = append(errs, fmt.Errorf("Invalid duplicate backends policy '%s': must be %s, %s or %s",
+			conf.DuplicateBackends, duplicateMerge, duplicateError, duplicateLastWins))
+	}
+
+	// Check the order of the backends given to templates
+	switch conf.BackendOrder {
+	case "":
+		conf.BackendOrder = backendOrderName
+	case backendOrderName, backendOrderConfig:
+	default:
+		errs = append(errs, fmt.Errorf("Invalid backend order '%s': must be %s or %s",
+			conf.BackendOrder, backendOrderName, backendOrderConfig))
+	}
+
+	if conf.InitAddr != "" && !validInitAddr(conf.InitAddr) {
+		errs = append(errs, fmt.Errorf("Invalid init-addr '%s': must be last, libc, none or IPs separated by commas",
+			conf.InitAddr))
+	}
+
+	// Check the replacement of unsafe characters is itself safe
+	if conf.NameReplacement == "" {
+		conf.NameReplacement = "_"
+	}
+	for _, r := range conf.NameReplacement {
+		if !safeNameChar(r) {
+			errs = append(errs, fmt.Errorf("Invalid name replacement '%s': must be letters, digits, - or _",
+				conf.NameReplacement))
+			break
+		}
+	}
+
+	// Check the canary rate is a fraction
+	if conf.CanaryRate < 0 || conf.CanaryRate > 1 {
+		errs = append(errs, fmt.Errorf("Invalid canary rate %v: must be between 0 and 1", conf.CanaryRate))
+	}
+
+	if conf.MaxConsecutiveFailures < 0 {
+		errs = append(errs, errors.New("Cannot specify negative max consecutive failures"))
+	}
+	if conf.ReloadFailureThreshold < 0 {
+		errs = append(errs, errors.New("Cannot specify a negative reload failure threshold"))
+	}
+	for _, service := range conf.IntentionServices {
+		if service == "" {
+			errs = append(errs, errors.New("Intention service cannot be empty"))
+		}
+	}
+
 	// Ensure a non-negative time interval
-	if conf.Quiet < 0 || conf.MaxWait < 0 {
+	if conf.Quiet < 0 || conf.MaxWait < 0 || conf.RenderTimeout < 0 ||
+		conf.ShutdownTimeout < 0 || conf.WarmupDelay < 0 || conf.InitialRenderTimeout < 0 ||
+		conf.CanaryInterval < 0 || conf.StartupStagger < 0 || conf.WatchFilesInterval < 0 ||
+		conf.QueryTimeoutMargin < 0 || conf.EmptyDebounce < 0 || conf.TemplateURLInterval < 0 {
 		errs = append(errs, errors.New("Cannot specify a negative time interval"))
 	}
 
@@ -233,13 +1118,289 @@ func validateConfig(conf *Config) (errs []error) {
 		conf.MaxWait = 4 * conf.Quiet
 	}
 
+	// Default the initial render timeout
+	if conf.InitialRenderTimeout == 0 {
+		conf.InitialRenderTimeout = defaultInitialRenderTimeout
+	}
+
+	// Default the canary interval
+	if conf.CanaryInterval == 0 {
+		conf.CanaryInterval = defaultCanaryInterval
+	}
+	if conf.WatchFilesInterval == 0 {
+		conf.WatchFilesInterval = defaultWatchFilesInterval
+	}
+	if conf.TemplateURLInterval == 0 {
+		conf.TemplateURLInterval = defaultTemplateURLInterval
+	}
+
+	// Default the shutdown timeout
+	if conf.ShutdownTimeout == 0 {
+		conf.ShutdownTimeout = defaultShutdownTimeout
+	}
+
+	return
+}
+
+// checkConfig is used to validate the configuration and
+// parse the templates, without contacting Consul
+func checkConfig(conf *Config) (errs []error) {
+	errs = validateConfig(conf)
+	templates := append([]string{}, conf.Templates...)
+	for _, t := range []string{conf.HeaderTemplate, conf.FooterTemplate} {
+		if t != "" {
+			templates = append(templates, t)
+		}
+	}
+	for _, t := range templates {
+		if _, err := parseTemplate(conf, t, nil); err != nil {
+			errs = append(errs, fmt.Errorf("template '%s': %v", t, err))
+		}
+	}
 	return
 }
 
+// resolveDuplicates is used to apply the duplicate backends policy to
+// the watches of the same service, tag and datacenter in the same
+// backend. With merge they are all kept, with last-wins only the last
+// is kept, in the place of the first, and with error each duplicate is
+// reported. Backends from the configuration file come before those of
+// the CLI, so those of the CLI win.
+func resolveDuplicates(policy string, watches []*WatchPath) ([]*WatchPath, []error) {
+	if policy != duplicateError && policy != duplicateLastWins {
+		return watches, nil
+	}
+	var errs []error
+	first := make(map[string]int)
+	out := make([]*WatchPath, 0, len(watches))
+	for _, wp := range watches {
+		key := strings.Join([]string{wp.Backend, wp.Tag, wp.Service, wp.Datacenter}, "\x00")
+		idx, ok := first[key]
+		switch {
+		case !ok:
+			first[key] = len(out)
+			out = append(out, wp)
+		case policy == duplicateLastWins:
+			log.Printf("[INFO] Backend '%s' replaces '%s'", wp.Spec, out[idx].Spec)
+			out[idx] = wp
+		case wp.Spec == out[idx].Spec:
+			errs = append(errs, fmt.Errorf("Backend '%s' is defined more than once", wp.Spec))
+		default:
+			errs = append(errs, fmt.Errorf("Backend '%s' conflicts with '%s', which watches the same service",
+				wp.Spec, out[idx].Spec))
+		}
+	}
+	return out, errs
+}
+
+// parseWatchOptions is used to parse the options given after
+// a backend specification, such as "app=webapp?max_servers=5"
+func parseWatchOptions(wp *WatchPath, raw string) error {
+	if raw == "" {
+		return nil
+	}
+	opts, err := url.ParseQuery(raw)
+	if err != nil {
+		return err
+	}
+	for key, vals := range opts {
+		val := vals[len(vals)-1]
+		switch key {
+		case "max_servers":
+			n, err := strconv.Atoi(val)
+			if err != nil || n < 0 {
+				return fmt.Errorf("invalid max_servers '%s'", val)
+			}
+			wp.MaxServers = n
+		case "max_failures":
+			n, err := strconv.Atoi(val)
+			if err != nil || n <= 0 {
+				return fmt.Errorf("invalid max_failures '%s'", val)
+			}
+			wp.MaxFailures = n
+		case "force_port":
+			n, err := strconv.Atoi(val)
+			if err != nil || n <= 0 || n > 65535 {
+				return fmt.Errorf("invalid force_port '%s'", val)
+			}
+			wp.ForcePort = n
+		case "default_port":
+			n, err := strconv.Atoi(val)
+			if err != nil || n <= 0 || n > 65535 {
+				return fmt.Errorf("invalid default_port '%s'", val)
+			}
+			wp.DefaultPort = n
+		case "protocol":
+			if val != "tcp" && val != "http" {
+				return fmt.Errorf("invalid protocol '%s'", val)
+			}
+			wp.Protocol = val
+		case "observe":
+			if val != "layer4" && val != "layer7" {
+				return fmt.Errorf("invalid observe '%s'", val)
+			}
+			wp.Observe = val
+		case "agent_port":
+			n, err := strconv.Atoi(val)
+			if err != nil || n <= 0 || n > 65535 {
+				return fmt.Errorf("invalid agent_port '%s'", val)
+			}
+			wp.AgentPort = n
+		case "send_proxy":
+			b, err := strconv.ParseBool(val)
+			if err != nil {
+				return fmt.Errorf("invalid send_proxy '%s'", val)
+			}
+			wp.SendProxy = b
+		case "include_unhealthy":
+			b, err := strconv.ParseBool(val)
+			if err != nil {
+				return fmt.Errorf("invalid include_unhealthy '%s'", val)
+			}
+			wp.IncludeUnhealthy = b
+		case "connect":
+			b, err := strconv.ParseBool(val)
+			if err != nil {
+				return fmt.Errorf("invalid connect '%s'", val)
+			}
+			wp.Connect = b
+		case "backup":
+			b, err := strconv.ParseBool(val)
+			if err != nil {
+				return fmt.Errorf("invalid backup '%s'", val)
+			}
+			wp.Backup = b
+		case "resolver":
+			b, err := strconv.ParseBool(val)
+			if err != nil {
+				return fmt.Errorf("invalid resolver '%s'", val)
+			}
+			wp.Resolver = b
+		case "mesh_gateway":
+			host, port, err := net.SplitHostPort(val)
+			if err != nil {
+				return fmt.Errorf("invalid mesh_gateway '%s'", val)
+			}
+			ip := net.ParseIP(host)
+			n, err := strconv.Atoi(port)
+			if ip == nil || err != nil || n <= 0 {
+				return fmt.Errorf("invalid mesh_gateway '%s'", val)
+			}
+			wp.MeshGateway = val
+			wp.meshGatewayAddr = &net.TCPAddr{IP: ip, Port: n}
+		case "split_tag":
+			if val == "" {
+				return fmt.Errorf("invalid split_tag '%s'", val)
+			}
+			wp.SplitTagPrefix = val
+		case "label":
+			for _, label := range vals {
+				parts := strings.SplitN(label, ":", 2)
+				if len(parts) != 2 || parts[0] == "" {
+					return fmt.Errorf("invalid label '%s'", label)
+				}
+				if wp.Labels == nil {
+					wp.Labels = make(map[string]string)
+				}
+				wp.Labels[parts[0]] = parts[1]
+			}
+		case "weight_key":
+			if val == "" || strings.Contains(val, "=") {
+				return fmt.Errorf("invalid weight_key '%s'", val)
+			}
+			wp.WeightKey = val
+		case "default_weight":
+			n, err := strconv.Atoi(val)
+			if err != nil || n < 0 || n > maxServerWeight {
+				return fmt.Errorf("invalid default_weight '%s'", val)
+			}
+			wp.DefaultWeight = n
+		case "check_weight":
+			b, err := strconv.ParseBool(val)
+			if err != nil {
+				return fmt.Errorf("invalid check_weight '%s'", val)
+			}
+			wp.CheckWeight = b
+		case "allow_missing":
+			b, err := strconv.ParseBool(val)
+			if err != nil {
+				return fmt.Errorf("invalid allow_missing '%s'", val)
+			}
+			wp.AllowMissing = b
+		case "missing_addr":
+			if val == "" || strings.Contains(val, " ") ||
+				(net.ParseIP(val) == nil && strings.Contains(val, ":")) {
+				return fmt.Errorf("invalid missing_addr '%s'", val)
+			}
+			wp.MissingAddress = val
+		case "tagged_address":
+			if val == "" {
+				return fmt.Errorf("invalid tagged_address '%s'", val)
+			}
+			wp.TaggedAddress = val
+		case "max_age":
+			d, err := time.ParseDuration(val)
+			if err != nil || d <= waitTime {
+				return fmt.Errorf("invalid max_age '%s', must be more than %v", val, waitTime)
+			}
+			wp.MaxDataAge = d
+		case "consistency":
+			switch val {
+			case "default", "stale", "consistent":
+				wp.Consistency = val
+			default:
+				return fmt.Errorf("invalid consistency '%s'", val)
+			}
+		case "sort":
+			switch val {
+			case "name", "address", "weight", "priority":
+				wp.SortMode = val
+			default:
+				return fmt.Errorf("invalid sort '%s'", val)
+			}
+		case "exclude_node", "exclude_id":
+			for _, pattern := range vals {
+				if _, err := path.Match(pattern, ""); err != nil {
+					return fmt.Errorf("invalid %s '%s'", key, pattern)
+				}
+			}
+			if key == "exclude_node" {
+				wp.ExcludeNodes = append(wp.ExcludeNodes, vals...)
+			} else {
+				wp.ExcludeServiceIDs = append(wp.ExcludeServiceIDs, vals...)
+			}
+		case "kind", "exclude_kind":
+			for _, pattern := range vals {
+				if _, err := path.Match(pattern, ""); err != nil || pattern == "" {
+					return fmt.Errorf("invalid %s '%s'", key, pattern)
+				}
+			}
+			if key == "kind" {
+				wp.Kinds = append(wp.Kinds, vals...)
+			} else {
+				wp.ExcludeKinds = append(wp.ExcludeKinds, vals...)
+			}
+		default:
+			return fmt.Errorf("unknown option '%s'", key)
+		}
+	}
+	if wp.Observe == "layer7" && wp.Protocol == "tcp" {
+		return errors.New("observe layer7 requires protocol http")
+	}
+	_, hasDefault := opts["default_weight"]
+	if hasDefault && wp.WeightKey == "" {
+		return errors.New("default_weight requires weight_key")
+	}
+	if !hasDefault && wp.WeightKey != "" {
+		wp.DefaultWeight = defaultServerWeight
+	}
+	return nil
+}
+
 // waitForTerm waits until we receive a signal to exit
 func waitForTerm(conf *Config, stopCh, finishCh chan struct{}) int {
 	signalCh := make(chan os.Signal, 1)
-	signal.Notify(signalCh, os.Interrupt, syscall.SIGHUP)
+	signal.Notify(signalCh, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
 	for {
 		select {
 		case sig := <-signalCh:
@@ -261,18 +1422,26 @@ func waitForTerm(conf *Config, stopCh, finishCh chan struct{}) int {
 					continue
 				}
 
-				// Switch to the new configuration
-				conf = newConf
-
-				// Stop the existing watcher
+				// Stop the existing watcher, waiting for it to finish
+				// so its state listener is closed and any final render
+				// does not race the new watcher
 				close(stopCh)
+				waitForFinish(finishCh, conf.ShutdownTimeout)
+
+				// Switch to the new configuration, staying paused
+				newConf.pause = conf.pause
+				conf = newConf
 
 				// Start a new watcher
-				stopCh, finishCh = watch(conf)
+				stopCh, finishCh, _ = watch(conf)
 				log.Printf("[INFO] Configuration reload complete")
 
 			default:
 				log.Printf("[WARN] Received %v signal, shutting down", sig)
+				close(stopCh)
+				if conf.FinalRender {
+					waitForFinish(finishCh, conf.ShutdownTimeout)
+				}
 				return 0
 			}
 		case <-finishCh:
@@ -283,7 +1452,15 @@ func waitForTerm(conf *Config, stopCh, finishCh chan struct{}) int {
 			return 1
 		}
 	}
-	return 0
+}
+
+// waitForFinish waits for the watcher to finish, up to the timeout
+func waitForFinish(finishCh chan struct{}, timeout time.Duration) {
+	select {
+	case <-finishCh:
+	case <-time.After(timeout):
+		log.Printf("[WARN] Timed out waiting for the watcher to finish")
+	}
 }
 
 func usage() {
@@ -326,15 +1503,139 @@ Usage: %s [options]
   populate the nodes in the 'app' backend. This can be used to merge
   multiple tags, datacenters, etc into a single backend.
 
+  Options can be given for a watch after a '?', separated by '&':
+
+    app=webapp?max_servers=5&default_port=9000
+
+  This limits the 'app' backend to at most 5 of the 'webapp' nodes,
+  and uses port 9000 for any of them that do not register a port.
+
+  Instead of merging, a backend can be populated from its watches in
+  the order they are given, using only the first one that has any
+  nodes. This is enabled with the -fallback flag:
+
+    -backend app=webapp -backend app=webapp-backup -fallback app
+
 Options:
 
-  -addr=127.0.0.1:8500  Provides the HTTP address of a Consul agent.
+  -addr=127.0.0.1:8500  Provides the HTTP address of a Consul agent. Defaults
+                        to CONSUL_HTTP_ADDR if set.
+  -failover-addr=addr   HTTP address of another Consul agent to query, and read
+                        and write keys with, while the agent is failing. Can be
+                        provided multiple times.
+  -bind=ip              Local address that requests to Consul originate from.
   -backend=spec         Backend specification. Can be provided multiple times.
+  -check                Validate the configuration and templates, then exit.
+  -render-test=path     Render the templates against the servers of each backend
+                        in a JSON file, print them, then exit.
   -dry                  Dry run. Emit config file to stdout.
+  -record=path          Record the entries of each watch to a file on every render.
+  -replay=path          Render once from entries recorded with -record, without
+                        contacting Consul.
   -f=path               Path to config file, overwrites CLI flags
+  -fallback=name        Use the watches of a backend in order as fallbacks.
+                        Can be provided multiple times.
+  -duplicate-backends=merge
+                        Keep backends watching the same service more than once,
+                        or "error" to fail, or "last-wins" to keep the last.
+  -include-backend=glob Only render the backends matching the pattern. Can be
+                        provided multiple times.
+  -exclude-backend=glob Do not render the backends matching the pattern. Can be
+                        provided multiple times.
+  -trust-domain=domain  Trust domain of the Connect CA, for mesh gateway routes.
+  -mesh-ca-file=path    Connect CA certificates to verify mesh gateways with.
+                        If not given, mesh gateways are not verified.
+  -mesh-crt=path        Connect client certificate and key for mesh gateways.
   -in=path              Path to a template file.  Can be provided multiple times.
+                        An http:// or https:// URL is fetched instead.
+  -in-url-interval=1m   Period between fetching the templates given as URLs.
+  -in-key=key           Consul KV key to source the template of the same position
+                        from, falling back to the file. Can be provided multiple times.
+  -intentions=service   Watch the Connect intentions of the destination service,
+                        for the intentions template function. Can be provided
+                        multiple times.
+  -per-dc               Render each template per datacenter, to the path with
+                        {{.Datacenter}} replaced by its name.
+  -group-dc             Group the servers of each datacenter under a comment.
+  -shared=path          Path or glob of templates parsed with every template, so
+                        their definitions are shared. Can be provided multiple times.
+  -header=path          Path to a template rendered before every output.
+  -footer=path          Path to a template rendered after every output.
+  -hash-comment         Start every output with a comment hashing the servers.
   -out=path             Path to output configuration file. Can be provided multiple times.
-  -reload=cmd           Command to invoke to reload configuration
+                        Prefix with "kv:" to write to a Consul KV key instead.
+  -drain=path           Path to write the servers removed since the last reload
+                        to, for the reload command to drain.
+  -compress-kv          Gzip the configuration written to Consul KV keys.
+  -ssl                  Use HTTPS to talk to Consul. Defaults to CONSUL_HTTP_SSL.
+  -ssl-no-verify        Skip verifying Consul's certificate. Defaults to
+                        the inverse of CONSUL_HTTP_SSL_VERIFY.
+  -token=token          Consul ACL token. Defaults to CONSUL_HTTP_TOKEN.
+  -reload=cmd           Command to invoke to reload configuration. If not
+                        provided, the configuration is written without reloading.
+  -reload-key=key       Consul KV key to source the reload command from, falling
+                        back to -reload. Requires -reload-key-exec.
+  -reload-key-exec      Allow running the reload command from -reload-key. Anyone
+                        able to write the key can run commands on this host.
+  -haproxy-version=x.y  Version of HAProxy, available to templates. The default
+                        server lines only use syntax it supports.
+  -stats-socket=path    Path of the HAProxy stats socket, available to templates.
+  -window=HH:MM-HH:MM   Only reload within this daily window of local time,
+                        deferring it otherwise. Can be provided multiple times.
+  -validate=cmd         Command to validate the configuration before it is
+                        written. The staged files are in $CONSUL_HAPROXY_FILES.
+                        Also run on dry runs, without writing or reloading.
+  -pid-file=path        Path to write the PID of this process to.
+  -state-addr=addr      Address to serve the current state as JSON on, at /state,
+                        and the readiness at /readyz. POST to /pause and /resume
+                        to pause and resume the writes and reloads.
+  -min-healthy=name:n   Only report ready once the backend has n enabled servers.
+                        Can be provided multiple times.
+  -min-reload=name:n    Only reload once the backend has n enabled servers, still
+                        writing the configuration. Can be provided multiple times.
+  -watch-file=path      Reload when the file, such as a certificate, changes.
+                        Can be provided multiple times.
+  -watch-file-interval=5s
+                        Period between checking the watched files for changes.
+  -reload-threshold=n   Only reload once n servers, or a percentage such as 10%,
+                        changed since the last reload, still writing the configuration.
+  -reload-failure-threshold=n
+                        Report not ready at /readyz once n reloads failed in a row.
+  -empty-command=cmd    Command to run when a backend is left without servers, or
+                        has servers again.
+  -empty-debounce=10s   Time a backend must stay empty, or not, to be reported.
   -quiet=0s             Period to wait without updates before trigger reload.
   -max-wait=0s          Maxium time to wait for quiet period. Default 4x of -quiet.
+  -render-timeout=0s    Maximum time to render a template. Default no limit.
+  -stagger=0s           Delay between starting each watch, with jitter, to spread
+                        out their first queries.
+  -warmup=0s            Period new servers are disabled for once discovered.
+  -canary-rate=0        Fraction of a backend's servers that can be new per
+                        refresh, such as 0.1. The rest are added later.
+  -canary-interval=30s  Period between refreshes adding held back servers.
+  -initial-render       Render once before watching for changes.
+  -initial-render-timeout=30s
+                        Maximum time to wait for the initial render.
+  -final-render         Apply any pending changes on shutdown.
+  -shutdown-timeout=10s Maximum time to wait for the watcher to finish on shutdown
+                        or a configuration reload.
+  -query-timeout-margin=10s
+                        Time a query to Consul may outlast its wait time before
+                        it is abandoned and retried.
+  -max-consecutive-failures=n
+                        Exit once a watch fails n queries in a row.
+  -dedupe               Collapse the servers of a backend with the same address.
+  -dns-resolvers=name   HAProxy resolvers section to resolve server hostnames with.
+  -init-addr=policy     init-addr policy of servers with hostnames, such as
+                        "last,libc,none". Defaults to "none" with -dns-resolvers.
+  -empty-placeholder    Emit a disabled placeholder server for empty backends.
+  -placeholder-addr=127.0.0.1:1
+                        Address of the placeholder server.
+  -on-all-errors=keep   When every watch of a backend fails, keep its last servers,
+                        or "empty" to render it without servers.
+  -backend-order=name   Order of the backends returned by the backends template
+                        function, or "config" for the order they are configured.
+  -name-replacement=_   Replaces the characters of server names that are unsafe
+                        in HAProxy, such as dots.
+  -raw-names            Do not replace unsafe characters in server names.
 `
@@ -1,8 +1,13 @@
 package main
 
 import (
+	"fmt"
+	"io/ioutil"
+	"os"
 	"reflect"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestWatchRE(t *testing.T) {
@@ -92,6 +97,9 @@ func TestValidateConfig_Good(t *testing.T) {
 	if len(conf.watches) != 3 {
 		t.Fatalf("bad: %v", conf.watches)
 	}
+	if conf.ShutdownTimeout != defaultShutdownTimeout {
+		t.Fatalf("bad: %v", conf.ShutdownTimeout)
+	}
 	wp1 := &WatchPath{
 		Spec:    "app=foo",
 		Backend: "app",
@@ -125,7 +133,463 @@ func TestValidateConfig_Good(t *testing.T) {
 func TestValidateConfig_Missing(t *testing.T) {
 	conf := &Config{}
 	errs := validateConfig(conf)
-	if len(errs) != 4 {
+	if len(errs) != 3 {
+		t.Fatalf("bad: %v", errs)
+	}
+}
+
+func TestValidateConfig_Fallback(t *testing.T) {
+	conf := &Config{
+		DryRun:           true,
+		Templates:        []string{"test-fixtures/simple.conf"},
+		Backends:         []string{"app=foo", "app=bar", "db=mysql"},
+		FallbackBackends: []string{"app"},
+	}
+	errs := validateConfig(conf)
+	if len(errs) > 0 {
+		t.Fatalf("err: %v", errs)
+	}
+	for _, wp := range conf.watches {
+		if wp.FallbackIfEmpty != (wp.Backend == "app") {
+			t.Fatalf("bad: %v", wp)
+		}
+	}
+
+	conf = &Config{
+		DryRun:           true,
+		Templates:        []string{"test-fixtures/simple.conf"},
+		Backends:         []string{"app=foo"},
+		FallbackBackends: []string{"db"},
+	}
+	if errs := validateConfig(conf); len(errs) != 1 {
+		t.Fatalf("bad: %v", errs)
+	}
+}
+
+func TestValidateConfig_WatchOptions(t *testing.T) {
+	conf := &Config{
+		DryRun:    true,
+		Templates: []string{"test-fixtures/simple.conf"},
+		Backends:  []string{"app=tag.foo@dc2:8000?max_servers=5&force_port=9000&default_port=7000"},
+	}
+	errs := validateConfig(conf)
+	if len(errs) > 0 {
+		t.Fatalf("err: %v", errs)
+	}
+	wp := &WatchPath{
+		Spec:        "app=tag.foo@dc2:8000?max_servers=5&force_port=9000&default_port=7000",
+		Backend:     "app",
+		Tag:         "tag",
+		Service:     "foo",
+		Datacenter:  "dc2",
+		Port:        8000,
+		ForcePort:   9000,
+		DefaultPort: 7000,
+		MaxServers:  5,
+	}
+	if !reflect.DeepEqual(wp, conf.watches[0]) {
+		t.Fatalf("bad: %v", conf.watches[0])
+	}
+
+	conf = &Config{
+		DryRun:    true,
+		Templates: []string{"test-fixtures/simple.conf"},
+		Backends:  []string{"db=mysql?protocol=tcp&send_proxy=true&include_unhealthy=true&check_weight=true"},
+	}
+	if errs := validateConfig(conf); len(errs) > 0 {
+		t.Fatalf("err: %v", errs)
+	}
+	if conf.watches[0].Protocol != "tcp" || !conf.watches[0].SendProxy {
+		t.Fatalf("bad: %v", conf.watches[0])
+	}
+	if !conf.watches[0].IncludeUnhealthy || !conf.watches[0].CheckWeight {
+		t.Fatalf("bad: %v", conf.watches[0])
+	}
+
+	conf = &Config{
+		DryRun:    true,
+		Templates: []string{"test-fixtures/simple.conf"},
+		Backends:  []string{"app=foo?backup=true&resolver=true&consistency=stale&allow_missing=true&missing_addr=fe80::1&max_age=5m"},
+	}
+	if errs := validateConfig(conf); len(errs) > 0 {
+		t.Fatalf("err: %v", errs)
+	}
+	if !conf.watches[0].Backup || !conf.watches[0].Resolver || conf.watches[0].Consistency != "stale" {
+		t.Fatalf("bad: %v", conf.watches[0])
+	}
+	if !conf.watches[0].AllowMissing || conf.watches[0].MissingAddress != "fe80::1" {
+		t.Fatalf("bad: %v", conf.watches[0])
+	}
+	if conf.watches[0].MaxDataAge != 5*time.Minute {
+		t.Fatalf("bad: %v", conf.watches[0])
+	}
+
+	conf = &Config{
+		DryRun:    true,
+		Templates: []string{"test-fixtures/simple.conf"},
+		Backends:  []string{"app=foo@dc2?label=team:payments&label=env:prod&max_servers=2"},
+	}
+	if errs := validateConfig(conf); len(errs) > 0 {
+		t.Fatalf("err: %v", errs)
+	}
+	labels := map[string]string{"team": "payments", "env": "prod"}
+	if !reflect.DeepEqual(conf.watches[0].Labels, labels) {
+		t.Fatalf("bad: %v", conf.watches[0])
+	}
+	if s := conf.watches[0].String(); s != "app=foo@dc2 [env=prod team=payments]" {
+		t.Fatalf("bad: %v", s)
+	}
+
+	conf = &Config{
+		DryRun:    true,
+		Templates: []string{"test-fixtures/simple.conf"},
+		Backends:  []string{"app=foo?exclude_node=web-1&exclude_node=db-*&exclude_id=foo-2"},
+	}
+	if errs := validateConfig(conf); len(errs) > 0 {
+		t.Fatalf("err: %v", errs)
+	}
+	if !reflect.DeepEqual(conf.watches[0].ExcludeNodes, []string{"web-1", "db-*"}) {
+		t.Fatalf("bad: %v", conf.watches[0])
+	}
+	if !reflect.DeepEqual(conf.watches[0].ExcludeServiceIDs, []string{"foo-2"}) {
+		t.Fatalf("bad: %v", conf.watches[0])
+	}
+
+	conf = &Config{
+		DryRun:    true,
+		Templates: []string{"test-fixtures/simple.conf"},
+		Backends:  []string{"app=foo?weight_key=lb_weight", "db=mysql?weight_key=lb_weight&default_weight=0"},
+	}
+	if errs := validateConfig(conf); len(errs) > 0 {
+		t.Fatalf("err: %v", errs)
+	}
+	if conf.watches[0].WeightKey != "lb_weight" || conf.watches[0].DefaultWeight != defaultServerWeight {
+		t.Fatalf("bad: %v", conf.watches[0])
+	}
+	if conf.watches[1].DefaultWeight != 0 {
+		t.Fatalf("bad: %v", conf.watches[1])
+	}
+
+	conf = &Config{
+		DryRun:    true,
+		Templates: []string{"test-fixtures/simple.conf"},
+		Backends:  []string{"app=foo?observe=layer7&agent_port=9999"},
+	}
+	if errs := validateConfig(conf); len(errs) > 0 {
+		t.Fatalf("err: %v", errs)
+	}
+	if conf.watches[0].Observe != "layer7" || conf.watches[0].AgentPort != 9999 {
+		t.Fatalf("bad: %v", conf.watches[0])
+	}
+
+	for _, b := range []string{
+		"app=foo?observe=layer3",
+		"app=foo?observe=layer7&protocol=tcp",
+		"app=foo?agent_port=0",
+		"app=foo?weight_key=",
+		"app=foo?weight_key=lb_weight&default_weight=300",
+		"app=foo?default_weight=50",
+		"app=foo?exclude_node=[",
+		"app=foo?kind=",
+		"app=foo?exclude_kind=[",
+		"app=foo?sort=random",
+		"app=foo?consistency=strong",
+		"app=foo?allow_missing=perhaps",
+		"app=foo?missing_addr=",
+		"app=foo?missing_addr=host:80",
+		"app=foo?tagged_address=",
+		"app=foo?max_age=30s",
+		"app=foo?max_age=soon",
+		"app=foo?check_weight=1.5",
+		"app=foo?label=team",
+		"app=foo?split_tag=",
+		"app=foo@dc2?mesh_gateway=localhost:8443",
+		"app=foo@dc2?mesh_gateway=10.0.0.9",
+		"app=foo?label=:x",
+		"app=foo?backup=maybe",
+		"app=foo?resolver=2",
+		"app=foo?max_servers=x",
+		"app=foo?max_failures=0",
+		"app=foo?bogus=1",
+		"app=foo?protocol=udp",
+		"app=foo?force_port=0",
+		"app=foo?default_port=x",
+		"app=foo?connect=sure",
+		"app=foo?send_proxy=maybe",
+	} {
+		conf = &Config{
+			DryRun:    true,
+			Templates: []string{"test-fixtures/simple.conf"},
+			Backends:  []string{b},
+		}
+		if errs := validateConfig(conf); len(errs) != 1 {
+			t.Fatalf("bad: %s %v", b, errs)
+		}
+	}
+}
+
+func TestValidateConfig_PerDatacenter(t *testing.T) {
+	conf := &Config{
+		Templates:     []string{"test-fixtures/simple.conf"},
+		Paths:         []string{"haproxy-{{.Datacenter}}.cfg"},
+		Backends:      []string{"app=foo@dc1", "app=foo@dc2"},
+		PerDatacenter: true,
+	}
+	if errs := validateConfig(conf); len(errs) > 0 {
+		t.Fatalf("err: %v", errs)
+	}
+
+	conf.Paths = []string{"haproxy.cfg"}
+	if errs := validateConfig(conf); len(errs) != 1 {
+		t.Fatalf("bad: %v", errs)
+	}
+}
+
+func TestValidateConfig_MinHealthy(t *testing.T) {
+	conf := &Config{
+		DryRun:     true,
+		Templates:  []string{"test-fixtures/simple.conf"},
+		Backends:   []string{"app=foo"},
+		MinHealthy: map[string]int{"app": 2},
+	}
+	if errs := validateConfig(conf); len(errs) > 0 {
+		t.Fatalf("err: %v", errs)
+	}
+
+	conf.MinHealthy = map[string]int{"app": -1, "db": 1}
+	if errs := validateConfig(conf); len(errs) != 2 {
+		t.Fatalf("bad: %v", errs)
+	}
+
+	conf.MinHealthy = nil
+	conf.MinReload = map[string]int{"db": 1}
+	if errs := validateConfig(conf); len(errs) != 1 {
+		t.Fatalf("bad: %v", errs)
+	}
+}
+
+func TestValidateConfig_ReloadThreshold(t *testing.T) {
+	for _, raw := range []string{"", "0", "3", "10%", "12.5%", "100%"} {
+		conf := &Config{
+			DryRun:                true,
+			Templates:             []string{"test-fixtures/simple.conf"},
+			Backends:              []string{"app=foo"},
+			ReloadChangeThreshold: raw,
+		}
+		if errs := validateConfig(conf); len(errs) > 0 {
+			t.Fatalf("err: %s %v", raw, errs)
+		}
+	}
+	for _, raw := range []string{"-1", "x", "101%", "-5%", "%"} {
+		conf := &Config{
+			DryRun:                true,
+			Templates:             []string{"test-fixtures/simple.conf"},
+			Backends:              []string{"app=foo"},
+			ReloadChangeThreshold: raw,
+		}
+		if errs := validateConfig(conf); len(errs) != 1 {
+			t.Fatalf("bad: %s %v", raw, errs)
+		}
+	}
+}
+
+func TestValidateConfig_Placeholder(t *testing.T) {
+	conf := &Config{
+		DryRun:                  true,
+		Templates:               []string{"test-fixtures/simple.conf"},
+		Backends:                []string{"app=foo"},
+		EmptyBackendPlaceholder: true,
+	}
+	if errs := validateConfig(conf); len(errs) > 0 {
+		t.Fatalf("err: %v", errs)
+	}
+	if conf.PlaceholderAddress != "127.0.0.1:1" {
+		t.Fatalf("bad: %v", conf.PlaceholderAddress)
+	}
+
+	conf.PlaceholderAddress = "localhost"
+	if errs := validateConfig(conf); len(errs) != 1 {
+		t.Fatalf("bad: %v", errs)
+	}
+}
+
+func TestCheckConfig(t *testing.T) {
+	conf := &Config{}
+	if err := readConfig("test-fixtures/config.json", conf); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if errs := checkConfig(conf); len(errs) > 0 {
+		t.Fatalf("err: %v", errs)
+	}
+
+	// Invalid template
+	conf = &Config{}
+	if err := readConfig("test-fixtures/config.json", conf); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	conf.Templates[1] = "test-fixtures/bad.conf"
+	if errs := checkConfig(conf); len(errs) != 1 {
+		t.Fatalf("bad: %v", errs)
+	}
+
+	// Invalid backend
+	conf = &Config{}
+	if err := readConfig("test-fixtures/config.json", conf); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	conf.Backends = append(conf.Backends, "bogus")
+	if errs := checkConfig(conf); len(errs) != 1 {
+		t.Fatalf("bad: %v", errs)
+	}
+}
+
+func TestPidFile(t *testing.T) {
+	path := "test_pid"
+	defer os.Remove(path)
+
+	// Stale file should be overwritten
+	if err := ioutil.WriteFile(path, []byte("99999\n"), 0644); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := writePidFile(path); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if string(raw) != fmt.Sprintf("%d\n", os.Getpid()) {
+		t.Fatalf("bad: %s", raw)
+	}
+
+	removePidFile(path)
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatalf("expected removal: %v", err)
+	}
+}
+
+func TestValidateConfig_BackendPatterns(t *testing.T) {
+	conf := &Config{
+		DryRun:          true,
+		Templates:       []string{"test-fixtures/simple.conf"},
+		Backends:        []string{"app=app"},
+		ExcludeBackends: []string{"["},
+	}
+	if errs := validateConfig(conf); len(errs) != 1 {
+		t.Fatalf("bad: %v", errs)
+	}
+}
+
+func TestValidateConfig_BackendOrder(t *testing.T) {
+	conf := &Config{
+		DryRun:    true,
+		Templates: []string{"test-fixtures/simple.conf"},
+		Backends:  []string{"app=app"},
+	}
+	if errs := validateConfig(conf); len(errs) > 0 {
+		t.Fatalf("err: %v", errs)
+	}
+	if conf.BackendOrder != backendOrderName {
+		t.Fatalf("bad: %v", conf.BackendOrder)
+	}
+
+	conf = &Config{
+		DryRun:       true,
+		Templates:    []string{"test-fixtures/simple.conf"},
+		Backends:     []string{"app=app"},
+		BackendOrder: "random",
+	}
+	if errs := validateConfig(conf); len(errs) != 1 {
+		t.Fatalf("bad: %v", errs)
+	}
+}
+
+func TestValidateConfig_NameReplacement(t *testing.T) {
+	conf := &Config{
+		DryRun:    true,
+		Templates: []string{"test-fixtures/simple.conf"},
+		Backends:  []string{"app=app"},
+	}
+	if errs := validateConfig(conf); len(errs) > 0 {
+		t.Fatalf("err: %v", errs)
+	}
+	if conf.NameReplacement != "_" {
+		t.Fatalf("bad: %v", conf.NameReplacement)
+	}
+
+	conf = &Config{
+		DryRun:          true,
+		Templates:       []string{"test-fixtures/simple.conf"},
+		Backends:        []string{"app=app"},
+		NameReplacement: ".",
+	}
+	if errs := validateConfig(conf); len(errs) != 1 {
+		t.Fatalf("bad: %v", errs)
+	}
+}
+
+func TestValidateConfig_DuplicateBackends(t *testing.T) {
+	backends := []string{
+		"app=foo",
+		"app=foo@dc2",
+		"app=foo",
+		"db=foo",
+		"app=foo?max_servers=2",
+	}
+	newConf := func(policy string) *Config {
+		return &Config{
+			DryRun:            true,
+			Templates:         []string{"test-fixtures/simple.conf"},
+			Backends:          backends,
+			DuplicateBackends: policy,
+		}
+	}
+	specs := func(conf *Config) []string {
+		var out []string
+		for _, wp := range conf.watches {
+			out = append(out, wp.Spec)
+		}
+		return out
+	}
+
+	// Every watch is kept by default
+	conf := newConf("")
+	if errs := validateConfig(conf); len(errs) > 0 {
+		t.Fatalf("err: %v", errs)
+	}
+	if out := specs(conf); !reflect.DeepEqual(out, backends) {
+		t.Fatalf("bad: %v", out)
+	}
+	if conf.DuplicateBackends != duplicateMerge {
+		t.Fatalf("bad: %v", conf.DuplicateBackends)
+	}
+
+	// The last duplicate takes the place of the first
+	conf = newConf(duplicateLastWins)
+	if errs := validateConfig(conf); len(errs) > 0 {
+		t.Fatalf("err: %v", errs)
+	}
+	if out := specs(conf); !reflect.DeepEqual(out, []string{"app=foo?max_servers=2", "app=foo@dc2", "db=foo"}) {
+		t.Fatalf("bad: %v", out)
+	}
+	if conf.watches[0].MaxServers != 2 {
+		t.Fatalf("bad: %v", conf.watches[0])
+	}
+
+	// Each duplicate is an error, distinguishing conflicts
+	conf = newConf(duplicateError)
+	errs := validateConfig(conf)
+	if len(errs) != 2 {
+		t.Fatalf("bad: %v", errs)
+	}
+	if !strings.Contains(errs[0].Error(), "defined more than once") {
+		t.Fatalf("bad: %v", errs[0])
+	}
+	if !strings.Contains(errs[1].Error(), "conflicts with 'app=foo'") {
+		t.Fatalf("bad: %v", errs[1])
+	}
+
+	if errs := validateConfig(newConf("first-wins")); len(errs) != 1 {
 		t.Fatalf("bad: %v", errs)
 	}
 }
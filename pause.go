@@ -0,0 +1,75 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"sync"
+)
+
+// pauseControl is used to pause the writes and reloads, for example
+// during maintenance of HAProxy. The watches keep updating while
+// paused, and the latest configuration is applied on resume.
+type pauseControl struct {
+	sync.Mutex
+	paused   bool
+	resumeCh chan struct{}
+}
+
+func newPauseControl() *pauseControl {
+	return &pauseControl{resumeCh: make(chan struct{}, 1)}
+}
+
+// isPaused returns if the writes and reloads are paused
+func (p *pauseControl) isPaused() bool {
+	if p == nil {
+		return false
+	}
+	p.Lock()
+	defer p.Unlock()
+	return p.paused
+}
+
+// set pauses or resumes the writes and reloads. Returns if the
+// state changed.
+func (p *pauseControl) set(paused bool) bool {
+	if p == nil {
+		return false
+	}
+	p.Lock()
+	defer p.Unlock()
+	if p.paused == paused {
+		return false
+	}
+	p.paused = paused
+	if !paused {
+		asyncNotify(p.resumeCh)
+	}
+	return true
+}
+
+// resumed returns the channel notified on resume
+func (p *pauseControl) resumed() chan struct{} {
+	if p == nil {
+		return nil
+	}
+	return p.resumeCh
+}
+
+// pauseHandler returns the handler pausing or resuming
+// the writes and reloads
+func pauseHandler(conf *Config, paused bool) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != "POST" {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		if conf.pause.set(paused) {
+			if paused {
+				log.Printf("[INFO] Pausing writes and reloads")
+			} else {
+				log.Printf("[INFO] Resuming writes and reloads")
+			}
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
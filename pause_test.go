@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/armon/consul-api"
+)
+
+func TestForceRefresh_Paused(t *testing.T) {
+	wp := &WatchPath{Backend: "app"}
+	d := &backendData{
+		Servers:  make(map[*WatchPath][]*consulapi.ServiceEntry),
+		Backends: map[string][]*WatchPath{"app": []*WatchPath{wp}},
+		ChangeCh: make(chan struct{}, 1),
+	}
+	applier := &fakeApplier{}
+	conf := &Config{
+		watches:   []*WatchPath{wp},
+		Templates: []string{"test-fixtures/simple.conf"},
+		Paths:     []string{"config_out"},
+		Applier:   applier,
+		pause:     newPauseControl(),
+	}
+	entry := func(node string) *consulapi.ServiceEntry {
+		return &consulapi.ServiceEntry{
+			Node:    &consulapi.Node{Node: node, Address: "127.0.0.1"},
+			Service: &consulapi.AgentService{ID: "app", Port: 8000},
+		}
+	}
+
+	// Nothing is applied while paused
+	conf.pause.set(true)
+	updateEntries(conf, d, wp, []*consulapi.ServiceEntry{entry("node1")}, nil)
+	if forceRefresh(conf, d) {
+		t.Fatalf("unexpected exit")
+	}
+	updateEntries(conf, d, wp, []*consulapi.ServiceEntry{entry("node1"), entry("node2")}, nil)
+	if forceRefresh(conf, d) {
+		t.Fatalf("unexpected exit")
+	}
+	if applier.rendered != nil {
+		t.Fatalf("bad: %v", applier.rendered)
+	}
+	if d.lastReload != "skipped: "+skipPaused {
+		t.Fatalf("bad: %s", d.lastReload)
+	}
+
+	// Reloads outside of a refresh are also held
+	conf.ReloadCommand = "false"
+	d.rendered = true
+	deferredReload(conf, d)
+	if d.reloadFailures != 0 || d.lastReload != "skipped: "+skipPaused {
+		t.Fatalf("bad: %d %s", d.reloadFailures, d.lastReload)
+	}
+	conf.ReloadCommand = ""
+
+	// The latest servers are applied on resume
+	if !conf.pause.set(false) {
+		t.Fatalf("expected change")
+	}
+	select {
+	case <-conf.pause.resumed():
+	default:
+		t.Fatalf("expected resume")
+	}
+	if forceRefresh(conf, d) {
+		t.Fatalf("unexpected exit")
+	}
+	if !bytes.Contains(applier.rendered["config_out"], []byte("server node2_app")) {
+		t.Fatalf("bad: %s", applier.rendered["config_out"])
+	}
+	if len(applier.changed) != 1 || applier.changed[0] != "app" {
+		t.Fatalf("bad: %v", applier.changed)
+	}
+}
+
+func TestPauseHandler(t *testing.T) {
+	conf := &Config{pause: newPauseControl()}
+	pause := pauseHandler(conf, true)
+	resume := pauseHandler(conf, false)
+
+	rec := httptest.NewRecorder()
+	pause.ServeHTTP(rec, httptest.NewRequest("GET", "/pause", nil))
+	if rec.Code != http.StatusMethodNotAllowed || conf.pause.isPaused() {
+		t.Fatalf("bad: %d", rec.Code)
+	}
+
+	rec = httptest.NewRecorder()
+	pause.ServeHTTP(rec, httptest.NewRequest("POST", "/pause", nil))
+	if rec.Code != http.StatusNoContent || !conf.pause.isPaused() {
+		t.Fatalf("bad: %d", rec.Code)
+	}
+
+	rec = httptest.NewRecorder()
+	resume.ServeHTTP(rec, httptest.NewRequest("POST", "/resume", nil))
+	if rec.Code != http.StatusNoContent || conf.pause.isPaused() {
+		t.Fatalf("bad: %d", rec.Code)
+	}
+
+	// A configuration without a pause control is never paused
+	conf = &Config{}
+	rec = httptest.NewRecorder()
+	pauseHandler(conf, true).ServeHTTP(rec, httptest.NewRequest("POST", "/pause", nil))
+	if conf.pause.isPaused() {
+		t.Fatalf("unexpected pause")
+	}
+}
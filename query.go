@@ -0,0 +1,117 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/armon/consul-api"
+)
+
+// ServiceQuerier is used to query the instances of a service. It
+// is implemented using the Consul client, and can be replaced to
+// test the watch pipeline without Consul.
+type ServiceQuerier interface {
+	// Service queries the instances of a service, along with the
+	// detail of each that the consul client drops
+	Service(service, tag string, passingOnly bool,
+		q *consulapi.QueryOptions) ([]*consulapi.ServiceEntry, instanceDetails, *consulapi.QueryMeta, error)
+
+	// Connect queries the Connect capable instances of a service
+	Connect(service, tag string, passingOnly bool,
+		q *consulapi.QueryOptions) ([]*consulapi.ServiceEntry, instanceDetails, *consulapi.QueryMeta, error)
+
+	// Resolver reads the service-resolver config entry of a service,
+	// returning nil if there is none
+	Resolver(service string, q *consulapi.QueryOptions) (*ServiceResolver, error)
+
+	// Intentions queries the intentions matching a destination service
+	Intentions(service string, q *consulapi.QueryOptions) ([]*Intention, *consulapi.QueryMeta, error)
+}
+
+// consulQuerier is the ServiceQuerier backed by Consul
+type consulQuerier struct {
+	config *consulapi.Config
+}
+
+func (c *consulQuerier) Service(service, tag string, passingOnly bool,
+	q *consulapi.QueryOptions) ([]*consulapi.ServiceEntry, instanceDetails, *consulapi.QueryMeta, error) {
+	return healthService(c.config, "service", service, tag, passingOnly, q)
+}
+
+func (c *consulQuerier) Connect(service, tag string, passingOnly bool,
+	q *consulapi.QueryOptions) ([]*consulapi.ServiceEntry, instanceDetails, *consulapi.QueryMeta, error) {
+	return healthService(c.config, "connect", service, tag, passingOnly, q)
+}
+
+func (c *consulQuerier) Resolver(service string,
+	q *consulapi.QueryOptions) (*ServiceResolver, error) {
+	return serviceResolver(c.config, service, q)
+}
+
+func (c *consulQuerier) Intentions(service string,
+	q *consulapi.QueryOptions) ([]*Intention, *consulapi.QueryMeta, error) {
+	return connectIntentions(c.config, service, q)
+}
+
+// queryParams returns the parameters of the query options, for
+// requests made to the HTTP API directly
+func queryParams(q *consulapi.QueryOptions) url.Values {
+	params := url.Values{}
+	if q == nil {
+		return params
+	}
+	if q.Datacenter != "" {
+		params.Set("dc", q.Datacenter)
+	}
+	if q.AllowStale {
+		params.Set("stale", "")
+	}
+	if q.RequireConsistent {
+		params.Set("consistent", "")
+	}
+	if q.WaitIndex != 0 {
+		params.Set("index", strconv.FormatUint(q.WaitIndex, 10))
+	}
+	if q.WaitTime != 0 {
+		params.Set("wait", fmt.Sprintf("%dms", q.WaitTime/time.Millisecond))
+	}
+	return params
+}
+
+// parseQueryMeta is used to parse the QueryMeta of a response
+// to a request made to the HTTP API directly
+func parseQueryMeta(resp *http.Response, start time.Time) (*consulapi.QueryMeta, error) {
+	qm := &consulapi.QueryMeta{RequestTime: time.Since(start)}
+	if index := resp.Header.Get("X-Consul-Index"); index != "" {
+		var err error
+		qm.LastIndex, err = strconv.ParseUint(index, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to parse X-Consul-Index: %v", err)
+		}
+	}
+	qm.KnownLeader = resp.Header.Get("X-Consul-Knownleader") == "true"
+	return qm, nil
+}
+
+// consulGet is used to make a request to the HTTP API directly, for
+// the endpoints the consul client does not support. The token of the
+// configuration is added to the parameters.
+func consulGet(consulConf *consulapi.Config, path string, params url.Values) (*http.Response, error) {
+	if consulConf.Token != "" {
+		params.Set("token", consulConf.Token)
+	}
+	u := &url.URL{
+		Scheme:   consulConf.Scheme,
+		Host:     consulConf.Address,
+		Path:     path,
+		RawQuery: params.Encode(),
+	}
+	client := consulConf.HttpClient
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return client.Get(u.String())
+}
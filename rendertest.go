@@ -0,0 +1,78 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sort"
+
+	"github.com/armon/consul-api"
+)
+
+// sampleServer is a server of a backend in the sample data of
+// -render-test, with the fields of a service instance in Consul
+type sampleServer struct {
+	Node    string
+	Address string
+	ID      string
+	Service string
+	Port    int
+	Tags    []string
+}
+
+// renderSample is used to render the templates against the sample
+// servers of each backend in a JSON file, writing the outputs to out,
+// without contacting Consul or writing the outputs. If no backends
+// are configured, those of the sample are used.
+func renderSample(conf *Config, out io.Writer) error {
+	raw, err := ioutil.ReadFile(conf.renderTestPath)
+	if err != nil {
+		return fmt.Errorf("Failed to read sample: %v", err)
+	}
+	var sample map[string][]*sampleServer
+	if err := json.Unmarshal(raw, &sample); err != nil {
+		return fmt.Errorf("Failed to decode sample: %v", err)
+	}
+
+	if len(conf.Backends) == 0 {
+		backends := make([]string, 0, len(sample))
+		for backend := range sample {
+			backends = append(backends, backend)
+		}
+		sort.Strings(backends)
+		for _, backend := range backends {
+			conf.Backends = append(conf.Backends, backend+"="+backend)
+		}
+	}
+	conf.DryRun = true
+	if errs := validateConfig(conf); len(errs) > 0 {
+		return errs[0]
+	}
+
+	servers := make(map[string][]*backendEntry, len(sample))
+	for backend, list := range sample {
+		entries := make([]*backendEntry, 0, len(list))
+		for _, s := range list {
+			entries = append(entries, &backendEntry{ServiceEntry: &consulapi.ServiceEntry{
+				Node: &consulapi.Node{Node: s.Node, Address: s.Address},
+				Service: &consulapi.AgentService{
+					ID:      s.ID,
+					Service: s.Service,
+					Tags:    s.Tags,
+					Port:    s.Port,
+				},
+			}})
+		}
+		servers[backend] = entries
+	}
+
+	_, outputs, err := renderOutputs(conf, servers, true)
+	if err != nil {
+		return err
+	}
+	for _, output := range outputs {
+		fmt.Fprintf(out, "%s\n", output)
+	}
+	return nil
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+)
+
+func TestRenderSample(t *testing.T) {
+	conf := &Config{
+		Templates:      []string{"test-fixtures/all.conf"},
+		renderTestPath: "test-fixtures/sample.json",
+	}
+	var out bytes.Buffer
+	if err := renderSample(conf, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	expect, err := ioutil.ReadFile("test-fixtures/sample.json.out")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !bytes.Equal(out.Bytes(), expect) {
+		t.Fatalf("bad: %s", out.Bytes())
+	}
+
+	// The backends of the sample are used if none are given
+	if len(conf.Backends) != 2 || conf.Backends[0] != "app=app" || conf.Backends[1] != "cache=cache" {
+		t.Fatalf("bad: %v", conf.Backends)
+	}
+}
+
+func TestRenderSample_Invalid(t *testing.T) {
+	conf := &Config{
+		Templates:      []string{"test-fixtures/all.conf"},
+		renderTestPath: "test-fixtures/simple.conf",
+	}
+	if err := renderSample(conf, &bytes.Buffer{}); err == nil {
+		t.Fatalf("expected error")
+	}
+}
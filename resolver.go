@@ -0,0 +1,103 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+
+	"github.com/armon/consul-api"
+)
+
+// ServiceResolver is the part of a service-resolver config
+// entry used to order the failover targets of a service
+type ServiceResolver struct {
+	Failover map[string]ResolverFailover
+}
+
+// ResolverFailover is a failover target of a service resolver.
+// If Service is empty, the resolved service is used, and if
+// Datacenters is empty, the datacenter of the watch is used.
+type ResolverFailover struct {
+	Service     string
+	Datacenters []string
+}
+
+// serviceResolver is used to read the service-resolver config entry
+// of a service. The consul client does not support config entries,
+// so the HTTP API is used directly.
+func serviceResolver(consulConf *consulapi.Config, service string,
+	q *consulapi.QueryOptions) (*ServiceResolver, error) {
+	params := url.Values{}
+	if q != nil && q.Datacenter != "" {
+		params.Set("dc", q.Datacenter)
+	}
+	resp, err := consulGet(consulConf, "/v1/config/service-resolver/"+service, params)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case 200:
+	case 404:
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("Unexpected response code: %d", resp.StatusCode)
+	}
+
+	var resolver ServiceResolver
+	if err := json.NewDecoder(resp.Body).Decode(&resolver); err != nil {
+		return nil, err
+	}
+	return &resolver, nil
+}
+
+// expandResolvers returns the watches with a backup watch following
+// each watch using a resolver, for each of its failover targets in
+// order. Only the failover for all subsets, "*", is used.
+func expandResolvers(querier ServiceQuerier, watches []*WatchPath) ([]*WatchPath, error) {
+	var out []*WatchPath
+	for _, watch := range watches {
+		out = append(out, watch)
+		if !watch.Resolver {
+			continue
+		}
+		opts := &consulapi.QueryOptions{Datacenter: watch.Datacenter}
+		resolver, err := querier.Resolver(watch.Service, opts)
+		if err != nil {
+			return nil, fmt.Errorf("resolver for '%s': %v", watch.Service, err)
+		}
+		if resolver == nil {
+			continue
+		}
+		failover, ok := resolver.Failover["*"]
+		if !ok {
+			continue
+		}
+
+		service := watch.Service
+		if failover.Service != "" {
+			service = failover.Service
+		}
+		datacenters := failover.Datacenters
+		if len(datacenters) == 0 {
+			datacenters = []string{watch.Datacenter}
+		}
+		for _, dc := range datacenters {
+			if service == watch.Service && dc == watch.Datacenter {
+				continue
+			}
+			target := service
+			if dc != "" {
+				target += "@" + dc
+			}
+			backup := *watch
+			backup.Spec = fmt.Sprintf("%s (failover to %s)", watch.Spec, target)
+			backup.Service = service
+			backup.Datacenter = dc
+			backup.Backup = true
+			backup.Resolver = false
+			out = append(out, &backup)
+		}
+	}
+	return out, nil
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/armon/consul-api"
+)
+
+func TestServiceResolver(t *testing.T) {
+	var req *http.Request
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		req = r
+		if r.URL.Path != "/v1/config/service-resolver/web" {
+			http.NotFound(w, r)
+			return
+		}
+		fmt.Fprint(w, `{
+			"Kind": "service-resolver",
+			"Name": "web",
+			"Failover": {"*": {"Datacenters": ["dc2", "dc3"]}}
+		}`)
+	}))
+	defer srv.Close()
+
+	consulConf := consulapi.DefaultConfig()
+	consulConf.Address = strings.TrimPrefix(srv.URL, "http://")
+	consulConf.Token = "secret"
+	opts := &consulapi.QueryOptions{Datacenter: "dc1"}
+	resolver, err := serviceResolver(consulConf, "web", opts)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if query := req.URL.Query(); query.Get("dc") != "dc1" || query.Get("token") != "secret" {
+		t.Fatalf("bad: %v", req.URL)
+	}
+	expect := &ServiceResolver{Failover: map[string]ResolverFailover{
+		"*": ResolverFailover{Datacenters: []string{"dc2", "dc3"}},
+	}}
+	if !reflect.DeepEqual(resolver, expect) {
+		t.Fatalf("bad: %v", resolver)
+	}
+
+	// A missing config entry is not an error
+	resolver, err = serviceResolver(consulConf, "db", nil)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if resolver != nil {
+		t.Fatalf("bad: %v", resolver)
+	}
+}
+
+func TestExpandResolvers(t *testing.T) {
+	querier := &fakeQuerier{
+		resolvers: map[string]*ServiceResolver{
+			"web": &ServiceResolver{Failover: map[string]ResolverFailover{
+				"*": ResolverFailover{Datacenters: []string{"dc1", "dc2"}},
+			}},
+			"db": &ServiceResolver{Failover: map[string]ResolverFailover{
+				"*": ResolverFailover{Service: "db-replica"},
+			}},
+		},
+	}
+	web := &WatchPath{Spec: "app=web@dc1?resolver=true", Backend: "app",
+		Service: "web", Datacenter: "dc1", Resolver: true}
+	db := &WatchPath{Spec: "db=db?resolver=true", Backend: "db",
+		Service: "db", Resolver: true}
+	cache := &WatchPath{Spec: "cache=redis", Backend: "cache", Service: "redis"}
+
+	watches, err := expandResolvers(querier, []*WatchPath{web, cache, db})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(watches) != 5 {
+		t.Fatalf("bad: %v", watches)
+	}
+	if watches[0] != web || watches[2] != cache || watches[3] != db {
+		t.Fatalf("bad: %v", watches)
+	}
+
+	// The primary datacenter is skipped as a failover target
+	failover := watches[1]
+	if failover.Backend != "app" || failover.Service != "web" ||
+		failover.Datacenter != "dc2" || !failover.Backup || failover.Resolver {
+		t.Fatalf("bad: %v", failover)
+	}
+	if failover.Spec != "app=web@dc1?resolver=true (failover to web@dc2)" {
+		t.Fatalf("bad: %v", failover.Spec)
+	}
+
+	failover = watches[4]
+	if failover.Backend != "db" || failover.Service != "db-replica" ||
+		failover.Datacenter != "" || !failover.Backup {
+		t.Fatalf("bad: %v", failover)
+	}
+
+	// The failover servers are rendered as backups after the primaries
+	entry := func(node, addr string) *consulapi.ServiceEntry {
+		return &consulapi.ServiceEntry{
+			Node:    &consulapi.Node{Node: node, Address: addr},
+			Service: &consulapi.AgentService{ID: "web", Port: 80},
+		}
+	}
+	servers := formatOutput(map[string][]*backendEntry{
+		"app": []*backendEntry{
+			&backendEntry{ServiceEntry: entry("remote", "10.0.1.1"), Watch: watches[1]},
+			&backendEntry{ServiceEntry: entry("local", "10.0.0.1"), Watch: web},
+		},
+	})
+	var lines []string
+	for _, server := range servers["app"] {
+		lines = append(lines, server.String())
+	}
+	expect := []string{
+		"server local_web 10.0.0.1:80",
+		"server remote_web 10.0.1.1:80 backup",
+	}
+	if !reflect.DeepEqual(lines, expect) {
+		t.Fatalf("bad: %v", lines)
+	}
+}
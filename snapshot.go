@@ -0,0 +1,95 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/armon/consul-api"
+)
+
+// snapshot is the resolved entries of each watch, by the key
+// of the watch, as recorded by -record
+type snapshot map[string][]*consulapi.ServiceEntry
+
+// snapshotKeys returns the key of each watch in a snapshot, which is
+// its spec. Watches sharing a spec, as kept by the merge duplicate
+// policy, are told apart by appending their occurrence after the
+// first, such as "app=web#2".
+func snapshotKeys(watches []*WatchPath) map[*WatchPath]string {
+	keys := make(map[*WatchPath]string, len(watches))
+	seen := make(map[string]int)
+	for _, watch := range watches {
+		seen[watch.Spec]++
+		key := watch.Spec
+		if n := seen[watch.Spec]; n > 1 {
+			key = fmt.Sprintf("%s#%d", watch.Spec, n)
+		}
+		keys[watch] = key
+	}
+	return keys
+}
+
+// recordSnapshot is used to write the current entries of each watch
+// to the record path. The entries are recorded after the options of
+// the watch are applied, so a replay renders the same output.
+func recordSnapshot(conf *Config, data *backendData) error {
+	snap := make(snapshot)
+	keys := snapshotKeys(conf.watches)
+	data.Lock()
+	for watch, entries := range data.Servers {
+		if key, ok := keys[watch]; ok {
+			snap[key] = entries
+		}
+	}
+	data.Unlock()
+
+	raw, err := json.MarshalIndent(snap, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := conf.RecordPath + stageSuffix
+	if err := ioutil.WriteFile(tmp, raw, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, conf.RecordPath)
+}
+
+// replaySnapshot is used to render the templates once from the
+// snapshot at the replay path, without contacting Consul. Failover
+// watches added by a resolver are not replayed.
+func replaySnapshot(conf *Config) error {
+	raw, err := ioutil.ReadFile(conf.ReplayPath)
+	if err != nil {
+		return fmt.Errorf("Failed to read snapshot: %v", err)
+	}
+	var snap snapshot
+	if err := json.Unmarshal(raw, &snap); err != nil {
+		return fmt.Errorf("Failed to decode snapshot: %v", err)
+	}
+
+	data := &backendData{
+		Servers:  make(map[*WatchPath][]*consulapi.ServiceEntry),
+		Backends: make(map[string][]*WatchPath),
+		ChangeCh: make(chan struct{}, 1),
+		ErrCh:    make(chan error, errChSize),
+	}
+	keys := snapshotKeys(conf.watches)
+	for _, watch := range conf.watches {
+		entries, ok := snap[keys[watch]]
+		if !ok {
+			return fmt.Errorf("Snapshot has no entries for %v", watch)
+		}
+		data.Backends[watch.Backend] = append(data.Backends[watch.Backend], watch)
+		updateEntries(conf, data, watch, entries, nil)
+	}
+
+	forceRefresh(conf, data)
+	select {
+	case err := <-data.ErrCh:
+		return err
+	default:
+		return nil
+	}
+}
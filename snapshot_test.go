@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/armon/consul-api"
+)
+
+func TestSnapshot_RecordReplay(t *testing.T) {
+	dir, err := ioutil.TempDir("", "consul-haproxy")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	snapPath := filepath.Join(dir, "snapshot.json")
+
+	newConf := func(applier Applier) *Config {
+		conf := &Config{
+			Templates: []string{"test-fixtures/simple.conf"},
+			Paths:     []string{"config_out"},
+			Backends:  []string{"app=app?send_proxy=true", "app=app@dc2?backup=true"},
+			Applier:   applier,
+		}
+		if errs := validateConfig(conf); len(errs) > 0 {
+			t.Fatalf("err: %v", errs)
+		}
+		return conf
+	}
+
+	// Render and record the entries
+	recorded := &fakeApplier{}
+	conf := newConf(recorded)
+	conf.RecordPath = snapPath
+	d := &backendData{
+		Servers:  make(map[*WatchPath][]*consulapi.ServiceEntry),
+		Backends: make(map[string][]*WatchPath),
+		ChangeCh: make(chan struct{}, 1),
+	}
+	for idx, wp := range conf.watches {
+		d.Backends[wp.Backend] = append(d.Backends[wp.Backend], wp)
+		querier := &fakeQuerier{
+			entries: []*consulapi.ServiceEntry{
+				&consulapi.ServiceEntry{
+					Node:    &consulapi.Node{Node: "node1", Address: "127.0.0.1"},
+					Service: &consulapi.AgentService{ID: "app", Service: "app", Port: 8000 + idx},
+				},
+			},
+		}
+		d.Querier = querier
+		entries, _, err := queryWatch(d, idx, wp, &consulapi.QueryOptions{})
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		updateEntries(conf, d, wp, entries, nil)
+	}
+	if forceRefresh(conf, d) {
+		t.Fatalf("unexpected exit")
+	}
+
+	// Replaying renders the same output
+	replayed := &fakeApplier{}
+	conf = newConf(replayed)
+	conf.ReplayPath = snapPath
+	if err := replaySnapshot(conf); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	out := replayed.rendered["config_out"]
+	if !bytes.Equal(out, recorded.rendered["config_out"]) {
+		t.Fatalf("bad: %s %s", out, recorded.rendered["config_out"])
+	}
+	if !bytes.Contains(out, []byte("server 1_node1_app 127.0.0.1:8001 backup")) {
+		t.Fatalf("bad: %s", out)
+	}
+
+	// A watch missing from the snapshot fails
+	conf = newConf(&fakeApplier{})
+	conf.Backends = append(conf.Backends, "db=mysql")
+	if errs := validateConfig(conf); len(errs) > 0 {
+		t.Fatalf("err: %v", errs)
+	}
+	conf.ReplayPath = snapPath
+	if err := replaySnapshot(conf); err == nil {
+		t.Fatalf("expected error")
+	}
+}
+
+func TestSnapshot_DuplicateSpecs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "consul-haproxy")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	snapPath := filepath.Join(dir, "snapshot.json")
+
+	newConf := func(applier Applier) *Config {
+		conf := &Config{
+			Templates: []string{"test-fixtures/simple.conf"},
+			Paths:     []string{"config_out"},
+			Backends:  []string{"app=app", "app=app"},
+			Applier:   applier,
+		}
+		if errs := validateConfig(conf); len(errs) > 0 {
+			t.Fatalf("err: %v", errs)
+		}
+		return conf
+	}
+
+	// Each of the watches sharing a spec is recorded
+	recorded := &fakeApplier{}
+	conf := newConf(recorded)
+	conf.RecordPath = snapPath
+	d := &backendData{
+		Servers:  make(map[*WatchPath][]*consulapi.ServiceEntry),
+		Backends: make(map[string][]*WatchPath),
+		ChangeCh: make(chan struct{}, 1),
+	}
+	for idx, wp := range conf.watches {
+		d.Backends[wp.Backend] = append(d.Backends[wp.Backend], wp)
+		updateEntries(conf, d, wp, []*consulapi.ServiceEntry{
+			&consulapi.ServiceEntry{
+				Node:    &consulapi.Node{Node: "node1", Address: "127.0.0.1"},
+				Service: &consulapi.AgentService{ID: "app", Service: "app", Port: 8000 + idx},
+			},
+		}, nil)
+	}
+	if forceRefresh(conf, d) {
+		t.Fatalf("unexpected exit")
+	}
+
+	// And replayed to its own watch
+	replayed := &fakeApplier{}
+	conf = newConf(replayed)
+	conf.ReplayPath = snapPath
+	if err := replaySnapshot(conf); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	out := replayed.rendered["config_out"]
+	if !bytes.Equal(out, recorded.rendered["config_out"]) {
+		t.Fatalf("bad: %s %s", out, recorded.rendered["config_out"])
+	}
+	if !bytes.Contains(out, []byte("127.0.0.1:8000")) || !bytes.Contains(out, []byte("127.0.0.1:8001")) {
+		t.Fatalf("bad: %s", out)
+	}
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"time"
+)
+
+// staleCheckInterval is how often the watches with a maximum
+// data age are checked for stale data
+const staleCheckInterval = 10 * time.Second
+
+// hasMaxDataAge returns if any watch has a maximum data age
+func hasMaxDataAge(conf *Config) bool {
+	for _, watch := range conf.watches {
+		if watch.MaxDataAge > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// checkStale is used to flag the watches that have not returned
+// within their maximum data age, such as when a blocking query is
+// stuck without failing. A watch that has not returned yet is left
+// to the readiness check. The flag is cleared by the next response.
+func checkStale(conf *Config, data *backendData, now time.Time) {
+	data.Lock()
+	defer data.Unlock()
+	for _, watch := range conf.watches {
+		if watch.MaxDataAge == 0 {
+			continue
+		}
+		stats, ok := data.Stats[watch]
+		if !ok || stats.LastResponse.IsZero() || stats.Stale {
+			continue
+		}
+		if now.Sub(stats.LastResponse) > watch.MaxDataAge {
+			stats.Stale = true
+			log.Printf("[WARN] No update from %v in over %v, its data may be stale",
+				watch, watch.MaxDataAge)
+		}
+	}
+}
+
+// staleWatch returns the first stale watch, or nothing if there is none
+func staleWatch(conf *Config, data *backendData) string {
+	data.Lock()
+	defer data.Unlock()
+	for _, watch := range conf.watches {
+		if stats, ok := data.Stats[watch]; ok && stats.Stale {
+			return fmt.Sprintf("watch %v has not updated in over %v", watch, watch.MaxDataAge)
+		}
+	}
+	return ""
+}
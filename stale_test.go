@@ -0,0 +1,63 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/armon/consul-api"
+)
+
+func TestCheckStale(t *testing.T) {
+	wp1 := &WatchPath{Spec: "app=app?max_age=5m", Backend: "app", MaxDataAge: 5 * time.Minute}
+	wp2 := &WatchPath{Spec: "db=db", Backend: "db"}
+	d := &backendData{
+		Servers: make(map[*WatchPath][]*consulapi.ServiceEntry),
+		Backends: map[string][]*WatchPath{
+			"app": []*WatchPath{wp1},
+			"db":  []*WatchPath{wp2},
+		},
+		ChangeCh: make(chan struct{}, 1),
+	}
+	conf := &Config{watches: []*WatchPath{wp1, wp2}}
+	if !hasMaxDataAge(conf) {
+		t.Fatalf("bad")
+	}
+	en := &consulapi.ServiceEntry{
+		Node:    &consulapi.Node{Node: "node1", Address: "127.0.0.1"},
+		Service: &consulapi.AgentService{ID: "app", Port: 8000},
+	}
+	updateEntries(conf, d, wp1, []*consulapi.ServiceEntry{en}, nil)
+	updateEntries(conf, d, wp2, nil, nil)
+
+	// Within the maximum age
+	checkStale(conf, d, time.Now().Add(time.Minute))
+	if reason := notReady(conf, d); reason != "" {
+		t.Fatalf("bad: %s", reason)
+	}
+
+	// Exceeding the maximum age flags the watch
+	checkStale(conf, d, time.Now().Add(10*time.Minute))
+	if !d.Stats[wp1].Stale || d.Stats[wp2].Stale {
+		t.Fatalf("bad: %v %v", d.Stats[wp1], d.Stats[wp2])
+	}
+	if reason := notReady(conf, d); reason != "watch app=app has not updated in over 5m0s" {
+		t.Fatalf("bad: %s", reason)
+	}
+	if state := currentState(conf, d); !state["app"].Watches[0].Stale {
+		t.Fatalf("bad: %v", state["app"].Watches[0])
+	}
+
+	// A failed query does not clear the flag, but a response does
+	updateEntries(conf, d, wp1, nil, errors.New("failed"))
+	if !d.Stats[wp1].Stale {
+		t.Fatalf("bad: %v", d.Stats[wp1])
+	}
+	updateEntries(conf, d, wp1, []*consulapi.ServiceEntry{en}, nil)
+	if d.Stats[wp1].Stale {
+		t.Fatalf("bad: %v", d.Stats[wp1])
+	}
+	if reason := notReady(conf, d); reason != "" {
+		t.Fatalf("bad: %s", reason)
+	}
+}
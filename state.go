@@ -0,0 +1,203 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// backendState is the state of a backend exposed by the
+// state endpoint
+type backendState struct {
+	Servers []*ServerEntry `json:"servers"`
+	Watches []*watchState  `json:"watches"`
+
+	// Empty is set if the backend was last reported without enabled
+	// servers, and EmptyTransitions counts the reported transitions
+	Empty            bool   `json:"empty"`
+	EmptyTransitions uint64 `json:"empty_transitions"`
+
+	// LastReload is whether the last refresh or reload reloaded
+	// HAProxy, or why not. It is the same for every backend.
+	LastReload string `json:"last_reload"`
+}
+
+// watchState is the state of a single watch exposed by
+// the state endpoint
+type watchState struct {
+	Spec       string            `json:"spec"`
+	Labels     map[string]string `json:"labels,omitempty"`
+	Changed    uint64            `json:"changed"`
+	Unchanged  uint64            `json:"unchanged"`
+	Failures   uint64            `json:"failures"`
+	Added      uint64            `json:"added"`
+	Removed    uint64            `json:"removed"`
+	LastUpdate time.Time         `json:"last_update"`
+
+	// LastResponse is when the watch last returned, and Stale is set
+	// while that is longer ago than its maximum age
+	LastResponse time.Time `json:"last_response"`
+	Stale        bool      `json:"stale"`
+
+	// The details of the last successful blocking query
+	LastQuery   time.Time `json:"last_query"`
+	LastIndex   uint64    `json:"last_index"`
+	RequestTime string    `json:"request_time"`
+}
+
+// serveState is used to serve the state endpoint on the state
+// address. The returned listener is closed to stop serving.
+func serveState(conf *Config, data *backendData) (net.Listener, error) {
+	ln, err := net.Listen("tcp", conf.StateAddr)
+	if err != nil {
+		return nil, err
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/state", stateHandler(conf, data))
+	mux.Handle("/readyz", readyHandler(conf, data))
+	mux.Handle("/pause", pauseHandler(conf, true))
+	mux.Handle("/resume", pauseHandler(conf, false))
+	go http.Serve(ln, mux)
+	log.Printf("[INFO] Serving state on http://%s/state", ln.Addr())
+	return ln, nil
+}
+
+// stateHandler returns the handler dumping the current state
+// of each backend as JSON
+func stateHandler(conf *Config, data *backendData) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != "GET" {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(currentState(conf, data)); err != nil {
+			log.Printf("[ERR] Failed to encode state: %v", err)
+		}
+	})
+}
+
+// readyHandler returns the handler reporting if the backends are
+// ready, for readiness checks. It responds with a 503 and the reason
+// if they are not.
+func readyHandler(conf *Config, data *backendData) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != "GET" {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		if reason := notReady(conf, data); reason != "" {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			fmt.Fprintln(w, reason)
+			return
+		}
+		fmt.Fprintln(w, "ready")
+	})
+}
+
+// notReady returns why the backends are not ready, or nothing if
+// they are. All the watches must have returned, none may be stale or
+// failing until the ACLs or configuration are fixed, the reloads must
+// not be failing past the threshold, and each backend with a minimum
+// must have at least that many enabled servers.
+func notReady(conf *Config, data *backendData) string {
+	if !allWatchesReturned(conf, data) {
+		return "waiting for all watches to return"
+	}
+	if reason := staleWatch(conf, data); reason != "" {
+		return reason
+	}
+	if reason := deniedWatch(conf, data); reason != "" {
+		return reason
+	}
+	if reason := failingReloads(conf, data); reason != "" {
+		return reason
+	}
+	return belowMinimum(conf.MinHealthy, formatOutput(aggregateServers(conf, data)))
+}
+
+// deniedWatch returns the first watch failing with an error that
+// needs the ACLs or configuration fixed, or nothing if there is none
+func deniedWatch(conf *Config, data *backendData) string {
+	data.Lock()
+	defer data.Unlock()
+	for _, watch := range conf.watches {
+		if class := classifyError(data.LastErrors[watch]); class != errNone && class != errTransient {
+			return fmt.Sprintf("watch %v is failing, %s", watch, class)
+		}
+	}
+	return ""
+}
+
+// failingReloads returns why the reloads are failing if at least
+// the reload failure threshold failed in a row, or nothing if not
+func failingReloads(conf *Config, data *backendData) string {
+	data.Lock()
+	defer data.Unlock()
+	if conf.ReloadFailureThreshold == 0 || data.reloadFailures < conf.ReloadFailureThreshold {
+		return ""
+	}
+	return fmt.Sprintf("%d reloads failed in a row", data.reloadFailures)
+}
+
+// belowMinimum returns the first backend, by name, with fewer
+// enabled servers than its minimum, or nothing if there is none
+func belowMinimum(mins map[string]int, servers map[string][]*ServerEntry) string {
+	backends := make([]string, 0, len(mins))
+	for backend := range mins {
+		backends = append(backends, backend)
+	}
+	sort.Strings(backends)
+	for _, backend := range backends {
+		enabled := enabledServers(servers[backend])
+		if min := mins[backend]; enabled < min {
+			return fmt.Sprintf("backend %s has %d of at least %d servers", backend, enabled, min)
+		}
+	}
+	return ""
+}
+
+// currentState is used to snapshot the state of each backend
+func currentState(conf *Config, data *backendData) map[string]*backendState {
+	servers := formatOutput(aggregateServers(conf, data))
+
+	data.Lock()
+	defer data.Unlock()
+	out := make(map[string]*backendState)
+	for backend, watches := range data.Backends {
+		state := &backendState{
+			Servers:    servers[backend],
+			Watches:    make([]*watchState, 0, len(watches)),
+			LastReload: data.lastReload,
+		}
+		if empty, ok := data.empties[backend]; ok {
+			state.Empty = empty.empty
+			state.EmptyTransitions = empty.transitions
+		}
+		for _, watch := range watches {
+			ws := &watchState{Spec: watch.Spec, Labels: watch.Labels}
+			if stats, ok := data.Stats[watch]; ok {
+				ws.Changed = stats.Changed
+				ws.Unchanged = stats.Unchanged
+				ws.Failures = stats.Failures
+				ws.Added = stats.Added
+				ws.Removed = stats.Removed
+				ws.LastUpdate = stats.LastUpdate
+				ws.LastResponse = stats.LastResponse
+				ws.Stale = stats.Stale
+				ws.LastQuery = stats.LastQuery
+				ws.LastIndex = stats.LastIndex
+				ws.RequestTime = stats.RequestTime.String()
+			}
+			state.Watches = append(state.Watches, ws)
+		}
+		out[backend] = state
+	}
+	return out
+}
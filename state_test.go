@@ -0,0 +1,197 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/armon/consul-api"
+)
+
+func TestServeState(t *testing.T) {
+	wp1 := &WatchPath{Spec: "app=app?label=team:web", Backend: "app",
+		Labels: map[string]string{"team": "web"}}
+	wp2 := &WatchPath{Spec: "db=db", Backend: "db"}
+	d := &backendData{
+		Servers: make(map[*WatchPath][]*consulapi.ServiceEntry),
+		Backends: map[string][]*WatchPath{
+			"app": []*WatchPath{wp1},
+			"db":  []*WatchPath{wp2},
+		},
+		ChangeCh: make(chan struct{}, 1),
+	}
+	conf := &Config{
+		watches:   []*WatchPath{wp1, wp2},
+		Templates: []string{"test-fixtures/simple.conf"},
+		Paths:     []string{"config_out"},
+		StateAddr: "127.0.0.1:0",
+		Applier:   &fakeApplier{},
+	}
+
+	en1 := &consulapi.ServiceEntry{
+		Node:    &consulapi.Node{Node: "node1", Address: "127.0.0.1"},
+		Service: &consulapi.AgentService{ID: "app", Port: 8000},
+	}
+	recordQuery(d, wp1, &consulapi.QueryMeta{LastIndex: 42, RequestTime: 5 * time.Millisecond})
+	updateEntries(conf, d, wp1, []*consulapi.ServiceEntry{en1}, nil)
+	updateEntries(conf, d, wp2, nil, errors.New("failed"))
+	if forceRefresh(conf, d) {
+		t.Fatalf("unexpected exit")
+	}
+
+	ln, err := serveState(conf, d)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer ln.Close()
+
+	resp, err := http.Get("http://" + ln.Addr().String() + "/state")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		t.Fatalf("bad: %v", resp.StatusCode)
+	}
+
+	var state map[string]*backendState
+	if err := json.NewDecoder(resp.Body).Decode(&state); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(state) != 2 {
+		t.Fatalf("bad: %v", state)
+	}
+
+	app := state["app"]
+	if len(app.Servers) != 1 || app.Servers[0].Node != "node1" || app.Servers[0].Port != 8000 {
+		t.Fatalf("bad: %v", app.Servers)
+	}
+	if len(app.Watches) != 1 || app.Watches[0].Spec != "app=app?label=team:web" || app.Watches[0].Changed != 1 {
+		t.Fatalf("bad: %v", app.Watches)
+	}
+	if !reflect.DeepEqual(app.Watches[0].Labels, map[string]string{"team": "web"}) {
+		t.Fatalf("bad: %v", app.Watches[0].Labels)
+	}
+	if app.Watches[0].LastUpdate.IsZero() {
+		t.Fatalf("missing last update")
+	}
+	if app.Watches[0].LastIndex != 42 || app.Watches[0].RequestTime != "5ms" {
+		t.Fatalf("bad: %v", app.Watches[0])
+	}
+
+	db := state["db"]
+	if len(db.Servers) != 0 {
+		t.Fatalf("bad: %v", db.Servers)
+	}
+	if len(db.Watches) != 1 || db.Watches[0].Failures != 1 {
+		t.Fatalf("bad: %v", db.Watches)
+	}
+}
+
+func TestServeState_Ready(t *testing.T) {
+	wp1 := &WatchPath{Spec: "app=app", Backend: "app"}
+	wp2 := &WatchPath{Spec: "db=db", Backend: "db"}
+	d := &backendData{
+		Servers: make(map[*WatchPath][]*consulapi.ServiceEntry),
+		Backends: map[string][]*WatchPath{
+			"app": []*WatchPath{wp1},
+			"db":  []*WatchPath{wp2},
+		},
+		ChangeCh: make(chan struct{}, 1),
+	}
+	conf := &Config{
+		watches:    []*WatchPath{wp1, wp2},
+		StateAddr:  "127.0.0.1:0",
+		MinHealthy: map[string]int{"app": 2},
+	}
+
+	ln, err := serveState(conf, d)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer ln.Close()
+	ready := func() bool {
+		resp, err := http.Get("http://" + ln.Addr().String() + "/readyz")
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode == 200
+	}
+
+	entry := func(node string) *consulapi.ServiceEntry {
+		return &consulapi.ServiceEntry{
+			Node:    &consulapi.Node{Node: node, Address: "127.0.0.1"},
+			Service: &consulapi.AgentService{ID: "app", Port: 8000},
+		}
+	}
+
+	// Not ready until all the watches return
+	updateEntries(conf, d, wp1, []*consulapi.ServiceEntry{entry("node1")}, nil)
+	if ready() {
+		t.Fatalf("unexpected ready")
+	}
+
+	// Not ready until the critical backend has enough servers
+	updateEntries(conf, d, wp2, nil, nil)
+	if ready() {
+		t.Fatalf("unexpected ready")
+	}
+	updateEntries(conf, d, wp1, []*consulapi.ServiceEntry{entry("node1"), entry("node2")}, nil)
+	if !ready() {
+		t.Fatalf("expected ready")
+	}
+}
+
+func TestNotReady_ReloadFailures(t *testing.T) {
+	dir, err := ioutil.TempDir("", "consul-haproxy")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	wp := &WatchPath{Spec: "app=app", Backend: "app"}
+	d := &backendData{
+		Servers:  make(map[*WatchPath][]*consulapi.ServiceEntry),
+		Backends: map[string][]*WatchPath{"app": []*WatchPath{wp}},
+		ChangeCh: make(chan struct{}, 1),
+		ErrCh:    make(chan error, errChSize),
+	}
+	conf := &Config{
+		watches:                []*WatchPath{wp},
+		Templates:              []string{"test-fixtures/simple.conf"},
+		Paths:                  []string{filepath.Join(dir, "config_out")},
+		ReloadFailureThreshold: 2,
+	}
+	updateEntries(conf, d, wp, nil, nil)
+
+	cases := []struct {
+		command string
+		reason  string
+	}{
+		// A single failure keeps the readiness
+		{"false", ""},
+		{"true", ""},
+		{"false", ""},
+
+		// Repeated failures flip it, until a reload succeeds
+		{"false", "2 reloads failed in a row"},
+		{"false", "3 reloads failed in a row"},
+		{"true", ""},
+	}
+	for _, c := range cases {
+		conf.ReloadCommand = c.command
+		if forceRefresh(conf, d) {
+			t.Fatalf("unexpected exit")
+		}
+		if reason := notReady(conf, d); reason != c.reason {
+			t.Fatalf("bad: %s %s", reason, c.reason)
+		}
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// defaultTemplateURLInterval is how often templates served
+	// over HTTP are fetched again
+	defaultTemplateURLInterval = time.Minute
+
+	// templateFetchTimeout limits how long fetching a template takes
+	templateFetchTimeout = 30 * time.Second
+)
+
+// isTemplateURL checks if a template is served over HTTP(S)
+// rather than read from disk
+func isTemplateURL(templatePath string) bool {
+	return strings.HasPrefix(templatePath, "http://") ||
+		strings.HasPrefix(templatePath, "https://")
+}
+
+// fetchedTemplate is the last good contents of a template
+// served over HTTP, and its ETag to fetch it conditionally
+type fetchedTemplate struct {
+	raw  []byte
+	etag string
+}
+
+// templateURLs holds the templates fetched from each URL
+type templateURLs struct {
+	sync.Mutex
+	fetched map[string]*fetchedTemplate
+}
+
+// get returns the last good contents of a URL, if it was fetched
+func (u *templateURLs) get(url string) ([]byte, bool) {
+	u.Lock()
+	defer u.Unlock()
+	last, ok := u.fetched[url]
+	if !ok {
+		return nil, false
+	}
+	return last.raw, true
+}
+
+// fetchTemplateURL is used to fetch the template served at a URL.
+// The previous contents are kept if the fetch fails, or the server
+// responds that they are not modified. Returns if they changed.
+func fetchTemplateURL(conf *Config, url string) (bool, error) {
+	if conf.templateURLs == nil {
+		conf.templateURLs = &templateURLs{fetched: make(map[string]*fetchedTemplate)}
+	}
+	urls := conf.templateURLs
+
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return false, err
+	}
+	urls.Lock()
+	last, ok := urls.fetched[url]
+	urls.Unlock()
+	if ok && last.etag != "" {
+		req.Header.Set("If-None-Match", last.etag)
+	}
+
+	client := &http.Client{Timeout: templateFetchTimeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotModified && ok {
+		return false, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("Unexpected response code: %d", resp.StatusCode)
+	}
+	raw, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return false, err
+	}
+
+	urls.Lock()
+	defer urls.Unlock()
+	urls.fetched[url] = &fetchedTemplate{raw: raw, etag: resp.Header.Get("ETag")}
+	return !ok || !bytes.Equal(last.raw, raw), nil
+}
+
+// readTemplateURL returns the last good contents of a template
+// served over HTTP, fetching it if it has not been yet
+func readTemplateURL(conf *Config, url string) ([]byte, error) {
+	if conf.templateURLs != nil {
+		if raw, ok := conf.templateURLs.get(url); ok {
+			return raw, nil
+		}
+	}
+	if _, err := fetchTemplateURL(conf, url); err != nil {
+		return nil, fmt.Errorf("Failed to fetch template: %v", err)
+	}
+	raw, _ := conf.templateURLs.get(url)
+	return raw, nil
+}
+
+// watchTemplateURL is used to fetch a template served over HTTP
+// every interval, refreshing every backend when it changes. If a
+// fetch fails, the last good template keeps being used.
+func watchTemplateURL(conf *Config, data *backendData, url string) {
+	for {
+		select {
+		case <-time.After(conf.TemplateURLInterval):
+		case <-data.StopCh:
+			return
+		}
+		changed, err := fetchTemplateURL(conf, url)
+		if err != nil {
+			log.Printf("[WARN] Failed to fetch template %s, using the last good template: %v", url, err)
+			continue
+		}
+		if !changed {
+			continue
+		}
+		log.Printf("[INFO] Template %s was updated", url)
+		markAllChanged(data)
+		asyncNotify(data.ChangeCh)
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/armon/consul-api"
+)
+
+func TestBuildTemplate_URL(t *testing.T) {
+	var l sync.Mutex
+	body, etag, status, served := "{{range .app}}{{.}}\n{{end}}", `"v1"`, 200, 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		l.Lock()
+		defer l.Unlock()
+		if status != 200 {
+			w.WriteHeader(status)
+			return
+		}
+		w.Header().Set("ETag", etag)
+		if r.Header.Get("If-None-Match") == etag {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		served++
+		w.Write([]byte(body))
+	}))
+	defer srv.Close()
+	templateURL := srv.URL + "/app.tmpl"
+
+	conf := &Config{
+		DryRun:    true,
+		Templates: []string{templateURL},
+		Backends:  []string{"app=app"},
+	}
+	if errs := validateConfig(conf); len(errs) > 0 {
+		t.Fatalf("err: %v", errs)
+	}
+	servers := map[string][]*backendEntry{
+		"app": []*backendEntry{
+			&backendEntry{ServiceEntry: &consulapi.ServiceEntry{
+				Node:    &consulapi.Node{Node: "node1", Address: "127.0.0.1"},
+				Service: &consulapi.AgentService{ID: "app", Port: 8000},
+			}},
+		},
+	}
+	render := func(expect string) {
+		out, err := buildTemplate(conf, templateURL, servers, false)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if !bytes.Equal(out, []byte(expect)) {
+			t.Fatalf("bad: %s", out)
+		}
+	}
+
+	// The template is fetched on the first render
+	render("server node1_app 127.0.0.1:8000\n")
+
+	// It is cached, and not fetched again if not modified
+	render("server node1_app 127.0.0.1:8000\n")
+	if changed, err := fetchTemplateURL(conf, templateURL); err != nil || changed {
+		t.Fatalf("bad: %v %v", changed, err)
+	}
+	if served != 1 {
+		t.Fatalf("bad: %d", served)
+	}
+
+	// A change is picked up by the next fetch
+	l.Lock()
+	body, etag = "{{range .app}}{{.}} check\n{{end}}", `"v2"`
+	l.Unlock()
+	if changed, err := fetchTemplateURL(conf, templateURL); err != nil || !changed {
+		t.Fatalf("bad: %v %v", changed, err)
+	}
+	render("server node1_app 127.0.0.1:8000 check\n")
+
+	// A failed fetch keeps the last good template
+	l.Lock()
+	status = 500
+	l.Unlock()
+	if _, err := fetchTemplateURL(conf, templateURL); err == nil {
+		t.Fatalf("expected error")
+	}
+	render("server node1_app 127.0.0.1:8000 check\n")
+}
+
+func TestReadTemplateURL_Unavailable(t *testing.T) {
+	srv := httptest.NewServer(http.NotFoundHandler())
+	defer srv.Close()
+
+	if _, err := readTemplateURL(&Config{}, srv.URL+"/app.tmpl"); err == nil {
+		t.Fatalf("expected error")
+	}
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+// timeoutTransport abandons each request to Consul once it outlasts
+// the wait time of its blocking query, given by the wait parameter,
+// plus a margin. Otherwise a connection whose packets are dropped
+// hangs the watch until the operating system gives up on it.
+type timeoutTransport struct {
+	base   http.RoundTripper
+	margin time.Duration
+}
+
+func (t *timeoutTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	timeout := t.margin
+	if wait, err := time.ParseDuration(req.URL.Query().Get("wait")); err == nil {
+		timeout += wait
+	}
+	base := t.base
+	if base == nil {
+		base = http.DefaultTransport
+	}
+
+	ctx, cancel := context.WithTimeout(req.Context(), timeout)
+	resp, err := base.RoundTrip(req.WithContext(ctx))
+	if err != nil {
+		cancel()
+		if ctx.Err() == context.DeadlineExceeded {
+			return nil, fmt.Errorf("Request abandoned after %v: %v", timeout, err)
+		}
+		return nil, err
+	}
+
+	// The deadline also covers reading the body
+	resp.Body = &cancelBody{ReadCloser: resp.Body, cancel: cancel}
+	return resp, nil
+}
+
+// cancelBody releases the deadline of a request once
+// its response body is closed
+type cancelBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b *cancelBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
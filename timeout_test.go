@@ -0,0 +1,59 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/armon/consul-api"
+)
+
+func TestTimeoutTransport(t *testing.T) {
+	var requests int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// The first request hangs, as if its packets were dropped
+		if atomic.AddInt32(&requests, 1) == 1 {
+			select {
+			case <-r.Context().Done():
+			case <-time.After(5 * time.Second):
+			}
+			return
+		}
+		w.Header().Set("X-Consul-Index", "7")
+		w.Write([]byte(`{"web": [{"SourceName": "api", "DestinationName": "web", "Action": "allow"}]}`))
+	}))
+	defer srv.Close()
+
+	consulConf, err := consulConfig(&Config{
+		Address:            srv.Listener.Addr().String(),
+		QueryTimeoutMargin: 50 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	opts := &consulapi.QueryOptions{WaitIndex: 5, WaitTime: 50 * time.Millisecond}
+
+	// The hanging request is abandoned after the wait time and margin
+	start := time.Now()
+	_, _, err = connectIntentions(consulConf, "web", opts)
+	if err == nil {
+		t.Fatalf("expected error")
+	}
+	if elapsed := time.Since(start); elapsed < 100*time.Millisecond || elapsed > 2*time.Second {
+		t.Fatalf("bad: %v", elapsed)
+	}
+	if classifyError(err) != errTransient {
+		t.Fatalf("bad: %v", err)
+	}
+
+	// So the retry succeeds
+	intentions, qm, err := connectIntentions(consulConf, "web", opts)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(intentions) != 1 || intentions[0].SourceName != "api" || qm.LastIndex != 7 {
+		t.Fatalf("bad: %v %v", intentions, qm)
+	}
+}
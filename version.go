@@ -0,0 +1,59 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// proxyProtocolVersion is the first HAProxy version supporting
+// the PROXY protocol on server lines
+var proxyProtocolVersion = &haproxyVersion{Major: 1, Minor: 5}
+
+// initAddrVersion is the first HAProxy version supporting
+// the init-addr server option
+var initAddrVersion = &haproxyVersion{Major: 1, Minor: 7}
+
+// serverTemplateVersion is the first HAProxy version supporting
+// the server-template directive
+var serverTemplateVersion = &haproxyVersion{Major: 1, Minor: 8}
+
+// haproxyVersion is the major and minor version of HAProxy
+type haproxyVersion struct {
+	Major int
+	Minor int
+}
+
+// parseHAProxyVersion is used to parse a version such as "1.8"
+// or "2.4.1". Anything after the minor version is ignored.
+func parseHAProxyVersion(raw string) (*haproxyVersion, error) {
+	parts := strings.SplitN(raw, ".", 3)
+	if len(parts) < 2 {
+		return nil, fmt.Errorf("Invalid HAProxy version '%s': must be major.minor", raw)
+	}
+	major, err := strconv.Atoi(parts[0])
+	if err != nil || major < 0 {
+		return nil, fmt.Errorf("Invalid HAProxy version '%s': bad major version", raw)
+	}
+	minor, err := strconv.Atoi(parts[1])
+	if err != nil || minor < 0 {
+		return nil, fmt.Errorf("Invalid HAProxy version '%s': bad minor version", raw)
+	}
+	return &haproxyVersion{Major: major, Minor: minor}, nil
+}
+
+// atLeast checks if the version is the same or newer than another.
+// A nil version is unknown, and assumed to be the latest.
+func (v *haproxyVersion) atLeast(other *haproxyVersion) bool {
+	if v == nil {
+		return true
+	}
+	if v.Major != other.Major {
+		return v.Major > other.Major
+	}
+	return v.Minor >= other.Minor
+}
+
+func (v *haproxyVersion) String() string {
+	return fmt.Sprintf("%d.%d", v.Major, v.Minor)
+}
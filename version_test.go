@@ -0,0 +1,40 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestParseHAProxyVersion(t *testing.T) {
+	v, err := parseHAProxyVersion("2.4.1")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if v.Major != 2 || v.Minor != 4 {
+		t.Fatalf("bad: %v", v)
+	}
+
+	for _, raw := range []string{"", "2", "x.4", "2.y", "-1.5"} {
+		if _, err := parseHAProxyVersion(raw); err == nil {
+			t.Fatalf("expected error: %s", raw)
+		}
+	}
+}
+
+func TestHAProxyVersion_AtLeast(t *testing.T) {
+	cases := []struct {
+		v      *haproxyVersion
+		expect bool
+	}{
+		{nil, true},
+		{&haproxyVersion{Major: 1, Minor: 4}, false},
+		{&haproxyVersion{Major: 1, Minor: 5}, true},
+		{&haproxyVersion{Major: 1, Minor: 8}, true},
+		{&haproxyVersion{Major: 2, Minor: 0}, true},
+		{&haproxyVersion{Major: 0, Minor: 9}, false},
+	}
+	for _, c := range cases {
+		if c.v.atLeast(proxyProtocolVersion) != c.expect {
+			t.Fatalf("bad: %v", c.v)
+		}
+	}
+}
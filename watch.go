@@ -2,15 +2,25 @@ package main
 
 import (
 	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"hash/fnv"
 	"io/ioutil"
 	"log"
 	"math"
+	"math/rand"
 	"net"
+	"net/http"
 	"os"
 	"os/exec"
-	"reflect"
+	"path"
 	"runtime"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
 	"text/template"
 	"time"
@@ -26,16 +36,111 @@ const (
 	// before we limit the sleep value
 	maxFailures = 5
 
+	// deniedSleep controls how long to sleep on a failure that
+	// needs the ACLs or configuration fixed, such as a permission
+	// denied, before trying again
+	deniedSleep = 5 * time.Minute
+
 	// waitTime is used to control how long we do a blocking
 	// query for
 	waitTime = 60 * time.Second
+
+	// defaultQueryTimeoutMargin is how long a query may outlast its
+	// wait time before it is abandoned. Consul adds up to 1/16th of
+	// the wait time as jitter to blocking queries.
+	defaultQueryTimeoutMargin = 10 * time.Second
+
+	// defaultInitAddr is the init-addr policy of servers resolved
+	// with a resolvers section, so HAProxy starts even if their
+	// hostnames do not resolve yet
+	defaultInitAddr = "none"
+
+	// defaultPlaceholderAddress is the address of the placeholder
+	// server emitted for empty backends
+	defaultPlaceholderAddress = "127.0.0.1:1"
+
+	// defaultServerWeight is the full weight of a server scaled by
+	// its passing checks, if it has no weight tag
+	defaultServerWeight = 100
+
+	// maxServerWeight is the highest weight HAProxy accepts
+	maxServerWeight = 256
+
+	// placeholderName is the name of the placeholder server
+	placeholderName = "PLACEHOLDER"
+
+	// datacenterPlaceholder is replaced by the datacenter in the
+	// output paths when rendering per datacenter
+	datacenterPlaceholder = "{{.Datacenter}}"
+
+	// consulDomain is the domain of the Consul DNS interface
+	consulDomain = "consul"
+
+	// localDatacenter is the name used for the datacenter of
+	// watches that do not specify one
+	localDatacenter = "local"
+
+	// onAllErrorsKeep and onAllErrorsEmpty are how a backend is
+	// rendered when every watch feeding it is failing: with the
+	// last entries of the watches, or without servers
+	onAllErrorsKeep  = "keep"
+	onAllErrorsEmpty = "empty"
+
+	// backendOrderName and backendOrderConfig are the orders the
+	// backends function returns the backends in: by name, or in
+	// the order they are configured
+	backendOrderName   = "name"
+	backendOrderConfig = "config"
+
+	// duplicateMerge, duplicateError and duplicateLastWins are how
+	// watches of the same service in the same backend are handled:
+	// all are kept, they are an error, or only the last is kept
+	duplicateMerge    = "merge"
+	duplicateError    = "error"
+	duplicateLastWins = "last-wins"
+
+	// reloadReloaded is the decision recorded when a refresh reloads,
+	// and skipNoCommand, skipOutsideWindows and skipPaused are why
+	// it may not
+	reloadReloaded     = "reloaded"
+	skipNoCommand      = "no reload command configured"
+	skipOutsideWindows = "outside of the maintenance windows, deferring reload"
+	skipPaused         = "writes and reloads are paused"
+
+	// errChSize is the number of errors buffered for the
+	// caller of watch
+	errChSize = 16
+
+	// templateReadAttempts is how many times reading a template
+	// is attempted, waiting templateReadRetry between attempts
+	templateReadAttempts = 3
+	templateReadRetry    = 100 * time.Millisecond
+
+	// defaultInitialRenderTimeout is how long we wait on start
+	// for the initial render
+	defaultInitialRenderTimeout = 30 * time.Second
+
+	// defaultCanaryInterval is the default time between admitting
+	// new servers when rolling them out gradually
+	defaultCanaryInterval = 30 * time.Second
+
+	// defaultWatchFilesInterval is the default time between
+	// checking the watched files for changes
+	defaultWatchFilesInterval = 5 * time.Second
+
+	// defaultShutdownTimeout is how long we wait on shutdown
+	// for the final render
+	defaultShutdownTimeout = 10 * time.Second
 )
 
 type backendData struct {
 	sync.Mutex
 
-	// Client is a shared Consul client
-	Client *consulapi.Client
+	// KV is used to write the configuration to keys
+	KV kvClient
+
+	// Querier is used to query the instances of a service
+	Querier ServiceQuerier
 
 	// Servers maps each watch path to a list of entries
 	Servers map[*WatchPath][]*consulapi.ServiceEntry
@@ -50,63 +155,323 @@ type backendData struct {
 	// StopCh is used to trigger a stop
 	StopCh chan struct{}
 
+	// ErrCh is used to report non-transient errors
+	ErrCh chan error
+
+	// FatalCh is used by a watch to stop watching, exiting
+	// the process, once it exhausts its failures
+	FatalCh chan struct{}
+
+	// Stats tracks how often each watch returns changed data
+	Stats map[*WatchPath]*watchStats
+
+	// LastErrors maps each watch path whose last query failed
+	// to the error, and is cleared once a query succeeds
+	LastErrors map[*WatchPath]error
+
+	// Hashes maps each watch path to the hash of its entries,
+	// used to detect changes that affect the output
+	Hashes map[*WatchPath]uint64
+
+	// Changed is the set of backends that have changed
+	// since the configuration was last applied
+	Changed map[string]bool
+
+	// FirstSeen tracks when each instance of a watch was first seen,
+	// by its instanceKey, to apply the warmup delay. Instances returned
+	// by the first successful query of a watch have a zero time, so
+	// are not delayed.
+	FirstSeen map[*WatchPath]map[string]time.Time
+
+	// details is the detail of the entries of each watch, by their
+	// instanceKey. queried holds the detail of the last query, until
+	// its entries are stored by updateEntries.
+	details map[*WatchPath]instanceDetails
+	queried map[*WatchPath]instanceDetails
+
+	// rendered is set once the first render has happened
+	rendered bool
+
+	// applied is set once a render has been applied successfully
+	applied bool
+
 	// quietTimer is used to wati for quiescence
 	quietTimer <-chan time.Time
 
 	// maxWaitTimer is used to prevent unbounded waiting
 	// for quiescence
 	maxWaitTimer <-chan time.Time
+
+	// warmupTimer fires when the next warming server is ready,
+	// and warming is the set of backends with warming servers
+	warmupTimer <-chan time.Time
+	warming     map[string]bool
+
+	// admitted is the set of instances admitted to each backend
+	// when rolling out new servers gradually. canaryTimer fires
+	// to admit more of them, and canary is the set of backends
+	// with servers still held back.
+	admitted    map[string]map[string]bool
+	canaryTimer <-chan time.Time
+	canary      map[string]bool
+
+	// drainNames is the set of server names of each backend as of
+	// the last reload, to find the servers to drain, and appliedNames
+	// as of the last applied configuration, which a reload outside of
+	// a refresh loads
+	drainNames   map[string]map[string]bool
+	appliedNames map[string]map[string]bool
+
+	// windowTimer fires when the next maintenance window
+	// opens, if a reload has been deferred until then
+	windowTimer <-chan time.Time
+
+	// fileTimer fires to check the watched files for changes,
+	// and fileStamps are their stamps as of the last check
+	fileTimer  <-chan time.Time
+	fileStamps map[string]fileStamp
+
+	// staleTimer fires to check the watches for stale data
+	staleTimer <-chan time.Time
+
+	// empties tracks if each backend is empty, and emptyTimer
+	// fires to check again while a transition is pending
+	empties    map[string]*emptyState
+	emptyTimer <-chan time.Time
+
+	// reloadedServers is the server line of each server, by backend
+	// and name, as of the last reload. It is nil until the first.
+	reloadedServers map[string]string
+
+	// reloadFailures counts the consecutive failed reloads
+	reloadFailures int
+
+	// lastReload records whether the last refresh or reload reloaded
+	// HAProxy, or why not, for debugging
+	lastReload string
+}
+
+// RefreshError is a non-transient error encountered while
+// refreshing the configuration, which is reported to the
+// caller of watch.
+type RefreshError struct {
+	// Stage is the failing step, one of "query", "render", "write",
+	// "validate", "kv", "reload" or "apply"
+	Stage string
+
+	// Path is the template or configuration path, if any
+	Path string
+
+	// Err is the underlying error
+	Err error
+}
+
+func (e *RefreshError) Error() string {
+	if e.Path == "" {
+		return fmt.Sprintf("%s failed: %v", e.Stage, e.Err)
+	}
+	return fmt.Sprintf("%s of %s failed: %v", e.Stage, e.Path, e.Err)
+}
+
+// watchStats tracks the results of the queries made by a watch.
+// This shows whether the blocking queries return meaningful changes.
+type watchStats struct {
+	// Changed counts the queries that returned changed entries
+	Changed uint64
+
+	// Unchanged counts the queries where the index advanced but
+	// the entries were identical
+	Unchanged uint64
+
+	// Failures counts the queries that failed
+	Failures uint64
+
+	// Added and Removed count the instances that appeared in and
+	// disappeared from the entries. The instances returned by the
+	// first query are not counted.
+	Added   uint64
+	Removed uint64
+
+	// LastUpdate is when the entries last changed
+	LastUpdate time.Time
+
+	// LastResponse is when the watch last returned without an error,
+	// and Stale is set while that is longer ago than its MaxDataAge
+	LastResponse time.Time
+	Stale        bool
+
+	// LastQuery is when the last successful query returned, and
+	// LastIndex and RequestTime are from its QueryMeta
+	LastQuery   time.Time
+	LastIndex   uint64
+	RequestTime time.Duration
 }
 
 // watch is used to start a long running watcher to handle updates.
-// Returns a stopCh, and a finishCh.
-func watch(conf *Config) (chan struct{}, chan struct{}) {
+// Returns a stopCh, a finishCh, and an errCh on which non-transient
+// errors are reported. Errors are dropped if errCh is not drained.
+func watch(conf *Config) (chan struct{}, chan struct{}, <-chan error) {
 	stopCh := make(chan struct{})
 	finishCh := make(chan struct{})
-	go runWatch(conf, stopCh, finishCh)
-	return stopCh, finishCh
+	errCh := make(chan error, errChSize)
+	readyCh := make(chan struct{})
+	go runWatch(conf, stopCh, finishCh, readyCh, errCh)
+
+	// Wait for the initial render if requested
+	if conf.InitialRender {
+		<-readyCh
+	}
+	return stopCh, finishCh, errCh
 }
 
 // runWatch is a long running routine that watches with a
 // given configuration
-func runWatch(conf *Config, stopCh, doneCh chan struct{}) {
+func runWatch(conf *Config, stopCh, doneCh, readyCh chan struct{}, errCh chan error) {
 	defer close(doneCh)
+	ready := false
+	defer func() {
+		if !ready {
+			close(readyCh)
+		}
+	}()
 
-	// Create the consul client
-	consulConf := consulapi.DefaultConfig()
-	if conf.Address != "" {
-		consulConf.Address = conf.Address
+	// Create the consul client for each address
+	consulConfs, err := consulConfigs(conf)
+	if err != nil {
+		log.Printf("[ERR] Failed to configure consul client: %v", err)
+		return
 	}
 
-	// Attempt to contact the agent
-	client, err := consulapi.NewClient(consulConf)
+	// Attempt to contact an agent, trying the addresses in order
+	var client *consulapi.Client
+	active := 0
+	for idx, consulConf := range consulConfs {
+		client, err = consulapi.NewClient(consulConf)
+		if err != nil {
+			log.Printf("[ERR] Failed to initialize consul client: %v", err)
+			return
+		}
+		if _, err = client.Agent().NodeName(); err == nil {
+			active = idx
+			break
+		}
+		log.Printf("[ERR] Failed to contact consul agent at %s: %v", consulConf.Address, err)
+	}
 	if err != nil {
-		log.Printf("[ERR] Failed to initialize consul client: %v", err)
 		return
 	}
-	if _, err := client.Agent().NodeName(); err != nil {
-		log.Printf("[ERR] Failed to contact consul agent: %v", err)
-		return
+	if active > 0 {
+		log.Printf("[WARN] Using consul agent at %s", consulConfs[active].Address)
+	}
+	var querier ServiceQuerier = &consulQuerier{config: consulConfs[active]}
+	var kv kvClient = client.KV()
+	if len(consulConfs) > 1 {
+		f, err := newFailoverQuerier(consulConfs, active)
+		if err != nil {
+			log.Printf("[ERR] Failed to initialize consul client: %v", err)
+			return
+		}
+		querier, kv = f, f.KV()
 	}
 
 	// Create a backend store
 	data := &backendData{
-		Client:   client,
+		KV:       kv,
+		Querier:  querier,
 		Servers:  make(map[*WatchPath][]*consulapi.ServiceEntry),
 		Backends: make(map[string][]*WatchPath),
+		Stats:    make(map[*WatchPath]*watchStats),
+		Hashes:   make(map[*WatchPath]uint64),
+		Changed:  make(map[string]bool),
 		ChangeCh: make(chan struct{}, 1),
 		StopCh:   stopCh,
+		ErrCh:    errCh,
+		FatalCh:  make(chan struct{}, 1),
+	}
+
+	// Add the failover targets of any service resolvers. This is done
+	// before serving the state, which reads the watches.
+	conf.watches, err = expandResolvers(data.Querier, conf.watches)
+	if err != nil {
+		log.Printf("[ERR] Failed to read service resolvers: %v", err)
+		return
+	}
+
+	// Serve the state if requested
+	if conf.StateAddr != "" {
+		ln, err := serveState(conf, data)
+		if err != nil {
+			log.Printf("[ERR] Failed to serve state: %v", err)
+			return
+		}
+		defer ln.Close()
+	}
+
+	// Read keys for templates using the shared client
+	conf.kv = kv
+
+	// Read the information of the agent contacted on start for templates
+	if conf.agent, err = fetchAgent(client); err != nil {
+		log.Printf("[WARN] Failed to read the agent information: %v", err)
+	}
+
+	// Watch the intentions of any destinations
+	for service, index := range fetchIntentions(conf, data.Querier) {
+		go watchIntentions(conf, data, service, index)
+	}
+
+	// Source the templates and reload command from any keys
+	for key, index := range fetchKeys(conf, kv) {
+		go watchKey(conf, data, kv, key, index)
+	}
+
+	// Fetch the templates served over HTTP, and again periodically
+	for _, t := range conf.Templates {
+		if !isTemplateURL(t) {
+			continue
+		}
+		if _, err := fetchTemplateURL(conf, t); err != nil {
+			log.Printf("[WARN] Failed to fetch template %s: %v", t, err)
+		}
+		go watchTemplateURL(conf, data, t)
 	}
 
 	// Start the watches
 	data.Lock()
-	for idx, watch := range conf.watches {
+	for _, watch := range conf.watches {
 		data.Backends[watch.Backend] = append(data.Backends[watch.Backend], watch)
-		go runSingleWatch(conf, data, idx, watch)
 	}
 	data.Unlock()
+	if conf.InitialRender && !conf.DryRun {
+		if initialRender(conf, data) {
+			return
+		}
+	} else {
+		go startWatches(conf, data, func(idx int, watch *WatchPath) {
+			runSingleWatch(conf, data, idx, watch)
+		})
+	}
+	ready = true
+	close(readyCh)
+
+	// Watch any files for changes
+	if len(conf.WatchFiles) > 0 {
+		data.fileStamps = statFiles(conf.WatchFiles)
+		data.fileTimer = time.After(conf.WatchFilesInterval)
+	}
+
+	// Check for watches that stopped updating
+	if hasMaxDataAge(conf) {
+		data.staleTimer = time.After(staleCheckInterval)
+	}
 
 	// Monitor for changes or stop
+	monitor(conf, data)
+}
+
+// monitor is used to refresh the configuration on changes,
+// until a refresh is fatal or the watch is stopped
+func monitor(conf *Config, data *backendData) {
 	for {
 		select {
 		case <-data.ChangeCh:
@@ -128,10 +493,144 @@ func runWatch(conf *Config, stopCh, doneCh chan struct{}) {
 				return
 			}
 
-		case <-stopCh:
+		case <-data.warmupTimer:
+			data.warmupTimer = nil
+			markChanged(data, data.warming)
+			if forceRefresh(conf, data) {
+				return
+			}
+
+		case <-data.canaryTimer:
+			data.canaryTimer = nil
+			markChanged(data, data.canary)
+			if forceRefresh(conf, data) {
+				return
+			}
+
+		case <-data.windowTimer:
+			data.windowTimer = nil
+			deferredReload(conf, data)
+
+		case <-data.fileTimer:
+			checkFiles(conf, data)
+			data.fileTimer = time.After(conf.WatchFilesInterval)
+
+		case <-data.staleTimer:
+			checkStale(conf, data, time.Now())
+			data.staleTimer = time.After(staleCheckInterval)
+
+		case <-conf.pause.resumed():
+			if allWatchesReturned(conf, data) && forceRefresh(conf, data) {
+				return
+			}
+
+		case <-data.emptyTimer:
+			checkEmpty(conf, data, formatOutput(aggregateServers(conf, data)), time.Now())
+
+		case <-data.FatalCh:
 			return
+
+		case <-data.StopCh:
+			if conf.FinalRender {
+				finalRefresh(conf, data)
+			}
+			return
+		}
+	}
+}
+
+// finalRefresh is used to apply any pending changes when stopping,
+// ignoring the quiet period, so the configuration is left up to date
+func finalRefresh(conf *Config, data *backendData) {
+	if !allWatchesReturned(conf, data) {
+		return
+	}
+	if len(changedBackends(data)) == 0 {
+		log.Printf("[DEBUG] No pending changes on shutdown")
+		return
+	}
+	log.Printf("[INFO] Applying pending changes before shutdown")
+	forceRefresh(conf, data)
+}
+
+// consulConfig is used to build the configuration of the consul
+// client. The standard Consul environment variables are used for
+// any values that are not explicitly configured.
+func consulConfig(conf *Config) (*consulapi.Config, error) {
+	consulConf := consulapi.DefaultConfig()
+	if addr := os.Getenv("CONSUL_HTTP_ADDR"); addr != "" {
+		consulConf.Address = addr
+	}
+	if token := os.Getenv("CONSUL_HTTP_TOKEN"); token != "" {
+		consulConf.Token = token
+	}
+	ssl, noVerify := conf.SSL, conf.SSLNoVerify
+	if v := os.Getenv("CONSUL_HTTP_SSL"); v != "" && !ssl {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid CONSUL_HTTP_SSL '%s'", v)
+		}
+		ssl = b
+	}
+	if v := os.Getenv("CONSUL_HTTP_SSL_VERIFY"); v != "" && !noVerify {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid CONSUL_HTTP_SSL_VERIFY '%s'", v)
+		}
+		noVerify = !b
+	}
+
+	// Explicit configuration takes precedence
+	if conf.Address != "" {
+		consulConf.Address = conf.Address
+	}
+	if conf.Token != "" {
+		consulConf.Token = conf.Token
+	}
+	if ssl {
+		consulConf.Scheme = "https"
+	}
+
+	// Customize the transport if needed
+	var base http.RoundTripper
+	if conf.BindAddr != "" || noVerify {
+		transport := &http.Transport{
+			Proxy: http.ProxyFromEnvironment,
+		}
+		if conf.BindAddr != "" {
+			dialer, err := localDialer(conf.BindAddr)
+			if err != nil {
+				return nil, err
+			}
+			transport.DialContext = dialer.DialContext
 		}
+		if noVerify {
+			transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+		}
+		base = transport
+	}
+
+	// Abandon queries that outlast their wait time, to retry them
+	margin := conf.QueryTimeoutMargin
+	if margin == 0 {
+		margin = defaultQueryTimeoutMargin
+	}
+	consulConf.HttpClient = &http.Client{Transport: &timeoutTransport{base: base, margin: margin}}
+	return consulConf, nil
+}
+
+// localDialer returns a dialer whose connections
+// originate from the given local address
+func localDialer(addr string) (*net.Dialer, error) {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return nil, fmt.Errorf("Invalid bind address '%s'", addr)
 	}
+	return &net.Dialer{
+		LocalAddr: &net.TCPAddr{IP: ip},
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+	}, nil
 }
 
 // maybeRefresh is used to handle a potential config update
@@ -156,163 +655,1796 @@ func maybeRefresh(conf *Config, data *backendData) (exit bool) {
 // forceRefresh is used to immediately refresh
 func forceRefresh(conf *Config, data *backendData) (exit bool) {
 	// Merge the data for each backend
-	backendServers := aggregateServers(data)
-
-	// Iterate through the list of templates to render
-	for idx, templatePath := range conf.Templates {
+	backendServers := aggregateServers(conf, data)
 
-		// Build the output template
-		output, err := buildTemplate(templatePath, backendServers)
-		if err != nil {
-			log.Printf("[ERR] %v", err)
-			return true
-		}
-
-		// Check for a dry run
-		if conf.DryRun {
-			fmt.Printf("%s\n", output)
-			return true
-		}
-
-		// Write out the configuration
-		if err := ioutil.WriteFile(conf.Paths[idx], output, 0660); err != nil {
-			log.Printf("[ERR] Failed to write config file at %s: %v", conf.Paths[idx], err)
-			return true
+	// Record the entries of each watch if requested
+	if conf.RecordPath != "" {
+		if err := recordSnapshot(conf, data); err != nil {
+			log.Printf("[ERR] Failed to record snapshot: %v", err)
 		}
-		log.Printf("[INFO] Updated configuration file at %s", conf.Paths[idx])
 	}
 
-	// Invoke the reload hook
-	if err := reload(conf); err != nil {
-		log.Printf("[ERR] Failed to reload: %v", err)
-	} else {
-		log.Printf("[INFO] Completed reload")
-	}
-	return
-}
+	// Report the backends that became empty, or have servers again
+	checkEmpty(conf, data, formatOutput(backendServers), time.Now())
 
-// allWatchesReturned checks if all the watches have some
-// data registered. Prevents early template generation.
-func allWatchesReturned(conf *Config, data *backendData) bool {
-	data.Lock()
-	defer data.Unlock()
-	return len(data.Servers) >= len(conf.watches)
-}
+	// Hold back new servers beyond the canary rate
+	admitted, held := admitCanaries(conf, data, backendServers)
 
-// aggregateServers merges the watches belonging to each
-// backend together to prepare for template generation
-func aggregateServers(data *backendData) map[string][]*consulapi.ServiceEntry {
-	backendServers := make(map[string][]*consulapi.ServiceEntry)
-	data.Lock()
-	defer data.Unlock()
-	for backend, watches := range data.Backends {
-		var all []*consulapi.ServiceEntry
-		for _, watch := range watches {
-			entries := data.Servers[watch]
-			all = append(all, entries...)
+	// Check for likely misconfigurations on the first render
+	if !data.rendered {
+		data.rendered = true
+		for _, dups := range duplicateBackends(backendServers) {
+			log.Printf("[WARN] Backends %s have identical servers, check for a misconfiguration",
+				strings.Join(dups, ", "))
 		}
-		backendServers[backend] = all
 	}
-	return backendServers
-}
 
-// buildTemplate is used to build the output templates
-// from the configuration and server list
-func buildTemplate(templatePath string,
-	servers map[string][]*consulapi.ServiceEntry) ([]byte, error) {
-	// Format the output
-	outVars := formatOutput(servers)
+	// Decide if HAProxy is reloaded. While paused, the changes are
+	// held until resumed, then the latest are applied.
+	var current map[string]string
+	var skipReload string
+	if !conf.DryRun {
+		formatted := formatOutput(backendServers)
+		current = serverLines(formatted)
+		skipReload = decideReload(conf, data, formatted, current)
+		if skipReload == skipPaused {
+			log.Printf("[INFO] Writes and reloads are paused, deferring the update")
+			recordReload(data, "skipped: "+skipReload)
+			return false
+		}
+	}
 
-	// Read the template
-	raw, err := ioutil.ReadFile(templatePath)
+	// Render the templates. A failure is not fatal, since the
+	// template may be fixed. The last good configuration is kept.
+	paths, outputs, err := renderOutputs(conf, backendServers, !data.applied)
 	if err != nil {
-		return nil, fmt.Errorf("Failed to read template: %v", err)
+		log.Printf("[ERR] %v", err)
+		reportError(data.ErrCh, err)
+		if !conf.DryRun {
+			log.Printf("[WARN] Keeping the last configuration until the template is fixed")
+		}
+		return conf.DryRun
 	}
+	if conf.DryRun {
+		for _, output := range outputs {
+			fmt.Printf("%s\n", output)
+		}
 
-	// Create the template
-	templ, err := template.New("output").Parse(string(raw))
-	if err != nil {
-		return nil, fmt.Errorf("Failed to parse the template: %v", err)
+		// Validate the outputs, but never write or reload them
+		if conf.ValidateCommand != "" {
+			if err := validateDryRun(conf, outputs); err != nil {
+				log.Printf("[ERR] Dry run failed validation: %v", err)
+				reportError(data.ErrCh, err)
+			} else {
+				log.Printf("[INFO] Dry run passed validation")
+			}
+		}
+		return true
+	}
+	rendered := make(map[string][]byte, len(paths))
+	for idx, outPath := range paths {
+		rendered[outPath] = outputs[idx]
 	}
 
-	// Generate the output
-	var output bytes.Buffer
-	if err := templ.Execute(&output, outVars); err != nil {
-		return nil, fmt.Errorf("Failed to generate the template: %v", err)
+	// Write the servers to drain before the reload command runs
+	var names map[string]map[string]bool
+	if conf.DrainPath != "" {
+		formatted := formatOutput(backendServers)
+		serverOptions(conf, formatted)
+		names = serverNames(formatted)
+		writeDrain(conf, data, names)
 	}
-	return output.Bytes(), nil
-}
 
-// runSingleWatch is used to query a single watch path for changes
-func runSingleWatch(conf *Config, data *backendData, idx int, watch *WatchPath) {
-	health := data.Client.Health()
-	opts := &consulapi.QueryOptions{
-		WaitTime: waitTime,
+	// Apply the new configuration
+	applier := conf.Applier
+	var fa *fileApplier
+	if applier == nil {
+		fa = &fileApplier{conf: conf, skipReload: skipReload, kv: data.KV}
+		applier = fa
 	}
-	if watch.Datacenter != "" {
-		opts.Datacenter = watch.Datacenter
+	changed := changedBackends(data)
+	if err := applier.Apply(rendered, changed); err != nil {
+		log.Printf("[ERR] %v", err)
+		rerr, ok := err.(*RefreshError)
+		if !ok {
+			rerr = &RefreshError{Stage: "apply", Err: err}
+		}
+		reportError(data.ErrCh, rerr)
+		if fa != nil {
+			recordReload(data, "failed: "+rerr.Error())
+		}
+		if rerr.Stage == "reload" {
+			trackReload(data, rerr)
+		}
+
+		// Failing to write the configuration is fatal
+		return rerr.Stage == "write"
 	}
+	clearChanged(data, changed)
+	data.applied = true
 
-	failures := 0
-	for {
-		if shouldStop(data.StopCh) {
-			return
-		}
-		entries, qm, err := health.Service(watch.Service, watch.Tag, true, opts)
-		if err != nil {
-			log.Printf("[ERR] Failed to fetch service nodes: %v", err)
+	// Refresh again once any warming servers are ready, or to
+	// admit more servers. This is only done once applied, so a
+	// paused or failed refresh does not advance the rollout.
+	scheduleWarmup(data, backendServers)
+	recordCanaries(conf, data, admitted, held)
+	if names != nil {
+		data.appliedNames = names
+		if fa == nil || fa.reloaded {
+			data.drainNames = names
 		}
+	}
+	if fa != nil && fa.reloaded {
+		data.reloadedServers = current
+		recordReload(data, reloadReloaded)
+		trackReload(data, nil)
+	} else if fa != nil {
+		recordReload(data, "skipped: "+fa.skipReload)
+	}
 
-		// Patch the entries as necessary
-		for _, entry := range entries {
-			// Modify the node name to prefix with the watch ID. This
-			// prevents a name conflict on duplicate names
-			entry.Node.Node = fmt.Sprintf("%d_%s", idx, entry.Node.Node)
+	// Reload once the next maintenance window opens if deferred
+	data.windowTimer = nil
+	if fa != nil && fa.skipReload == skipOutsideWindows {
+		data.windowTimer = time.After(untilNextWindow(conf.windows, time.Now()))
+	}
+	return
+}
 
-			// Patch the port if provided
-			if watch.Port != 0 {
-				entry.Service.Port = watch.Port
-			}
+// renderOutputs renders each template with the servers, once per
+// datacenter if requested, without any side effects. Returns the
+// output path and output of each render, in order. The paths are
+// empty if not configured, such as on a dry run.
+func renderOutputs(conf *Config, servers map[string][]*backendEntry,
+	first bool) (paths []string, outputs [][]byte, err error) {
+	groups := map[string]map[string][]*backendEntry{"": servers}
+	if conf.PerDatacenter {
+		groups = splitDatacenters(conf, servers)
+	}
+	datacenters := make([]string, 0, len(groups))
+	for dc := range groups {
+		datacenters = append(datacenters, dc)
+	}
+	sort.Strings(datacenters)
 
-			// Clear the health output to prevent reloading due to changes
-			// in output text since we don't care.
-			for _, c := range entry.Checks {
-				c.Notes = ""
-				c.Output = ""
+	for idx, templatePath := range conf.Templates {
+		for _, dc := range datacenters {
+			output, err := buildTemplate(conf, templatePath, groups[dc], first)
+			if err != nil {
+				return nil, nil, &RefreshError{Stage: "render", Path: templatePath, Err: err}
 			}
-		}
-
-		// Update the entries. If this is the first read, do it on error
-		data.Lock()
-		old, ok := data.Servers[watch]
-		if !ok || (err == nil && !reflect.DeepEqual(old, entries)) {
-			data.Servers[watch] = entries
-			asyncNotify(data.ChangeCh)
-			if !conf.DryRun {
-				log.Printf("[DEBUG] Updated nodes for %v", watch.Spec)
+			var outPath string
+			if idx < len(conf.Paths) {
+				outPath = conf.Paths[idx]
+				if conf.PerDatacenter {
+					outPath = datacenterPath(outPath, dc)
+				}
 			}
+			paths = append(paths, outPath)
+			outputs = append(outputs, output)
 		}
-		data.Unlock()
+	}
+	return paths, outputs, nil
+}
 
-		// Stop immediately on a dry run
-		if conf.DryRun {
-			return
+// Render is used to render the template of the configuration with
+// the entries of each backend, without writing the output or reloading
+// HAProxy, for programs embedding the rendering. The configuration
+// must render a single output, and firstRender is always false.
+func Render(conf *Config, data map[string][]*consulapi.ServiceEntry) ([]byte, error) {
+	servers := make(map[string][]*backendEntry, len(data))
+	for backend, entries := range data {
+		var list []*backendEntry
+		for _, entry := range entries {
+			list = append(list, &backendEntry{ServiceEntry: entry})
 		}
+		servers[backend] = list
+	}
+	_, outputs, err := renderOutputs(conf, servers, false)
+	if err != nil {
+		return nil, err
+	}
+	if len(outputs) != 1 {
+		return nil, fmt.Errorf("Render requires a single output, got %d", len(outputs))
+	}
+	return outputs[0], nil
+}
 
-		// Check for an error
-		if err != nil {
-			failures = min(failures+1, maxFailures)
-			time.Sleep(backoff(failSleep, failures))
-		} else {
-			failures = 0
-			opts.WaitIndex = qm.LastIndex
-		}
+// decideReload decides if HAProxy is reloaded, after a refresh
+// applies the configuration or for a deferred or file triggered
+// reload, returning why not, or nothing if it is. The checks are made
+// in order, so the first reason is returned. The current server lines
+// are nil for reloads not caused by the servers changing, which skip
+// the reload threshold.
+func decideReload(conf *Config, data *backendData,
+	servers map[string][]*ServerEntry, current map[string]string) string {
+	if conf.pause.isPaused() {
+		return skipPaused
+	}
+	if reloadCommand(conf) == "" {
+		return skipNoCommand
+	}
+	if !inWindows(conf.windows, time.Now()) {
+		return skipOutsideWindows
+	}
+	if reason := belowMinimum(conf.MinReload, servers); reason != "" {
+		return reason
 	}
+	if current == nil {
+		return ""
+	}
+	return belowThreshold(conf, data.reloadedServers, current)
 }
 
-// reload is used to invoke the reload command
-func reload(conf *Config) error {
-	// Determine the shell invocation based on OS
+// invokeReload is used to reload HAProxy outside of a refresh, for
+// the given cause, if decideReload allows it. A reload outside of the
+// maintenance windows is deferred until the next one opens.
+func invokeReload(conf *Config, data *backendData, cause string,
+	servers map[string][]*ServerEntry, current map[string]string) {
+	if skip := decideReload(conf, data, servers, current); skip != "" {
+		switch skip {
+		case skipNoCommand, skipOutsideWindows, skipPaused:
+			log.Printf("[INFO] Not invoking the %s reload, %s", cause, skip)
+		default:
+			log.Printf("[WARN] Not invoking the %s reload, %s", cause, skip)
+		}
+		recordReload(data, "skipped: "+skip)
+		if skip == skipOutsideWindows && data.windowTimer == nil {
+			data.windowTimer = time.After(untilNextWindow(conf.windows, time.Now()))
+		}
+		return
+	}
+	log.Printf("[INFO] Invoking the %s reload", cause)
+	if conf.DrainPath != "" {
+		writeDrain(conf, data, data.appliedNames)
+	}
+	if err := reload(conf); err != nil {
+		rerr := &RefreshError{Stage: "reload", Err: err}
+		log.Printf("[ERR] %v", rerr)
+		reportError(data.ErrCh, rerr)
+		recordReload(data, "failed: "+rerr.Error())
+		trackReload(data, rerr)
+		return
+	}
+	if current != nil {
+		data.reloadedServers = current
+	}
+	if data.appliedNames != nil {
+		data.drainNames = data.appliedNames
+	}
+	recordReload(data, reloadReloaded)
+	trackReload(data, nil)
+	log.Printf("[INFO] Completed reload")
+}
+
+// trackReload is used to count the consecutive failed reloads,
+// given the result of a reload
+func trackReload(data *backendData, err error) {
+	data.Lock()
+	defer data.Unlock()
+	if err == nil {
+		data.reloadFailures = 0
+		return
+	}
+	data.reloadFailures++
+}
+
+// recordReload is used to record the reload decision of the
+// last refresh
+func recordReload(data *backendData, decision string) {
+	data.Lock()
+	data.lastReload = decision
+	data.Unlock()
+	log.Printf("[DEBUG] Reload decision: %s", decision)
+}
+
+// serverLines returns the server line of each server, keyed
+// by its backend and name
+func serverLines(servers map[string][]*ServerEntry) map[string]string {
+	out := make(map[string]string)
+	for backend, entries := range servers {
+		for _, server := range entries {
+			out[backend+"/"+server.Node+"/"+server.ID] = server.String()
+		}
+	}
+	return out
+}
+
+// belowThreshold returns why the reload is skipped if fewer servers
+// changed since the last reload than the reload threshold, or nothing
+// if it is not. A server is changed if it was added, removed, or its
+// server line differs. The first reload is never skipped.
+func belowThreshold(conf *Config, last, current map[string]string) string {
+	if last == nil || (conf.reloadThreshold == 0 && conf.reloadThresholdPct == 0) {
+		return ""
+	}
+	changed := 0
+	for key, line := range current {
+		if last[key] != line {
+			changed++
+		}
+	}
+	for key := range last {
+		if _, ok := current[key]; !ok {
+			changed++
+		}
+	}
+	threshold := float64(conf.reloadThreshold)
+	if conf.reloadThresholdPct > 0 {
+		threshold = conf.reloadThresholdPct / 100 * float64(len(last))
+	}
+	if changed == 0 || float64(changed) >= threshold {
+		return ""
+	}
+	return fmt.Sprintf("only %d servers changed since the last reload, below the threshold of %s",
+		changed, conf.ReloadChangeThreshold)
+}
+
+// splitDatacenters groups the servers of each backend by the datacenter
+// of their watch. Every group has all of the backends, so a template
+// can be rendered for each. Watches of the local datacenter are
+// grouped under localDatacenter.
+func splitDatacenters(conf *Config,
+	servers map[string][]*backendEntry) map[string]map[string][]*backendEntry {
+	out := make(map[string]map[string][]*backendEntry)
+	group := func(dc string) map[string][]*backendEntry {
+		if dc == "" {
+			dc = localDatacenter
+		}
+		if out[dc] == nil {
+			out[dc] = make(map[string][]*backendEntry, len(servers))
+			for backend := range servers {
+				out[dc][backend] = nil
+			}
+		}
+		return out[dc]
+	}
+	for _, watch := range conf.watches {
+		group(watch.Datacenter)
+	}
+	for backend, entries := range servers {
+		for _, entry := range entries {
+			dc := ""
+			if entry.Watch != nil {
+				dc = entry.Watch.Datacenter
+			}
+			g := group(dc)
+			g[backend] = append(g[backend], entry)
+		}
+	}
+	return out
+}
+
+// datacenterPath returns the output path for a datacenter,
+// replacing each datacenterPlaceholder with its name
+func datacenterPath(outPath, dc string) string {
+	return strings.Replace(outPath, datacenterPlaceholder, dc, -1)
+}
+
+// deferredReload is used to invoke a reload deferred until
+// a maintenance window opens
+func deferredReload(conf *Config, data *backendData) {
+	servers := formatOutput(aggregateServers(conf, data))
+	invokeReload(conf, data, "deferred", servers, serverLines(servers))
+}
+
+// duplicateBackends finds the groups of backends with identical,
+// non-empty server sets. This usually means a watch was copied and
+// not updated. The groups and the names within them are sorted.
+func duplicateBackends(servers map[string][]*backendEntry) [][]string {
+	groups := make(map[string][]string)
+	for backend, entries := range servers {
+		if len(entries) == 0 {
+			continue
+		}
+		addrs := make([]string, len(entries))
+		for idx, entry := range entries {
+			addrs[idx] = fmt.Sprintf("%s/%s:%d", entry.Service.ID,
+				entry.Node.Address, entry.Service.Port)
+		}
+		sort.Strings(addrs)
+		key := strings.Join(addrs, ",")
+		groups[key] = append(groups[key], backend)
+	}
+
+	var dups [][]string
+	for _, backends := range groups {
+		if len(backends) > 1 {
+			sort.Strings(backends)
+			dups = append(dups, backends)
+		}
+	}
+	sort.Slice(dups, func(i, j int) bool { return dups[i][0] < dups[j][0] })
+	return dups
+}
+
+// changedBackends returns the sorted names of the backends
+// that have changed since the configuration was last applied
+func changedBackends(data *backendData) []string {
+	data.Lock()
+	defer data.Unlock()
+	changed := make([]string, 0, len(data.Changed))
+	for backend := range data.Changed {
+		changed = append(changed, backend)
+	}
+	sort.Strings(changed)
+	return changed
+}
+
+// markAllChanged is used to mark every backend as changed
+func markAllChanged(data *backendData) {
+	data.Lock()
+	defer data.Unlock()
+	if data.Changed == nil {
+		data.Changed = make(map[string]bool)
+	}
+	for backend := range data.Backends {
+		data.Changed[backend] = true
+	}
+}
+
+// markChanged is used to mark the given backends as changed
+func markChanged(data *backendData, backends map[string]bool) {
+	data.Lock()
+	defer data.Unlock()
+	if data.Changed == nil {
+		data.Changed = make(map[string]bool)
+	}
+	for backend := range backends {
+		data.Changed[backend] = true
+	}
+}
+
+// clearChanged is used to clear the given changed backends
+// once the configuration has been applied
+func clearChanged(data *backendData, changed []string) {
+	data.Lock()
+	defer data.Unlock()
+	for _, backend := range changed {
+		delete(data.Changed, backend)
+	}
+}
+
+// allWatchesReturned checks if all the watches have some
+// data registered. Prevents early template generation.
+func allWatchesReturned(conf *Config, data *backendData) bool {
+	data.Lock()
+	defer data.Unlock()
+	return len(data.Servers) >= len(conf.watches)
+}
+
+// backendEntry is a service entry along with the watch that
+// returned it, so per-watch options can be applied on output
+type backendEntry struct {
+	*consulapi.ServiceEntry
+	Watch *WatchPath
+
+	// WarmUntil is set if the instance is new, and is disabled
+	// until it has been present for the warmup delay
+	WarmUntil time.Time
+
+	// Kind is the kind of the service, such as "connect-proxy",
+	// or empty if not known
+	Kind string
+
+	// Meta is the metadata of the service, if known
+	Meta map[string]string
+}
+
+// scheduleWarmup is used to start the timer for the next warming
+// server to be ready, so the configuration is refreshed to enable it
+func scheduleWarmup(data *backendData, servers map[string][]*backendEntry) {
+	var next time.Time
+	warming := make(map[string]bool)
+	for backend, entries := range servers {
+		for _, entry := range entries {
+			if entry.WarmUntil.IsZero() {
+				continue
+			}
+			warming[backend] = true
+			if next.IsZero() || entry.WarmUntil.Before(next) {
+				next = entry.WarmUntil
+			}
+		}
+	}
+	data.warming = warming
+	data.warmupTimer = nil
+	if !next.IsZero() {
+		data.warmupTimer = time.After(time.Until(next))
+	}
+}
+
+// admitCanaries is used to limit the new servers admitted to each
+// backend per refresh to the canary rate of its servers, rounded up.
+// The rest are left out and admitted by later refreshes. All servers
+// are admitted until a configuration is first applied. Returns the
+// instances admitted to each backend, and the backends with servers
+// held back, to record with recordCanaries once applied.
+func admitCanaries(conf *Config, data *backendData,
+	servers map[string][]*backendEntry) (admitted map[string]map[string]bool, held map[string]bool) {
+	if conf.CanaryRate <= 0 {
+		return nil, nil
+	}
+	admitted = make(map[string]map[string]bool, len(servers))
+	held = make(map[string]bool)
+	for backend, entries := range servers {
+		known := data.admitted[backend]
+		limit := int(math.Ceil(conf.CanaryRate * float64(len(entries))))
+		current := make(map[string]bool, len(entries))
+		out := make([]*backendEntry, 0, len(entries))
+		for _, entry := range entries {
+			key := instanceKey(entry.ServiceEntry)
+			switch {
+			case known[key] || !data.applied:
+			case limit > 0:
+				limit--
+			default:
+				held[backend] = true
+				continue
+			}
+			current[key] = true
+			out = append(out, entry)
+		}
+		admitted[backend] = current
+		servers[backend] = out
+	}
+	return admitted, held
+}
+
+// recordCanaries is used to record the instances admitted by
+// admitCanaries, scheduling a refresh after the canary interval
+// if any servers are held back
+func recordCanaries(conf *Config, data *backendData,
+	admitted map[string]map[string]bool, held map[string]bool) {
+	if conf.CanaryRate <= 0 {
+		return
+	}
+	data.admitted = admitted
+	data.canary = held
+	data.canaryTimer = nil
+	if len(held) > 0 {
+		data.canaryTimer = time.After(conf.CanaryInterval)
+	}
+}
+
+// instanceKey is used to identify an instance for the warmup
+// delay and its detail
+func instanceKey(entry *consulapi.ServiceEntry) string {
+	return entry.Node.Node + "/" + entry.Service.ID
+}
+
+// aggregateServers merges the watches belonging to each
+// backend together to prepare for template generation. For
+// fallback backends, the first watch with any entries is used.
+func aggregateServers(conf *Config, data *backendData) map[string][]*backendEntry {
+	backendServers := make(map[string][]*backendEntry)
+	now := time.Now()
+	data.Lock()
+	defer data.Unlock()
+
+	// Visit the backends in order, so the servers split into
+	// other backends are consistently ordered
+	backends := make([]string, 0, len(data.Backends))
+	for backend := range data.Backends {
+		backends = append(backends, backend)
+	}
+	sort.Strings(backends)
+
+	split := make(map[string][]*backendEntry)
+	for _, backend := range backends {
+		// Render the backend empty if every watch is failing and
+		// requested, rather than with the last servers
+		if conf.OnAllErrors == onAllErrorsEmpty && allFailing(data, backend) {
+			backendServers[backend] = nil
+			continue
+		}
+
+		var all []*backendEntry
+		for _, watch := range data.Backends[backend] {
+			if watch.FallbackIfEmpty && len(all) > 0 {
+				break
+			}
+			for _, entry := range data.Servers[watch] {
+				be := &backendEntry{
+					ServiceEntry: entry,
+					Watch:        watch,
+					Kind:         entryKind(data.details[watch], entry),
+					Meta:         entryMeta(data.details[watch], entry),
+				}
+				if conf.WarmupDelay > 0 {
+					if first, ok := data.FirstSeen[watch][instanceKey(entry)]; ok && !first.IsZero() {
+						if ready := first.Add(conf.WarmupDelay); ready.After(now) {
+							be.WarmUntil = ready
+						}
+					}
+				}
+				for _, target := range entryBackends(watch, entry) {
+					if target == backend {
+						all = append(all, be)
+					} else {
+						split[target] = append(split[target], be)
+					}
+				}
+			}
+		}
+		backendServers[backend] = all
+	}
+	for backend, entries := range split {
+		backendServers[backend] = append(backendServers[backend], entries...)
+	}
+	for backend := range backendServers {
+		if !renderBackend(conf, backend) {
+			delete(backendServers, backend)
+		}
+	}
+	return backendServers
+}
+
+// renderBackend checks if a backend is rendered by this instance,
+// given the included and excluded backends
+func renderBackend(conf *Config, backend string) bool {
+	if len(conf.IncludeBackends) > 0 && !matchAny(conf.IncludeBackends, backend) {
+		return false
+	}
+	return !matchAny(conf.ExcludeBackends, backend)
+}
+
+// allFailing checks if the last query of every watch of a backend
+// failed. Must be called with the lock held.
+func allFailing(data *backendData, backend string) bool {
+	watches := data.Backends[backend]
+	if len(watches) == 0 {
+		return false
+	}
+	for _, watch := range watches {
+		if _, ok := data.LastErrors[watch]; !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// entryBackends returns the backends an entry of a watch belongs
+// to. If the watch splits by tag, these are named by the tags of
+// the entry with the prefix, or the backend of the watch if none.
+func entryBackends(watch *WatchPath, entry *consulapi.ServiceEntry) []string {
+	if watch.SplitTagPrefix == "" {
+		return []string{watch.Backend}
+	}
+	var out []string
+	seen := make(map[string]bool)
+	for _, tag := range entry.Service.Tags {
+		if !strings.HasPrefix(tag, watch.SplitTagPrefix) {
+			continue
+		}
+		backend := strings.TrimPrefix(tag, watch.SplitTagPrefix)
+		if backend == "" || seen[backend] {
+			continue
+		}
+		seen[backend] = true
+		out = append(out, backend)
+	}
+	if len(out) == 0 {
+		return []string{watch.Backend}
+	}
+	return out
+}
+
+// buildTemplate is used to build the output templates
+// from the configuration and server list. First is set
+// until a render has been applied.
+func buildTemplate(conf *Config, templatePath string,
+	servers map[string][]*backendEntry, first bool) ([]byte, error) {
+	// Format the output
+	outVars := formatOutput(servers)
+
+	// Collapse servers sharing an address if requested
+	if conf.DedupeAddresses {
+		for backend, entries := range outVars {
+			outVars[backend] = dedupeServers(entries)
+		}
+	}
+
+	// Keep empty backends valid if requested
+	if conf.EmptyBackendPlaceholder {
+		if err := addPlaceholders(outVars, conf.PlaceholderAddress); err != nil {
+			return nil, err
+		}
+	}
+
+	// Group the servers of each datacenter if requested
+	if conf.GroupDatacenters {
+		for _, entries := range outVars {
+			groupDatacenters(entries)
+		}
+	}
+
+	// Use server lines supported by the HAProxy version
+	serverOptions(conf, outVars)
+
+	// Read and parse the template, binding firstRender to this render
+	templ, err := loadTemplate(conf, templatePath, outVars)
+	if err != nil {
+		return nil, err
+	}
+	templ = bindFirstRender(templ, first)
+
+	// Generate the output
+	output, err := executeTemplate(templ, outVars, conf.RenderTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to generate the template: %v", err)
+	}
+
+	// Wrap it in the header and footer
+	output, err = wrapOutput(conf, templatePath, outVars, output, first)
+	if err != nil {
+		return nil, err
+	}
+
+	// Start with the hash of the servers if requested
+	if conf.HashComment {
+		comment := fmt.Sprintf("# config-hash: %s\n", serversHash(outVars))
+		output = append([]byte(comment), output...)
+	}
+	return output, nil
+}
+
+// validInitAddr checks if an init-addr policy is a list of the
+// methods HAProxy supports, separated by commas
+func validInitAddr(policy string) bool {
+	for _, method := range strings.Split(policy, ",") {
+		switch method {
+		case "last", "libc", "none":
+		default:
+			if net.ParseIP(method) == nil {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// serverOptions is used to set the options of the configuration
+// that affect the server lines on each server
+func serverOptions(conf *Config, servers map[string][]*ServerEntry) {
+	replacement := conf.NameReplacement
+	if conf.RawNames {
+		replacement = ""
+	}
+	for _, entries := range servers {
+		for _, entry := range entries {
+			entry.version = conf.haproxyVersion
+			entry.resolvers = conf.DNSResolvers
+			entry.nameReplacement = replacement
+			entry.initAddr = conf.InitAddr
+			if entry.SNI != "" {
+				entry.caFile = conf.MeshCAFile
+				entry.crt = conf.MeshCert
+			}
+		}
+	}
+}
+
+// serversHash returns the SHA256 of the servers of every backend,
+// as hex. It only changes if the servers in the output change.
+func serversHash(servers map[string][]*ServerEntry) string {
+	backends := make([]string, 0, len(servers))
+	for backend := range servers {
+		backends = append(backends, backend)
+	}
+	sort.Strings(backends)
+
+	h := sha256.New()
+	for _, backend := range backends {
+		fmt.Fprintf(h, "%s\x00", backend)
+		for _, server := range servers[backend] {
+			fmt.Fprintf(h, "%s\x00", server)
+		}
+		h.Write([]byte{0xff})
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// wrapOutput is used to wrap the output of a template in the
+// header and footer templates, if any
+func wrapOutput(conf *Config, templatePath string,
+	outVars map[string][]*ServerEntry, output []byte, first bool) ([]byte, error) {
+	if conf.HeaderTemplate == "" && conf.FooterTemplate == "" {
+		return output, nil
+	}
+	info := &RenderInfo{
+		Time:           time.Now(),
+		Template:       templatePath,
+		HAProxyVersion: conf.HAProxyVersion,
+		FirstRender:    first,
+		Backends:       len(outVars),
+	}
+	for _, server := range outVars {
+		info.Servers += len(server)
+	}
+	header, err := buildWrapper(conf, conf.HeaderTemplate, outVars, info)
+	if err != nil {
+		return nil, err
+	}
+	footer, err := buildWrapper(conf, conf.FooterTemplate, outVars, info)
+	if err != nil {
+		return nil, err
+	}
+	return bytes.Join([][]byte{header, output, footer}, nil), nil
+}
+
+// bindFirstRender binds the firstRender function of a loaded
+// template to the render it is executed for
+func bindFirstRender(templ *template.Template, first bool) *template.Template {
+	return templ.Funcs(template.FuncMap{
+		"firstRender": func() bool {
+			return first
+		},
+	})
+}
+
+// RenderInfo describes a render, and is provided to the
+// header and footer templates
+type RenderInfo struct {
+	// Time is when the render happened
+	Time time.Time
+
+	// Template is the path of the template being rendered
+	Template string
+
+	// HAProxyVersion is the configured version of HAProxy
+	HAProxyVersion string
+
+	// FirstRender is set until a render has been applied
+	// successfully since startup
+	FirstRender bool
+
+	// Backends and Servers are the number of backends, and
+	// the total number of servers across them
+	Backends int
+	Servers  int
+}
+
+// buildWrapper is used to render a header or footer template,
+// returning nothing if the path is empty
+func buildWrapper(conf *Config, templatePath string,
+	servers map[string][]*ServerEntry, info *RenderInfo) ([]byte, error) {
+	if templatePath == "" {
+		return nil, nil
+	}
+	templ, err := loadTemplate(conf, templatePath, servers)
+	if err != nil {
+		return nil, err
+	}
+	templ = bindFirstRender(templ, info.FirstRender)
+	output, err := executeTemplate(templ, info, conf.RenderTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to generate the template %s: %v", templatePath, err)
+	}
+	return output, nil
+}
+
+// executeTemplate is used to execute a template, giving up after
+// the timeout if it is non-zero. A template cannot be interrupted,
+// so on a timeout the execution is left to finish in the background.
+func executeTemplate(templ *template.Template, vars interface{},
+	timeout time.Duration) ([]byte, error) {
+	if timeout == 0 {
+		var output bytes.Buffer
+		err := templ.Execute(&output, vars)
+		return output.Bytes(), err
+	}
+
+	type result struct {
+		output []byte
+		err    error
+	}
+	resultCh := make(chan result, 1)
+	go func() {
+		var output bytes.Buffer
+		err := templ.Execute(&output, vars)
+		resultCh <- result{output.Bytes(), err}
+	}()
+
+	select {
+	case res := <-resultCh:
+		return res.output, res.err
+	case <-time.After(timeout):
+		return nil, fmt.Errorf("timed out after %v", timeout)
+	}
+}
+
+// parseTemplate is used to read and parse a template. The
+// servers are made available to the template functions.
+func parseTemplate(conf *Config, templatePath string,
+	servers map[string][]*ServerEntry) (*template.Template, error) {
+	// Read the template
+	if isTemplateURL(templatePath) {
+		raw, err := readTemplateURL(conf, templatePath)
+		if err != nil {
+			return nil, err
+		}
+		return newTemplate(conf, raw, servers)
+	}
+	raw, err := ioutil.ReadFile(templatePath)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read template: %v", err)
+	}
+	return newTemplate(conf, raw, servers)
+}
+
+// newTemplate is used to parse the contents of a template
+func newTemplate(conf *Config, raw []byte,
+	servers map[string][]*ServerEntry) (*template.Template, error) {
+	templ := template.New("output").Funcs(templateFuncs(conf, servers))
+
+	// Parse the shared templates first, so their definitions can be
+	// invoked, and overridden by the template itself
+	for _, shared := range conf.sharedTemplates {
+		sharedRaw, err := readTemplate(conf, shared)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := templ.New(shared).Parse(string(sharedRaw)); err != nil {
+			return nil, fmt.Errorf("Failed to parse the shared template %s: %v", shared, err)
+		}
+	}
+	if _, err := templ.Parse(string(raw)); err != nil {
+		return nil, fmt.Errorf("Failed to parse the template: %v", err)
+	}
+	return templ, nil
+}
+
+// parsedTemplates keeps the last parsed version of each template,
+// so a template rendered to several outputs is parsed once
+type parsedTemplates struct {
+	sync.Mutex
+	templates map[string]*parsedTemplate
+
+	// parses counts the templates parsed
+	parses int
+}
+
+// parsedTemplate is a parsed template, and the hash of the
+// contents of it and the shared templates it was parsed from
+type parsedTemplate struct {
+	source []byte
+	templ  *template.Template
+}
+
+// loadTemplate is used to read a template and bind its functions to the
+// servers. It is only parsed again if the contents of it or the shared
+// templates changed since it was last parsed.
+func loadTemplate(conf *Config, templatePath string,
+	servers map[string][]*ServerEntry) (*template.Template, error) {
+	if conf.parsedTemplates == nil {
+		conf.parsedTemplates = &parsedTemplates{templates: make(map[string]*parsedTemplate)}
+	}
+	parsed := conf.parsedTemplates
+
+	// Hash the contents the template is parsed from
+	raw, err := readTemplate(conf, templatePath)
+	if err != nil {
+		return nil, err
+	}
+	hash := sha256.New()
+	fmt.Fprintf(hash, "%d\x00", len(raw))
+	hash.Write(raw)
+	for _, shared := range conf.sharedTemplates {
+		sharedRaw, err := readTemplate(conf, shared)
+		if err != nil {
+			return nil, err
+		}
+		fmt.Fprintf(hash, "%s\x00%d\x00", shared, len(sharedRaw))
+		hash.Write(sharedRaw)
+	}
+	source := hash.Sum(nil)
+
+	parsed.Lock()
+	defer parsed.Unlock()
+	last, ok := parsed.templates[templatePath]
+	if !ok || !bytes.Equal(last.source, source) {
+		templ, err := newTemplate(conf, raw, nil)
+		if err != nil {
+			return nil, err
+		}
+		last = &parsedTemplate{source: source, templ: templ}
+		parsed.templates[templatePath] = last
+		parsed.parses++
+	}
+
+	// Execute a copy, with the functions bound to these servers
+	templ, err := last.templ.Clone()
+	if err != nil {
+		return nil, err
+	}
+	return templ.Funcs(templateFuncs(conf, servers)), nil
+}
+
+// templateCache keeps the last contents read of each template
+type templateCache struct {
+	sync.Mutex
+	contents map[string][]byte
+}
+
+// readTemplate is used to read a template, retrying on failure. If
+// it still cannot be read, the last contents read are used so a
+// transient error does not prevent a refresh.
+func readTemplate(conf *Config, templatePath string) ([]byte, error) {
+	if conf.templateCache == nil {
+		conf.templateCache = &templateCache{contents: make(map[string][]byte)}
+	}
+	cache := conf.templateCache
+
+	// Prefer the contents of the key the template is sourced from
+	if key := templateKey(conf, templatePath); key != "" {
+		if raw, ok := conf.kvValues.get(key); ok {
+			return raw, nil
+		}
+	}
+	if isTemplateURL(templatePath) {
+		return readTemplateURL(conf, templatePath)
+	}
+
+	var raw []byte
+	var err error
+	for attempt := 0; attempt < templateReadAttempts; attempt++ {
+		if attempt > 0 {
+			time.Sleep(templateReadRetry)
+		}
+		raw, err = ioutil.ReadFile(templatePath)
+		if err == nil {
+			cache.Lock()
+			cache.contents[templatePath] = raw
+			cache.Unlock()
+			return raw, nil
+		}
+	}
+
+	cache.Lock()
+	defer cache.Unlock()
+	if last, ok := cache.contents[templatePath]; ok {
+		log.Printf("[WARN] Failed to read template %s, using the last contents: %v", templatePath, err)
+		return last, nil
+	}
+	return nil, fmt.Errorf("Failed to read template: %v", err)
+}
+
+// templateFuncs returns the functions available to templates
+func templateFuncs(conf *Config, servers map[string][]*ServerEntry) template.FuncMap {
+	keys := make(map[string]string)
+	return template.FuncMap{
+		"key": func(key string) (string, error) {
+			return lookupKey(conf, keys, key)
+		},
+		"intentions": func(service string) ([]*Intention, error) {
+			return lookupIntentions(conf, service)
+		},
+		"haproxyVersion": func() string {
+			return conf.HAProxyVersion
+		},
+		"statsSocket": func() string {
+			return conf.StatsSocket
+		},
+		"agent": func() AgentInfo {
+			return conf.agent
+		},
+		"firstRender": func() bool {
+			return false
+		},
+		"haproxyAtLeast": func(raw string) (bool, error) {
+			v, err := parseHAProxyVersion(raw)
+			if err != nil {
+				return false, err
+			}
+			return conf.haproxyVersion.atLeast(v), nil
+		},
+		"tagMap": func(prefix string) map[string]string {
+			return tagMap(servers, prefix)
+		},
+		"serverTemplate": func(backend string, headroom int) (string, error) {
+			return serverTemplate(conf, servers, backend, headroom)
+		},
+		"backends": func() []*Backend {
+			return orderedBackends(conf, servers)
+		},
+		"add": func(a, b int) int { return a + b },
+		"sub": func(a, b int) int { return a - b },
+		"mul": func(a, b int) int { return a * b },
+		"div": func(a, b int) (int, error) {
+			if b == 0 {
+				return 0, errors.New("division by zero")
+			}
+			return a / b, nil
+		},
+	}
+}
+
+// Backend is a backend and its servers, as provided to
+// templates by the backends function
+type Backend struct {
+	Name    string
+	Servers []*ServerEntry
+}
+
+// orderedBackends returns every backend and its servers, sorted by
+// the name of the backend, or in the order the backends are first
+// configured if requested. Backends without a configured watch, such
+// as those split by tag, follow by name.
+func orderedBackends(conf *Config, servers map[string][]*ServerEntry) []*Backend {
+	rank := make(map[string]int)
+	if conf.BackendOrder == backendOrderConfig {
+		for _, watch := range conf.watches {
+			if _, ok := rank[watch.Backend]; !ok {
+				rank[watch.Backend] = len(rank)
+			}
+		}
+	}
+	out := make([]*Backend, 0, len(servers))
+	for name, entries := range servers {
+		out = append(out, &Backend{Name: name, Servers: entries})
+	}
+	sort.Slice(out, func(i, j int) bool {
+		ri, iok := rank[out[i].Name]
+		rj, jok := rank[out[j].Name]
+		if iok != jok {
+			return iok
+		}
+		if iok && ri != rj {
+			return ri < rj
+		}
+		return out[i].Name < out[j].Name
+	})
+	return out
+}
+
+// tagMap maps the value of each tag with the given prefix to the
+// backend of the server carrying it. This can be used to render an
+// HAProxy map file, such as for routing hosts to backends. If a value
+// is used in multiple backends, the first backend by name is used.
+func tagMap(servers map[string][]*ServerEntry, prefix string) map[string]string {
+	backends := make([]string, 0, len(servers))
+	for backend := range servers {
+		backends = append(backends, backend)
+	}
+	sort.Strings(backends)
+
+	out := make(map[string]string)
+	for _, backend := range backends {
+		for _, server := range servers[backend] {
+			for _, tag := range server.Tags {
+				if !strings.HasPrefix(tag, prefix) {
+					continue
+				}
+				key := strings.TrimPrefix(tag, prefix)
+				if _, ok := out[key]; key != "" && !ok {
+					out[key] = backend
+				}
+			}
+		}
+	}
+	return out
+}
+
+// lookupKey is used to read a Consul KV key from a template. The values
+// are cached for the render, so a key is read once. A missing key is
+// empty, while failing to read it fails the render.
+func lookupKey(conf *Config, cache map[string]string, key string) (string, error) {
+	if value, ok := cache[key]; ok {
+		return value, nil
+	}
+	if conf.kv == nil {
+		return "", fmt.Errorf("Failed to read key %s: no Consul client", key)
+	}
+	pair, _, err := conf.kv.Get(key, nil)
+	if err != nil {
+		return "", fmt.Errorf("Failed to read key %s: %v", key, err)
+	}
+	var value string
+	if pair != nil {
+		value = string(pair.Value)
+	}
+	cache[key] = value
+	return value, nil
+}
+
+// serverTemplate returns an HAProxy server-template directive for a
+// backend, resolving the Consul DNS SRV record of the service of its
+// first watch. It is sized to the servers of the backend plus the
+// headroom, so HAProxy can add instances without a reload.
+func serverTemplate(conf *Config, servers map[string][]*ServerEntry,
+	backend string, headroom int) (string, error) {
+	if conf.DNSResolvers == "" {
+		return "", errors.New("serverTemplate requires -dns-resolvers")
+	}
+	if !conf.haproxyVersion.atLeast(serverTemplateVersion) {
+		return "", fmt.Errorf("serverTemplate requires HAProxy %v or newer", serverTemplateVersion)
+	}
+	if headroom < 0 {
+		return "", fmt.Errorf("Invalid headroom %d: cannot be negative", headroom)
+	}
+	var watch *WatchPath
+	for _, wp := range conf.watches {
+		if wp.Backend == backend {
+			watch = wp
+			break
+		}
+	}
+	if watch == nil {
+		return "", fmt.Errorf("Backend '%s' is not defined", backend)
+	}
+
+	// Build the SRV name, such as _app._tcp.service.dc1.consul
+	proto := "_tcp"
+	if watch.Tag != "" {
+		proto = "_" + watch.Tag
+	}
+	name := fmt.Sprintf("_%s.%s.service.", watch.Service, proto)
+	if watch.Datacenter != "" {
+		name += watch.Datacenter + "."
+	}
+	name += consulDomain
+
+	count := len(servers[backend]) + headroom
+	if count < 1 {
+		count = 1
+	}
+	initAddr := conf.InitAddr
+	if initAddr == "" {
+		initAddr = defaultInitAddr
+	}
+	out := fmt.Sprintf("server-template %s %d %s resolvers %s init-addr %s",
+		backend, count, name, conf.DNSResolvers, initAddr)
+	return out, nil
+}
+
+// queryOptions returns the options to query a watch with,
+// according to its datacenter and consistency mode
+func queryOptions(watch *WatchPath) *consulapi.QueryOptions {
+	opts := &consulapi.QueryOptions{
+		Datacenter: watch.Datacenter,
+	}
+	switch watch.Consistency {
+	case "stale":
+		opts.AllowStale = true
+	case "consistent":
+		opts.RequireConsistent = true
+	}
+	return opts
+}
+
+// startWatches is used to run each watch in its own goroutine. The
+// launches are spread out by the startup stagger, with jitter, so
+// the first queries of many watches do not reach Consul at once.
+func startWatches(conf *Config, data *backendData, run func(idx int, watch *WatchPath)) {
+	for idx, watch := range conf.watches {
+		if idx > 0 && conf.StartupStagger > 0 {
+			select {
+			case <-time.After(staggerDelay(conf.StartupStagger)):
+			case <-data.StopCh:
+				return
+			}
+		}
+		go run(idx, watch)
+	}
+}
+
+// staggerDelay returns the delay before the next launch, which
+// is between half and one and a half times the stagger
+func staggerDelay(stagger time.Duration) time.Duration {
+	return stagger/2 + time.Duration(rand.Int63n(int64(stagger)))
+}
+
+// runSingleWatch is used to query a single watch path for changes
+func runSingleWatch(conf *Config, data *backendData, idx int, watch *WatchPath) {
+	opts := queryOptions(watch)
+	opts.WaitTime = waitTime
+
+	var failures FailureTracker
+	consecutive := 0
+	for {
+		if shouldStop(data.StopCh) {
+			return
+		}
+		entries, qm, err := queryWatch(data, idx, watch, opts)
+
+		// Treat a missing service as having no instances if allowed
+		missing := watch.AllowMissing && isMissing(err)
+		if missing {
+			log.Printf("[DEBUG] Service of %v is missing, treating it as empty: %v", watch, err)
+			entries, err = nil, nil
+		}
+		class := classifyError(err)
+		switch class {
+		case errNone:
+			if !missing {
+				recordQuery(data, watch, qm)
+			}
+		case errTransient:
+			log.Printf("[ERR] Failed to fetch service nodes for %v: %v", watch, err)
+		default:
+			log.Printf("[ERR] Failed to fetch service nodes for %v, %s. Retrying in %v, "+
+				"fix the ACLs or configuration: %v", watch, class, deniedSleep, err)
+		}
+
+		// Update the entries
+		updateEntries(conf, data, watch, entries, err)
+
+		// Stop immediately on a dry run
+		if conf.DryRun {
+			return
+		}
+
+		// Check for an error. One that needs the ACLs or configuration
+		// fixed is retried slowly, or exits at once if failures are
+		// limited, as retrying it is unlikely to help.
+		if err != nil {
+			consecutive++
+			limit := failureLimit(conf, watch)
+			transient := class == errTransient
+			if limit > 0 && (consecutive >= limit || !transient) {
+				if transient {
+					log.Printf("[ERR] %v failed %d queries in a row, exiting", watch, consecutive)
+				} else {
+					log.Printf("[ERR] %v failed with %s, exiting", watch, class)
+				}
+				reportError(data.ErrCh, &RefreshError{Stage: "query", Path: watch.Spec, Err: err})
+				asyncNotify(data.FatalCh)
+				return
+			}
+			if !transient {
+				reportError(data.ErrCh, &RefreshError{Stage: "query", Path: watch.Spec, Err: err})
+				failures.Reset()
+				select {
+				case <-time.After(deniedSleep):
+				case <-data.StopCh:
+					return
+				}
+				continue
+			}
+			failures.Record()
+			time.Sleep(failures.Backoff())
+		} else if missing {
+			// There is no index to block on until it exists
+			consecutive = 0
+			failures.Reset()
+			time.Sleep(failSleep)
+		} else {
+			consecutive = 0
+			failures.Reset()
+			opts.WaitIndex = nextWaitIndex(opts.WaitIndex, qm.LastIndex)
+		}
+	}
+}
+
+// failureLimit returns the number of consecutive failures of a
+// watch after which the process exits, or zero for no limit
+func failureLimit(conf *Config, watch *WatchPath) int {
+	if watch.MaxFailures > 0 {
+		return watch.MaxFailures
+	}
+	return conf.MaxConsecutiveFailures
+}
+
+// queryWatch is used to query the entries of a watch, applying
+// the options of the watch to them
+func queryWatch(data *backendData, idx int, watch *WatchPath,
+	opts *consulapi.QueryOptions) ([]*consulapi.ServiceEntry, *consulapi.QueryMeta, error) {
+	var entries []*consulapi.ServiceEntry
+	var details instanceDetails
+	var qm *consulapi.QueryMeta
+	var err error
+	if watch.Connect {
+		entries, details, qm, err = data.Querier.Connect(watch.Service, watch.Tag, !watch.IncludeUnhealthy, opts)
+	} else {
+		entries, details, qm, err = data.Querier.Service(watch.Service, watch.Tag, !watch.IncludeUnhealthy, opts)
+	}
+
+	// Leave out any excluded instances
+	entries = excludeEntries(watch, entries)
+	entries = filterKinds(watch, entries, details)
+
+	// Patch the entries as necessary. The entries are copied first,
+	// since a querier may share them between watches or queries.
+	var patched []*consulapi.ServiceEntry
+	patchedDetails := make(instanceDetails, len(entries))
+	for _, entry := range entries {
+		detail := details[instanceKey(entry)]
+		entry = cloneEntry(entry)
+		patchTaggedAddress(watch, entry, detail)
+
+		// Fill in a missing address, or leave out the entry rather
+		// than rendering a broken server line. Servers reached through
+		// a mesh gateway use the gateway address instead.
+		if entry.Node.Address == "" && watch.meshGatewayAddr == nil {
+			if watch.MissingAddress == "" {
+				log.Printf("[WARN] Skipping service %s on node %s of %v, which has no address",
+					entry.Service.ID, entry.Node.Node, watch)
+				continue
+			}
+			entry.Node.Address = watch.MissingAddress
+		}
+		patched = append(patched, entry)
+
+		// Modify the node name to prefix with the watch ID. This
+		// prevents a name conflict on duplicate names
+		entry.Node.Node = fmt.Sprintf("%d_%s", idx, entry.Node.Node)
+		if detail != nil {
+			patchedDetails[instanceKey(entry)] = detail
+		}
+
+		// Patch the port if provided
+		patchPort(watch, entry)
+	}
+	entries = patched
+
+	// Keep the detail of the entries until they are stored
+	if err == nil {
+		data.Lock()
+		if data.queried == nil {
+			data.queried = make(map[*WatchPath]instanceDetails)
+		}
+		data.queried[watch] = patchedDetails
+		data.Unlock()
+	}
+
+	// Limit the number of servers if requested
+	if watch.MaxServers > 0 {
+		entries = limitServers(entries, watch.MaxServers)
+	}
+	return entries, qm, err
+}
+
+// initialRender is used to query every watch once and render the
+// configuration before watching for changes, so it is up to date
+// on start. Each watch starts watching once its query completes.
+// If the queries do not complete within the timeout, the render is
+// left to the watch loop as usual.
+func initialRender(conf *Config, data *backendData) (exit bool) {
+	doneCh := make(chan struct{}, len(conf.watches))
+	go startWatches(conf, data, func(idx int, watch *WatchPath) {
+		entries, _, err := queryWatch(data, idx, watch, queryOptions(watch))
+		if watch.AllowMissing && isMissing(err) {
+			entries, err = nil, nil
+		}
+		if err != nil {
+			log.Printf("[ERR] Failed to fetch service nodes for %v: %v", watch, err)
+		}
+		updateEntries(conf, data, watch, entries, err)
+		doneCh <- struct{}{}
+		runSingleWatch(conf, data, idx, watch)
+	})
+
+	timeout := time.After(conf.InitialRenderTimeout)
+	for range conf.watches {
+		select {
+		case <-doneCh:
+		case <-timeout:
+			log.Printf("[WARN] Timed out waiting for the initial render")
+			return
+		case <-data.StopCh:
+			return true
+		}
+	}
+
+	// The changes are applied here, not by the watch loop
+	select {
+	case <-data.ChangeCh:
+	default:
+	}
+	log.Printf("[INFO] Performing the initial render")
+	return forceRefresh(conf, data)
+}
+
+// excludeEntries removes the entries whose node or service ID
+// match any of the exclude patterns of the watch
+func excludeEntries(watch *WatchPath, entries []*consulapi.ServiceEntry) []*consulapi.ServiceEntry {
+	if len(watch.ExcludeNodes) == 0 && len(watch.ExcludeServiceIDs) == 0 {
+		return entries
+	}
+	var out []*consulapi.ServiceEntry
+	for _, entry := range entries {
+		if matchAny(watch.ExcludeNodes, entry.Node.Node) ||
+			matchAny(watch.ExcludeServiceIDs, entry.Service.ID) {
+			continue
+		}
+		out = append(out, entry)
+	}
+	return out
+}
+
+// matchAny checks if the name matches any of the glob patterns
+func matchAny(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// cloneEntry returns a copy of an entry whose node and service
+// can be patched without affecting the original
+func cloneEntry(entry *consulapi.ServiceEntry) *consulapi.ServiceEntry {
+	clone := *entry
+	if entry.Node != nil {
+		node := *entry.Node
+		clone.Node = &node
+	}
+	if entry.Service != nil {
+		service := *entry.Service
+		clone.Service = &service
+	}
+	return &clone
+}
+
+// patchPort applies the port of the watch to an entry. ForcePort
+// and Port always override the port, while DefaultPort is only
+// used if the service did not register one.
+func patchPort(watch *WatchPath, entry *consulapi.ServiceEntry) {
+	if watch.ForcePort != 0 {
+		entry.Service.Port = watch.ForcePort
+	} else if watch.Port != 0 {
+		entry.Service.Port = watch.Port
+	} else if entry.Service.Port == 0 && watch.DefaultPort != 0 {
+		entry.Service.Port = watch.DefaultPort
+	}
+}
+
+// updateEntries stores the entries returned for a watch, notifying
+// of a change if they differ from the previous entries. If this is
+// the first read, it is done even on error. The entries are compared
+// after the options of the watch are applied, so must not be patched
+// once stored.
+func updateEntries(conf *Config, data *backendData, watch *WatchPath,
+	entries []*consulapi.ServiceEntry, err error) {
+	data.Lock()
+	defer data.Unlock()
+	if data.Stats == nil {
+		data.Stats = make(map[*WatchPath]*watchStats)
+	}
+	if data.Hashes == nil {
+		data.Hashes = make(map[*WatchPath]uint64)
+	}
+	if data.Changed == nil {
+		data.Changed = make(map[string]bool)
+	}
+	stats, ok := data.Stats[watch]
+	if !ok {
+		stats = &watchStats{}
+		data.Stats[watch] = stats
+	}
+
+	if err != nil {
+		stats.Failures++
+	} else {
+		stats.LastResponse = time.Now()
+		if stats.Stale {
+			stats.Stale = false
+			log.Printf("[INFO] Watch %v is updating again", watch)
+		}
+	}
+
+	// Track if the watch is failing. If failing backends are
+	// rendered empty, the backend changes when this does.
+	if data.LastErrors == nil {
+		data.LastErrors = make(map[*WatchPath]error)
+	}
+	_, wasFailing := data.LastErrors[watch]
+	if err != nil {
+		data.LastErrors[watch] = err
+	} else {
+		delete(data.LastErrors, watch)
+	}
+	if err != nil && !wasFailing && allFailing(data, watch.Backend) {
+		if conf.OnAllErrors == onAllErrorsEmpty {
+			log.Printf("[WARN] Every watch of backend %s is failing, rendering it empty", watch.Backend)
+		} else {
+			log.Printf("[WARN] Every watch of backend %s is failing, keeping the last servers", watch.Backend)
+		}
+	}
+	if conf.OnAllErrors == onAllErrorsEmpty && wasFailing != (err != nil) {
+		data.Changed[watch.Backend] = true
+		asyncNotify(data.ChangeCh)
+	}
+
+	old, ok := data.Servers[watch]
+	if ok && err != nil {
+		return
+	}
+	if conf.WarmupDelay > 0 && err == nil {
+		updateFirstSeen(data, watch, entries)
+	}
+	details := data.queried[watch]
+	delete(data.queried, watch)
+	hash := hashEntries(entries, details)
+	if ok && data.Hashes[watch] == hash {
+		stats.Unchanged++
+		if !conf.DryRun {
+			log.Printf("[DEBUG] No change in nodes for %v", watch)
+		}
+		return
+	}
+
+	stats.Changed++
+	stats.LastUpdate = time.Now()
+	warnWeights(watch, entries, details)
+	if ok {
+		added, removed := diffEntries(old, entries)
+		stats.Added += uint64(added)
+		stats.Removed += uint64(removed)
+	}
+	data.Servers[watch] = entries
+	data.Hashes[watch] = hash
+	if data.details == nil {
+		data.details = make(map[*WatchPath]instanceDetails)
+	}
+	data.details[watch] = details
+	data.Changed[watch.Backend] = true
+	if watch.SplitTagPrefix != "" {
+		for _, list := range [][]*consulapi.ServiceEntry{old, entries} {
+			for _, entry := range list {
+				for _, backend := range entryBackends(watch, entry) {
+					data.Changed[backend] = true
+				}
+			}
+		}
+	}
+	asyncNotify(data.ChangeCh)
+	if !conf.DryRun {
+		log.Printf("[DEBUG] Updated nodes for %v (%d -> %d)", watch, len(old), len(entries))
+	}
+}
+
+// diffEntries counts the instances added and removed
+// between two sets of entries
+func diffEntries(old, entries []*consulapi.ServiceEntry) (added, removed int) {
+	before := make(map[string]bool, len(old))
+	for _, entry := range old {
+		before[instanceKey(entry)] = true
+	}
+	after := make(map[string]bool, len(entries))
+	for _, entry := range entries {
+		key := instanceKey(entry)
+		after[key] = true
+		if !before[key] {
+			added++
+		}
+	}
+	for key := range before {
+		if !after[key] {
+			removed++
+		}
+	}
+	return added, removed
+}
+
+// updateFirstSeen is used to track when the instances of a watch
+// were first seen, on each successful query. Instances returned by
+// the first successful query are given a zero time, so only the
+// instances added later are delayed. The instances that are gone
+// are forgotten, so they are delayed again if they return. Must be
+// called with the lock held.
+func updateFirstSeen(data *backendData, watch *WatchPath, entries []*consulapi.ServiceEntry) {
+	if data.FirstSeen == nil {
+		data.FirstSeen = make(map[*WatchPath]map[string]time.Time)
+	}
+	last, seen := data.FirstSeen[watch]
+	now := time.Now()
+	current := make(map[string]time.Time, len(entries))
+	for _, entry := range entries {
+		key := instanceKey(entry)
+		if first, ok := last[key]; ok {
+			current[key] = first
+		} else if seen {
+			current[key] = now
+		} else {
+			current[key] = time.Time{}
+		}
+	}
+	data.FirstSeen[watch] = current
+}
+
+// recordQuery is used to store the QueryMeta of a successful
+// query of a watch, for diagnosing blocking queries
+func recordQuery(data *backendData, watch *WatchPath, qm *consulapi.QueryMeta) {
+	data.Lock()
+	defer data.Unlock()
+	if data.Stats == nil {
+		data.Stats = make(map[*WatchPath]*watchStats)
+	}
+	stats, ok := data.Stats[watch]
+	if !ok {
+		stats = &watchStats{}
+		data.Stats[watch] = stats
+	}
+	stats.LastQuery = time.Now()
+	stats.LastIndex = qm.LastIndex
+	stats.RequestTime = qm.RequestTime
+}
+
+// hashEntries computes a hash of the fields of the entries and
+// their details that affect the rendered output. Changes to other
+// fields, such as health check output, are ignored to avoid
+// needless reloads.
+func hashEntries(entries []*consulapi.ServiceEntry, details instanceDetails) uint64 {
+	h := fnv.New64a()
+	for _, entry := range entries {
+		if detail := details[instanceKey(entry)]; detail != nil {
+			fmt.Fprintf(h, "%s\x00", detail.Kind)
+			keys := make([]string, 0, len(detail.Meta))
+			for key := range detail.Meta {
+				keys = append(keys, key)
+			}
+			sort.Strings(keys)
+			for _, key := range keys {
+				fmt.Fprintf(h, "%s=%s\x00", key, detail.Meta[key])
+			}
+		}
+		fmt.Fprintf(h, "%s\x00%s\x00", entry.Node.Node, entry.Node.Address)
+		fmt.Fprintf(h, "%s\x00%s\x00%d\x00", entry.Service.ID, entry.Service.Service, entry.Service.Port)
+		for _, tag := range entry.Service.Tags {
+			fmt.Fprintf(h, "%s\x00", tag)
+		}
+		for _, check := range entry.Checks {
+			fmt.Fprintf(h, "%s\x00", check.Status)
+		}
+		h.Write([]byte{0xff})
+	}
+	return h.Sum64()
+}
+
+// limitServers truncates the entries to at most n servers. The
+// entries are sorted first so the same servers are consistently
+// selected, avoiding needless reloads.
+func limitServers(entries []*consulapi.ServiceEntry, n int) []*consulapi.ServiceEntry {
+	if len(entries) <= n {
+		return entries
+	}
+	sorted := make([]*consulapi.ServiceEntry, len(entries))
+	copy(sorted, entries)
+	sort.Sort(entriesByNode(sorted))
+	return sorted[:n]
+}
+
+// entriesByNode sorts service entries by node name and service ID
+type entriesByNode []*consulapi.ServiceEntry
+
+func (e entriesByNode) Len() int      { return len(e) }
+func (e entriesByNode) Swap(i, j int) { e[i], e[j] = e[j], e[i] }
+func (e entriesByNode) Less(i, j int) bool {
+	if e[i].Node.Node != e[j].Node.Node {
+		return e[i].Node.Node < e[j].Node.Node
+	}
+	return e[i].Service.ID < e[j].Service.ID
+}
+
+// nextWaitIndex computes the index to use for the next blocking
+// query. If the index goes backwards, as can happen after a Consul
+// restart or state reset, it is reset so the watch doesn't get stuck.
+// The index is never less than 1, since a zero index makes the query
+// non-blocking and would cause us to spin in a tight loop.
+func nextWaitIndex(current, last uint64) uint64 {
+	next := current
+	if last < current {
+		next = 0
+	} else if last > current {
+		next = last
+	}
+	if next < 1 {
+		next = 1
+	}
+	return next
+}
+
+// reload is used to invoke the reload command
+func reload(conf *Config) error {
+	return runCommand(reloadCommand(conf), nil)
+}
+
+// runCommand is used to invoke a command using the shell, with
+// the given additional environment variables
+func runCommand(command string, env []string) error {
+	// Determine the shell invocation based on OS
 	var shell, flag string
 	if runtime.GOOS == "windows" {
 		shell = "cmd"
@@ -323,7 +2455,10 @@ func reload(conf *Config) error {
 	}
 
 	// Create and invoke the command
-	cmd := exec.Command(shell, flag, conf.ReloadCommand)
+	cmd := exec.Command(shell, flag, command)
+	if len(env) > 0 {
+		cmd.Env = append(os.Environ(), env...)
+	}
 	cmd.Stdout = os.Stdout
 	cmd.Stderr = os.Stderr
 	return cmd.Run()
@@ -347,12 +2482,94 @@ func asyncNotify(ch chan struct{}) {
 	}
 }
 
-// min returns the min of two ints
-func min(a, b int) int {
-	if a < b {
-		return a
+// reportError is used to report an error without blocking
+func reportError(ch chan error, err error) {
+	select {
+	case ch <- err:
+	default:
+	}
+}
+
+// errorClass classifies the errors of a query
+type errorClass int
+
+const (
+	errNone errorClass = iota
+	errTransient
+	errPermissionDenied
+	errNotFound
+)
+
+func (c errorClass) String() string {
+	switch c {
+	case errNone:
+		return "no error"
+	case errPermissionDenied:
+		return "permission denied by the ACLs"
+	case errNotFound:
+		return "not found"
+	default:
+		return "transient error"
+	}
+}
+
+// classifyError is used to classify the error of a query. Errors
+// without an HTTP response code, such as a refused connection, are
+// transient, while a permission denied or not found response is
+// unlikely to succeed until the ACLs or configuration are fixed.
+func classifyError(err error) errorClass {
+	if err == nil {
+		return errNone
+	}
+	serr, ok := err.(*statusError)
+	if !ok {
+		return errTransient
+	}
+	switch serr.Code {
+	case 403:
+		return errPermissionDenied
+	case 404:
+		return errNotFound
+	default:
+		return errTransient
+	}
+}
+
+// isMissing checks if the error of a query means the service or
+// its datacenter does not exist, rather than the query failing
+func isMissing(err error) bool {
+	if classifyError(err) == errNotFound {
+		return true
+	}
+	serr, ok := err.(*statusError)
+	return ok && strings.Contains(serr.Body, "No path to datacenter")
+}
+
+// FailureTracker counts the consecutive failures of a watch
+// and determines how long to back off before retrying
+type FailureTracker struct {
+	failures int
+}
+
+// Record is used to note a failure. The count is capped at
+// maxFailures to limit the sleep value.
+func (f *FailureTracker) Record() {
+	if f.failures < maxFailures {
+		f.failures++
+	}
+}
+
+// Reset is used to clear the failures after a success
+func (f *FailureTracker) Reset() {
+	f.failures = 0
+}
+
+// Backoff returns how long to sleep before the next attempt
+func (f *FailureTracker) Backoff() time.Duration {
+	if f.failures == 0 {
+		return 0
 	}
-	return b
+	return backoff(failSleep, f.failures)
 }
 
 // backoff is used to compute an exponential backoff
@@ -370,32 +2587,505 @@ type ServerEntry struct {
 	Port    int
 	IP      net.IP
 	Node    string
+
+	// TagMap maps the key of each "key=value" tag to its value.
+	// If a key is repeated, the first value is used.
+	TagMap map[string]string
+
+	// Meta is the metadata of the service
+	Meta map[string]string
+
+	// Protocol is the protocol of the watch, "tcp" or "http".
+	// It is empty if not configured.
+	Protocol string
+
+	// SendProxy enables the PROXY protocol to the server
+	SendProxy bool
+
+	// Observe is the traffic HAProxy observes to detect a failing
+	// server, and AgentPort the port of its agent check, if set
+	Observe   string
+	AgentPort int
+
+	// Disabled marks the server as disabled
+	Disabled bool
+
+	// Backup marks the server as a backup server
+	Backup bool
+
+	// SNI is the server name sent over TLS, set for servers
+	// reached through a mesh gateway
+	SNI string
+
+	// Weight is the weight of the server, if not the default
+	Weight int
+
+	// weighted is set if the weight is taken from a weight key,
+	// so it is emitted even if zero
+	weighted bool
+
+	// Host is the address of the server if it is a hostname
+	// rather than an IP, in which case IP is nil
+	Host string
+
+	// Datacenter is the datacenter of the watch of the server,
+	// or "local" if it does not specify one
+	Datacenter string
+
+	// Kind is the kind of the service, such as "connect-proxy",
+	// or "typical" if it is not a proxy or gateway
+	Kind string
+
+	// Comment is a comment for the template to emit before the
+	// server line, used to annotate groups of servers
+	Comment string
+
+	// version is the HAProxy version the server line is for
+	version *haproxyVersion
+
+	// resolvers is the HAProxy resolvers section used to
+	// resolve the server if it has a hostname
+	resolvers string
+
+	// nameReplacement replaces the characters of the server name
+	// that are unsafe in HAProxy, unless empty
+	nameReplacement string
+
+	// initAddr is the init-addr policy if the server has a hostname
+	initAddr string
+
+	// caFile and crt are the CA certificates the server is verified
+	// with, and the client certificate presented to it, over TLS
+	caFile string
+	crt    string
+}
+
+// Address returns the address and port of the server
+func (se *ServerEntry) Address() string {
+	if se.Host != "" {
+		return net.JoinHostPort(se.Host, strconv.Itoa(se.Port))
+	}
+	return (&net.TCPAddr{IP: se.IP, Port: se.Port}).String()
+}
+
+// name returns the name of the server in the configuration
+func (se *ServerEntry) name() string {
+	name := se.Node
+	if se.ID != "" {
+		name = fmt.Sprintf("%s_%s", se.Node, se.ID)
+	}
+	if se.nameReplacement != "" {
+		name = sanitizeName(name, se.nameReplacement)
+	}
+	return name
+}
+
+// sanitizeName replaces each character of a name that is not a
+// letter, digit, dash or underscore with the replacement
+func sanitizeName(name, replacement string) string {
+	var out bytes.Buffer
+	for _, r := range name {
+		if safeNameChar(r) {
+			out.WriteRune(r)
+		} else {
+			out.WriteString(replacement)
+		}
+	}
+	return out.String()
+}
+
+// safeNameChar checks if a character is safe in an HAProxy identifier
+func safeNameChar(r rune) bool {
+	return (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') ||
+		(r >= '0' && r <= '9') || r == '-' || r == '_'
 }
 
 // String is the default text representation of a server
 func (se *ServerEntry) String() string {
-	name := fmt.Sprintf("%s_%s", se.Node, se.ID)
-	addr := &net.TCPAddr{IP: se.IP, Port: se.Port}
-	return fmt.Sprintf("server %s %s", name, addr)
+	out := fmt.Sprintf("server %s %s", se.name(), se.Address())
+	if se.Host != "" {
+		initAddr := se.initAddr
+		if se.resolvers != "" {
+			out += " resolvers " + se.resolvers
+			if initAddr == "" {
+				initAddr = defaultInitAddr
+			}
+		}
+		if initAddr != "" && se.version.atLeast(initAddrVersion) {
+			out += " init-addr " + initAddr
+		}
+	}
+	if se.SNI != "" {
+		out += fmt.Sprintf(" ssl sni str(%s)", se.SNI)
+		if se.caFile != "" {
+			out += " verify required ca-file " + se.caFile
+		} else {
+			out += " verify none"
+		}
+		if se.crt != "" {
+			out += " crt " + se.crt
+		}
+	}
+	if se.Weight > 0 || se.weighted {
+		out += fmt.Sprintf(" weight %d", se.Weight)
+	}
+	if se.SendProxy && se.version.atLeast(proxyProtocolVersion) {
+		out += " send-proxy"
+	}
+	if se.Observe != "" {
+		out += " observe " + se.Observe
+	}
+	if se.AgentPort != 0 {
+		out += fmt.Sprintf(" agent-check agent-port %d", se.AgentPort)
+	}
+	if se.Backup {
+		out += " backup"
+	}
+	if se.Disabled {
+		out += " disabled"
+	}
+	return out
+}
+
+// groupDatacenters orders the servers so those of each datacenter are
+// together, in the order the datacenters first appear, and annotates
+// the first server of each group with a "# datacenter: X" comment
+func groupDatacenters(servers []*ServerEntry) {
+	order := make(map[string]int)
+	for _, server := range servers {
+		if _, ok := order[server.Datacenter]; !ok {
+			order[server.Datacenter] = len(order)
+		}
+	}
+	sort.SliceStable(servers, func(i, j int) bool {
+		return order[servers[i].Datacenter] < order[servers[j].Datacenter]
+	})
+	for idx, server := range servers {
+		if server.Datacenter == "" {
+			continue
+		}
+		if idx == 0 || servers[idx-1].Datacenter != server.Datacenter {
+			server.Comment = "# datacenter: " + server.Datacenter
+		}
+	}
+}
+
+// placeholderServer returns the disabled server used
+// to populate an empty backend
+func placeholderServer(addr string) (*ServerEntry, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid placeholder address '%s': %v", addr, err)
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return nil, fmt.Errorf("Invalid placeholder address '%s': not an IP", addr)
+	}
+	p, err := strconv.Atoi(port)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid placeholder address '%s': %v", addr, err)
+	}
+	return &ServerEntry{
+		Node:     placeholderName,
+		IP:       ip,
+		Port:     p,
+		Disabled: true,
+	}, nil
+}
+
+// addPlaceholders adds a placeholder server to any empty backend
+func addPlaceholders(out map[string][]*ServerEntry, addr string) error {
+	for backend, servers := range out {
+		if len(servers) != 0 {
+			continue
+		}
+		placeholder, err := placeholderServer(addr)
+		if err != nil {
+			return err
+		}
+		out[backend] = []*ServerEntry{placeholder}
+	}
+	return nil
+}
+
+// isPassing checks if all the health checks of an entry are passing
+func isPassing(entry *consulapi.ServiceEntry) bool {
+	for _, check := range entry.Checks {
+		if check.Status != "passing" {
+			return false
+		}
+	}
+	return true
+}
+
+// checkWeight is used to scale the weight of a server by the ratio
+// of its checks that are passing, rounded and at least one, or zero
+// if none are passing. The full weight is taken from the meta key
+// of the watch if any, or a "weight=N" tag, or defaultServerWeight.
+func checkWeight(watch *WatchPath, entry *consulapi.ServiceEntry, meta map[string]string) int {
+	var weight int
+	if watch.WeightKey != "" {
+		weight, _ = keyWeight(watch, meta)
+	} else if n, ok := tagInt(entry.Service.Tags, "weight"); ok && n > 0 {
+		weight = n
+	} else {
+		weight = defaultServerWeight
+	}
+	if weight == 0 {
+		return 0
+	}
+	if len(entry.Checks) == 0 {
+		return weight
+	}
+	passing := 0
+	for _, check := range entry.Checks {
+		if check.Status == "passing" {
+			passing++
+		}
+	}
+	if passing == 0 {
+		return 0
+	}
+	total := len(entry.Checks)
+	scaled := (weight*passing + total/2) / total
+	if scaled < 1 {
+		scaled = 1
+	}
+	return scaled
+}
+
+// keyWeight returns the weight of a server from the meta with the weight
+// key of the watch, clamped between 0 and maxServerWeight. The default
+// weight of the watch is used if the meta is missing or not a number.
+// Returns why the meta is invalid, if it is.
+func keyWeight(watch *WatchPath, meta map[string]string) (int, string) {
+	raw, ok := meta[watch.WeightKey]
+	if !ok {
+		return watch.DefaultWeight, ""
+	}
+	n, err := strconv.Atoi(raw)
+	switch {
+	case err != nil:
+		return watch.DefaultWeight, fmt.Sprintf("%s=%s is not a number, using %d",
+			watch.WeightKey, raw, watch.DefaultWeight)
+	case n < 0:
+		return 0, fmt.Sprintf("%s=%s is out of range, using 0", watch.WeightKey, raw)
+	case n > maxServerWeight:
+		return maxServerWeight, fmt.Sprintf("%s=%s is out of range, using %d",
+			watch.WeightKey, raw, maxServerWeight)
+	}
+	return n, ""
+}
+
+// warnWeights is used to warn of the instances with an invalid
+// weight meta, once when the entries of the watch change
+func warnWeights(watch *WatchPath, entries []*consulapi.ServiceEntry, details instanceDetails) {
+	if watch.WeightKey == "" {
+		return
+	}
+	for _, entry := range entries {
+		if _, invalid := keyWeight(watch, entryMeta(details, entry)); invalid != "" {
+			log.Printf("[WARN] Invalid weight of %s on node %s for %v: %s",
+				entry.Service.ID, entry.Node.Node, watch, invalid)
+		}
+	}
+}
+
+// backendSortMode returns the sort mode of a backend, which is
+// the first sort mode given by any of its watches
+func backendSortMode(entries []*backendEntry) string {
+	for _, entry := range entries {
+		if entry.Watch != nil && entry.Watch.SortMode != "" {
+			return entry.Watch.SortMode
+		}
+	}
+	return ""
+}
+
+// dedupeServers removes the servers sharing the address, port and
+// SNI of an earlier server, keeping the first
+func dedupeServers(servers []*ServerEntry) []*ServerEntry {
+	seen := make(map[string]bool, len(servers))
+	out := make([]*ServerEntry, 0, len(servers))
+	for _, server := range servers {
+		addr := server.Address() + " " + server.SNI
+		if seen[addr] {
+			continue
+		}
+		seen[addr] = true
+		out = append(out, server)
+	}
+	return out
+}
+
+// dedupeGateways collapses the servers reached through the same
+// mesh gateway route, which are otherwise identical, keeping the
+// first that is enabled
+func dedupeGateways(servers []*ServerEntry) []*ServerEntry {
+	seen := make(map[string]int)
+	out := make([]*ServerEntry, 0, len(servers))
+	for _, server := range servers {
+		if server.SNI == "" {
+			out = append(out, server)
+			continue
+		}
+		route := server.Address() + " " + server.SNI
+		if idx, ok := seen[route]; ok {
+			if out[idx].Disabled && !server.Disabled {
+				out[idx] = server
+			}
+			continue
+		}
+		seen[route] = len(out)
+		out = append(out, server)
+	}
+	return out
+}
+
+// sortServers sorts the servers according to the sort mode. Weight
+// and priority are taken from "weight=N" and "priority=N" tags. Servers
+// are sorted by weight descending and priority ascending, with ties
+// and servers missing the tag ordered by name.
+func sortServers(servers []*ServerEntry, mode string) {
+	byName := func(i, j int) bool {
+		if servers[i].Node != servers[j].Node {
+			return servers[i].Node < servers[j].Node
+		}
+		return servers[i].ID < servers[j].ID
+	}
+	switch mode {
+	case "name":
+		sort.SliceStable(servers, byName)
+	case "address":
+		sort.SliceStable(servers, func(i, j int) bool {
+			if c := bytes.Compare(servers[i].IP.To16(), servers[j].IP.To16()); c != 0 {
+				return c < 0
+			}
+			if servers[i].Port != servers[j].Port {
+				return servers[i].Port < servers[j].Port
+			}
+			return byName(i, j)
+		})
+	case "weight":
+		sort.SliceStable(servers, func(i, j int) bool {
+			wi, _ := tagInt(servers[i].Tags, "weight")
+			wj, _ := tagInt(servers[j].Tags, "weight")
+			if wi != wj {
+				return wi > wj
+			}
+			return byName(i, j)
+		})
+	case "priority":
+		sort.SliceStable(servers, func(i, j int) bool {
+			pi, iok := tagInt(servers[i].Tags, "priority")
+			pj, jok := tagInt(servers[j].Tags, "priority")
+			if iok != jok {
+				return iok
+			}
+			if pi != pj {
+				return pi < pj
+			}
+			return byName(i, j)
+		})
+	}
+}
+
+// parseTagMap splits the "key=value" tags into a map. Tags
+// without a "=" are left out.
+func parseTagMap(tags []string) map[string]string {
+	out := make(map[string]string)
+	for _, tag := range tags {
+		idx := strings.Index(tag, "=")
+		if idx < 1 {
+			continue
+		}
+		key := tag[:idx]
+		if _, ok := out[key]; !ok {
+			out[key] = tag[idx+1:]
+		}
+	}
+	return out
+}
+
+// tagInt returns the integer value of a "key=N" tag
+func tagInt(tags []string, key string) (int, bool) {
+	prefix := key + "="
+	for _, tag := range tags {
+		if !strings.HasPrefix(tag, prefix) {
+			continue
+		}
+		n, err := strconv.Atoi(strings.TrimPrefix(tag, prefix))
+		if err != nil {
+			continue
+		}
+		return n, true
+	}
+	return 0, false
 }
 
 // formatOutput converts the service entries into a format
 // suitable for templating into the HAProxy file
-func formatOutput(inp map[string][]*consulapi.ServiceEntry) map[string][]*ServerEntry {
+func formatOutput(inp map[string][]*backendEntry) map[string][]*ServerEntry {
 	out := make(map[string][]*ServerEntry)
 	for backend, entries := range inp {
 		servers := make([]*ServerEntry, len(entries))
 		for idx, entry := range entries {
-			servers[idx] = &ServerEntry{
+			server := &ServerEntry{
 				ID:      entry.Service.ID,
 				Service: entry.Service.Service,
 				Tags:    entry.Service.Tags,
+				TagMap:  parseTagMap(entry.Service.Tags),
+				Meta:    entry.Meta,
 				Port:    entry.Service.Port,
 				IP:      net.ParseIP(entry.Node.Address),
 				Node:    entry.Node.Node,
+				Kind:    entry.Kind,
+			}
+			if server.Kind == "" {
+				server.Kind = kindTypical
 			}
+			if server.IP == nil {
+				server.Host = entry.Node.Address
+			}
+			if w := entry.Watch; w != nil {
+				server.Datacenter = w.Datacenter
+				if server.Datacenter == "" {
+					server.Datacenter = localDatacenter
+				}
+				server.Protocol = w.Protocol
+				server.SendProxy = w.SendProxy
+				server.Observe = w.Observe
+				server.AgentPort = w.AgentPort
+				server.Disabled = w.IncludeUnhealthy && !isPassing(entry.ServiceEntry)
+				server.Backup = w.Backup
+				if w.WeightKey != "" {
+					server.Weight, _ = keyWeight(w, server.Meta)
+					server.weighted = true
+				}
+				if w.CheckWeight {
+					// Only servers without any passing check are disabled
+					server.Weight = checkWeight(w, entry.ServiceEntry, entry.Meta)
+					server.Disabled = w.IncludeUnhealthy && server.Weight == 0
+				}
+				if w.meshGatewayAddr != nil {
+					server.IP = w.meshGatewayAddr.IP
+					server.Host = ""
+					server.Port = w.meshGatewayAddr.Port
+					server.SNI = w.meshSNI
+				}
+			}
+			if !entry.WarmUntil.IsZero() {
+				server.Disabled = true
+			}
+			servers[idx] = server
 		}
-		out[backend] = servers
+		sortServers(servers, backendSortMode(entries))
+
+		// Backup servers are always placed last
+		sort.SliceStable(servers, func(i, j int) bool {
+			return !servers[i].Backup && servers[j].Backup
+		})
+		out[backend] = dedupeGateways(servers)
 	}
 	return out
 }
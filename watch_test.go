@@ -2,13 +2,102 @@ package main
 
 import (
 	"bytes"
+	"errors"
+	"fmt"
 	"github.com/armon/consul-api"
 	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
 	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
 	"testing"
+	"text/template"
 	"time"
 )
 
+func TestConsulConfig(t *testing.T) {
+	consulConf, err := consulConfig(&Config{Address: "127.0.0.2:8500"})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if consulConf.Address != "127.0.0.2:8500" {
+		t.Fatalf("bad: %v", consulConf)
+	}
+	transport, ok := consulConf.HttpClient.Transport.(*timeoutTransport)
+	if !ok || transport.base != nil || transport.margin != defaultQueryTimeoutMargin {
+		t.Fatalf("bad: %#v", consulConf.HttpClient)
+	}
+
+	consulConf, err = consulConfig(&Config{BindAddr: "10.1.2.3"})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	transport, ok = consulConf.HttpClient.Transport.(*timeoutTransport)
+	if !ok || transport.base == nil {
+		t.Fatalf("expected custom transport")
+	}
+
+	if _, err := consulConfig(&Config{BindAddr: "bogus"}); err == nil {
+		t.Fatalf("expected error")
+	}
+}
+
+func TestConsulConfig_Env(t *testing.T) {
+	t.Setenv("CONSUL_HTTP_ADDR", "10.0.0.1:8501")
+	t.Setenv("CONSUL_HTTP_TOKEN", "secret")
+	t.Setenv("CONSUL_HTTP_SSL", "true")
+	t.Setenv("CONSUL_HTTP_SSL_VERIFY", "false")
+
+	consulConf, err := consulConfig(&Config{})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if consulConf.Address != "10.0.0.1:8501" {
+		t.Fatalf("bad: %v", consulConf.Address)
+	}
+	if consulConf.Token != "secret" {
+		t.Fatalf("bad: %v", consulConf.Token)
+	}
+	if consulConf.Scheme != "https" {
+		t.Fatalf("bad: %v", consulConf.Scheme)
+	}
+	transport, ok := consulConf.HttpClient.Transport.(*timeoutTransport).base.(*http.Transport)
+	if !ok || !transport.TLSClientConfig.InsecureSkipVerify {
+		t.Fatalf("bad: %#v", consulConf.HttpClient)
+	}
+
+	// Explicit configuration takes precedence
+	consulConf, err = consulConfig(&Config{Address: "127.0.0.2:8500", Token: "mine"})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if consulConf.Address != "127.0.0.2:8500" || consulConf.Token != "mine" {
+		t.Fatalf("bad: %v", consulConf)
+	}
+
+	t.Setenv("CONSUL_HTTP_SSL", "bogus")
+	if _, err := consulConfig(&Config{}); err == nil {
+		t.Fatalf("expected error")
+	}
+}
+
+func TestLocalDialer(t *testing.T) {
+	dialer, err := localDialer("10.1.2.3")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	addr, ok := dialer.LocalAddr.(*net.TCPAddr)
+	if !ok {
+		t.Fatalf("bad: %#v", dialer.LocalAddr)
+	}
+	if !addr.IP.Equal(net.ParseIP("10.1.2.3")) {
+		t.Fatalf("bad: %v", addr)
+	}
+}
+
 func TestMaybeRefresh(t *testing.T) {
 	defer os.Remove("config_out")
 	defer os.Remove("config_out2")
@@ -48,156 +137,2923 @@ func TestMaybeRefresh(t *testing.T) {
 		ReloadCommand: "echo 'foo' > reload_out",
 	}
 
-	// Attempt a refresh
-	if maybeRefresh(conf, d) {
-		t.Fatalf("unexpected exit")
+	// Attempt a refresh
+	if maybeRefresh(conf, d) {
+		t.Fatalf("unexpected exit")
+	}
+
+	// Check config file
+	out, err := ioutil.ReadFile("config_out")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	expect, err := ioutil.ReadFile("test-fixtures/simple.conf.out")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !bytes.Equal(out, expect) {
+		t.Fatalf("bad: %s", out)
+	}
+
+	// Check second config file
+	out2, err := ioutil.ReadFile("config_out2")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	expect2, err := ioutil.ReadFile("test-fixtures/varnish.vcl.out")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !bytes.Equal(out2, expect2) {
+		t.Fatalf("bad: %s", out)
+	}
+
+	// Check reload fie
+	bytes, err := ioutil.ReadFile("reload_out")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if string(bytes) != "foo\n" {
+		t.Fatalf("bad: %v", bytes)
+	}
+}
+
+func TestMaybeRefresh_NoReload(t *testing.T) {
+	defer os.Remove("config_out")
+
+	en1 := &consulapi.ServiceEntry{
+		Node:    &consulapi.Node{Node: "node1", Address: "127.0.0.1"},
+		Service: &consulapi.AgentService{ID: "app", Port: 8000},
+	}
+	wp1 := &WatchPath{Backend: "app"}
+	d := &backendData{
+		Servers: map[*WatchPath][]*consulapi.ServiceEntry{
+			wp1: []*consulapi.ServiceEntry{en1},
+		},
+		Backends: map[string][]*WatchPath{
+			"app": []*WatchPath{wp1},
+		},
+	}
+	conf := &Config{
+		watches:   []*WatchPath{wp1},
+		Templates: []string{"test-fixtures/simple.conf"},
+		Paths:     []string{"config_out"},
+	}
+
+	// Attempt a refresh
+	if maybeRefresh(conf, d) {
+		t.Fatalf("unexpected exit")
+	}
+
+	// Check config file
+	out, err := ioutil.ReadFile("config_out")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !bytes.Contains(out, []byte("server node1_app 127.0.0.1:8000")) {
+		t.Fatalf("bad: %s", out)
+	}
+}
+
+func TestForceRefresh_ReportsError(t *testing.T) {
+	wp1 := &WatchPath{Backend: "app"}
+	d := &backendData{
+		Servers: map[*WatchPath][]*consulapi.ServiceEntry{
+			wp1: nil,
+		},
+		Backends: map[string][]*WatchPath{
+			"app": []*WatchPath{wp1},
+		},
+		ErrCh: make(chan error, 1),
+	}
+	conf := &Config{
+		watches:   []*WatchPath{wp1},
+		Templates: []string{"test-fixtures/bad.conf"},
+		Paths:     []string{"config_out"},
+	}
+
+	if forceRefresh(conf, d) {
+		t.Fatalf("unexpected exit")
+	}
+
+	select {
+	case err := <-d.ErrCh:
+		rerr, ok := err.(*RefreshError)
+		if !ok {
+			t.Fatalf("bad: %#v", err)
+		}
+		if rerr.Stage != "render" || rerr.Path != "test-fixtures/bad.conf" {
+			t.Fatalf("bad: %#v", rerr)
+		}
+	default:
+		t.Fatalf("expected error")
+	}
+}
+
+func TestForceRefresh_BadTemplate(t *testing.T) {
+	defer os.Remove("config_out")
+	defer os.Remove("template_in")
+
+	en1 := &consulapi.ServiceEntry{
+		Node:    &consulapi.Node{Node: "node1", Address: "127.0.0.1"},
+		Service: &consulapi.AgentService{ID: "app", Port: 8000},
+	}
+	wp1 := &WatchPath{Backend: "app"}
+	d := &backendData{
+		Servers: map[*WatchPath][]*consulapi.ServiceEntry{
+			wp1: []*consulapi.ServiceEntry{en1},
+		},
+		Backends: map[string][]*WatchPath{
+			"app": []*WatchPath{wp1},
+		},
+	}
+	conf := &Config{
+		watches:   []*WatchPath{wp1},
+		Templates: []string{"template_in"},
+		Paths:     []string{"config_out"},
+	}
+
+	// Render a good configuration
+	good, err := ioutil.ReadFile("test-fixtures/simple.conf")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := ioutil.WriteFile("template_in", good, 0660); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if forceRefresh(conf, d) {
+		t.Fatalf("unexpected exit")
+	}
+	expect, err := ioutil.ReadFile("config_out")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Break the template, the watcher should continue and
+	// the last configuration should be kept
+	bad, err := ioutil.ReadFile("test-fixtures/bad.conf")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := ioutil.WriteFile("template_in", bad, 0660); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	d.Servers[wp1] = nil
+	if forceRefresh(conf, d) {
+		t.Fatalf("unexpected exit")
+	}
+	out, err := ioutil.ReadFile("config_out")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !bytes.Equal(out, expect) {
+		t.Fatalf("bad: %s", out)
+	}
+
+	// Fix the template, should recover
+	if err := ioutil.WriteFile("template_in", good, 0660); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if forceRefresh(conf, d) {
+		t.Fatalf("unexpected exit")
+	}
+	out, err = ioutil.ReadFile("config_out")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if bytes.Contains(out, []byte("node1")) {
+		t.Fatalf("bad: %s", out)
+	}
+}
+
+// fakeApplier captures what would be applied
+type fakeApplier struct {
+	rendered map[string][]byte
+	changed  []string
+	err      error
+}
+
+func (f *fakeApplier) Apply(rendered map[string][]byte, changed []string) error {
+	f.rendered = rendered
+	f.changed = changed
+	return f.err
+}
+
+func TestForceRefresh_Applier(t *testing.T) {
+	wp1 := &WatchPath{Backend: "app"}
+	wp2 := &WatchPath{Backend: "db"}
+	d := &backendData{
+		Servers: make(map[*WatchPath][]*consulapi.ServiceEntry),
+		Backends: map[string][]*WatchPath{
+			"app": []*WatchPath{wp1},
+			"db":  []*WatchPath{wp2},
+		},
+		ChangeCh: make(chan struct{}, 1),
+	}
+	applier := &fakeApplier{}
+	conf := &Config{
+		watches:   []*WatchPath{wp1, wp2},
+		Templates: []string{"test-fixtures/simple.conf", "test-fixtures/varnish.vcl"},
+		Paths:     []string{"config_out", "config_out2"},
+		Applier:   applier,
+	}
+
+	en1 := &consulapi.ServiceEntry{
+		Node:    &consulapi.Node{Node: "node1", Address: "127.0.0.1"},
+		Service: &consulapi.AgentService{ID: "app", Port: 8000},
+	}
+	updateEntries(conf, d, wp1, []*consulapi.ServiceEntry{en1}, nil)
+	updateEntries(conf, d, wp2, nil, nil)
+
+	if forceRefresh(conf, d) {
+		t.Fatalf("unexpected exit")
+	}
+	if len(applier.rendered) != 2 {
+		t.Fatalf("bad: %v", applier.rendered)
+	}
+	if !bytes.Contains(applier.rendered["config_out"], []byte("server node1_app")) {
+		t.Fatalf("bad: %s", applier.rendered["config_out"])
+	}
+	if !bytes.Contains(applier.rendered["config_out2"], []byte("backend node1_app")) {
+		t.Fatalf("bad: %s", applier.rendered["config_out2"])
+	}
+	if !reflect.DeepEqual(applier.changed, []string{"app", "db"}) {
+		t.Fatalf("bad: %v", applier.changed)
+	}
+
+	// Nothing changed since
+	if forceRefresh(conf, d) {
+		t.Fatalf("unexpected exit")
+	}
+	if len(applier.changed) != 0 {
+		t.Fatalf("bad: %v", applier.changed)
+	}
+
+	// Changes are kept if the apply fails
+	applier.err = errors.New("failed")
+	updateEntries(conf, d, wp2, []*consulapi.ServiceEntry{en1}, nil)
+	if forceRefresh(conf, d) {
+		t.Fatalf("unexpected exit")
+	}
+	applier.err = nil
+	if forceRefresh(conf, d) {
+		t.Fatalf("unexpected exit")
+	}
+	if !reflect.DeepEqual(applier.changed, []string{"db"}) {
+		t.Fatalf("bad: %v", applier.changed)
+	}
+}
+
+type fakeQuerier struct {
+	entries    []*consulapi.ServiceEntry
+	details    instanceDetails
+	resolvers  map[string]*ServiceResolver
+	intentions map[string][]*Intention
+	blockCh    chan struct{}
+	stopCh     chan struct{}
+	err        error
+	calls      int
+}
+
+func (f *fakeQuerier) Service(service, tag string, passingOnly bool,
+	q *consulapi.QueryOptions) ([]*consulapi.ServiceEntry, instanceDetails, *consulapi.QueryMeta, error) {
+	f.calls++
+	if f.err != nil {
+		return nil, nil, nil, f.err
+	}
+	if f.blockCh != nil {
+		<-f.blockCh
+	}
+	if q.WaitIndex != 0 {
+		<-f.stopCh
+	}
+	var out []*consulapi.ServiceEntry
+	for _, entry := range f.entries {
+		node := *entry.Node
+		out = append(out, &consulapi.ServiceEntry{Node: &node, Service: entry.Service})
+	}
+	return out, f.details, &consulapi.QueryMeta{LastIndex: 10, RequestTime: time.Millisecond}, nil
+}
+
+func (f *fakeQuerier) Connect(service, tag string, passingOnly bool,
+	q *consulapi.QueryOptions) ([]*consulapi.ServiceEntry, instanceDetails, *consulapi.QueryMeta, error) {
+	return nil, nil, nil, errors.New("not supported")
+}
+
+func (f *fakeQuerier) Resolver(service string,
+	q *consulapi.QueryOptions) (*ServiceResolver, error) {
+	return f.resolvers[service], nil
+}
+
+func (f *fakeQuerier) Intentions(service string,
+	q *consulapi.QueryOptions) ([]*Intention, *consulapi.QueryMeta, error) {
+	if f.err != nil {
+		return nil, nil, f.err
+	}
+	return f.intentions[service], &consulapi.QueryMeta{LastIndex: 10}, nil
+}
+
+func TestQueryOptions(t *testing.T) {
+	cases := []struct {
+		consistency string
+		stale       bool
+		consistent  bool
+	}{
+		{"", false, false},
+		{"default", false, false},
+		{"stale", true, false},
+		{"consistent", false, true},
+	}
+	for _, c := range cases {
+		wp := &WatchPath{Datacenter: "dc2", Consistency: c.consistency}
+		opts := queryOptions(wp)
+		if opts.Datacenter != "dc2" {
+			t.Fatalf("bad: %v", opts)
+		}
+		if opts.AllowStale != c.stale || opts.RequireConsistent != c.consistent {
+			t.Fatalf("bad: %s %v", c.consistency, opts)
+		}
+	}
+}
+
+func TestForceRefresh_PerDatacenter(t *testing.T) {
+	wp1 := &WatchPath{Backend: "app", Datacenter: "dc1"}
+	wp2 := &WatchPath{Backend: "app", Datacenter: "dc2"}
+	d := &backendData{
+		Servers: make(map[*WatchPath][]*consulapi.ServiceEntry),
+		Backends: map[string][]*WatchPath{
+			"app": []*WatchPath{wp1, wp2},
+		},
+		ChangeCh: make(chan struct{}, 1),
+	}
+	dir, err := ioutil.TempDir("", "consul-haproxy")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	conf := &Config{
+		watches:       []*WatchPath{wp1, wp2},
+		Templates:     []string{"test-fixtures/simple.conf"},
+		Paths:         []string{filepath.Join(dir, "config_{{.Datacenter}}")},
+		PerDatacenter: true,
+	}
+
+	en1 := &consulapi.ServiceEntry{
+		Node:    &consulapi.Node{Node: "node1", Address: "127.0.0.1"},
+		Service: &consulapi.AgentService{ID: "app", Port: 8000},
+	}
+	en2 := &consulapi.ServiceEntry{
+		Node:    &consulapi.Node{Node: "node2", Address: "127.0.0.2"},
+		Service: &consulapi.AgentService{ID: "app", Port: 8000},
+	}
+	updateEntries(conf, d, wp1, []*consulapi.ServiceEntry{en1}, nil)
+	updateEntries(conf, d, wp2, []*consulapi.ServiceEntry{en2}, nil)
+
+	if forceRefresh(conf, d) {
+		t.Fatalf("unexpected exit")
+	}
+
+	// A file is written for each datacenter
+	files, err := filepath.Glob(filepath.Join(dir, "config_*"))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(files) != 2 {
+		t.Fatalf("bad: %v", files)
+	}
+	dc1, err := ioutil.ReadFile(filepath.Join(dir, "config_dc1"))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	dc2, err := ioutil.ReadFile(filepath.Join(dir, "config_dc2"))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !bytes.Contains(dc1, []byte("server node1_app")) || bytes.Contains(dc1, []byte("node2")) {
+		t.Fatalf("bad: %s", dc1)
+	}
+	if !bytes.Contains(dc2, []byte("server node2_app")) || bytes.Contains(dc2, []byte("node1")) {
+		t.Fatalf("bad: %s", dc2)
+	}
+}
+
+func TestStartWatches_Stagger(t *testing.T) {
+	conf := &Config{StartupStagger: 20 * time.Millisecond}
+	for i := 0; i < 4; i++ {
+		conf.watches = append(conf.watches, &WatchPath{Backend: "app"})
+	}
+	d := &backendData{StopCh: make(chan struct{})}
+
+	launchCh := make(chan time.Time, len(conf.watches))
+	start := time.Now()
+	startWatches(conf, d, func(idx int, watch *WatchPath) {
+		launchCh <- time.Now()
+	})
+
+	// Each launch after the first waits at least half the stagger
+	var last time.Time
+	for range conf.watches {
+		select {
+		case at := <-launchCh:
+			if at.After(last) {
+				last = at
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("timeout")
+		}
+	}
+	if spread := last.Sub(start); spread < 30*time.Millisecond {
+		t.Fatalf("bad: %v", spread)
+	}
+
+	// Without a stagger the watches start at once
+	conf.StartupStagger = 0
+	start = time.Now()
+	startWatches(conf, d, func(idx int, watch *WatchPath) {})
+	if elapsed := time.Since(start); elapsed > 10*time.Millisecond {
+		t.Fatalf("bad: %v", elapsed)
+	}
+}
+
+func TestClassifyError(t *testing.T) {
+	cases := []struct {
+		err   error
+		class errorClass
+	}{
+		{nil, errNone},
+		{errors.New("dial tcp 127.0.0.1:8500: connection refused"), errTransient},
+		{&statusError{Code: 500, Body: "rpc error"}, errTransient},
+		{&statusError{Code: 403, Body: "Permission denied"}, errPermissionDenied},
+		{&statusError{Code: 403, Body: "ACL not found"}, errPermissionDenied},
+		{&statusError{Code: 404}, errNotFound},
+		// Errors only mentioning a response code are not classified
+		{errors.New("Unexpected response code: 403 (Permission denied)"), errTransient},
+	}
+	for _, c := range cases {
+		if class := classifyError(c.err); class != c.class {
+			t.Fatalf("bad: %v %v", c.err, class)
+		}
+	}
+}
+
+func TestRunSingleWatch_PermissionDenied(t *testing.T) {
+	querier := &fakeQuerier{
+		err: &statusError{Code: 403, Body: "Permission denied"},
+	}
+	wp := &WatchPath{Spec: "app=app", Backend: "app", Service: "app"}
+	d := &backendData{
+		Querier:  querier,
+		Servers:  make(map[*WatchPath][]*consulapi.ServiceEntry),
+		Backends: map[string][]*WatchPath{"app": []*WatchPath{wp}},
+		ChangeCh: make(chan struct{}, 1),
+		StopCh:   make(chan struct{}),
+		ErrCh:    make(chan error, 1),
+	}
+	conf := &Config{watches: []*WatchPath{wp}}
+
+	// The error is reported, and the watch waits long to retry
+	doneCh := make(chan struct{})
+	go func() {
+		runSingleWatch(conf, d, 0, wp)
+		close(doneCh)
+	}()
+	select {
+	case err := <-d.ErrCh:
+		rerr, ok := err.(*RefreshError)
+		if !ok || rerr.Stage != "query" || rerr.Path != "app=app" {
+			t.Fatalf("bad: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("timeout")
+	}
+	select {
+	case <-doneCh:
+		t.Fatalf("watch stopped")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// The watch is not ready until the ACLs are fixed
+	if reason := notReady(conf, d); !strings.Contains(reason, "permission denied") {
+		t.Fatalf("bad: %s", reason)
+	}
+
+	// But still stops promptly
+	close(d.StopCh)
+	select {
+	case <-doneCh:
+	case <-time.After(time.Second):
+		t.Fatalf("timeout")
+	}
+	if querier.calls != 1 {
+		t.Fatalf("bad: %d", querier.calls)
+	}
+}
+
+func TestRunSingleWatch_MaxFailures(t *testing.T) {
+	querier := &fakeQuerier{err: errors.New("dial tcp 127.0.0.1:8500: connection refused")}
+	wp := &WatchPath{Spec: "app=app?max_failures=1", Backend: "app", Service: "app", MaxFailures: 1}
+	d := &backendData{
+		Querier:  querier,
+		Servers:  make(map[*WatchPath][]*consulapi.ServiceEntry),
+		Backends: map[string][]*WatchPath{"app": []*WatchPath{wp}},
+		ChangeCh: make(chan struct{}, 1),
+		StopCh:   make(chan struct{}),
+		ErrCh:    make(chan error, 1),
+		FatalCh:  make(chan struct{}, 1),
+	}
+	conf := &Config{watches: []*WatchPath{wp}, MaxConsecutiveFailures: 5}
+	if limit := failureLimit(conf, wp); limit != 1 {
+		t.Fatalf("bad: %d", limit)
+	}
+
+	// Exhausting the failures stops the watch and the monitor
+	doneCh := make(chan struct{})
+	go func() {
+		runSingleWatch(conf, d, 0, wp)
+		monitor(conf, d)
+		close(doneCh)
+	}()
+	select {
+	case <-doneCh:
+	case <-time.After(time.Second):
+		t.Fatalf("timeout")
+	}
+	if querier.calls != 1 {
+		t.Fatalf("bad: %d", querier.calls)
+	}
+	select {
+	case err := <-d.ErrCh:
+		if rerr, ok := err.(*RefreshError); !ok || rerr.Stage != "query" {
+			t.Fatalf("bad: %v", err)
+		}
+	default:
+		t.Fatalf("expected error")
+	}
+
+	// Without any limit the failures are retried
+	if limit := failureLimit(&Config{}, &WatchPath{}); limit != 0 {
+		t.Fatalf("bad: %d", limit)
+	}
+}
+
+func TestRunSingleWatch_MaxFailuresNotRetried(t *testing.T) {
+	querier := &fakeQuerier{
+		err: &statusError{Code: 403, Body: "Permission denied"},
+	}
+	wp := &WatchPath{Spec: "app=app", Backend: "app", Service: "app"}
+	d := &backendData{
+		Querier:  querier,
+		Servers:  make(map[*WatchPath][]*consulapi.ServiceEntry),
+		Backends: map[string][]*WatchPath{"app": []*WatchPath{wp}},
+		ChangeCh: make(chan struct{}, 1),
+		StopCh:   make(chan struct{}),
+		ErrCh:    make(chan error, 1),
+		FatalCh:  make(chan struct{}, 1),
+	}
+	conf := &Config{watches: []*WatchPath{wp}, MaxConsecutiveFailures: 3}
+
+	// An error that is not retried exits, rather than never
+	// reaching the limit
+	doneCh := make(chan struct{})
+	go func() {
+		runSingleWatch(conf, d, 0, wp)
+		monitor(conf, d)
+		close(doneCh)
+	}()
+	select {
+	case <-doneCh:
+	case <-time.After(time.Second):
+		t.Fatalf("timeout")
+	}
+	if querier.calls != 1 {
+		t.Fatalf("bad: %d", querier.calls)
+	}
+}
+
+func TestRunSingleWatch_AllowMissing(t *testing.T) {
+	for _, allow := range []bool{false, true} {
+		querier := &fakeQuerier{
+			err: &statusError{Code: 500, Body: "No path to datacenter"},
+		}
+		wp := &WatchPath{Spec: "app=app@dc9", Backend: "app", Service: "app",
+			Datacenter: "dc9", AllowMissing: allow}
+		d := &backendData{
+			Querier:  querier,
+			Servers:  make(map[*WatchPath][]*consulapi.ServiceEntry),
+			Backends: map[string][]*WatchPath{"app": []*WatchPath{wp}},
+			ChangeCh: make(chan struct{}, 1),
+			StopCh:   make(chan struct{}),
+		}
+		conf := &Config{DryRun: true, watches: []*WatchPath{wp}}
+		runSingleWatch(conf, d, 0, wp)
+
+		// A missing service is empty rather than a failure
+		entries, ok := d.Servers[wp]
+		if !ok || len(entries) != 0 {
+			t.Fatalf("bad: %v %v", allow, entries)
+		}
+		failures := d.Stats[wp].Failures
+		if allow && failures != 0 || !allow && failures != 1 {
+			t.Fatalf("bad: %v %d", allow, failures)
+		}
+	}
+}
+
+func TestRunSingleWatch_FakeQuerier(t *testing.T) {
+	stopCh := make(chan struct{})
+	querier := &fakeQuerier{
+		entries: []*consulapi.ServiceEntry{
+			&consulapi.ServiceEntry{
+				Node:    &consulapi.Node{Node: "node1", Address: "127.0.0.1"},
+				Service: &consulapi.AgentService{ID: "app", Port: 8000},
+			},
+		},
+		stopCh: stopCh,
+	}
+	wp := &WatchPath{Backend: "app", Service: "app"}
+	d := &backendData{
+		Querier:  querier,
+		Servers:  make(map[*WatchPath][]*consulapi.ServiceEntry),
+		Backends: map[string][]*WatchPath{"app": []*WatchPath{wp}},
+		ChangeCh: make(chan struct{}, 1),
+		StopCh:   stopCh,
+	}
+	applier := &fakeApplier{}
+	conf := &Config{
+		watches:   []*WatchPath{wp},
+		Templates: []string{"test-fixtures/simple.conf"},
+		Paths:     []string{"config_out"},
+		Applier:   applier,
+	}
+
+	doneCh := make(chan struct{})
+	go func() {
+		runSingleWatch(conf, d, 0, wp)
+		close(doneCh)
+	}()
+
+	select {
+	case <-d.ChangeCh:
+	case <-time.After(time.Second):
+		t.Fatalf("timeout")
+	}
+	if maybeRefresh(conf, d) {
+		t.Fatalf("unexpected exit")
+	}
+	if !bytes.Contains(applier.rendered["config_out"], []byte("server 0_node1_app 127.0.0.1:8000")) {
+		t.Fatalf("bad: %s", applier.rendered["config_out"])
+	}
+
+	// The query details are recorded
+	d.Lock()
+	stats := *d.Stats[wp]
+	d.Unlock()
+	if stats.LastIndex != 10 || stats.RequestTime != time.Millisecond || stats.LastQuery.IsZero() {
+		t.Fatalf("bad: %v", stats)
+	}
+
+	close(stopCh)
+	select {
+	case <-doneCh:
+	case <-time.After(time.Second):
+		t.Fatalf("timeout")
+	}
+}
+
+func TestInitialRender(t *testing.T) {
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	querier := &fakeQuerier{
+		entries: []*consulapi.ServiceEntry{
+			&consulapi.ServiceEntry{
+				Node:    &consulapi.Node{Node: "node1", Address: "127.0.0.1"},
+				Service: &consulapi.AgentService{ID: "app", Port: 8000},
+			},
+		},
+		stopCh: stopCh,
+	}
+	wp := &WatchPath{Backend: "app", Service: "app"}
+	d := &backendData{
+		Querier:  querier,
+		Servers:  make(map[*WatchPath][]*consulapi.ServiceEntry),
+		Backends: map[string][]*WatchPath{"app": []*WatchPath{wp}},
+		ChangeCh: make(chan struct{}, 1),
+		StopCh:   stopCh,
+	}
+	applier := &fakeApplier{}
+	conf := &Config{
+		watches:              []*WatchPath{wp},
+		Templates:            []string{"test-fixtures/simple.conf"},
+		Paths:                []string{"config_out"},
+		InitialRender:        true,
+		InitialRenderTimeout: time.Second,
+		Applier:              applier,
+	}
+
+	// The configuration is rendered before returning
+	if initialRender(conf, d) {
+		t.Fatalf("unexpected exit")
+	}
+	if !bytes.Contains(applier.rendered["config_out"], []byte("server 0_node1_app 127.0.0.1:8000")) {
+		t.Fatalf("bad: %s", applier.rendered["config_out"])
+	}
+
+	// The watch loop does not render it again
+	select {
+	case <-d.ChangeCh:
+		t.Fatalf("unexpected change")
+	case <-time.After(10 * time.Millisecond):
+	}
+}
+
+func TestInitialRender_Timeout(t *testing.T) {
+	stopCh := make(chan struct{})
+	blockCh := make(chan struct{})
+	defer close(stopCh)
+	defer close(blockCh)
+	querier := &fakeQuerier{blockCh: blockCh, stopCh: stopCh}
+	wp := &WatchPath{Backend: "app", Service: "app"}
+	d := &backendData{
+		Querier:  querier,
+		Servers:  make(map[*WatchPath][]*consulapi.ServiceEntry),
+		Backends: map[string][]*WatchPath{"app": []*WatchPath{wp}},
+		ChangeCh: make(chan struct{}, 1),
+		StopCh:   stopCh,
+	}
+	applier := &fakeApplier{}
+	conf := &Config{
+		watches:              []*WatchPath{wp},
+		Templates:            []string{"test-fixtures/simple.conf"},
+		Paths:                []string{"config_out"},
+		InitialRender:        true,
+		InitialRenderTimeout: 10 * time.Millisecond,
+		Applier:              applier,
+	}
+	if initialRender(conf, d) {
+		t.Fatalf("unexpected exit")
+	}
+	if applier.rendered != nil {
+		t.Fatalf("bad: %v", applier.rendered)
+	}
+}
+
+func TestMonitor_FinalRender(t *testing.T) {
+	for _, final := range []bool{false, true} {
+		wp := &WatchPath{Backend: "app"}
+		d := &backendData{
+			Servers:  make(map[*WatchPath][]*consulapi.ServiceEntry),
+			Backends: map[string][]*WatchPath{"app": []*WatchPath{wp}},
+			ChangeCh: make(chan struct{}, 1),
+			StopCh:   make(chan struct{}),
+		}
+		applier := &fakeApplier{}
+		conf := &Config{
+			watches:     []*WatchPath{wp},
+			Templates:   []string{"test-fixtures/simple.conf"},
+			Paths:       []string{"config_out"},
+			Quiet:       time.Hour,
+			MaxWait:     time.Hour,
+			FinalRender: final,
+			Applier:     applier,
+		}
+
+		en1 := &consulapi.ServiceEntry{
+			Node:    &consulapi.Node{Node: "node1", Address: "127.0.0.1"},
+			Service: &consulapi.AgentService{ID: "app", Port: 8000},
+		}
+		updateEntries(conf, d, wp, []*consulapi.ServiceEntry{en1}, nil)
+
+		// The change is pending on the quiet period when stopped
+		doneCh := make(chan struct{})
+		go func() {
+			monitor(conf, d)
+			close(doneCh)
+		}()
+		time.Sleep(10 * time.Millisecond)
+		close(d.StopCh)
+		select {
+		case <-doneCh:
+		case <-time.After(time.Second):
+			t.Fatalf("timeout")
+		}
+
+		if rendered := applier.rendered != nil; rendered != final {
+			t.Fatalf("bad: %v %v", final, applier.rendered)
+		}
+	}
+}
+
+func TestForceRefresh_Canary(t *testing.T) {
+	wp := &WatchPath{Backend: "app"}
+	d := &backendData{
+		Servers:  make(map[*WatchPath][]*consulapi.ServiceEntry),
+		Backends: map[string][]*WatchPath{"app": []*WatchPath{wp}},
+		ChangeCh: make(chan struct{}, 1),
+	}
+	applier := &fakeApplier{}
+	conf := &Config{
+		watches:        []*WatchPath{wp},
+		Templates:      []string{"test-fixtures/simple.conf"},
+		Paths:          []string{"config_out"},
+		CanaryRate:     0.25,
+		CanaryInterval: 10 * time.Millisecond,
+		Applier:        applier,
+	}
+
+	var entries []*consulapi.ServiceEntry
+	for i := 1; i <= 6; i++ {
+		entries = append(entries, &consulapi.ServiceEntry{
+			Node:    &consulapi.Node{Node: fmt.Sprintf("node%d", i), Address: "127.0.0.1"},
+			Service: &consulapi.AgentService{ID: "app", Port: 8000 + i},
+		})
+	}
+	servers := func() int {
+		return bytes.Count(applier.rendered["config_out"], []byte("server node"))
+	}
+
+	// Servers present on the first render are all admitted
+	updateEntries(conf, d, wp, entries[:2], nil)
+	if forceRefresh(conf, d) {
+		t.Fatalf("unexpected exit")
+	}
+	if n := servers(); n != 2 {
+		t.Fatalf("bad: %d", n)
+	}
+	if d.canaryTimer != nil {
+		t.Fatalf("unexpected canary")
+	}
+
+	// A failed apply does not admit any servers
+	updateEntries(conf, d, wp, entries, nil)
+	applier.err = errors.New("failed")
+	forceRefresh(conf, d)
+	if len(d.admitted["app"]) != 2 || d.canaryTimer != nil {
+		t.Fatalf("bad: %v", d.admitted)
+	}
+	applier.err = nil
+
+	// New servers are admitted at 25% of the backend per refresh
+	for _, expect := range []int{4, 6} {
+		if forceRefresh(conf, d) {
+			t.Fatalf("unexpected exit")
+		}
+		if n := servers(); n != expect {
+			t.Fatalf("bad: %d %s", n, applier.rendered["config_out"])
+		}
+		if expect < len(entries) && d.canaryTimer == nil {
+			t.Fatalf("missing canary")
+		}
+	}
+	if d.canaryTimer != nil {
+		t.Fatalf("unexpected canary")
+	}
+}
+
+func TestForceRefresh_Warmup(t *testing.T) {
+	wp := &WatchPath{Backend: "app"}
+	d := &backendData{
+		Servers:  make(map[*WatchPath][]*consulapi.ServiceEntry),
+		Backends: map[string][]*WatchPath{"app": []*WatchPath{wp}},
+		ChangeCh: make(chan struct{}, 1),
+	}
+	applier := &fakeApplier{}
+	conf := &Config{
+		watches:     []*WatchPath{wp},
+		Templates:   []string{"test-fixtures/simple.conf"},
+		Paths:       []string{"config_out"},
+		WarmupDelay: 50 * time.Millisecond,
+		Applier:     applier,
+	}
+
+	en1 := &consulapi.ServiceEntry{
+		Node:    &consulapi.Node{Node: "node1", Address: "127.0.0.1"},
+		Service: &consulapi.AgentService{ID: "app", Port: 8000},
+	}
+	en2 := &consulapi.ServiceEntry{
+		Node:    &consulapi.Node{Node: "node2", Address: "127.0.0.2"},
+		Service: &consulapi.AgentService{ID: "app", Port: 8000},
+	}
+
+	// Servers present on the first query are not delayed
+	updateEntries(conf, d, wp, []*consulapi.ServiceEntry{en1}, nil)
+	if forceRefresh(conf, d) {
+		t.Fatalf("unexpected exit")
+	}
+	if !bytes.Contains(applier.rendered["config_out"], []byte("server node1_app 127.0.0.1:8000\n")) {
+		t.Fatalf("bad: %s", applier.rendered["config_out"])
+	}
+	if d.warmupTimer != nil {
+		t.Fatalf("unexpected warmup")
+	}
+
+	// A new server is disabled until it has warmed up
+	updateEntries(conf, d, wp, []*consulapi.ServiceEntry{en1, en2}, nil)
+	if forceRefresh(conf, d) {
+		t.Fatalf("unexpected exit")
+	}
+	if !bytes.Contains(applier.rendered["config_out"], []byte("server node2_app 127.0.0.2:8000 disabled")) {
+		t.Fatalf("bad: %s", applier.rendered["config_out"])
+	}
+	if d.warmupTimer == nil {
+		t.Fatalf("missing warmup")
+	}
+
+	// Once the warmup timer fires, the server is enabled
+	select {
+	case <-d.warmupTimer:
+	case <-time.After(time.Second):
+		t.Fatalf("timeout")
+	}
+	markChanged(d, d.warming)
+	if forceRefresh(conf, d) {
+		t.Fatalf("unexpected exit")
+	}
+	if !bytes.Contains(applier.rendered["config_out"], []byte("server node2_app 127.0.0.2:8000\n")) {
+		t.Fatalf("bad: %s", applier.rendered["config_out"])
+	}
+	if !reflect.DeepEqual(applier.changed, []string{"app"}) {
+		t.Fatalf("bad: %v", applier.changed)
+	}
+	if d.warmupTimer != nil {
+		t.Fatalf("unexpected warmup")
+	}
+}
+
+func TestUpdateFirstSeen(t *testing.T) {
+	wp1 := &WatchPath{Backend: "app"}
+	wp2 := &WatchPath{Backend: "app", Tag: "v2"}
+	d := &backendData{
+		Servers:  make(map[*WatchPath][]*consulapi.ServiceEntry),
+		ChangeCh: make(chan struct{}, 1),
+	}
+	conf := &Config{DryRun: true, WarmupDelay: time.Minute}
+	en1 := &consulapi.ServiceEntry{
+		Node:    &consulapi.Node{Node: "node1", Address: "127.0.0.1"},
+		Service: &consulapi.AgentService{ID: "app", Port: 8000},
+	}
+	en2 := &consulapi.ServiceEntry{
+		Node:    &consulapi.Node{Node: "node2", Address: "127.0.0.2"},
+		Service: &consulapi.AgentService{ID: "app", Port: 8000},
+	}
+
+	// A failed first query does not count as seeing the instances
+	updateEntries(conf, d, wp1, nil, errors.New("failed"))
+	updateEntries(conf, d, wp1, []*consulapi.ServiceEntry{en1}, nil)
+	if first, ok := d.FirstSeen[wp1]["node1/app"]; !ok || !first.IsZero() {
+		t.Fatalf("bad: %v", d.FirstSeen)
+	}
+
+	// Nor does an empty first query delay the later instances less
+	updateEntries(conf, d, wp2, nil, nil)
+	updateEntries(conf, d, wp2, []*consulapi.ServiceEntry{en1, en2}, nil)
+	if first := d.FirstSeen[wp2]["node1/app"]; first.IsZero() {
+		t.Fatalf("bad: %v", d.FirstSeen)
+	}
+
+	// An instance gone from one watch is kept by the other
+	updateEntries(conf, d, wp2, []*consulapi.ServiceEntry{en2}, nil)
+	if _, ok := d.FirstSeen[wp1]["node1/app"]; !ok {
+		t.Fatalf("bad: %v", d.FirstSeen)
+	}
+	if _, ok := d.FirstSeen[wp2]["node1/app"]; ok {
+		t.Fatalf("bad: %v", d.FirstSeen)
+	}
+}
+
+func TestDuplicateBackends(t *testing.T) {
+	entry := func(addr string) *backendEntry {
+		return &backendEntry{ServiceEntry: &consulapi.ServiceEntry{
+			Node:    &consulapi.Node{Node: "node", Address: addr},
+			Service: &consulapi.AgentService{ID: "app", Port: 8000},
+		}}
+	}
+	servers := map[string][]*backendEntry{
+		"app":   []*backendEntry{entry("127.0.0.1"), entry("127.0.0.2")},
+		"app2":  []*backendEntry{entry("127.0.0.2"), entry("127.0.0.1")},
+		"db":    []*backendEntry{entry("127.0.0.3")},
+		"empty": nil,
+		"none":  nil,
+	}
+	dups := duplicateBackends(servers)
+	if !reflect.DeepEqual(dups, [][]string{{"app", "app2"}}) {
+		t.Fatalf("bad: %v", dups)
+	}
+}
+
+func TestForceRefresh_DuplicateWarning(t *testing.T) {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+
+	en1 := &consulapi.ServiceEntry{
+		Node:    &consulapi.Node{Node: "node1", Address: "127.0.0.1"},
+		Service: &consulapi.AgentService{ID: "app", Port: 8000},
+	}
+	wp1 := &WatchPath{Backend: "app"}
+	wp2 := &WatchPath{Backend: "other"}
+	d := &backendData{
+		Servers: map[*WatchPath][]*consulapi.ServiceEntry{
+			wp1: []*consulapi.ServiceEntry{en1},
+			wp2: []*consulapi.ServiceEntry{en1},
+		},
+		Backends: map[string][]*WatchPath{
+			"app":   []*WatchPath{wp1},
+			"other": []*WatchPath{wp2},
+		},
+	}
+	conf := &Config{
+		watches:   []*WatchPath{wp1, wp2},
+		Templates: []string{"test-fixtures/simple.conf"},
+		Paths:     []string{"config_out"},
+		Applier:   &fakeApplier{},
+	}
+
+	forceRefresh(conf, d)
+	if !bytes.Contains(buf.Bytes(), []byte("[WARN] Backends app, other have identical servers")) {
+		t.Fatalf("bad: %s", buf.Bytes())
+	}
+
+	// Only warned on the first render
+	buf.Reset()
+	forceRefresh(conf, d)
+	if bytes.Contains(buf.Bytes(), []byte("identical servers")) {
+		t.Fatalf("bad: %s", buf.Bytes())
+	}
+}
+
+func TestAllWatchesReturned(t *testing.T) {
+	wp1 := &WatchPath{Backend: "app"}
+	wp2 := &WatchPath{Backend: "app"}
+	wp3 := &WatchPath{Backend: "db"}
+	d := &backendData{
+		Servers: map[*WatchPath][]*consulapi.ServiceEntry{
+			wp1: nil,
+			wp2: nil,
+		},
+	}
+	conf := &Config{
+		watches: []*WatchPath{wp1, wp2, wp3},
+	}
+
+	if allWatchesReturned(conf, d) {
+		t.Fatalf("unexpected done")
+	}
+
+	d.Servers[wp3] = nil
+	if !allWatchesReturned(conf, d) {
+		t.Fatalf("expected done")
+	}
+}
+
+func TestAggregateServers(t *testing.T) {
+	en1 := &consulapi.ServiceEntry{
+		Node:    &consulapi.Node{Node: "node1", Address: "127.0.0.1"},
+		Service: &consulapi.AgentService{ID: "app", Port: 8000},
+	}
+	en2 := &consulapi.ServiceEntry{
+		Node:    &consulapi.Node{Node: "node3", Address: "127.0.0.3"},
+		Service: &consulapi.AgentService{ID: "app", Port: 8000},
+	}
+	en3 := &consulapi.ServiceEntry{
+		Node:    &consulapi.Node{Node: "node2", Address: "127.0.0.2"},
+		Service: &consulapi.AgentService{ID: "db", Port: 5000},
+	}
+	wp1 := &WatchPath{Backend: "app"}
+	wp2 := &WatchPath{Backend: "app"}
+	wp3 := &WatchPath{Backend: "db"}
+	d := &backendData{
+		Servers: map[*WatchPath][]*consulapi.ServiceEntry{
+			wp1: []*consulapi.ServiceEntry{en1},
+			wp2: []*consulapi.ServiceEntry{en2},
+			wp3: []*consulapi.ServiceEntry{en3},
+		},
+		Backends: map[string][]*WatchPath{
+			"app": []*WatchPath{wp1, wp2},
+			"db":  []*WatchPath{wp3},
+		},
+	}
+	agg := aggregateServers(&Config{}, d)
+	if len(agg) != 2 {
+		t.Fatalf("Bad: %v", agg)
+	}
+	app := agg["app"]
+	if len(app) != 2 {
+		t.Fatalf("Bad: %v", app)
+	}
+	if app[0].ServiceEntry != en1 && app[1].ServiceEntry != en2 {
+		t.Fatalf("Bad: %v", app)
+	}
+	db := agg["db"]
+	if len(db) != 1 {
+		t.Fatalf("Bad: %v", db)
+	}
+	if db[0].ServiceEntry != en3 {
+		t.Fatalf("Bad: %v", db)
+	}
+}
+
+func TestAggregateServers_Fallback(t *testing.T) {
+	en1 := &consulapi.ServiceEntry{
+		Node:    &consulapi.Node{Node: "node1", Address: "127.0.0.1"},
+		Service: &consulapi.AgentService{ID: "backup", Port: 8000},
+	}
+	en2 := &consulapi.ServiceEntry{
+		Node:    &consulapi.Node{Node: "node2", Address: "127.0.0.2"},
+		Service: &consulapi.AgentService{ID: "last", Port: 8000},
+	}
+	wp1 := &WatchPath{Backend: "app", FallbackIfEmpty: true}
+	wp2 := &WatchPath{Backend: "app", FallbackIfEmpty: true}
+	wp3 := &WatchPath{Backend: "app", FallbackIfEmpty: true}
+	d := &backendData{
+		Servers: map[*WatchPath][]*consulapi.ServiceEntry{
+			wp1: nil,
+			wp2: []*consulapi.ServiceEntry{en1},
+			wp3: []*consulapi.ServiceEntry{en2},
+		},
+		Backends: map[string][]*WatchPath{
+			"app": []*WatchPath{wp1, wp2, wp3},
+		},
+	}
+	agg := aggregateServers(&Config{}, d)
+	app := agg["app"]
+	if len(app) != 1 {
+		t.Fatalf("Bad: %v", app)
+	}
+	if app[0].ServiceEntry != en1 {
+		t.Fatalf("Bad: %v", app)
+	}
+}
+
+func TestAggregateServers_SplitTag(t *testing.T) {
+	entry := func(node string, tags ...string) *consulapi.ServiceEntry {
+		return &consulapi.ServiceEntry{
+			Node:    &consulapi.Node{Node: node, Address: "127.0.0.1"},
+			Service: &consulapi.AgentService{ID: "app", Port: 8000, Tags: tags},
+		}
+	}
+	en1 := entry("node1", "be-web", "release")
+	en2 := entry("node2", "be-api")
+	en3 := entry("node3", "be-web", "be-api")
+	en4 := entry("node4", "release")
+	en5 := entry("node5")
+	wp1 := &WatchPath{Backend: "default", SplitTagPrefix: "be-"}
+	wp2 := &WatchPath{Backend: "web"}
+	d := &backendData{
+		Servers: map[*WatchPath][]*consulapi.ServiceEntry{
+			wp1: []*consulapi.ServiceEntry{en1, en2, en3, en4},
+			wp2: []*consulapi.ServiceEntry{en5},
+		},
+		Backends: map[string][]*WatchPath{
+			"default": []*WatchPath{wp1},
+			"web":     []*WatchPath{wp2},
+		},
+	}
+	agg := aggregateServers(&Config{}, d)
+	nodes := make(map[string][]string)
+	for backend, entries := range agg {
+		for _, entry := range entries {
+			nodes[backend] = append(nodes[backend], entry.Node.Node)
+		}
+	}
+	expect := map[string][]string{
+		"default": []string{"node4"},
+		"web":     []string{"node5", "node1", "node3"},
+		"api":     []string{"node2", "node3"},
+	}
+	if !reflect.DeepEqual(nodes, expect) {
+		t.Fatalf("bad: %v", nodes)
+	}
+
+	// The split backends are marked as changed
+	conf := &Config{}
+	d.Changed = make(map[string]bool)
+	updateEntries(conf, d, wp1, []*consulapi.ServiceEntry{en2}, nil)
+	if !reflect.DeepEqual(changedBackends(d), []string{"api", "default", "web"}) {
+		t.Fatalf("bad: %v", changedBackends(d))
+	}
+}
+
+func TestBuildTemplate(t *testing.T) {
+	templates := []string {
+		"test-fixtures/simple.conf",
+		"test-fixtures/varnish.vcl",
+	}
+	expectations := []string {
+		"test-fixtures/simple.conf.out",
+		"test-fixtures/varnish.vcl.out",
+	}
+	servers := map[string][]*backendEntry{
+		"app": []*backendEntry{
+			&backendEntry{ServiceEntry: &consulapi.ServiceEntry{
+				Node:    &consulapi.Node{Node: "node1", Address: "127.0.0.1"},
+				Service: &consulapi.AgentService{ID: "app", Port: 8000},
+			}},
+			&backendEntry{ServiceEntry: &consulapi.ServiceEntry{
+				Node:    &consulapi.Node{Node: "node3", Address: "127.0.0.3"},
+				Service: &consulapi.AgentService{ID: "app", Port: 8000},
+			}},
+		},
+	}
+
+	// Iterate through the list of templates to render
+	for idx, templatePath := range templates {
+		out, err := buildTemplate(&Config{}, templatePath, servers, false)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+
+		expect, err := ioutil.ReadFile(expectations[idx])
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+
+		if !bytes.Equal(out, expect) {
+			t.Fatalf("bad: %s", out)
+		}
+
+	}
+}
+
+func TestExcludeEntries(t *testing.T) {
+	entry := func(node, id string) *consulapi.ServiceEntry {
+		return &consulapi.ServiceEntry{
+			Node:    &consulapi.Node{Node: node, Address: "127.0.0.1"},
+			Service: &consulapi.AgentService{ID: id, Port: 8000},
+		}
+	}
+	entries := []*consulapi.ServiceEntry{
+		entry("web-1", "web"),
+		entry("web-2", "web"),
+		entry("web-3", "web-canary"),
+		entry("db-1", "web"),
+	}
+
+	out := excludeEntries(&WatchPath{}, entries)
+	if len(out) != 4 {
+		t.Fatalf("bad: %v", out)
+	}
+
+	wp := &WatchPath{
+		ExcludeNodes:      []string{"web-1", "db-*"},
+		ExcludeServiceIDs: []string{"*-canary"},
+	}
+	out = excludeEntries(wp, entries)
+	if len(out) != 1 || out[0].Node.Node != "web-2" {
+		t.Fatalf("bad: %v", out)
+	}
+}
+
+func TestPatchPort(t *testing.T) {
+	type val struct {
+		watch  *WatchPath
+		port   int
+		expect int
+	}
+	inps := []val{
+		{&WatchPath{}, 8000, 8000},
+		{&WatchPath{Port: 9000}, 8000, 9000},
+		{&WatchPath{Port: 9000}, 0, 9000},
+		{&WatchPath{ForcePort: 9000}, 8000, 9000},
+		{&WatchPath{ForcePort: 9000}, 0, 9000},
+		{&WatchPath{Port: 7000, ForcePort: 9000}, 8000, 9000},
+		{&WatchPath{DefaultPort: 9000}, 8000, 8000},
+		{&WatchPath{DefaultPort: 9000}, 0, 9000},
+		{&WatchPath{Port: 7000, DefaultPort: 9000}, 0, 7000},
+	}
+	for _, inp := range inps {
+		entry := &consulapi.ServiceEntry{
+			Node:    &consulapi.Node{Node: "node1", Address: "127.0.0.1"},
+			Service: &consulapi.AgentService{ID: "app", Port: inp.port},
+		}
+		patchPort(inp.watch, entry)
+		if entry.Service.Port != inp.expect {
+			t.Fatalf("bad: %v %v", inp, entry.Service.Port)
+		}
+	}
+}
+
+func TestQueryWatch_MissingAddress(t *testing.T) {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+
+	d := &backendData{Querier: &fakeQuerier{entries: []*consulapi.ServiceEntry{
+		&consulapi.ServiceEntry{
+			Node:    &consulapi.Node{Node: "node1", Address: "127.0.0.1"},
+			Service: &consulapi.AgentService{ID: "app-1", Service: "app", Port: 8000},
+		},
+		&consulapi.ServiceEntry{
+			Node:    &consulapi.Node{Node: "node2"},
+			Service: &consulapi.AgentService{ID: "app-2", Service: "app", Port: 8000},
+		},
+	}}}
+
+	// The entry without an address is skipped and logged
+	wp := &WatchPath{Backend: "app", Service: "app"}
+	entries, _, err := queryWatch(d, 0, wp, &consulapi.QueryOptions{})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(entries) != 1 || entries[0].Service.ID != "app-1" {
+		t.Fatalf("bad: %v", entries)
+	}
+	if !strings.Contains(buf.String(), "[WARN] Skipping service app-2 on node node2") {
+		t.Fatalf("bad: %s", buf.String())
+	}
+
+	// Or given the fallback address
+	wp.MissingAddress = "10.0.0.1"
+	entries, _, err = queryWatch(d, 0, wp, &consulapi.QueryOptions{})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(entries) != 2 || entries[1].Node.Address != "10.0.0.1" {
+		t.Fatalf("bad: %v", entries)
+	}
+}
+
+func TestQueryWatch_Kind(t *testing.T) {
+	d := &backendData{Querier: &fakeQuerier{
+		entries: []*consulapi.ServiceEntry{
+			&consulapi.ServiceEntry{
+				Node:    &consulapi.Node{Node: "node1", Address: "127.0.0.1"},
+				Service: &consulapi.AgentService{ID: "web1", Service: "web", Port: 8000},
+			},
+			&consulapi.ServiceEntry{
+				Node:    &consulapi.Node{Node: "node1", Address: "127.0.0.1"},
+				Service: &consulapi.AgentService{ID: "web1-sidecar-proxy", Service: "web", Port: 21000},
+			},
+		},
+		details: instanceDetails{
+			"node1/web1":               &instanceDetail{},
+			"node1/web1-sidecar-proxy": &instanceDetail{Kind: "connect-proxy"},
+		},
+	}}
+
+	// The sidecar is left out of the plain backend
+	wp := &WatchPath{Backend: "web", Service: "web", ExcludeKinds: []string{"connect-proxy"}}
+	entries, _, err := queryWatch(d, 0, wp, &consulapi.QueryOptions{})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(entries) != 1 || entries[0].Service.ID != "web1" {
+		t.Fatalf("bad: %v", entries)
+	}
+
+	// And is the only server of the proxy backend
+	proxies := &WatchPath{Backend: "web-proxy", Service: "web", Kinds: []string{"connect-proxy"}}
+	entries, _, err = queryWatch(d, 1, proxies, &consulapi.QueryOptions{})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(entries) != 1 || entries[0].Service.ID != "web1-sidecar-proxy" {
+		t.Fatalf("bad: %v", entries)
+	}
+
+	// The kind is kept for the servers, by the renamed node
+	d.Servers = make(map[*WatchPath][]*consulapi.ServiceEntry)
+	d.ChangeCh = make(chan struct{}, 1)
+	updateEntries(&Config{}, d, proxies, entries, nil)
+	if kind := entryKind(d.details[proxies], entries[0]); kind != "connect-proxy" {
+		t.Fatalf("bad: %s", kind)
+	}
+	if kind := entryKind(nil, entries[0]); kind != kindTypical {
+		t.Fatalf("bad: %s", kind)
+	}
+}
+
+func TestQueryWatch_PortNotShared(t *testing.T) {
+	shared := &consulapi.ServiceEntry{
+		Node:    &consulapi.Node{Node: "node1", Address: "127.0.0.1"},
+		Service: &consulapi.AgentService{ID: "app", Service: "app", Port: 8000},
+	}
+	d := &backendData{Querier: &fakeQuerier{entries: []*consulapi.ServiceEntry{shared}}}
+	wp1 := &WatchPath{Backend: "app", Service: "app", ForcePort: 9000}
+	wp2 := &WatchPath{Backend: "admin", Service: "app", ForcePort: 9001}
+
+	entries1, _, err := queryWatch(d, 0, wp1, &consulapi.QueryOptions{})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	entries2, _, err := queryWatch(d, 1, wp2, &consulapi.QueryOptions{})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Each watch has its own port, and the original is untouched
+	if port := entries1[0].Service.Port; port != 9000 {
+		t.Fatalf("bad: %d", port)
+	}
+	if port := entries2[0].Service.Port; port != 9001 {
+		t.Fatalf("bad: %d", port)
+	}
+	if shared.Service.Port != 8000 || shared.Node.Node != "node1" {
+		t.Fatalf("bad: %#v %#v", shared.Service, shared.Node)
+	}
+}
+
+func TestQueryWatch_StablePortFixup(t *testing.T) {
+	shared := &consulapi.ServiceEntry{
+		Node:    &consulapi.Node{Node: "node1", Address: "127.0.0.1"},
+		Service: &consulapi.AgentService{ID: "app", Service: "app"},
+	}
+	d := &backendData{
+		Querier:  &fakeQuerier{entries: []*consulapi.ServiceEntry{shared}},
+		Servers:  make(map[*WatchPath][]*consulapi.ServiceEntry),
+		ChangeCh: make(chan struct{}, 1),
+	}
+	conf := &Config{DryRun: true}
+	wp := &WatchPath{Backend: "app", Service: "app", DefaultPort: 9000}
+
+	// Query the same data repeatedly, with the port fixup applying
+	var first []*consulapi.ServiceEntry
+	for i := 0; i < 3; i++ {
+		entries, _, err := queryWatch(d, 0, wp, &consulapi.QueryOptions{})
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if first == nil {
+			first = entries
+		}
+		updateEntries(conf, d, wp, entries, nil)
+	}
+
+	// Only the first is a change, and the stored entries are patched
+	stats := d.Stats[wp]
+	if stats.Changed != 1 || stats.Unchanged != 2 {
+		t.Fatalf("bad: %#v", stats)
+	}
+	stored := d.Servers[wp]
+	if len(stored) != 1 || stored[0] != first[0] || stored[0].Service.Port != 9000 {
+		t.Fatalf("bad: %#v", stored)
+	}
+	if shared.Service.Port != 0 {
+		t.Fatalf("bad: %d", shared.Service.Port)
+	}
+}
+
+func TestUpdateEntries(t *testing.T) {
+	wp1 := &WatchPath{Backend: "app"}
+	d := &backendData{
+		Servers:  make(map[*WatchPath][]*consulapi.ServiceEntry),
+		ChangeCh: make(chan struct{}, 1),
+	}
+	conf := &Config{DryRun: true}
+	notified := func() bool {
+		select {
+		case <-d.ChangeCh:
+			return true
+		default:
+			return false
+		}
+	}
+	entries := func(addr string) []*consulapi.ServiceEntry {
+		return []*consulapi.ServiceEntry{
+			&consulapi.ServiceEntry{
+				Node:    &consulapi.Node{Node: "node1", Address: addr},
+				Service: &consulapi.AgentService{ID: "app", Port: 8000},
+			},
+		}
+	}
+
+	// First read is a change, even on error
+	updateEntries(conf, d, wp1, nil, errors.New("failed"))
+	if _, ok := d.Servers[wp1]; !ok {
+		t.Fatalf("expected entries")
+	}
+	if !notified() {
+		t.Fatalf("expected notify")
+	}
+
+	// New data is a change
+	updateEntries(conf, d, wp1, entries("127.0.0.1"), nil)
+	if !notified() {
+		t.Fatalf("expected notify")
+	}
+
+	// Identical data is not
+	updateEntries(conf, d, wp1, entries("127.0.0.1"), nil)
+	if notified() {
+		t.Fatalf("unexpected notify")
+	}
+
+	// Errors after the first read are ignored
+	updateEntries(conf, d, wp1, nil, errors.New("failed"))
+	if notified() {
+		t.Fatalf("unexpected notify")
+	}
+	if len(d.Servers[wp1]) != 1 {
+		t.Fatalf("bad: %v", d.Servers[wp1])
+	}
+
+	updateEntries(conf, d, wp1, entries("127.0.0.2"), nil)
+	stats := d.Stats[wp1]
+	if stats.Changed != 3 || stats.Unchanged != 1 {
+		t.Fatalf("bad: %#v", stats)
+	}
+}
+
+func TestUpdateEntries_AddedRemoved(t *testing.T) {
+	wp1 := &WatchPath{Backend: "app"}
+	d := &backendData{
+		Servers:  make(map[*WatchPath][]*consulapi.ServiceEntry),
+		ChangeCh: make(chan struct{}, 1),
+	}
+	conf := &Config{DryRun: true}
+	entry := func(node string) *consulapi.ServiceEntry {
+		return &consulapi.ServiceEntry{
+			Node:    &consulapi.Node{Node: node, Address: "127.0.0.1"},
+			Service: &consulapi.AgentService{ID: "app", Port: 8000},
+		}
+	}
+
+	// The initial instances are not counted
+	updateEntries(conf, d, wp1, []*consulapi.ServiceEntry{entry("node1")}, nil)
+	stats := d.Stats[wp1]
+	if stats.Added != 0 || stats.Removed != 0 {
+		t.Fatalf("bad: %#v", stats)
+	}
+
+	// Registering an instance
+	updateEntries(conf, d, wp1, []*consulapi.ServiceEntry{entry("node1"), entry("node2")}, nil)
+	if stats.Added != 1 || stats.Removed != 0 {
+		t.Fatalf("bad: %#v", stats)
+	}
+
+	// Deregistering an instance
+	updateEntries(conf, d, wp1, []*consulapi.ServiceEntry{entry("node2")}, nil)
+	if stats.Added != 1 || stats.Removed != 1 {
+		t.Fatalf("bad: %#v", stats)
+	}
+
+	// Replacing an instance
+	updateEntries(conf, d, wp1, []*consulapi.ServiceEntry{entry("node3")}, nil)
+	if stats.Added != 2 || stats.Removed != 2 {
+		t.Fatalf("bad: %#v", stats)
+	}
+}
+
+func TestForceRefresh_AllWatchesFailing(t *testing.T) {
+	wp1 := &WatchPath{Backend: "app"}
+	wp2 := &WatchPath{Backend: "app", Datacenter: "dc2"}
+	d := &backendData{
+		Servers: make(map[*WatchPath][]*consulapi.ServiceEntry),
+		Backends: map[string][]*WatchPath{
+			"app": []*WatchPath{wp1, wp2},
+		},
+		ChangeCh: make(chan struct{}, 1),
+	}
+	applier := &fakeApplier{}
+	conf := &Config{
+		watches:   []*WatchPath{wp1, wp2},
+		Templates: []string{"test-fixtures/simple.conf"},
+		Paths:     []string{"config_out"},
+		Applier:   applier,
+	}
+
+	en1 := &consulapi.ServiceEntry{
+		Node:    &consulapi.Node{Node: "node1", Address: "127.0.0.1"},
+		Service: &consulapi.AgentService{ID: "app", Port: 8000},
+	}
+	en2 := &consulapi.ServiceEntry{
+		Node:    &consulapi.Node{Node: "node2", Address: "127.0.0.2"},
+		Service: &consulapi.AgentService{ID: "app", Port: 8000},
+	}
+	updateEntries(conf, d, wp1, []*consulapi.ServiceEntry{en1}, nil)
+	updateEntries(conf, d, wp2, []*consulapi.ServiceEntry{en2}, nil)
+	if forceRefresh(conf, d) {
+		t.Fatalf("unexpected exit")
+	}
+
+	// Only one watch failing is not every watch failing
+	failed := errors.New("failed")
+	updateEntries(conf, d, wp1, nil, failed)
+	if allFailing(d, "app") {
+		t.Fatalf("bad: all failing")
+	}
+
+	// Every watch failing keeps the last servers by default
+	updateEntries(conf, d, wp2, nil, failed)
+	if !allFailing(d, "app") {
+		t.Fatalf("bad: not all failing")
+	}
+	if d.LastErrors[wp1] != failed || d.LastErrors[wp2] != failed {
+		t.Fatalf("bad: %v", d.LastErrors)
+	}
+	markChanged(d, map[string]bool{"app": true})
+	if forceRefresh(conf, d) {
+		t.Fatalf("unexpected exit")
+	}
+	out := applier.rendered["config_out"]
+	if !bytes.Contains(out, []byte("server node1_app")) || !bytes.Contains(out, []byte("server node2_app")) {
+		t.Fatalf("bad: %s", out)
+	}
+
+	// The backend is rendered empty if requested
+	conf.OnAllErrors = onAllErrorsEmpty
+	if forceRefresh(conf, d) {
+		t.Fatalf("unexpected exit")
+	}
+	out = applier.rendered["config_out"]
+	if bytes.Contains(out, []byte("server ")) {
+		t.Fatalf("bad: %s", out)
+	}
+
+	// A watch succeeding again restores the servers
+	updateEntries(conf, d, wp2, []*consulapi.ServiceEntry{en2}, nil)
+	if _, ok := d.LastErrors[wp2]; ok {
+		t.Fatalf("bad: %v", d.LastErrors)
+	}
+	if !d.Changed["app"] {
+		t.Fatalf("bad: %v", d.Changed)
+	}
+	if forceRefresh(conf, d) {
+		t.Fatalf("unexpected exit")
+	}
+	out = applier.rendered["config_out"]
+	if !bytes.Contains(out, []byte("server node1_app")) || !bytes.Contains(out, []byte("server node2_app")) {
+		t.Fatalf("bad: %s", out)
+	}
+}
+
+func TestUpdateEntries_IrrelevantChange(t *testing.T) {
+	wp1 := &WatchPath{Backend: "app"}
+	d := &backendData{
+		Servers:  make(map[*WatchPath][]*consulapi.ServiceEntry),
+		ChangeCh: make(chan struct{}, 1),
+	}
+	conf := &Config{DryRun: true}
+	entries := func(check string) []*consulapi.ServiceEntry {
+		return []*consulapi.ServiceEntry{
+			&consulapi.ServiceEntry{
+				Node:    &consulapi.Node{Node: "node1", Address: "127.0.0.1"},
+				Service: &consulapi.AgentService{ID: "app", Port: 8000},
+				Checks: []*consulapi.HealthCheck{
+					&consulapi.HealthCheck{CheckID: "web", Name: check},
+				},
+			},
+		}
+	}
+
+	updateEntries(conf, d, wp1, entries("web check"), nil)
+	<-d.ChangeCh
+
+	// The check name does not affect the output
+	updateEntries(conf, d, wp1, entries("renamed check"), nil)
+	select {
+	case <-d.ChangeCh:
+		t.Fatalf("unexpected notify")
+	default:
+	}
+}
+
+func TestHashEntries(t *testing.T) {
+	entry := func(node, addr string, port int, tags ...string) *consulapi.ServiceEntry {
+		return &consulapi.ServiceEntry{
+			Node:    &consulapi.Node{Node: node, Address: addr},
+			Service: &consulapi.AgentService{ID: "app", Service: "app", Port: port, Tags: tags},
+		}
+	}
+	base := hashEntries([]*consulapi.ServiceEntry{entry("node1", "127.0.0.1", 80, "a")}, nil)
+	if base != hashEntries([]*consulapi.ServiceEntry{entry("node1", "127.0.0.1", 80, "a")}, nil) {
+		t.Fatalf("unstable hash")
+	}
+	critical := entry("node1", "127.0.0.1", 80, "a")
+	critical.Checks = []*consulapi.HealthCheck{&consulapi.HealthCheck{Status: "critical"}}
+	changed := [][]*consulapi.ServiceEntry{
+		{critical},
+		nil,
+		{entry("node2", "127.0.0.1", 80, "a")},
+		{entry("node1", "127.0.0.2", 80, "a")},
+		{entry("node1", "127.0.0.1", 81, "a")},
+		{entry("node1", "127.0.0.1", 80, "b")},
+		{entry("node1", "127.0.0.1", 80, "a", "b")},
+	}
+	for _, entries := range changed {
+		if hashEntries(entries, nil) == base {
+			t.Fatalf("expected change: %v", entries)
+		}
+	}
+
+	// A change of kind alone is a change
+	entries := []*consulapi.ServiceEntry{entry("node1", "127.0.0.1", 80, "a")}
+	proxy := instanceDetails{"node1/app": &instanceDetail{Kind: "connect-proxy"}}
+	if hashEntries(entries, proxy) == base {
+		t.Fatalf("expected change")
+	}
+	gateway := instanceDetails{"node1/app": &instanceDetail{Kind: "mesh-gateway"}}
+	if hashEntries(entries, proxy) == hashEntries(entries, gateway) {
+		t.Fatalf("expected change")
+	}
+
+	// As is a change of meta alone
+	weighted := instanceDetails{"node1/app": &instanceDetail{Meta: map[string]string{"lb_weight": "50"}}}
+	reweighted := instanceDetails{"node1/app": &instanceDetail{Meta: map[string]string{"lb_weight": "60"}}}
+	if hashEntries(entries, weighted) == hashEntries(entries, reweighted) {
+		t.Fatalf("expected change")
+	}
+}
+
+func TestLimitServers(t *testing.T) {
+	var entries []*consulapi.ServiceEntry
+	for i := 9; i >= 0; i-- {
+		entries = append(entries, &consulapi.ServiceEntry{
+			Node:    &consulapi.Node{Node: fmt.Sprintf("node%d", i), Address: "127.0.0.1"},
+			Service: &consulapi.AgentService{ID: "app", Port: 8000 + i},
+		})
+	}
+
+	out := limitServers(entries, 5)
+	if len(out) != 5 {
+		t.Fatalf("bad: %v", out)
+	}
+	for i, entry := range out {
+		if entry.Node.Node != fmt.Sprintf("node%d", i) {
+			t.Fatalf("bad: %v", entry.Node)
+		}
+	}
+
+	// Input should not be modified
+	if entries[0].Node.Node != "node9" {
+		t.Fatalf("bad: %v", entries[0].Node)
+	}
+
+	// Fewer entries than the limit
+	if out := limitServers(entries[:3], 5); len(out) != 3 {
+		t.Fatalf("bad: %v", out)
+	}
+}
+
+func TestNextWaitIndex(t *testing.T) {
+	if idx := nextWaitIndex(0, 10); idx != 10 {
+		t.Fatalf("bad: %v", idx)
+	}
+	if idx := nextWaitIndex(10, 12); idx != 12 {
+		t.Fatalf("bad: %v", idx)
+	}
+	if idx := nextWaitIndex(12, 12); idx != 12 {
+		t.Fatalf("bad: %v", idx)
+	}
+
+	// Index went backwards, should reset
+	if idx := nextWaitIndex(12, 3); idx != 1 {
+		t.Fatalf("bad: %v", idx)
+	}
+}
+
+func TestNextWaitIndex_Zero(t *testing.T) {
+	// A zero index would make the next query non-blocking
+	if idx := nextWaitIndex(0, 0); idx != 1 {
+		t.Fatalf("bad: %v", idx)
+	}
+	if idx := nextWaitIndex(1, 0); idx != 1 {
+		t.Fatalf("bad: %v", idx)
+	}
+	if idx := nextWaitIndex(12, 0); idx != 1 {
+		t.Fatalf("bad: %v", idx)
+	}
+}
+
+func TestBuildTemplate_Map(t *testing.T) {
+	servers := map[string][]*backendEntry{
+		"web": []*backendEntry{
+			&backendEntry{ServiceEntry: &consulapi.ServiceEntry{
+				Node:    &consulapi.Node{Node: "node1", Address: "127.0.0.1"},
+				Service: &consulapi.AgentService{ID: "web", Port: 80, Tags: []string{"host=www.example.com", "release"}},
+			}},
+			&backendEntry{ServiceEntry: &consulapi.ServiceEntry{
+				Node:    &consulapi.Node{Node: "node2", Address: "127.0.0.2"},
+				Service: &consulapi.AgentService{ID: "web", Port: 80, Tags: []string{"host=example.com", "host=www.example.com"}},
+			}},
+		},
+		"api": []*backendEntry{
+			&backendEntry{ServiceEntry: &consulapi.ServiceEntry{
+				Node:    &consulapi.Node{Node: "node3", Address: "127.0.0.3"},
+				Service: &consulapi.AgentService{ID: "api", Port: 8080, Tags: []string{"host=api.example.com"}},
+			}},
+		},
+	}
+	out, err := buildTemplate(&Config{}, "test-fixtures/hosts.map", servers, false)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	expect, err := ioutil.ReadFile("test-fixtures/hosts.map.out")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !bytes.Equal(out, expect) {
+		t.Fatalf("bad: %s", out)
+	}
+}
+
+func TestFormatOutput_TagMap(t *testing.T) {
+	servers := map[string][]*backendEntry{
+		"app": []*backendEntry{
+			&backendEntry{ServiceEntry: &consulapi.ServiceEntry{
+				Node: &consulapi.Node{Node: "node1", Address: "127.0.0.1"},
+				Service: &consulapi.AgentService{ID: "app", Port: 8000,
+					Tags: []string{"version=1.2.3", "release", "url=/a=b", "version=2.0", "=bad", "empty="}},
+			}},
+		},
+	}
+	out := formatOutput(servers)
+	expect := map[string]string{"version": "1.2.3", "url": "/a=b", "empty": ""}
+	if !reflect.DeepEqual(out["app"][0].TagMap, expect) {
+		t.Fatalf("bad: %v", out["app"][0].TagMap)
+	}
+
+	// The values can be indexed from a template
+	templ, err := newTemplate(&Config{}, []byte(`{{range .app}}{{index .TagMap "version"}}{{end}}`), out)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	var buf bytes.Buffer
+	if err := templ.Execute(&buf, out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if buf.String() != "1.2.3" {
+		t.Fatalf("bad: %s", buf.String())
+	}
+}
+
+func TestBuildTemplate_AllBackends(t *testing.T) {
+	servers := map[string][]*backendEntry{
+		"db": nil,
+		"app": []*backendEntry{
+			&backendEntry{ServiceEntry: &consulapi.ServiceEntry{
+				Node:    &consulapi.Node{Node: "node1", Address: "127.0.0.1"},
+				Service: &consulapi.AgentService{ID: "app", Port: 8000},
+			}},
+			&backendEntry{ServiceEntry: &consulapi.ServiceEntry{
+				Node:    &consulapi.Node{Node: "node2", Address: "127.0.0.2"},
+				Service: &consulapi.AgentService{ID: "app", Port: 8000},
+			}},
+		},
+	}
+	out, err := buildTemplate(&Config{}, "test-fixtures/all.conf", servers, false)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	expect, err := ioutil.ReadFile("test-fixtures/all.conf.out")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !bytes.Equal(out, expect) {
+		t.Fatalf("bad: %s", out)
+	}
+}
+
+func TestOrderedBackends(t *testing.T) {
+	servers := map[string][]*ServerEntry{
+		"web":    nil,
+		"app":    nil,
+		"db":     nil,
+		"cache":  nil,
+		"api-v2": nil,
+	}
+	conf := &Config{
+		BackendOrder: backendOrderConfig,
+		watches: []*WatchPath{
+			&WatchPath{Backend: "web"},
+			&WatchPath{Backend: "db"},
+			&WatchPath{Backend: "web"},
+			&WatchPath{Backend: "app"},
+			&WatchPath{Backend: "api", SplitTagPrefix: "v"},
+		},
+	}
+	names := func() []string {
+		var out []string
+		for _, backend := range orderedBackends(conf, servers) {
+			out = append(out, backend.Name)
+		}
+		return out
+	}
+
+	// The order is the same on every call, despite map iteration
+	expect := []string{"web", "db", "app", "api-v2", "cache"}
+	for i := 0; i < 10; i++ {
+		if out := names(); !reflect.DeepEqual(out, expect) {
+			t.Fatalf("bad: %v", out)
+		}
+	}
+
+	conf.BackendOrder = backendOrderName
+	expect = []string{"api-v2", "app", "cache", "db", "web"}
+	for i := 0; i < 10; i++ {
+		if out := names(); !reflect.DeepEqual(out, expect) {
+			t.Fatalf("bad: %v", out)
+		}
+	}
+}
+
+func TestBuildTemplate_Math(t *testing.T) {
+	servers := map[string][]*backendEntry{
+		"app": []*backendEntry{
+			&backendEntry{ServiceEntry: &consulapi.ServiceEntry{
+				Node:    &consulapi.Node{Node: "node1", Address: "127.0.0.1"},
+				Service: &consulapi.AgentService{ID: "app", Port: 8000},
+			}},
+			&backendEntry{ServiceEntry: &consulapi.ServiceEntry{
+				Node:    &consulapi.Node{Node: "node2", Address: "127.0.0.2"},
+				Service: &consulapi.AgentService{ID: "app", Port: 8000},
+			}},
+		},
+	}
+	out, err := buildTemplate(&Config{}, "test-fixtures/math.conf", servers, false)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	expect, err := ioutil.ReadFile("test-fixtures/math.conf.out")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !bytes.Equal(out, expect) {
+		t.Fatalf("bad: %s", out)
+	}
+
+	// Division by zero is an error
+	servers["app"] = nil
+	if _, err := buildTemplate(&Config{}, "test-fixtures/math.conf", servers, false); err == nil {
+		t.Fatalf("expected error")
+	}
+}
+
+func TestBuildTemplate_ReadError(t *testing.T) {
+	f, err := ioutil.TempFile("", "consul-haproxy")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.WriteString("backend app{{range .app}}\n    {{.}}{{end}}\n"); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	f.Close()
+
+	servers := map[string][]*backendEntry{
+		"app": []*backendEntry{
+			&backendEntry{ServiceEntry: &consulapi.ServiceEntry{
+				Node:    &consulapi.Node{Node: "node1", Address: "127.0.0.1"},
+				Service: &consulapi.AgentService{ID: "app", Port: 8000},
+			}},
+		},
+	}
+	conf := &Config{}
+	out, err := buildTemplate(conf, f.Name(), servers, false)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	expect := "backend app\n    server node1_app 127.0.0.1:8000\n"
+	if string(out) != expect {
+		t.Fatalf("bad: %s", out)
+	}
+
+	// The last contents are used if the template cannot be read
+	os.Remove(f.Name())
+	out, err = buildTemplate(conf, f.Name(), servers, false)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if string(out) != expect {
+		t.Fatalf("bad: %s", out)
+	}
+
+	// Without them, the read error is returned
+	if _, err := buildTemplate(&Config{}, f.Name(), servers, false); err == nil {
+		t.Fatalf("expected error")
+	}
+}
+
+func TestExecuteTemplate_Timeout(t *testing.T) {
+	releaseCh := make(chan struct{})
+	defer close(releaseCh)
+	funcs := template.FuncMap{
+		"slow": func() string {
+			<-releaseCh
+			return "slow"
+		},
+		"fast": func() string { return "fast" },
+	}
+
+	templ := template.Must(template.New("output").Funcs(funcs).Parse("{{fast}}"))
+	out, err := executeTemplate(templ, nil, time.Second)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if string(out) != "fast" {
+		t.Fatalf("bad: %s", out)
+	}
+
+	templ = template.Must(template.New("output").Funcs(funcs).Parse("{{slow}}"))
+	start := time.Now()
+	if _, err := executeTemplate(templ, nil, 10*time.Millisecond); err == nil {
+		t.Fatalf("expected error")
+	}
+	if time.Since(start) > time.Second {
+		t.Fatalf("timeout not enforced")
+	}
+}
+
+func TestBuildTemplate_Dedupe(t *testing.T) {
+	entry := func(node, id, addr string) *backendEntry {
+		return &backendEntry{ServiceEntry: &consulapi.ServiceEntry{
+			Node:    &consulapi.Node{Node: node, Address: addr},
+			Service: &consulapi.AgentService{ID: id, Port: 8000},
+		}}
+	}
+	servers := map[string][]*backendEntry{
+		"app": []*backendEntry{
+			entry("node1", "web", "127.0.0.1"),
+			entry("node1", "api", "127.0.0.1"),
+			entry("node2", "web", "127.0.0.2"),
+		},
+	}
+
+	out, err := buildTemplate(&Config{}, "test-fixtures/simple.conf", servers, false)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !bytes.Contains(out, []byte("server node1_api 127.0.0.1:8000")) {
+		t.Fatalf("bad: %s", out)
+	}
+
+	conf := &Config{DedupeAddresses: true}
+	out, err = buildTemplate(conf, "test-fixtures/simple.conf", servers, false)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	expect := "backend app\n    server node1_web 127.0.0.1:8000\n    server node2_web 127.0.0.2:8000\n"
+	if !bytes.Contains(out, []byte(expect)) {
+		t.Fatalf("bad: %s", out)
+	}
+}
+
+func TestBuildTemplate_NameReplacement(t *testing.T) {
+	servers := map[string][]*backendEntry{
+		"app": []*backendEntry{
+			&backendEntry{ServiceEntry: &consulapi.ServiceEntry{
+				Node:    &consulapi.Node{Node: "web1.dc1.example", Address: "127.0.0.1"},
+				Service: &consulapi.AgentService{ID: "api/v2", Port: 8000},
+			}},
+		},
+	}
+
+	conf := &Config{NameReplacement: "_"}
+	out, err := buildTemplate(conf, "test-fixtures/simple.conf", servers, false)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !bytes.Contains(out, []byte("server web1_dc1_example_api_v2 127.0.0.1:8000")) {
+		t.Fatalf("bad: %s", out)
+	}
+
+	conf = &Config{NameReplacement: "-"}
+	out, err = buildTemplate(conf, "test-fixtures/simple.conf", servers, false)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !bytes.Contains(out, []byte("server web1-dc1-example_api-v2 127.0.0.1:8000")) {
+		t.Fatalf("bad: %s", out)
+	}
+
+	// Raw names are kept as they are
+	conf = &Config{NameReplacement: "_", RawNames: true}
+	out, err = buildTemplate(conf, "test-fixtures/simple.conf", servers, false)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !bytes.Contains(out, []byte("server web1.dc1.example_api/v2 127.0.0.1:8000")) {
+		t.Fatalf("bad: %s", out)
+	}
+}
+
+func TestBuildTemplate_HeaderFooter(t *testing.T) {
+	servers := map[string][]*backendEntry{
+		"app": []*backendEntry{
+			&backendEntry{ServiceEntry: &consulapi.ServiceEntry{
+				Node:    &consulapi.Node{Node: "node1", Address: "127.0.0.1"},
+				Service: &consulapi.AgentService{ID: "app", Port: 8000},
+			}},
+		},
+		"db": nil,
+	}
+	conf := &Config{
+		HeaderTemplate: "test-fixtures/header.conf",
+		FooterTemplate: "test-fixtures/footer.conf",
+	}
+	out, err := buildTemplate(conf, "test-fixtures/simple.conf", servers, false)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	body, err := buildTemplate(&Config{}, "test-fixtures/simple.conf", servers, false)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	expect := "# Generated from test-fixtures/simple.conf, 1 servers in 2 backends\n" +
+		string(body) + "# End of test-fixtures/simple.conf\n"
+	if string(out) != expect {
+		t.Fatalf("bad: %s", out)
+	}
+}
+
+func TestBuildTemplate_HAProxyVersion(t *testing.T) {
+	servers := map[string][]*backendEntry{
+		"app": []*backendEntry{
+			&backendEntry{
+				ServiceEntry: &consulapi.ServiceEntry{
+					Node:    &consulapi.Node{Node: "node1", Address: "127.0.0.1"},
+					Service: &consulapi.AgentService{ID: "app", Port: 8000},
+				},
+				Watch: &WatchPath{Protocol: "tcp", SendProxy: true},
+			},
+		},
+	}
+
+	cases := map[string]string{
+		"":    "# HAProxy \nbackend app\n    server node1_app 127.0.0.1:8000 send-proxy\n",
+		"1.8": "# HAProxy 1.8\nbackend app\n    server node1_app 127.0.0.1:8000 send-proxy\n",
+		"1.4": "# Legacy HAProxy 1.4\nbackend app\n    server node1_app 127.0.0.1:8000\n",
+	}
+	for version, expect := range cases {
+		conf := &Config{
+			DryRun:         true,
+			Templates:      []string{"test-fixtures/version.conf"},
+			Backends:       []string{"app=app"},
+			HAProxyVersion: version,
+		}
+		if errs := validateConfig(conf); len(errs) > 0 {
+			t.Fatalf("err: %v", errs)
+		}
+		out, err := buildTemplate(conf, "test-fixtures/version.conf", servers, false)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if string(out) != expect {
+			t.Fatalf("bad: %s %q", version, out)
+		}
+	}
+}
+
+func TestBuildTemplate_DNSResolvers(t *testing.T) {
+	servers := map[string][]*backendEntry{
+		"app": []*backendEntry{
+			&backendEntry{ServiceEntry: &consulapi.ServiceEntry{
+				Node:    &consulapi.Node{Node: "node1", Address: "127.0.0.1"},
+				Service: &consulapi.AgentService{ID: "app", Port: 8000},
+			}},
+			&backendEntry{ServiceEntry: &consulapi.ServiceEntry{
+				Node:    &consulapi.Node{Node: "node2", Address: "web.example.com"},
+				Service: &consulapi.AgentService{ID: "app", Port: 8000},
+			}},
+		},
+	}
+
+	// Hostnames are passed through as is
+	out, err := buildTemplate(&Config{}, "test-fixtures/simple.conf", servers, false)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !bytes.Contains(out, []byte("server node2_app web.example.com:8000\n")) {
+		t.Fatalf("bad: %s", out)
+	}
+
+	cases := map[string]string{
+		"":    "server node2_app web.example.com:8000 resolvers dns init-addr none\n",
+		"1.6": "server node2_app web.example.com:8000 resolvers dns\n",
+	}
+	for version, expect := range cases {
+		conf := &Config{
+			DryRun:         true,
+			Templates:      []string{"test-fixtures/simple.conf"},
+			Backends:       []string{"app=app"},
+			DNSResolvers:   "dns",
+			HAProxyVersion: version,
+		}
+		if errs := validateConfig(conf); len(errs) > 0 {
+			t.Fatalf("err: %v", errs)
+		}
+		out, err := buildTemplate(conf, "test-fixtures/simple.conf", servers, false)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if !bytes.Contains(out, []byte(expect)) {
+			t.Fatalf("bad: %s %s", version, out)
+		}
+		if !bytes.Contains(out, []byte("server node1_app 127.0.0.1:8000\n")) {
+			t.Fatalf("bad: %s %s", version, out)
+		}
+	}
+}
+
+func TestBuildTemplate_InitAddr(t *testing.T) {
+	servers := map[string][]*backendEntry{
+		"app": []*backendEntry{
+			&backendEntry{ServiceEntry: &consulapi.ServiceEntry{
+				Node:    &consulapi.Node{Node: "node1", Address: "127.0.0.1"},
+				Service: &consulapi.AgentService{ID: "app", Port: 8000},
+			}},
+			&backendEntry{ServiceEntry: &consulapi.ServiceEntry{
+				Node:    &consulapi.Node{Node: "node2", Address: "web.example.com"},
+				Service: &consulapi.AgentService{ID: "app", Port: 8000},
+			}},
+		},
+	}
+
+	type val struct {
+		resolvers string
+		initAddr  string
+		expect    string
+	}
+	inps := []val{
+		{"dns", "last,libc,none", "server node2_app web.example.com:8000 resolvers dns init-addr last,libc,none\n"},
+		{"", "libc,10.0.0.1", "server node2_app web.example.com:8000 init-addr libc,10.0.0.1\n"},
+	}
+	for _, inp := range inps {
+		conf := &Config{
+			DryRun:       true,
+			Templates:    []string{"test-fixtures/simple.conf"},
+			Backends:     []string{"app=app"},
+			DNSResolvers: inp.resolvers,
+			InitAddr:     inp.initAddr,
+		}
+		if errs := validateConfig(conf); len(errs) > 0 {
+			t.Fatalf("err: %v", errs)
+		}
+		out, err := buildTemplate(conf, "test-fixtures/simple.conf", servers, false)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if !bytes.Contains(out, []byte(inp.expect)) {
+			t.Fatalf("bad: %s", out)
+		}
+
+		// Servers with an IP are unaffected
+		if !bytes.Contains(out, []byte("server node1_app 127.0.0.1:8000\n")) {
+			t.Fatalf("bad: %s", out)
+		}
+	}
+
+	conf := &Config{
+		DryRun:    true,
+		Templates: []string{"test-fixtures/simple.conf"},
+		Backends:  []string{"app=app"},
+		InitAddr:  "last,dns",
+	}
+	if errs := validateConfig(conf); len(errs) != 1 {
+		t.Fatalf("bad: %v", errs)
+	}
+}
+
+func TestNewTemplate_StatsSocket(t *testing.T) {
+	conf := &Config{StatsSocket: "/var/run/haproxy.sock"}
+	templ, err := newTemplate(conf, []byte("stats socket {{statsSocket}} level admin"), nil)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	out, err := executeTemplate(templ, nil, 0)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if string(out) != "stats socket /var/run/haproxy.sock level admin" {
+		t.Fatalf("bad: %s", out)
+	}
+}
+
+type countingKV struct {
+	*fakeKV
+	gets int
+}
+
+func (c *countingKV) Get(key string, q *consulapi.QueryOptions) (*consulapi.KVPair, *consulapi.QueryMeta, error) {
+	c.gets++
+	return c.fakeKV.Get(key, q)
+}
+
+func TestNewTemplate_Key(t *testing.T) {
+	kv := &countingKV{fakeKV: &fakeKV{pairs: map[string]*consulapi.KVPair{
+		"haproxy/maxconn": &consulapi.KVPair{Key: "haproxy/maxconn", Value: []byte("4096")},
+	}}}
+	conf := &Config{kv: kv}
+	raw := `maxconn {{key "haproxy/maxconn"}} {{key "haproxy/maxconn"}} [{{key "haproxy/missing"}}]`
+	templ, err := newTemplate(conf, []byte(raw), nil)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	out, err := executeTemplate(templ, nil, 0)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if string(out) != "maxconn 4096 4096 []" {
+		t.Fatalf("bad: %s", out)
+	}
+
+	// Each key is read once per render
+	if kv.gets != 2 {
+		t.Fatalf("bad: %d", kv.gets)
+	}
+
+	// Without a client the render fails
+	templ, err = newTemplate(&Config{}, []byte(raw), nil)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if _, err := executeTemplate(templ, nil, 0); err == nil {
+		t.Fatalf("expected error")
+	}
+}
+
+func TestNewTemplate_ServerTemplate(t *testing.T) {
+	conf := &Config{
+		DryRun:       true,
+		Templates:    []string{"test-fixtures/simple.conf"},
+		Backends:     []string{"app=app", "db=primary.mysql@dc2"},
+		DNSResolvers: "dns",
+	}
+	if errs := validateConfig(conf); len(errs) > 0 {
+		t.Fatalf("err: %v", errs)
+	}
+	server := &ServerEntry{Node: "node1", IP: net.ParseIP("127.0.0.1"), Port: 8000}
+	servers := map[string][]*ServerEntry{
+		"app": []*ServerEntry{server, server, server},
+	}
+	render := func(conf *Config, raw string) (string, error) {
+		templ, err := newTemplate(conf, []byte(raw), servers)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		out, err := executeTemplate(templ, servers, 0)
+		return string(out), err
+	}
+
+	// Sized to the servers plus the headroom
+	out, err := render(conf, `{{serverTemplate "app" 2}}`)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if out != "server-template app 5 _app._tcp.service.consul resolvers dns init-addr none" {
+		t.Fatalf("bad: %s", out)
+	}
+
+	// The tag and datacenter are part of the name, and there
+	// is always at least one slot
+	out, err = render(conf, `{{serverTemplate "db" 0}}`)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if out != "server-template db 1 _mysql._primary.service.dc2.consul resolvers dns init-addr none" {
+		t.Fatalf("bad: %s", out)
+	}
+
+	// Unknown backends, and missing resolvers are errors
+	if _, err := render(conf, `{{serverTemplate "web" 2}}`); err == nil {
+		t.Fatalf("expected error")
+	}
+	conf.DNSResolvers = ""
+	if _, err := render(conf, `{{serverTemplate "app" 2}}`); err == nil {
+		t.Fatalf("expected error")
+	}
+
+	// Older versions of HAProxy do not support it
+	conf.DNSResolvers = "dns"
+	conf.haproxyVersion = &haproxyVersion{Major: 1, Minor: 7}
+	if _, err := render(conf, `{{serverTemplate "app" 2}}`); err == nil {
+		t.Fatalf("expected error")
+	}
+}
+
+func TestForceRefresh_ParseOnce(t *testing.T) {
+	dir, err := ioutil.TempDir("", "consul-haproxy")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	templatePath := filepath.Join(dir, "app.tmpl")
+	if err := ioutil.WriteFile(templatePath, []byte("{{range .app}}{{.}}{{end}}"), 0644); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	wp := &WatchPath{Backend: "app"}
+	d := &backendData{
+		Servers:  make(map[*WatchPath][]*consulapi.ServiceEntry),
+		Backends: map[string][]*WatchPath{"app": []*WatchPath{wp}},
+		ChangeCh: make(chan struct{}, 1),
+	}
+	applier := &fakeApplier{}
+	conf := &Config{
+		watches:   []*WatchPath{wp},
+		Templates: []string{templatePath, templatePath},
+		Paths:     []string{"config_out", "config_out2"},
+		Applier:   applier,
+	}
+	updateEntries(conf, d, wp, []*consulapi.ServiceEntry{
+		&consulapi.ServiceEntry{
+			Node:    &consulapi.Node{Node: "node1", Address: "127.0.0.1"},
+			Service: &consulapi.AgentService{ID: "app", Port: 8000},
+		},
+	}, nil)
+
+	// Both targets are rendered from a single parse
+	for i := 0; i < 2; i++ {
+		if forceRefresh(conf, d) {
+			t.Fatalf("unexpected exit")
+		}
+		if parses := conf.parsedTemplates.parses; parses != 1 {
+			t.Fatalf("bad: %d", parses)
+		}
+	}
+	for _, path := range conf.Paths {
+		if out := string(applier.rendered[path]); out != "server node1_app 127.0.0.1:8000" {
+			t.Fatalf("bad: %s %s", path, out)
+		}
+	}
+
+	// A change to the template is parsed again
+	if err := ioutil.WriteFile(templatePath, []byte("{{range .app}}{{.Port}}{{end}}"), 0644); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if forceRefresh(conf, d) {
+		t.Fatalf("unexpected exit")
+	}
+	if parses := conf.parsedTemplates.parses; parses != 2 {
+		t.Fatalf("bad: %d", parses)
+	}
+	if out := string(applier.rendered["config_out2"]); out != "8000" {
+		t.Fatalf("bad: %s", out)
+	}
+}
+
+func TestBuildTemplate_Shared(t *testing.T) {
+	conf := &Config{
+		DryRun:          true,
+		Templates:       []string{"test-fixtures/shared.conf"},
+		Backends:        []string{"app=app"},
+		SharedTemplates: []string{"test-fixtures/shared/*.tmpl"},
+	}
+	if errs := validateConfig(conf); len(errs) > 0 {
+		t.Fatalf("err: %v", errs)
+	}
+	servers := map[string][]*backendEntry{
+		"app": []*backendEntry{
+			&backendEntry{ServiceEntry: &consulapi.ServiceEntry{
+				Node:    &consulapi.Node{Node: "node1", Address: "127.0.0.1"},
+				Service: &consulapi.AgentService{ID: "app", Port: 8000},
+			}},
+		},
+	}
+	out, err := buildTemplate(conf, "test-fixtures/shared.conf", servers, false)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	expect := "defaults\n    timeout connect 5000ms\n\nbackend app\n    server node1_app 127.0.0.1:8000\n"
+	if string(out) != expect {
+		t.Fatalf("bad: %q", out)
+	}
+
+	// Without the shared templates the definitions are missing
+	conf.SharedTemplates = nil
+	if errs := validateConfig(conf); len(errs) > 0 {
+		t.Fatalf("err: %v", errs)
+	}
+	if _, err := buildTemplate(conf, "test-fixtures/shared.conf", servers, false); err == nil {
+		t.Fatalf("expected error")
+	}
+
+	conf.SharedTemplates = []string{"test-fixtures/shared/*.missing"}
+	if errs := validateConfig(conf); len(errs) != 1 {
+		t.Fatalf("bad: %v", errs)
+	}
+}
+
+func TestBuildTemplate_HashComment(t *testing.T) {
+	servers := map[string][]*backendEntry{
+		"app": []*backendEntry{
+			&backendEntry{ServiceEntry: &consulapi.ServiceEntry{
+				Node:    &consulapi.Node{Node: "node1", Address: "127.0.0.1"},
+				Service: &consulapi.AgentService{ID: "app", Port: 8000},
+			}},
+		},
+	}
+	conf := &Config{HashComment: true, HeaderTemplate: "test-fixtures/header.conf"}
+	out, err := buildTemplate(conf, "test-fixtures/simple.conf", servers, false)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// The hash comes first, and matches the servers
+	lines := strings.SplitN(string(out), "\n", 2)
+	hash := serversHash(formatOutput(servers))
+	if lines[0] != "# config-hash: "+hash {
+		t.Fatalf("bad: %s", lines[0])
+	}
+	if !strings.HasPrefix(lines[1], "# Generated from") {
+		t.Fatalf("bad: %s", out)
+	}
+	if len(hash) != 64 {
+		t.Fatalf("bad: %s", hash)
+	}
+
+	// The hash changes with the servers
+	servers["app"][0].Service.Port = 9000
+	if other := serversHash(formatOutput(servers)); other == hash {
+		t.Fatalf("bad: %s", other)
+	}
+}
+
+func TestBuildTemplate_GroupDatacenters(t *testing.T) {
+	dc1 := &WatchPath{Backend: "app", Service: "app", Datacenter: "dc1"}
+	dc2 := &WatchPath{Backend: "app", Service: "app", Datacenter: "dc2"}
+	entry := func(node, addr string, watch *WatchPath) *backendEntry {
+		return &backendEntry{
+			ServiceEntry: &consulapi.ServiceEntry{
+				Node:    &consulapi.Node{Node: node, Address: addr},
+				Service: &consulapi.AgentService{ID: "app", Port: 8000},
+			},
+			Watch: watch,
+		}
+	}
+	servers := map[string][]*backendEntry{
+		"app": []*backendEntry{
+			entry("node1", "127.0.0.1", dc1),
+			entry("node2", "127.0.0.2", dc2),
+			entry("node3", "127.0.0.3", dc1),
+		},
+	}
+
+	conf := &Config{GroupDatacenters: true}
+	out, err := buildTemplate(conf, "test-fixtures/grouped.conf", servers, false)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	expect := "backend app\n" +
+		"    # datacenter: dc1\n" +
+		"    server node1_app 127.0.0.1:8000\n" +
+		"    server node3_app 127.0.0.3:8000\n" +
+		"    # datacenter: dc2\n" +
+		"    server node2_app 127.0.0.2:8000\n"
+	if !bytes.Contains(out, []byte(expect)) {
+		t.Fatalf("bad: %s", out)
+	}
+
+	// The server lines themselves have no comment
+	out, err = buildTemplate(conf, "test-fixtures/simple.conf", servers, false)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if bytes.Contains(out, []byte("# datacenter")) {
+		t.Fatalf("bad: %s", out)
+	}
+
+	// No comments are emitted by default
+	out, err = buildTemplate(&Config{}, "test-fixtures/grouped.conf", servers, false)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if bytes.Contains(out, []byte("# datacenter")) {
+		t.Fatalf("bad: %s", out)
+	}
+}
+
+func TestBuildTemplate_Placeholder(t *testing.T) {
+	conf := &Config{
+		EmptyBackendPlaceholder: true,
+		PlaceholderAddress:      "127.0.0.1:1",
+	}
+	servers := map[string][]*backendEntry{
+		"app": nil,
+	}
+	out, err := buildTemplate(conf, "test-fixtures/simple.conf", servers, false)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !bytes.Contains(out, []byte("backend app\n    server PLACEHOLDER 127.0.0.1:1 disabled\n")) {
+		t.Fatalf("bad: %s", out)
+	}
+}
+
+func TestFormatOutput_SendProxy(t *testing.T) {
+	entry := &consulapi.ServiceEntry{
+		Node:    &consulapi.Node{Node: "node1", Address: "127.0.0.1"},
+		Service: &consulapi.AgentService{ID: "db", Port: 5000},
+	}
+	inp := map[string][]*backendEntry{
+		"plain": []*backendEntry{
+			&backendEntry{ServiceEntry: entry, Watch: &WatchPath{Protocol: "tcp"}},
+		},
+		"proxy": []*backendEntry{
+			&backendEntry{ServiceEntry: entry, Watch: &WatchPath{Protocol: "tcp", SendProxy: true}},
+		},
+	}
+
+	output := formatOutput(inp)
+	plain := output["plain"][0]
+	if plain.Protocol != "tcp" {
+		t.Fatalf("bad: %v", plain)
+	}
+	if plain.String() != "server node1_db 127.0.0.1:5000" {
+		t.Fatalf("bad: %v", plain)
+	}
+	proxy := output["proxy"][0]
+	if proxy.String() != "server node1_db 127.0.0.1:5000 send-proxy" {
+		t.Fatalf("bad: %v", proxy)
+	}
+}
+
+func TestFormatOutput_MeshGateway(t *testing.T) {
+	conf := &Config{
+		DryRun:      true,
+		Templates:   []string{"test-fixtures/simple.conf"},
+		Backends:    []string{"app=web", "app=web@dc2?mesh_gateway=10.0.0.9:8443"},
+		TrustDomain: "7c2a4f5e.consul",
+	}
+	if errs := validateConfig(conf); len(errs) > 0 {
+		t.Fatalf("err: %v", errs)
+	}
+	local, remote := conf.watches[0], conf.watches[1]
+	inp := map[string][]*backendEntry{
+		"app": []*backendEntry{
+			&backendEntry{
+				ServiceEntry: &consulapi.ServiceEntry{
+					Node:    &consulapi.Node{Node: "node1", Address: "127.0.0.1"},
+					Service: &consulapi.AgentService{ID: "web", Service: "web", Port: 8000},
+				},
+				Watch: local,
+			},
+			&backendEntry{
+				ServiceEntry: &consulapi.ServiceEntry{
+					Node:    &consulapi.Node{Node: "node2", Address: "192.168.0.2"},
+					Service: &consulapi.AgentService{ID: "web", Service: "web", Port: 8000},
+				},
+				Watch: remote,
+			},
+			&backendEntry{
+				ServiceEntry: &consulapi.ServiceEntry{
+					Node:    &consulapi.Node{Node: "node3", Address: "web3.dc2.example.com"},
+					Service: &consulapi.AgentService{ID: "web", Service: "web", Port: 8000},
+				},
+				Watch: remote,
+			},
+		},
+	}
+
+	// The remote nodes, including those with a hostname, are reached
+	// through the same gateway route, so are collapsed
+	out := formatOutput(inp)
+	app := out["app"]
+	if len(app) != 2 {
+		t.Fatalf("bad: %v", app)
+	}
+	if app[0].String() != "server node1_web 127.0.0.1:8000" {
+		t.Fatalf("bad: %v", app[0])
+	}
+	expect := "server node2_web 10.0.0.9:8443 ssl sni str(web.default.dc2.internal.7c2a4f5e.consul) verify none"
+	if app[1].String() != expect {
+		t.Fatalf("bad: %v", app[1])
+	}
+
+	// An enabled server is kept over a disabled one
+	inp["app"][1].WarmUntil = time.Now().Add(time.Minute)
+	if app := formatOutput(inp)["app"]; len(app) != 2 || app[1].Node != "node3" || app[1].Disabled {
+		t.Fatalf("bad: %v", app)
 	}
 
-	// Check config file
-	out, err := ioutil.ReadFile("config_out")
-	if err != nil {
-		t.Fatalf("err: %v", err)
+	// The gateway is verified, and given a certificate, if configured
+	conf.MeshCAFile = "/etc/consul/ca.pem"
+	conf.MeshCert = "/etc/consul/client.pem"
+	serverOptions(conf, out)
+	expect = "server node2_web 10.0.0.9:8443 ssl sni str(web.default.dc2.internal.7c2a4f5e.consul)" +
+		" verify required ca-file /etc/consul/ca.pem crt /etc/consul/client.pem"
+	if app[1].String() != expect {
+		t.Fatalf("bad: %v", app[1])
 	}
-	expect, err := ioutil.ReadFile("test-fixtures/simple.conf.out")
-	if err != nil {
-		t.Fatalf("err: %v", err)
+	if app[0].String() != "server node1_web 127.0.0.1:8000" {
+		t.Fatalf("bad: %v", app[0])
 	}
-	if !bytes.Equal(out, expect) {
-		t.Fatalf("bad: %s", out)
+
+	// The gateway requires a datacenter and trust domain
+	for _, c := range []*Config{
+		&Config{DryRun: true, Templates: []string{"test-fixtures/simple.conf"},
+			Backends: []string{"app=web?mesh_gateway=10.0.0.9:8443"}, TrustDomain: "7c2a4f5e.consul"},
+		&Config{DryRun: true, Templates: []string{"test-fixtures/simple.conf"},
+			Backends: []string{"app=web@dc2?mesh_gateway=10.0.0.9:8443"}},
+	} {
+		if errs := validateConfig(c); len(errs) != 1 {
+			t.Fatalf("bad: %v", errs)
+		}
 	}
+}
 
-	// Check second config file
-	out2, err := ioutil.ReadFile("config_out2")
-	if err != nil {
-		t.Fatalf("err: %v", err)
+func TestFormatOutput_IncludeUnhealthy(t *testing.T) {
+	healthy := &consulapi.ServiceEntry{
+		Node:    &consulapi.Node{Node: "node1", Address: "127.0.0.1"},
+		Service: &consulapi.AgentService{ID: "app", Port: 8000},
+		Checks: []*consulapi.HealthCheck{
+			&consulapi.HealthCheck{CheckID: "serfHealth", Status: "passing"},
+			&consulapi.HealthCheck{CheckID: "web", Status: "passing"},
+		},
 	}
-	expect2, err := ioutil.ReadFile("test-fixtures/varnish.vcl.out")
-	if err != nil {
-		t.Fatalf("err: %v", err)
+	unhealthy := &consulapi.ServiceEntry{
+		Node:    &consulapi.Node{Node: "node2", Address: "127.0.0.2"},
+		Service: &consulapi.AgentService{ID: "app", Port: 8000},
+		Checks: []*consulapi.HealthCheck{
+			&consulapi.HealthCheck{CheckID: "serfHealth", Status: "passing"},
+			&consulapi.HealthCheck{CheckID: "web", Status: "critical"},
+		},
 	}
-	if !bytes.Equal(out2, expect2) {
-		t.Fatalf("bad: %s", out)
+	wp := &WatchPath{IncludeUnhealthy: true}
+	inp := map[string][]*backendEntry{
+		"app": []*backendEntry{
+			&backendEntry{ServiceEntry: healthy, Watch: wp},
+			&backendEntry{ServiceEntry: unhealthy, Watch: wp},
+		},
 	}
 
-	// Check reload fie
-	bytes, err := ioutil.ReadFile("reload_out")
-	if err != nil {
-		t.Fatalf("err: %v", err)
+	app := formatOutput(inp)["app"]
+	if app[0].String() != "server node1_app 127.0.0.1:8000" {
+		t.Fatalf("bad: %v", app[0])
 	}
-	if string(bytes) != "foo\n" {
-		t.Fatalf("bad: %v", bytes)
+	if app[1].String() != "server node2_app 127.0.0.2:8000 disabled" {
+		t.Fatalf("bad: %v", app[1])
 	}
 }
 
-func TestAllWatchesReturned(t *testing.T) {
-	wp1 := &WatchPath{Backend: "app"}
-	wp2 := &WatchPath{Backend: "app"}
-	wp3 := &WatchPath{Backend: "db"}
-	d := &backendData{
-		Servers: map[*WatchPath][]*consulapi.ServiceEntry{
-			wp1: nil,
-			wp2: nil,
-		},
+func TestFormatOutput_CheckWeight(t *testing.T) {
+	entry := func(node string, tags []string, statuses ...string) *consulapi.ServiceEntry {
+		e := &consulapi.ServiceEntry{
+			Node:    &consulapi.Node{Node: node, Address: "127.0.0.1"},
+			Service: &consulapi.AgentService{ID: "app", Port: 8000, Tags: tags},
+		}
+		for _, status := range statuses {
+			e.Checks = append(e.Checks, &consulapi.HealthCheck{Status: status})
+		}
+		return e
 	}
-	conf := &Config{
-		watches: []*WatchPath{wp1, wp2, wp3},
+	wp := &WatchPath{IncludeUnhealthy: true, CheckWeight: true}
+	inp := map[string][]*backendEntry{
+		"app": []*backendEntry{
+			&backendEntry{ServiceEntry: entry("node1", nil, "passing", "passing", "passing"), Watch: wp},
+			&backendEntry{ServiceEntry: entry("node2", nil, "passing", "passing", "critical"), Watch: wp},
+			&backendEntry{ServiceEntry: entry("node3", []string{"weight=30"}, "passing", "warning", "critical"), Watch: wp},
+			&backendEntry{ServiceEntry: entry("node4", nil, "critical"), Watch: wp},
+		},
 	}
 
-	if allWatchesReturned(conf, d) {
-		t.Fatalf("unexpected done")
+	expect := []string{
+		"server node1_app 127.0.0.1:8000 weight 100",
+		"server node2_app 127.0.0.1:8000 weight 67",
+		"server node3_app 127.0.0.1:8000 weight 10",
+		"server node4_app 127.0.0.1:8000 disabled",
 	}
-
-	d.Servers[wp3] = nil
-	if !allWatchesReturned(conf, d) {
-		t.Fatalf("expected done")
+	for idx, server := range formatOutput(inp)["app"] {
+		if server.String() != expect[idx] {
+			t.Fatalf("bad: %v", server)
+		}
 	}
 }
 
-func TestAggregateServers(t *testing.T) {
-	en1 := &consulapi.ServiceEntry{
+func TestFormatOutput_HealthDirectives(t *testing.T) {
+	entry := &consulapi.ServiceEntry{
 		Node:    &consulapi.Node{Node: "node1", Address: "127.0.0.1"},
 		Service: &consulapi.AgentService{ID: "app", Port: 8000},
 	}
-	en2 := &consulapi.ServiceEntry{
-		Node:    &consulapi.Node{Node: "node3", Address: "127.0.0.3"},
-		Service: &consulapi.AgentService{ID: "app", Port: 8000},
+	type val struct {
+		wp     *WatchPath
+		expect string
 	}
-	en3 := &consulapi.ServiceEntry{
-		Node:    &consulapi.Node{Node: "node2", Address: "127.0.0.2"},
-		Service: &consulapi.AgentService{ID: "db", Port: 5000},
+	inps := []val{
+		{&WatchPath{}, "server node1_app 127.0.0.1:8000"},
+		{&WatchPath{Observe: "layer7"}, "server node1_app 127.0.0.1:8000 observe layer7"},
+		{&WatchPath{AgentPort: 9999}, "server node1_app 127.0.0.1:8000 agent-check agent-port 9999"},
+		{&WatchPath{Observe: "layer4", AgentPort: 9999, SendProxy: true},
+			"server node1_app 127.0.0.1:8000 send-proxy observe layer4 agent-check agent-port 9999"},
 	}
-	wp1 := &WatchPath{Backend: "app"}
-	wp2 := &WatchPath{Backend: "app"}
-	wp3 := &WatchPath{Backend: "db"}
-	d := &backendData{
-		Servers: map[*WatchPath][]*consulapi.ServiceEntry{
-			wp1: []*consulapi.ServiceEntry{en1},
-			wp2: []*consulapi.ServiceEntry{en2},
-			wp3: []*consulapi.ServiceEntry{en3},
-		},
-		Backends: map[string][]*WatchPath{
-			"app": []*WatchPath{wp1, wp2},
-			"db":  []*WatchPath{wp3},
-		},
+	for _, inp := range inps {
+		out := formatOutput(map[string][]*backendEntry{
+			"app": []*backendEntry{&backendEntry{ServiceEntry: entry, Watch: inp.wp}},
+		})
+		if s := out["app"][0].String(); s != inp.expect {
+			t.Fatalf("bad: %s", s)
+		}
 	}
-	agg := aggregateServers(d)
-	if len(agg) != 2 {
-		t.Fatalf("Bad: %v", agg)
+}
+
+func TestFormatOutput_WeightKey(t *testing.T) {
+	wp := &WatchPath{WeightKey: "lb_weight", DefaultWeight: 20}
+	entry := func(node string, meta map[string]string, tags ...string) *backendEntry {
+		return &backendEntry{
+			ServiceEntry: &consulapi.ServiceEntry{
+				Node:    &consulapi.Node{Node: node, Address: "127.0.0.1"},
+				Service: &consulapi.AgentService{ID: "app", Port: 8000, Tags: tags},
+				Checks:  []*consulapi.HealthCheck{&consulapi.HealthCheck{Status: "passing"}, &consulapi.HealthCheck{Status: "critical"}},
+			},
+			Watch: wp,
+			Meta:  meta,
+		}
 	}
-	app := agg["app"]
-	if len(app) != 2 {
-		t.Fatalf("Bad: %v", app)
+	inp := map[string][]*backendEntry{
+		"app": []*backendEntry{
+			entry("node1", map[string]string{"lb_weight": "50"}),
+			entry("node2", map[string]string{"lb_weight": "0"}),
+			entry("node3", map[string]string{"lb_weight": "1000"}),
+			entry("node4", map[string]string{"lb_weight": "-5"}),
+			entry("node5", map[string]string{"lb_weight": "heavy"}),
+			entry("node6", nil, "weight=80", "lb_weight=80"),
+		},
 	}
-	if app[0] != en1 && app[1] != en2 {
-		t.Fatalf("Bad: %v", app)
+
+	expect := []string{
+		"server node1_app 127.0.0.1:8000 weight 50",
+		"server node2_app 127.0.0.1:8000 weight 0",
+		"server node3_app 127.0.0.1:8000 weight 256",
+		"server node4_app 127.0.0.1:8000 weight 0",
+		"server node5_app 127.0.0.1:8000 weight 20",
+		"server node6_app 127.0.0.1:8000 weight 20",
 	}
-	db := agg["db"]
-	if len(db) != 1 {
-		t.Fatalf("Bad: %v", db)
+	for idx, server := range formatOutput(inp)["app"] {
+		if server.String() != expect[idx] {
+			t.Fatalf("bad: %v", server)
+		}
 	}
-	if db[0] != en3 {
-		t.Fatalf("Bad: %v", db)
+
+	// With check_weight, the weight from the key is scaled
+	wp.CheckWeight = true
+	expect = []string{
+		"server node1_app 127.0.0.1:8000 weight 25",
+		"server node2_app 127.0.0.1:8000 weight 0",
+		"server node3_app 127.0.0.1:8000 weight 128",
+		"server node4_app 127.0.0.1:8000 weight 0",
+		"server node5_app 127.0.0.1:8000 weight 10",
+		"server node6_app 127.0.0.1:8000 weight 10",
+	}
+	for idx, server := range formatOutput(inp)["app"] {
+		if server.String() != expect[idx] {
+			t.Fatalf("bad: %v", server)
+		}
 	}
 }
 
-func TestBuildTemplate(t *testing.T) {
-	templates := []string {
-		"test-fixtures/simple.conf",
-		"test-fixtures/varnish.vcl",
+func TestKeyWeight(t *testing.T) {
+	wp := &WatchPath{WeightKey: "lb_weight", DefaultWeight: 100}
+	type val struct {
+		meta    map[string]string
+		weight  int
+		invalid bool
 	}
-	expectations := []string {
-		"test-fixtures/simple.conf.out",
-		"test-fixtures/varnish.vcl.out",
+	inps := []val{
+		{map[string]string{"lb_weight": "50"}, 50, false},
+		{map[string]string{"lb_weight": "256"}, 256, false},
+		{map[string]string{"lb_weight": "257"}, 256, true},
+		{map[string]string{"lb_weight": "-1"}, 0, true},
+		{map[string]string{"lb_weight": "x"}, 100, true},
+		{map[string]string{"weight": "50"}, 100, false},
+		{nil, 100, false},
 	}
-	servers := map[string][]*consulapi.ServiceEntry{
-		"app": []*consulapi.ServiceEntry{
-			&consulapi.ServiceEntry{
-				Node:    &consulapi.Node{Node: "node1", Address: "127.0.0.1"},
-				Service: &consulapi.AgentService{ID: "app", Port: 8000},
-			},
-			&consulapi.ServiceEntry{
-				Node:    &consulapi.Node{Node: "node3", Address: "127.0.0.3"},
-				Service: &consulapi.AgentService{ID: "app", Port: 8000},
-			},
-		},
+	for _, inp := range inps {
+		weight, invalid := keyWeight(wp, inp.meta)
+		if weight != inp.weight || (invalid != "") != inp.invalid {
+			t.Fatalf("bad: %v %d %q", inp.meta, weight, invalid)
+		}
 	}
+}
 
-	// Iterate through the list of templates to render
-	for idx, templatePath := range templates {
-		out, err := buildTemplate(templatePath, servers)
-		if err != nil {
-			t.Fatalf("err: %v", err)
+func TestFormatOutput_Sort(t *testing.T) {
+	entry := func(node, addr string, tags ...string) *consulapi.ServiceEntry {
+		return &consulapi.ServiceEntry{
+			Node:    &consulapi.Node{Node: node, Address: addr},
+			Service: &consulapi.AgentService{ID: "app", Port: 8000, Tags: tags},
 		}
-
-		expect, err := ioutil.ReadFile(expectations[idx])
-		if err != nil {
-			t.Fatalf("err: %v", err)
+	}
+	entries := []*consulapi.ServiceEntry{
+		entry("node3", "127.0.0.1", "weight=10", "priority=2"),
+		entry("node1", "127.0.0.10", "weight=50"),
+		entry("node2", "127.0.0.2", "weight=10", "priority=1"),
+	}
+	sorted := func(mode string) []string {
+		wp := &WatchPath{SortMode: mode}
+		var inp []*backendEntry
+		for _, e := range entries {
+			inp = append(inp, &backendEntry{ServiceEntry: e, Watch: wp})
 		}
-
-		if !bytes.Equal(out, expect) {
-			t.Fatalf("bad: %s", out)
+		var nodes []string
+		for _, server := range formatOutput(map[string][]*backendEntry{"app": inp})["app"] {
+			nodes = append(nodes, server.Node)
 		}
+		return nodes
+	}
 
+	type val struct {
+		mode   string
+		expect []string
+	}
+	inps := []val{
+		{"", []string{"node3", "node1", "node2"}},
+		{"name", []string{"node1", "node2", "node3"}},
+		{"address", []string{"node3", "node2", "node1"}},
+		{"weight", []string{"node1", "node2", "node3"}},
+		{"priority", []string{"node2", "node3", "node1"}},
+	}
+	for _, inp := range inps {
+		if out := sorted(inp.mode); !reflect.DeepEqual(out, inp.expect) {
+			t.Fatalf("bad: %s %v", inp.mode, out)
+		}
 	}
 }
 
@@ -249,12 +3105,37 @@ func TestAsyncNotify(t *testing.T) {
 
 }
 
-func TestMin(t *testing.T) {
-	if min(1, 2) != 1 {
-		t.Fatalf("Bad")
+func TestFailureTracker(t *testing.T) {
+	var f FailureTracker
+	if out := f.Backoff(); out != 0 {
+		t.Fatalf("bad: %v", out)
+	}
+
+	// Ramp up until the cap is reached
+	expect := failSleep
+	for i := 0; i < maxFailures; i++ {
+		f.Record()
+		if out := f.Backoff(); out != expect {
+			t.Fatalf("bad: %d %v %v", i, out, expect)
+		}
+		expect *= 2
+	}
+
+	// Further failures should not increase the backoff
+	capped := f.Backoff()
+	f.Record()
+	if out := f.Backoff(); out != capped {
+		t.Fatalf("bad: %v %v", out, capped)
+	}
+
+	// Reset should clear the backoff
+	f.Reset()
+	if out := f.Backoff(); out != 0 {
+		t.Fatalf("bad: %v", out)
 	}
-	if min(2, 1) != 1 {
-		t.Fatalf("Bad")
+	f.Record()
+	if out := f.Backoff(); out != failSleep {
+		t.Fatalf("bad: %v", out)
 	}
 }
 
@@ -277,26 +3158,26 @@ func TestBackoff(t *testing.T) {
 }
 
 func TestFormatOutput(t *testing.T) {
-	inp := map[string][]*consulapi.ServiceEntry{
-		"foo": []*consulapi.ServiceEntry{
-			&consulapi.ServiceEntry{
+	inp := map[string][]*backendEntry{
+		"foo": []*backendEntry{
+			&backendEntry{ServiceEntry: &consulapi.ServiceEntry{
 				Node:    &consulapi.Node{Node: "node1", Address: "127.0.0.1"},
 				Service: &consulapi.AgentService{ID: "redis", Port: 8000},
-			},
-			&consulapi.ServiceEntry{
+			}},
+			&backendEntry{ServiceEntry: &consulapi.ServiceEntry{
 				Node:    &consulapi.Node{Node: "node3", Address: "127.0.0.3"},
 				Service: &consulapi.AgentService{ID: "redis", Port: 1234},
-			},
+			}},
 		},
-		"bar": []*consulapi.ServiceEntry{
-			&consulapi.ServiceEntry{
+		"bar": []*backendEntry{
+			&backendEntry{ServiceEntry: &consulapi.ServiceEntry{
 				Node:    &consulapi.Node{Node: "node2", Address: "127.0.0.2"},
 				Service: &consulapi.AgentService{ID: "memcache", Port: 80},
-			},
-			&consulapi.ServiceEntry{
+			}},
+			&backendEntry{ServiceEntry: &consulapi.ServiceEntry{
 				Node:    &consulapi.Node{Node: "node4", Address: "127.0.0.4"},
 				Service: &consulapi.AgentService{ID: "memcache", Port: 10000},
-			},
+			}},
 		},
 	}
 
@@ -326,3 +3207,217 @@ func TestFormatOutput(t *testing.T) {
 		t.Fatalf("Bad: %v", bar)
 	}
 }
+
+func TestForceRefresh_FirstRender(t *testing.T) {
+	dir, err := ioutil.TempDir("", "consul-haproxy")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	templatePath := filepath.Join(dir, "app.tmpl")
+	if err := ioutil.WriteFile(templatePath, []byte("{{if firstRender}}first{{else}}later{{end}}"), 0644); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	wp := &WatchPath{Backend: "app"}
+	d := &backendData{
+		Servers:  make(map[*WatchPath][]*consulapi.ServiceEntry),
+		Backends: map[string][]*WatchPath{"app": []*WatchPath{wp}},
+		ChangeCh: make(chan struct{}, 1),
+	}
+	applier := &fakeApplier{}
+	conf := &Config{
+		watches:   []*WatchPath{wp},
+		Templates: []string{templatePath},
+		Paths:     []string{"config_out"},
+		Applier:   applier,
+	}
+	en := &consulapi.ServiceEntry{
+		Node:    &consulapi.Node{Node: "node1", Address: "127.0.0.1"},
+		Service: &consulapi.AgentService{ID: "app", Port: 8000},
+	}
+	updateEntries(conf, d, wp, []*consulapi.ServiceEntry{en}, nil)
+
+	// A failed apply is not the first render
+	applier.err = errors.New("failed")
+	if forceRefresh(conf, d) {
+		t.Fatalf("unexpected exit")
+	}
+	if out := string(applier.rendered["config_out"]); out != "first" {
+		t.Fatalf("bad: %s", out)
+	}
+
+	applier.err = nil
+	expect := []string{"first", "later", "later"}
+	for _, e := range expect {
+		if forceRefresh(conf, d) {
+			t.Fatalf("unexpected exit")
+		}
+		if out := string(applier.rendered["config_out"]); out != e {
+			t.Fatalf("bad: %s %s", out, e)
+		}
+	}
+}
+
+func TestForceRefresh_IncludeBackends(t *testing.T) {
+	dir, err := ioutil.TempDir("", "consul-haproxy")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	templatePath := filepath.Join(dir, "app.tmpl")
+	tmpl := "{{range .app}}app {{end}}{{range .api}}api {{end}}{{range .db}}db {{end}}"
+	if err := ioutil.WriteFile(templatePath, []byte(tmpl), 0644); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	applier := &fakeApplier{}
+	conf := &Config{
+		Templates:       []string{templatePath},
+		Paths:           []string{"config_out"},
+		Backends:        []string{"app=app", "api=api", "db=db", "default=web?split_tag=be-"},
+		IncludeBackends: []string{"a*", "db"},
+		ExcludeBackends: []string{"api"},
+		Applier:         applier,
+	}
+	if errs := validateConfig(conf); len(errs) > 0 {
+		t.Fatalf("err: %v", errs)
+	}
+
+	// Only the watches of the included backends, or splitting, are kept
+	if len(conf.watches) != 3 || conf.watches[0].Backend != "app" ||
+		conf.watches[1].Backend != "db" || conf.watches[2].Backend != "default" {
+		t.Fatalf("bad: %v", conf.watches)
+	}
+
+	d := &backendData{
+		Servers:  make(map[*WatchPath][]*consulapi.ServiceEntry),
+		Backends: make(map[string][]*WatchPath),
+		ChangeCh: make(chan struct{}, 1),
+	}
+	for _, wp := range conf.watches {
+		d.Backends[wp.Backend] = append(d.Backends[wp.Backend], wp)
+	}
+	entry := func(node string, tags ...string) *consulapi.ServiceEntry {
+		return &consulapi.ServiceEntry{
+			Node:    &consulapi.Node{Node: node, Address: "127.0.0.1"},
+			Service: &consulapi.AgentService{ID: "svc", Tags: tags, Port: 8000},
+		}
+	}
+	updateEntries(conf, d, conf.watches[0], []*consulapi.ServiceEntry{entry("node1")}, nil)
+	updateEntries(conf, d, conf.watches[1], []*consulapi.ServiceEntry{entry("node2")}, nil)
+	updateEntries(conf, d, conf.watches[2], []*consulapi.ServiceEntry{
+		entry("node3", "be-api"), entry("node4", "be-db"),
+	}, nil)
+
+	if forceRefresh(conf, d) {
+		t.Fatalf("unexpected exit")
+	}
+	if out := string(applier.rendered["config_out"]); out != "app db db " {
+		t.Fatalf("bad: %s", out)
+	}
+	servers := aggregateServers(conf, d)
+	if _, ok := servers["api"]; ok {
+		t.Fatalf("bad: %v", servers)
+	}
+	if _, ok := servers["default"]; ok {
+		t.Fatalf("bad: %v", servers)
+	}
+}
+
+func TestForceRefresh_ReloadDecision(t *testing.T) {
+	dir, err := ioutil.TempDir("", "consul-haproxy")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	now := time.Now()
+	start := (now.Hour()+1)%24*60 + now.Minute()
+	closed := &maintenanceWindow{Start: start, End: (start + 60) % (24 * 60)}
+
+	wp := &WatchPath{Backend: "app"}
+	d := &backendData{
+		Servers:  make(map[*WatchPath][]*consulapi.ServiceEntry),
+		Backends: map[string][]*WatchPath{"app": []*WatchPath{wp}},
+		ChangeCh: make(chan struct{}, 1),
+	}
+	conf := &Config{
+		watches:   []*WatchPath{wp},
+		Templates: []string{"test-fixtures/simple.conf"},
+		Paths:     []string{filepath.Join(dir, "config_out")},
+	}
+	updateEntries(conf, d, wp, []*consulapi.ServiceEntry{
+		&consulapi.ServiceEntry{
+			Node:    &consulapi.Node{Node: "node1", Address: "127.0.0.1"},
+			Service: &consulapi.AgentService{ID: "app", Port: 8000},
+		},
+	}, nil)
+
+	cases := []struct {
+		command  string
+		windows  []*maintenanceWindow
+		mins     map[string]int
+		decision string
+	}{
+		{"", nil, nil, "skipped: no reload command configured"},
+		{"true", []*maintenanceWindow{closed}, nil,
+			"skipped: outside of the maintenance windows, deferring reload"},
+		{"true", nil, map[string]int{"app": 2}, "skipped: backend app has 1 of at least 2 servers"},
+		{"true", nil, nil, "reloaded"},
+		{"false", nil, nil, "failed: reload failed: exit status 1"},
+	}
+	for _, c := range cases {
+		conf.ReloadCommand = c.command
+		conf.windows = c.windows
+		conf.MinReload = c.mins
+		if forceRefresh(conf, d) {
+			t.Fatalf("unexpected exit")
+		}
+		if d.lastReload != c.decision {
+			t.Fatalf("bad: %s %s", d.lastReload, c.decision)
+		}
+		if state := currentState(conf, d)["app"]; state.LastReload != c.decision {
+			t.Fatalf("bad: %s %s", state.LastReload, c.decision)
+		}
+	}
+}
+
+func TestRender(t *testing.T) {
+	conf := &Config{
+		DryRun:    true,
+		Templates: []string{"test-fixtures/simple.conf"},
+		Backends:  []string{"app=app"},
+	}
+	if errs := validateConfig(conf); len(errs) > 0 {
+		t.Fatalf("err: %v", errs)
+	}
+	out, err := Render(conf, map[string][]*consulapi.ServiceEntry{
+		"app": []*consulapi.ServiceEntry{
+			&consulapi.ServiceEntry{
+				Node:    &consulapi.Node{Node: "node1", Address: "127.0.0.1"},
+				Service: &consulapi.AgentService{ID: "app", Port: 8000},
+			},
+			&consulapi.ServiceEntry{
+				Node:    &consulapi.Node{Node: "node3", Address: "127.0.0.3"},
+				Service: &consulapi.AgentService{ID: "app", Port: 8000},
+			},
+		},
+	})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	expect, err := ioutil.ReadFile("test-fixtures/simple.conf.out")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !bytes.Equal(out, expect) {
+		t.Fatalf("bad: %s", out)
+	}
+
+	// Several outputs cannot be returned
+	conf.Templates = append(conf.Templates, "test-fixtures/varnish.vcl")
+	if _, err := Render(conf, nil); err == nil {
+		t.Fatalf("expected error")
+	}
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// maintenanceWindow is a daily window of local time during which
+// reloads are allowed, given in minutes since midnight. A window
+// ending before it starts wraps around midnight.
+type maintenanceWindow struct {
+	Start int
+	End   int
+}
+
+// parseWindow is used to parse a window given as "HH:MM-HH:MM"
+func parseWindow(raw string) (*maintenanceWindow, error) {
+	parts := strings.Split(raw, "-")
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("Invalid maintenance window '%s'", raw)
+	}
+	var times [2]int
+	for idx, part := range parts {
+		t, err := time.Parse("15:04", strings.TrimSpace(part))
+		if err != nil {
+			return nil, fmt.Errorf("Invalid maintenance window '%s': %v", raw, err)
+		}
+		times[idx] = t.Hour()*60 + t.Minute()
+	}
+	if times[0] == times[1] {
+		return nil, fmt.Errorf("Invalid maintenance window '%s': empty window", raw)
+	}
+	return &maintenanceWindow{Start: times[0], End: times[1]}, nil
+}
+
+// contains checks if the time falls within the window
+func (w *maintenanceWindow) contains(t time.Time) bool {
+	m := t.Hour()*60 + t.Minute()
+	if w.Start < w.End {
+		return m >= w.Start && m < w.End
+	}
+	return m >= w.Start || m < w.End
+}
+
+// inWindows checks if the time falls within any of the windows.
+// Without any windows, every time is allowed.
+func inWindows(windows []*maintenanceWindow, t time.Time) bool {
+	if len(windows) == 0 {
+		return true
+	}
+	for _, w := range windows {
+		if w.contains(t) {
+			return true
+		}
+	}
+	return false
+}
+
+// untilNextWindow returns how long until the next window opens
+func untilNextWindow(windows []*maintenanceWindow, t time.Time) time.Duration {
+	var next time.Duration
+	for _, w := range windows {
+		start := time.Date(t.Year(), t.Month(), t.Day(), w.Start/60, w.Start%60, 0, 0, t.Location())
+		if !start.After(t) {
+			start = start.AddDate(0, 0, 1)
+		}
+		if until := start.Sub(t); next == 0 || until < next {
+			next = until
+		}
+	}
+	return next
+}
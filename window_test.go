@@ -0,0 +1,124 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/armon/consul-api"
+)
+
+func TestParseWindow(t *testing.T) {
+	w, err := parseWindow("22:00-06:30")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if w.Start != 22*60 || w.End != 6*60+30 {
+		t.Fatalf("bad: %v", w)
+	}
+
+	for _, raw := range []string{"", "22:00", "22:00-25:00", "9-10", "10:00-10:00"} {
+		if _, err := parseWindow(raw); err == nil {
+			t.Fatalf("expected error: %s", raw)
+		}
+	}
+}
+
+func TestInWindows(t *testing.T) {
+	at := func(hour, min int) time.Time {
+		return time.Date(2014, 6, 1, hour, min, 0, 0, time.Local)
+	}
+	day := &maintenanceWindow{Start: 9 * 60, End: 17 * 60}
+	night := &maintenanceWindow{Start: 22 * 60, End: 6 * 60}
+
+	if !inWindows(nil, at(12, 0)) {
+		t.Fatalf("expected no windows to allow")
+	}
+	cases := []struct {
+		t      time.Time
+		expect bool
+	}{
+		{at(8, 59), false},
+		{at(9, 0), true},
+		{at(16, 59), true},
+		{at(17, 0), false},
+		{at(23, 0), true},
+		{at(2, 0), true},
+		{at(6, 0), false},
+	}
+	for _, c := range cases {
+		if inWindows([]*maintenanceWindow{day, night}, c.t) != c.expect {
+			t.Fatalf("bad: %v", c.t)
+		}
+	}
+
+	windows := []*maintenanceWindow{day, night}
+	if d := untilNextWindow(windows, at(8, 30)); d != 30*time.Minute {
+		t.Fatalf("bad: %v", d)
+	}
+	if d := untilNextWindow(windows, at(17, 0)); d != 5*time.Hour {
+		t.Fatalf("bad: %v", d)
+	}
+	if d := untilNextWindow(windows, at(23, 0)); d != 10*time.Hour {
+		t.Fatalf("bad: %v", d)
+	}
+}
+
+func TestForceRefresh_DeferReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "consul-haproxy")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	reloaded := filepath.Join(dir, "reloaded")
+
+	// A window opening in an hour
+	now := time.Now()
+	start := (now.Hour()+1)%24*60 + now.Minute()
+	closed := &maintenanceWindow{Start: start, End: (start + 60) % (24 * 60)}
+
+	wp := &WatchPath{Backend: "app"}
+	d := &backendData{
+		Servers:  make(map[*WatchPath][]*consulapi.ServiceEntry),
+		Backends: map[string][]*WatchPath{"app": []*WatchPath{wp}},
+		ChangeCh: make(chan struct{}, 1),
+	}
+	conf := &Config{
+		watches:       []*WatchPath{wp},
+		Templates:     []string{"test-fixtures/simple.conf"},
+		Paths:         []string{filepath.Join(dir, "config_out")},
+		ReloadCommand: "touch " + reloaded,
+		windows:       []*maintenanceWindow{closed},
+	}
+	updateEntries(conf, d, wp, nil, nil)
+
+	// The configuration is written, but the reload deferred
+	if forceRefresh(conf, d) {
+		t.Fatalf("unexpected exit")
+	}
+	if _, err := os.Stat(conf.Paths[0]); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if _, err := os.Stat(reloaded); !os.IsNotExist(err) {
+		t.Fatalf("unexpected reload")
+	}
+	if d.windowTimer == nil {
+		t.Fatalf("missing window timer")
+	}
+	if d.lastReload != "skipped: "+skipOutsideWindows {
+		t.Fatalf("bad: %s", d.lastReload)
+	}
+
+	// Once the window opens, the reload is done
+	open := &maintenanceWindow{Start: (now.Hour()+23)%24*60 + now.Minute(), End: start}
+	conf.windows = []*maintenanceWindow{closed, open}
+	deferredReload(conf, d)
+	if _, err := os.Stat(reloaded); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if d.lastReload != reloadReloaded {
+		t.Fatalf("bad: %s", d.lastReload)
+	}
+}